@@ -7,19 +7,24 @@ import (
 	"syscall"
 
 	"github.com/sunweiwe/kuber/pkg/agent"
+	"github.com/sunweiwe/kuber/pkg/utils/config"
 	"github.com/urfave/cli"
 )
 
 func NewAgentCmd() cli.Command {
-	options := agent.NewDefaultOptions()
+	cfg := config.New("KUBER_AGENT", agent.NewDefaultOptions)
 
 	cmd := cli.Command{
-		Name:  "controller",
+		Name:  "agent",
 		Usage: "run agent",
+		Flags: cfg.Flags(),
 		Action: func(ctx *cli.Context) error {
 			_context, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 			defer cancel()
-			return agent.Run(_context, options)
+			return agent.Run(_context, cfg)
+		},
+		Subcommands: []cli.Command{
+			cfg.Command(),
 		},
 	}
 	return cmd
@@ -7,20 +7,29 @@ import (
 	"syscall"
 
 	"github.com/sunweiwe/kuber/pkg/controller"
+	"github.com/sunweiwe/kuber/pkg/utils/config"
 	"github.com/urfave/cli"
 )
 
 func NewControllerCmd() cli.Command {
-	options := controller.NewDefaultOptions()
+	cfg := config.New("KUBER_CONTROLLER", controller.NewDefaultOptions)
 
 	cmd := cli.Command{
 		Name:  "controller",
 		Usage: "run controller",
+		Flags: cfg.Flags(),
 		Action: func(ctx *cli.Context) error {
+			options, err := cfg.Load()
+			if err != nil {
+				return err
+			}
 			_context, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 			defer cancel()
 			return controller.Run(_context, options)
 		},
+		Subcommands: []cli.Command{
+			cfg.Command(),
+		},
 	}
 	return cmd
 }
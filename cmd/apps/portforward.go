@@ -0,0 +1,96 @@
+package apps
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/sunweiwe/kuber/pkg/agent/client"
+	"github.com/sunweiwe/kuber/pkg/utils/httpsigs"
+	"github.com/urfave/cli"
+)
+
+func NewPortForwardCmd() cli.Command {
+	cmd := cli.Command{
+		Name:      "port-forward",
+		Usage:     "forward local ports to a pod or service through the agent",
+		ArgsUsage: "pod/NAME|svc/NAME [LOCAL_PORT:]REMOTE_PORT...",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "server",
+				Value:  "http://127.0.0.1:8080",
+				Usage:  "address of the agent",
+				EnvVar: "KUBER_AGENT_SERVER",
+			},
+			cli.StringFlag{
+				Name:  "namespace, n",
+				Value: "default",
+				Usage: "namespace of the pod or service",
+			},
+			cli.StringFlag{
+				Name:  "address",
+				Value: "127.0.0.1",
+				Usage: "local address to listen on",
+			},
+			cli.StringFlag{
+				Name:   "signer-token",
+				Usage:  "token of http sigs, use the builtin token if empty",
+				EnvVar: "KUBER_AGENT_SIGNER_TOKEN",
+			},
+			cli.BoolFlag{
+				Name:  "insecure-skip-tls-verify",
+				Usage: "skip verifying the certificate of the agent",
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			if ctx.NArg() < 2 {
+				return cli.ShowCommandHelp(ctx, "port-forward")
+			}
+			kind, name, err := parseForwardTarget(ctx.Args().First())
+			if err != nil {
+				return err
+			}
+			ports, err := client.ParseForwardedPorts(ctx.Args().Tail())
+			if err != nil {
+				return err
+			}
+			httpsigs.GetSigner().SetToken(ctx.String("signer-token"))
+
+			_context, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+			forwarder := &client.PortForwarder{
+				Server:    ctx.String("server"),
+				Namespace: ctx.String("namespace"),
+				Kind:      kind,
+				Name:      name,
+				Address:   ctx.String("address"),
+				Ports:     ports,
+				Insecure:  ctx.Bool("insecure-skip-tls-verify"),
+				Out:       os.Stdout,
+			}
+			return forwarder.Run(_context)
+		},
+	}
+	return cmd
+}
+
+// parseForwardTarget 没有类型时默认为 pod
+func parseForwardTarget(target string) (string, string, error) {
+	kind, name := "pod", target
+	if i := strings.Index(target, "/"); i >= 0 {
+		kind, name = strings.ToLower(target[:i]), target[i+1:]
+	}
+	if name == "" {
+		return "", "", fmt.Errorf("invalid target %q", target)
+	}
+	switch kind {
+	case "pod", "pods", "po":
+		return "Pod", name, nil
+	case "service", "services", "svc":
+		return "Service", name, nil
+	}
+	return "", "", fmt.Errorf("unsupported type %q, must be pod or svc", kind)
+}
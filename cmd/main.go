@@ -23,6 +23,7 @@ func main() {
 	app.Commands = []cli.Command{
 		apps.NewControllerCmd(),
 		apps.NewAgentCmd(),
+		apps.NewPortForwardCmd(),
 	}
 	if err := app.Run(os.Args); err != nil {
 		log.Fatal(err)
@@ -3,6 +3,7 @@ package agent
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"strconv"
 
@@ -12,17 +13,20 @@ import (
 	"github.com/sunweiwe/kuber/pkg/agent/indexer"
 	"github.com/sunweiwe/kuber/pkg/kube"
 	"github.com/sunweiwe/kuber/pkg/log"
+	"github.com/sunweiwe/kuber/pkg/utils/config"
 	"github.com/sunweiwe/kuber/pkg/utils/pprof"
 	"github.com/sunweiwe/kuber/pkg/utils/prometheus"
 	"github.com/sunweiwe/kuber/pkg/utils/prometheus/exporter"
 	"github.com/sunweiwe/kuber/pkg/utils/system"
-
+	"go.uber.org/zap/zapcore"
 	"golang.org/x/sync/errgroup"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/util/errors"
 )
 
 type Options struct {
 	DebugMode bool                        `json:"debugMode,omitempty" description:"enable debug mode"`
-	LogLevel  string                      `json:"logLevel,omitempty"`
+	LogLevel  string                      `json:"logLevel,omitempty" description:"log level, one of debug, info, warn, error"`
 	System    *system.Options             `json:"system,omitempty"`
 	API       *apis.Options               `json:"api,omitempty"`
 	Debug     *apis.DebugOptions          `json:"debug,omitempty" description:"debug options"`
@@ -44,8 +48,33 @@ func NewDefaultOptions() *Options {
 	return defaultOptions
 }
 
+func (o *Options) Validate() error {
+	errs := []error{}
+	level := zapcore.InfoLevel
+	if err := level.UnmarshalText([]byte(o.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("logLevel: %v", err))
+	}
+	errs = append(errs,
+		o.System.Validate(),
+		o.API.Validate(),
+		o.Debug.Validate(),
+		o.Exporter.Validate(),
+	)
+	return errors.NewAggregate(errs)
+}
+
+// Loader 加载配置, 配置文件变化后重新调用
+type Loader interface {
+	Load() (*Options, error)
+	ConfigFile() string
+}
+
 // TODO
-func Run(ctx context.Context, options *Options) error {
+func Run(ctx context.Context, loader Loader) error {
+	options, err := loader.Load()
+	if err != nil {
+		return err
+	}
 	log.SetLevel(options.LogLevel)
 
 	if options.DebugMode {
@@ -59,7 +88,7 @@ func Run(ctx context.Context, options *Options) error {
 		return err
 	}
 
-	c, err := cluster.NewCluster(rest)
+	c, err := cluster.NewCluster(rest, cluster.WithDisableCaches())
 	if err != nil {
 		return err
 	}
@@ -71,15 +100,22 @@ func Run(ctx context.Context, options *Options) error {
 	go c.Start(ctx)
 	c.GetCache().WaitForCacheSync(ctx)
 
+	runtime, err := apis.NewRuntime(options.API, options.Debug, config.Hash(options))
+	if err != nil {
+		return err
+	}
+
 	exporterHandler := exporter.NewHandler("kuber_agent", map[string]exporter.CollectorFunc{
 		"plugin":                 exporter.NewPluginCollectorFunc(c), // plugin exporter
 		"request":                exporter.NewRequestCollector(),     // http exporter
+		"transfer":               exporter.NewTransferCollector(),    // file transfer exporter
+		"portforward":            exporter.NewPortForwardCollector(), // port-forward exporter
 		"cluster_component_cert": exporter.NewCertCollectorFunc(),    // cluster component cert
 	})
 
 	eg, ctx := errgroup.WithContext(ctx)
 	eg.Go(func() error {
-		return apis.Run(ctx, c, options.System, options.API, options.Debug)
+		return apis.Run(ctx, c, options.System, runtime)
 	})
 
 	eg.Go(func() error {
@@ -90,5 +126,36 @@ func Run(ctx context.Context, options *Options) error {
 		return exporterHandler.Run(ctx, options.Exporter)
 	})
 
+	if file := loader.ConfigFile(); file != "" {
+		eg.Go(func() error {
+			return config.Watch(ctx, file, func() {
+				reload(loader, options, runtime)
+			})
+		})
+	}
+
 	return eg.Wait()
 }
+
+// reload 热更新日志级别、prometheus客户端、alertmanager地址、debug配置和签名token
+// 监听地址、证书等需要重启才能生效
+func reload(loader Loader, started *Options, runtime *apis.Runtime) {
+	options, err := loader.Load()
+	if err != nil {
+		log.Error(err, "reload config, keep the current config")
+		return
+	}
+	hash := config.Hash(options)
+	if hash == runtime.Load().Hash {
+		return
+	}
+	if err := runtime.Update(options.API, options.Debug, hash); err != nil {
+		log.Error(err, "reload config, keep the current config")
+		return
+	}
+	log.SetLevel(options.LogLevel)
+	if !equality.Semantic.DeepEqual(started.System, options.System) || !equality.Semantic.DeepEqual(started.Exporter, options.Exporter) {
+		log.Info("system and exporter options changed, restart to take effect")
+	}
+	log.Info("config reloaded", "hash", hash)
+}
@@ -1,59 +1,666 @@
 package apis
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
 	"github.com/gin-gonic/gin"
-	"github.com/prometheus/alertmanager/client"
-	"github.com/prometheus/client_golang/api"
-	"k8s.io/client-go/kubernetes"
+	"github.com/prometheus/common/model"
+	"github.com/sunweiwe/kuber/pkg/agent/cluster"
+	"github.com/sunweiwe/kuber/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// 告警中表示 namespace 的 label, 用于按照租户过滤告警和静默
+	alertNamespaceLabel = "namespace"
+	// AlertRule 生成的告警中表示租户的 label
+	alertTenantLabel = "tenant"
+	// 告警转换成的 event 的来源
+	alertEventComponent = "alertmanager"
 )
 
 type AlertManagerHandler struct {
-	client api.Client
-	c      kubernetes.Interface
+	cluster cluster.Interface
+	runtime *Runtime
 }
 
-func NewAlertManagerClient(server string, k8sclient kubernetes.Interface) (*AlertManagerHandler, error) {
-	client, err := api.NewClient(api.Config{Address: server})
-	if err != nil {
-		return nil, err
-	}
-	return &AlertManagerHandler{
-		client: client,
-		c:      k8sclient,
-	}, nil
+// AlertGroup alertmanager v2 接口返回的告警分组
+type AlertGroup struct {
+	Labels   map[string]string `json:"labels"`
+	Receiver AlertReceiver     `json:"receiver"`
+	Alerts   []Alert           `json:"alerts"`
+}
+
+type AlertReceiver struct {
+	Name string `json:"name"`
+}
+
+// Alert alertmanager v2 接口返回的告警
+type Alert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	Fingerprint  string            `json:"fingerprint"`
+	Receivers    []AlertReceiver   `json:"receivers"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	UpdatedAt    time.Time         `json:"updatedAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Status       struct {
+		State       string   `json:"state"`
+		SilencedBy  []string `json:"silencedBy"`
+		InhibitedBy []string `json:"inhibitedBy"`
+	} `json:"status"`
+}
+
+// Silence alertmanager v2 接口的静默, 创建时 id 为空, 更新时指定 id
+type Silence struct {
+	ID        string           `json:"id,omitempty"`
+	Matchers  []SilenceMatcher `json:"matchers"`
+	StartsAt  time.Time        `json:"startsAt"`
+	EndsAt    time.Time        `json:"endsAt"`
+	CreatedBy string           `json:"createdBy"`
+	Comment   string           `json:"comment"`
+	UpdatedAt *time.Time       `json:"updatedAt,omitempty"`
+	Status    *struct {
+		State string `json:"state"`
+	} `json:"status,omitempty"`
 }
 
-type alertQuery struct {
-	Filter      string `form:"filter"`
-	Receiver    string `form:"receiver"`
-	Silenced    bool   `form:"silenced"`
-	Inhibited   bool   `form:"inhibited"`
-	Active      bool   `form:"active"`
-	Unprocessed bool   `form:"unprocessed"`
+// SilenceMatcher isEqual 为空时为 true
+type SilenceMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual *bool  `json:"isEqual,omitempty"`
+}
+
+func (m SilenceMatcher) equal() bool {
+	return m.IsEqual == nil || *m.IsEqual
+}
+
+// AlertWebhook alertmanager webhook 通知的内容
+type AlertWebhook struct {
+	Receiver string         `json:"receiver"`
+	Status   string         `json:"status"`
+	Alerts   []WebhookAlert `json:"alerts"`
+}
+
+type WebhookAlert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
 }
 
 // @Tags        Agent.V1
 // @Summary     获取alertmanager中的告警数据
-// @Description 获取alertmanager中的告警数据
+// @Description 获取alertmanager中的告警数据, 只返回调用方范围内namespace的告警
 // @Accept      json
 // @Produce     json
-// @Param       cluster     path     string                                               true  "cluster"
-// @Param       filter      query    string                                               false "filter"
-// @Param       receiver    query    string                                               false "receiver"
-// @Param       silenced    query    bool                                                 false "silenced"
-// @Param       inhibited   query    bool                                                 false "inhibited"
-// @Param       active      query    bool                                                 false "active"
-// @Param       unprocessed query    bool                                                 false "unprocessed"
-// @Success     200         {object} handlers.ResponseStruct{Data=[]client.ExtendedAlert} "labelvalues"
+// @Param       cluster     path     string                                true  "cluster"
+// @Param       filter      query    []string                              false "label matcher, 如 severity=critical, 可以多个"
+// @Param       receiver    query    string                                false "receiver 正则"
+// @Param       silenced    query    bool                                  false "是否包含已静默的告警, 默认 true"
+// @Param       inhibited   query    bool                                  false "是否包含已抑制的告警, 默认 true"
+// @Param       active      query    bool                                  false "是否包含未静默的告警, 默认 true"
+// @Param       unprocessed query    bool                                  false "是否包含未处理的告警, 默认 true"
+// @Success     200         {object} handlers.ResponseStruct{Data=[]Alert} "alerts"
 // @Router      /v1/proxy/cluster/{cluster}/custom/alertmanager/v1/alerts [get]
 // @Security    JWT
 func (h *AlertManagerHandler) ListAlerts(c *gin.Context) {
-	api := client.NewAlertAPI(h.client)
-	query := &alertQuery{}
-	_ = c.BindQuery(query)
-	alerts, err := api.List(c.Request.Context(), query.Filter, query.Receiver, query.Silenced, query.Inhibited, query.Active, query.Unprocessed)
+	filter, err := h.namespaceFilter(c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	alerts := []Alert{}
+	params := alertParams(c, "receiver", "active", "silenced", "inhibited", "unprocessed")
+	if err := h.v2(c.Request.Context(), http.MethodGet, "/alerts", params, nil, &alerts); err != nil {
+		NotOK(c, err)
+		return
+	}
+	ret := []Alert{}
+	for _, alert := range alerts {
+		if filter(alert.Labels[alertNamespaceLabel]) {
+			ret = append(ret, alert)
+		}
+	}
+	OK(c, ret)
+}
+
+// @Tags        Agent.V1
+// @Summary     获取alertmanager中的告警分组
+// @Description 获取alertmanager中的告警分组, 只返回调用方范围内namespace的告警
+// @Accept      json
+// @Produce     json
+// @Param       cluster  path     string                                     true  "cluster"
+// @Param       filter   query    []string                                   false "label matcher, 如 severity=critical, 可以多个"
+// @Param       receiver query    string                                     false "receiver 正则"
+// @Param       active   query    bool                                       false "是否包含未静默的告警, 默认 true"
+// @Param       silenced query    bool                                       false "是否包含已静默的告警, 默认 true"
+// @Success     200      {object} handlers.ResponseStruct{Data=[]AlertGroup} "groups"
+// @Router      /v1/proxy/cluster/{cluster}/custom/alertmanager/v1/groups [get]
+// @Security    JWT
+func (h *AlertManagerHandler) ListAlertGroups(c *gin.Context) {
+	filter, err := h.namespaceFilter(c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	groups := []AlertGroup{}
+	params := alertParams(c, "receiver", "active", "silenced", "inhibited")
+	if err := h.v2(c.Request.Context(), http.MethodGet, "/alerts/groups", params, nil, &groups); err != nil {
+		NotOK(c, err)
+		return
+	}
+
+	ret := []AlertGroup{}
+	for _, group := range groups {
+		alerts := []Alert{}
+		for _, alert := range group.Alerts {
+			if filter(alert.Labels[alertNamespaceLabel]) {
+				alerts = append(alerts, alert)
+			}
+		}
+		if len(alerts) > 0 {
+			group.Alerts = alerts
+			ret = append(ret, group)
+		}
+	}
+	OK(c, ret)
+}
+
+// @Tags        Agent.V1
+// @Summary     获取alertmanager中的接收器
+// @Description 获取alertmanager中的接收器名称, 包含整个集群的配置, 租户内的用户不能查看
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                 true "cluster"
+// @Success     200     {object} handlers.ResponseStruct{Data=[]string} "receivers"
+// @Router      /v1/proxy/cluster/{cluster}/custom/alertmanager/v1/receivers [get]
+// @Security    JWT
+func (h *AlertManagerHandler) ListReceivers(c *gin.Context) {
+	scope, err := scopeFromRequest(c.Request.Context(), h.cluster.GetClient(), c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	if !scope.Unlimited() {
+		NotOK(c, scope.Forbidden("receivers", ""))
+		return
+	}
+	receivers := []AlertReceiver{}
+	if err := h.v2(c.Request.Context(), http.MethodGet, "/receivers", nil, nil, &receivers); err != nil {
+		NotOK(c, err)
+		return
+	}
+	names := make([]string, 0, len(receivers))
+	for _, r := range receivers {
+		names = append(names, r.Name)
+	}
+	OK(c, names)
+}
+
+// @Tags        Agent.V1
+// @Summary     获取alertmanager的状态
+// @Description 获取alertmanager的版本、配置和集群状态, 包含整个集群的配置, 租户内的用户不能查看
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                           true "cluster"
+// @Success     200     {object} handlers.ResponseStruct{Data=object} "status"
+// @Router      /v1/proxy/cluster/{cluster}/custom/alertmanager/v1/status [get]
+// @Security    JWT
+func (h *AlertManagerHandler) Status(c *gin.Context) {
+	scope, err := scopeFromRequest(c.Request.Context(), h.cluster.GetClient(), c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	if !scope.Unlimited() {
+		NotOK(c, scope.Forbidden("status", ""))
+		return
+	}
+	status := json.RawMessage{}
+	if err := h.v2(c.Request.Context(), http.MethodGet, "/status", nil, nil, &status); err != nil {
+		NotOK(c, err)
+		return
+	}
+	OK(c, status)
+}
+
+// @Tags        Agent.V1
+// @Summary     获取静默列表
+// @Description 获取静默列表, 租户内的用户只能看到限制在自己namespace内的静默
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                        true  "cluster"
+// @Param       filter  query    []string                                false "label matcher, 如 alertname=foo, 可以多个"
+// @Success     200     {object} handlers.ResponseStruct{Data=[]Silence} "silences"
+// @Router      /v1/proxy/cluster/{cluster}/custom/alertmanager/v1/silences [get]
+// @Security    JWT
+func (h *AlertManagerHandler) ListSilences(c *gin.Context) {
+	scope, err := h.scope(c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	silences := []*Silence{}
+	if err := h.v2(c.Request.Context(), http.MethodGet, "/silences", alertParams(c), nil, &silences); err != nil {
+		NotOK(c, err)
+		return
+	}
+	namespace := c.Param("namespace")
+	ret := []*Silence{}
+	for _, silence := range silences {
+		namespaces, owned := silenceNamespaces(silence)
+		if namespace != "" && !containsString(namespaces, namespace) {
+			continue
+		}
+		if !scope.Unlimited() && !(owned && scopeContainsAll(scope, namespaces)) {
+			continue
+		}
+		ret = append(ret, silence)
+	}
+	OK(c, ret)
+}
+
+// @Tags        Agent.V1
+// @Summary     获取静默
+// @Description 获取静默
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                      true "cluster"
+// @Param       name    path     string                                      true "silence id"
+// @Success     200     {object} handlers.ResponseStruct{Data=Silence} "silence"
+// @Router      /v1/proxy/cluster/{cluster}/custom/alertmanager/v1/silences/{name} [get]
+// @Security    JWT
+func (h *AlertManagerHandler) GetSilence(c *gin.Context) {
+	silence, err := h.ownedSilence(c, c.Param("name"))
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	OK(c, silence)
+}
+
+// @Tags        Agent.V1
+// @Summary     创建或者更新静默
+// @Description 创建静默, 指定 id 时更新静默. 会自动追加调用方范围内的 namespace matcher
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                 true "cluster"
+// @Param       body    body     Silence                                true "silence"
+// @Success     200     {object} handlers.ResponseStruct{Data=string} "silence id"
+// @Router      /v1/proxy/cluster/{cluster}/custom/alertmanager/v1/silences [post]
+// @Security    JWT
+func (h *AlertManagerHandler) CreateSilence(c *gin.Context) {
+	silence := Silence{}
+	if err := c.BindJSON(&silence); err != nil {
+		NotOK(c, err)
+		return
+	}
+	scope, err := h.scope(c)
 	if err != nil {
 		NotOK(c, err)
+		return
+	}
+	if silence.ID != "" {
+		// 更新时原有的静默也要在调用方范围内
+		if _, err := h.ownedSilence(c, silence.ID); err != nil {
+			NotOK(c, err)
+			return
+		}
+	}
+	if err := scopeSilence(scope, c.Param("namespace"), &silence); err != nil {
+		NotOK(c, err)
+		return
+	}
+	if silence.CreatedBy == "" {
+		silence.CreatedBy = scope.User
+	}
+	if silence.StartsAt.IsZero() {
+		silence.StartsAt = time.Now()
+	}
+	// 只提交 postableSilence 中的字段
+	silence.UpdatedAt, silence.Status = nil, nil
+	ret := struct {
+		SilenceID string `json:"silenceID"`
+	}{}
+	if err := h.v2(c.Request.Context(), http.MethodPost, "/silences", nil, silence, &ret); err != nil {
+		NotOK(c, err)
+		return
+	}
+	OK(c, ret.SilenceID)
+}
+
+// @Tags        Agent.V1
+// @Summary     使静默过期
+// @Description 使静默过期
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                               true "cluster"
+// @Param       name    path     string                               true "silence id"
+// @Success     200     {object} handlers.ResponseStruct{Data=string} "ok"
+// @Router      /v1/proxy/cluster/{cluster}/custom/alertmanager/v1/silences/{name}/actions/expire [post]
+// @Security    JWT
+func (h *AlertManagerHandler) ExpireSilence(c *gin.Context) {
+	id := c.Param("name")
+	if _, err := h.ownedSilence(c, id); err != nil {
+		NotOK(c, err)
+		return
+	}
+	if err := h.v2(c.Request.Context(), http.MethodDelete, "/silence/"+url.PathEscape(id), nil, nil, nil); err != nil {
+		NotOK(c, err)
+		return
+	}
+	OK(c, "ok")
+}
+
+// @Tags        Agent.V1
+// @Summary     alertmanager webhook
+// @Description 接收 alertmanager 的 webhook 通知, 在告警涉及的对象上生成 event, 需要 alertWebhookToken 作为 bearer token 或者 basic auth 密码
+// @Accept      json
+// @Produce     json
+// @Param       body body     AlertWebhook                         true "alertmanager webhook"
+// @Success     200  {object} handlers.ResponseStruct{Data=string} "ok"
+// @Router      /alert [post]
+func (h *AlertManagerHandler) Webhook(c *gin.Context) {
+	if err := authorizeWebhook(h.runtime.Load().Options.AlertWebhookToken, c.Request); err != nil {
+		NotOK(c, err)
+		return
+	}
+	data := AlertWebhook{}
+	if err := c.BindJSON(&data); err != nil {
+		NotOK(c, err)
+		return
+	}
+	ctx := c.Request.Context()
+	for _, alert := range data.Alerts {
+		ref, ok := alertInvolvedObject(alert.Labels)
+		if !ok {
+			continue
+		}
+		if err := h.recordAlertEvent(ctx, ref, alert); err != nil {
+			// 单个对象失败不影响其他告警, alertmanager 重试会产生重复的 event
+			log.Error(err, "record alert event", "alert", alert.Labels["alertname"], "kind", ref.Kind, "namespace", ref.Namespace, "name", ref.Name)
+		}
+	}
+	OK(c, "ok")
+}
+
+// authorizeWebhook 对应 alertmanager webhook_configs 中 http_config 的 authorization 或者 basic_auth
+func authorizeWebhook(token string, req *http.Request) error {
+	if token == "" {
+		return apiErrors.NewForbidden(schema.GroupResource{Resource: "alert"}, "", fmt.Errorf("alert webhook token is not configured"))
+	}
+	got := ""
+	if _, password, ok := req.BasicAuth(); ok {
+		got = password
+	} else if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		got = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		return apiErrors.NewUnauthorized("invalid alert webhook token")
+	}
+	return nil
+}
+
+// recordAlertEvent 同一个告警在同一个对象上只生成一个 event, 重复通知时累加次数
+func (h *AlertManagerHandler) recordAlertEvent(ctx context.Context, ref corev1.ObjectReference, alert WebhookAlert) error {
+	fingerprint := alert.Fingerprint
+	if fingerprint == "" {
+		set := model.LabelSet{}
+		for k, v := range alert.Labels {
+			set[model.LabelName(k)] = model.LabelValue(v)
+		}
+		fingerprint = set.Fingerprint().String()
+	}
+	eventType, message := corev1.EventTypeWarning, alertMessage(alert)
+	if alert.Status == string(model.AlertResolved) {
+		eventType, message = corev1.EventTypeNormal, "[resolved] "+message
+	}
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	now := metav1.Now()
+
+	events := h.cluster.Kubernetes().CoreV1().Events(namespace)
+	name := strings.ToLower(ref.Name + "." + fingerprint)
+	existing, err := events.Get(ctx, name, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		existing.Type = eventType
+		existing.Message = message
+		existing.Count++
+		existing.LastTimestamp = now
+		_, err = events.Update(ctx, existing, metav1.UpdateOptions{})
+		return err
+	case apiErrors.IsNotFound(err):
+		event := &corev1.Event{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+			},
+			InvolvedObject: ref,
+			Reason:         alert.Labels["alertname"],
+			Message:        message,
+			Type:           eventType,
+			Source:         corev1.EventSource{Component: alertEventComponent},
+			FirstTimestamp: now,
+			LastTimestamp:  now,
+			Count:          1,
+		}
+		_, err = events.Create(ctx, event, metav1.CreateOptions{})
+		return err
+	default:
+		return err
+	}
+}
+
+func alertMessage(alert WebhookAlert) string {
+	for _, key := range []string{"message", "description", "summary"} {
+		if msg := alert.Annotations[key]; msg != "" {
+			return msg
+		}
+	}
+	return alert.Labels["alertname"]
+}
+
+// alertInvolvedObject 按照 kube-state-metrics/cadvisor 的 label 找到告警涉及的对象, 越具体的对象优先;
+// 属于租户或者 namespace 的告警不关联到节点, 否则租户的告警会出现在集群范围的节点 event 中
+func alertInvolvedObject(kv map[string]string) (corev1.ObjectReference, bool) {
+	namespace := kv[alertNamespaceLabel]
+	scoped := namespace != "" || kv[alertTenantLabel] != ""
+	candidates := []struct {
+		label      string
+		apiVersion string
+		kind       string
+		namespaced bool
+		cluster    bool
+	}{
+		{label: "pod", apiVersion: "v1", kind: "Pod", namespaced: true},
+		{label: "deployment", apiVersion: "apps/v1", kind: "Deployment", namespaced: true},
+		{label: "statefulset", apiVersion: "apps/v1", kind: "StatefulSet", namespaced: true},
+		{label: "daemonset", apiVersion: "apps/v1", kind: "DaemonSet", namespaced: true},
+		{label: "job_name", apiVersion: "batch/v1", kind: "Job", namespaced: true},
+		{label: "persistentvolumeclaim", apiVersion: "v1", kind: "PersistentVolumeClaim", namespaced: true},
+		{label: "node", apiVersion: "v1", kind: "Node", cluster: true},
+		{label: alertNamespaceLabel, apiVersion: "v1", kind: "Namespace"},
+	}
+	for _, candidate := range candidates {
+		name := kv[candidate.label]
+		if name == "" || len(validation.IsDNS1123Subdomain(name)) > 0 {
+			continue
+		}
+		if candidate.namespaced && namespace == "" || candidate.cluster && scoped {
+			continue
+		}
+		ref := corev1.ObjectReference{APIVersion: candidate.apiVersion, Kind: candidate.kind, Name: name}
+		if candidate.namespaced {
+			ref.Namespace = namespace
+		}
+		return ref, true
+	}
+	return corev1.ObjectReference{}, false
+}
+
+func (h *AlertManagerHandler) scope(c *gin.Context) (*Scope, error) {
+	scope, err := scopeFromRequest(c.Request.Context(), h.cluster.GetClient(), c)
+	if err != nil {
+		return nil, err
+	}
+	if namespace := c.Param("namespace"); namespace != "" && !scope.Contains(namespace) {
+		return nil, scope.Forbidden("namespaces", namespace)
+	}
+	return scope, nil
+}
+
+// namespaceFilter 根据调用方范围和路径中的 namespace 过滤告警
+func (h *AlertManagerHandler) namespaceFilter(c *gin.Context) (func(namespace string) bool, error) {
+	scope, err := h.scope(c)
+	if err != nil {
+		return nil, err
+	}
+	if namespace := c.Param("namespace"); namespace != "" {
+		return func(ns string) bool { return ns == namespace }, nil
+	}
+	if scope.Unlimited() {
+		return func(string) bool { return true }, nil
+	}
+	return func(ns string) bool { return ns != "" && scope.Contains(ns) }, nil
+}
+
+// ownedSilence 租户内的用户只能操作限制在自己namespace内的静默
+func (h *AlertManagerHandler) ownedSilence(c *gin.Context, id string) (*Silence, error) {
+	scope, err := h.scope(c)
+	if err != nil {
+		return nil, err
+	}
+	silence := &Silence{}
+	if err := h.v2(c.Request.Context(), http.MethodGet, "/silence/"+url.PathEscape(id), nil, nil, silence); err != nil {
+		return nil, err
+	}
+	namespaces, owned := silenceNamespaces(silence)
+	if namespace := c.Param("namespace"); namespace != "" && !containsString(namespaces, namespace) {
+		return nil, scope.Forbidden("silences", id)
+	}
+	if !scope.Unlimited() && !(owned && scopeContainsAll(scope, namespaces)) {
+		return nil, scope.Forbidden("silences", id)
+	}
+	return silence, nil
+}
+
+// v2 请求 alertmanager 的 v2 接口, v1 接口在新版本中已经移除
+func (h *AlertManagerHandler) v2(ctx context.Context, method, path string, params url.Values, body, into interface{}) error {
+	u, err := upstreamURL(h.runtime.Load().Options.AlertManagerServer, "/api/v2"+path, params)
+	if err != nil {
+		return err
+	}
+	return doJSON(ctx, method, u, body, into)
+}
+
+// alertParams 透传 filter 和指定的查询参数, 未指定的参数使用 alertmanager 的默认值
+func alertParams(c *gin.Context, keys ...string) url.Values {
+	params := url.Values{}
+	for _, key := range keys {
+		if v := c.Query(key); v != "" {
+			params.Set(key, v)
+		}
+	}
+	for _, f := range c.QueryArray("filter") {
+		params.Add("filter", f)
+	}
+	return params
+}
+
+// scopeSilence 追加 namespace matcher, 与原有的 matcher 是 "与" 的关系, 只会缩小静默的范围
+func scopeSilence(scope *Scope, namespace string, silence *Silence) error {
+	var matcher SilenceMatcher
+	switch {
+	case namespace != "":
+		matcher = SilenceMatcher{Name: alertNamespaceLabel, Value: namespace}
+	case !scope.Unlimited():
+		if len(scope.Namespaces) == 0 {
+			return scope.Forbidden("namespaces", "")
+		}
+		// namespace 名称中没有正则的特殊字符, 不需要转义
+		matcher = SilenceMatcher{Name: alertNamespaceLabel, Value: strings.Join(scope.Namespaces, "|"), IsRegex: true}
+	default:
+		return nil
+	}
+	silence.Matchers = append(silence.Matchers, matcher)
+	return nil
+}
+
+// silenceNamespaces 返回静默限制的namespace, 没有限制或者无法确定时 owned 为 false
+func silenceNamespaces(silence *Silence) (namespaces []string, owned bool) {
+	for _, m := range silence.Matchers {
+		if m.Name != alertNamespaceLabel || !m.equal() {
+			continue
+		}
+		values := []string{m.Value}
+		if m.IsRegex {
+			values = strings.Split(m.Value, "|")
+		}
+		valid := true
+		for _, v := range values {
+			if len(validation.IsDNS1123Label(v)) > 0 {
+				valid = false
+				break
+			}
+		}
+		if !valid {
+			continue
+		}
+		// 多个 namespace matcher 取交集
+		if owned {
+			namespaces = intersectStrings(namespaces, values)
+		} else {
+			namespaces, owned = values, true
+		}
+	}
+	return namespaces, owned
+}
+
+func scopeContainsAll(scope *Scope, namespaces []string) bool {
+	for _, ns := range namespaces {
+		if !scope.Contains(ns) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func intersectStrings(a, b []string) []string {
+	ret := []string{}
+	for _, v := range a {
+		if containsString(b, v) {
+			ret = append(ret, v)
+		}
 	}
-	OK(c, alerts)
+	return ret
 }
@@ -0,0 +1,349 @@
+package apis
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/agent/middleware"
+	"github.com/sunweiwe/kuber/pkg/api/kuber/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestAuthorizeWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		header  func(req *http.Request)
+		wantErr func(error) bool
+	}{
+		{
+			name:    "not configured",
+			header:  func(req *http.Request) { req.Header.Set("Authorization", "Bearer ") },
+			wantErr: apiErrors.IsForbidden,
+		},
+		{
+			name:   "bearer token",
+			token:  "secret",
+			header: func(req *http.Request) { req.Header.Set("Authorization", "Bearer secret") },
+		},
+		{
+			name:   "basic auth password",
+			token:  "secret",
+			header: func(req *http.Request) { req.SetBasicAuth("alertmanager", "secret") },
+		},
+		{
+			name:    "wrong bearer token",
+			token:   "secret",
+			header:  func(req *http.Request) { req.Header.Set("Authorization", "Bearer secret2") },
+			wantErr: apiErrors.IsUnauthorized,
+		},
+		{
+			name:    "wrong basic auth password",
+			token:   "secret",
+			header:  func(req *http.Request) { req.SetBasicAuth("secret", "") },
+			wantErr: apiErrors.IsUnauthorized,
+		},
+		{
+			name:    "token without scheme",
+			token:   "secret",
+			header:  func(req *http.Request) { req.Header.Set("Authorization", "secret") },
+			wantErr: apiErrors.IsUnauthorized,
+		},
+		{
+			name:    "missing",
+			token:   "secret",
+			header:  func(req *http.Request) {},
+			wantErr: apiErrors.IsUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/alert", nil)
+			tt.header(req)
+			err := authorizeWebhook(tt.token, req)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Errorf("authorizeWebhook() error = %v", err)
+				}
+				return
+			}
+			if !tt.wantErr(err) {
+				t.Errorf("authorizeWebhook() unexpected error = %v", err)
+			}
+		})
+	}
+}
+
+func TestSilenceNamespaces(t *testing.T) {
+	notEqual := false
+	tests := []struct {
+		name      string
+		matchers  []SilenceMatcher
+		want      []string
+		wantOwned bool
+	}{
+		{
+			name:     "no namespace matcher",
+			matchers: []SilenceMatcher{{Name: "alertname", Value: "a"}},
+		},
+		{
+			name:      "equal",
+			matchers:  []SilenceMatcher{{Name: "namespace", Value: "dev"}},
+			want:      []string{"dev"},
+			wantOwned: true,
+		},
+		{
+			name:      "regex alternation",
+			matchers:  []SilenceMatcher{{Name: "namespace", Value: "dev|test", IsRegex: true}},
+			want:      []string{"dev", "test"},
+			wantOwned: true,
+		},
+		{
+			name:     "regex wildcard",
+			matchers: []SilenceMatcher{{Name: "namespace", Value: ".*", IsRegex: true}},
+		},
+		{
+			name:     "not equal",
+			matchers: []SilenceMatcher{{Name: "namespace", Value: "dev", IsEqual: &notEqual}},
+		},
+		{
+			name: "intersection",
+			matchers: []SilenceMatcher{
+				{Name: "namespace", Value: "dev|test", IsRegex: true},
+				{Name: "namespace", Value: "test|prod", IsRegex: true},
+			},
+			want:      []string{"test"},
+			wantOwned: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, owned := silenceNamespaces(&Silence{Matchers: tt.matchers})
+			if owned != tt.wantOwned || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("silenceNamespaces() = %v, %v, want %v, %v", got, owned, tt.want, tt.wantOwned)
+			}
+		})
+	}
+}
+
+func TestScopeSilence(t *testing.T) {
+	tests := []struct {
+		name      string
+		scope     *Scope
+		namespace string
+		want      []SilenceMatcher
+		wantErr   bool
+	}{
+		{
+			name:  "unlimited",
+			scope: &Scope{},
+		},
+		{
+			name:      "path namespace",
+			scope:     &Scope{Namespaces: []string{"dev", "test"}},
+			namespace: "dev",
+			want:      []SilenceMatcher{{Name: "namespace", Value: "dev"}},
+		},
+		{
+			name:  "scope namespaces",
+			scope: &Scope{Namespaces: []string{"dev", "test"}},
+			want:  []SilenceMatcher{{Name: "namespace", Value: "dev|test", IsRegex: true}},
+		},
+		{
+			name:    "no namespaces",
+			scope:   &Scope{Namespaces: []string{}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			silence := &Silence{}
+			if err := scopeSilence(tt.scope, tt.namespace, silence); (err != nil) != tt.wantErr {
+				t.Fatalf("scopeSilence() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(silence.Matchers, tt.want) {
+				t.Errorf("scopeSilence() matchers = %v, want %v", silence.Matchers, tt.want)
+			}
+			if namespaces, owned := silenceNamespaces(silence); len(tt.want) > 0 && (!owned || !scopeContainsAll(tt.scope, namespaces)) {
+				t.Errorf("scoped silence is not owned by scope: %v", namespaces)
+			}
+		})
+	}
+}
+
+func TestAlertInvolvedObject(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   corev1.ObjectReference
+		wantOK bool
+	}{
+		{
+			name:   "pod first",
+			labels: map[string]string{"namespace": "dev", "pod": "web-0", "deployment": "web", "node": "n1"},
+			want:   corev1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: "dev", Name: "web-0"},
+			wantOK: true,
+		},
+		{
+			name:   "job",
+			labels: map[string]string{"namespace": "dev", "job_name": "backup"},
+			want:   corev1.ObjectReference{APIVersion: "batch/v1", Kind: "Job", Namespace: "dev", Name: "backup"},
+			wantOK: true,
+		},
+		{
+			name:   "namespaced without namespace falls back to node",
+			labels: map[string]string{"pod": "web-0", "node": "n1"},
+			want:   corev1.ObjectReference{APIVersion: "v1", Kind: "Node", Name: "n1"},
+			wantOK: true,
+		},
+		{
+			name:   "namespaced alert not on node",
+			labels: map[string]string{"namespace": "dev", "pod": "Web_0", "node": "n1"},
+			want:   corev1.ObjectReference{APIVersion: "v1", Kind: "Namespace", Name: "dev"},
+			wantOK: true,
+		},
+		{
+			name:   "tenant alert not on node",
+			labels: map[string]string{"tenant": "t1", "pod": "web-0", "node": "n1"},
+		},
+		{
+			name:   "invalid name skipped",
+			labels: map[string]string{"namespace": "dev", "pod": "Web_0"},
+			want:   corev1.ObjectReference{APIVersion: "v1", Kind: "Namespace", Name: "dev"},
+			wantOK: true,
+		},
+		{
+			name:   "nothing",
+			labels: map[string]string{"alertname": "Watchdog"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := alertInvolvedObject(tt.labels)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("alertInvolvedObject() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestAlertManagerHandlerV2(t *testing.T) {
+	var posted map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v2/silence/abc":
+			_, _ = w.Write([]byte(`{"id":"abc","matchers":[{"name":"namespace","value":"dev","isRegex":false,"isEqual":true}],"status":{"state":"active"}}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v2/silences":
+			if r.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("unexpected content type %s", r.Header.Get("Content-Type"))
+			}
+			_ = json.NewDecoder(r.Body).Decode(&posted)
+			_, _ = w.Write([]byte(`{"silenceID":"def"}`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/api/v2/silence/abc":
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	options := NewDefaultOptions()
+	options.AlertManagerServer = server.URL
+	runtime, err := NewRuntime(options, NewDefaultDebugOptions(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &AlertManagerHandler{runtime: runtime}
+	ctx := context.Background()
+
+	silence := &Silence{}
+	if err := h.v2(ctx, http.MethodGet, "/silence/abc", nil, nil, silence); err != nil {
+		t.Fatal(err)
+	}
+	if namespaces, owned := silenceNamespaces(silence); !owned || !reflect.DeepEqual(namespaces, []string{"dev"}) {
+		t.Errorf("silenceNamespaces() = %v, %v", namespaces, owned)
+	}
+
+	silence.UpdatedAt, silence.Status = nil, nil
+	ret := struct {
+		SilenceID string `json:"silenceID"`
+	}{}
+	if err := h.v2(ctx, http.MethodPost, "/silences", nil, silence, &ret); err != nil {
+		t.Fatal(err)
+	}
+	if ret.SilenceID != "def" || posted["id"] != "abc" || posted["status"] != nil {
+		t.Errorf("post silence = %v, posted %v", ret.SilenceID, posted)
+	}
+
+	if err := h.v2(ctx, http.MethodDelete, "/silence/abc", nil, nil, nil); err != nil {
+		t.Error(err)
+	}
+	if err := h.v2(ctx, http.MethodDelete, "/silence/unknown", nil, nil, nil); err == nil {
+		t.Error("expect error for unknown silence")
+	}
+}
+
+func TestAlertManagerListReceivers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/receivers" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`[{"name":"ops"},{"name":"t1-webhook"}]`))
+	}))
+	defer server.Close()
+
+	scheme := runtime.NewScheme()
+	if err := v1beta1.SchemeBuilder.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&v1beta1.Environment{
+		ObjectMeta: metav1.ObjectMeta{Name: "dev"},
+		Spec:       v1beta1.EnvironmentSpec{Tenant: "t1", Namespace: "t1-dev"},
+	}).Build()
+	options := NewDefaultOptions()
+	options.AlertManagerServer = server.URL
+	runtime, err := NewRuntime(options, NewDefaultDebugOptions(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &AlertManagerHandler{cluster: &fakeCluster{client: cli}, runtime: runtime}
+
+	tests := []struct {
+		name      string
+		header    map[string]string
+		untrusted bool
+		wantCode  int
+	}{
+		{name: "unauthenticated", untrusted: true, wantCode: http.StatusUnauthorized},
+		{name: "tenant", header: map[string]string{HeaderUser: "alice", HeaderTenant: "t1"}, wantCode: http.StatusForbidden},
+		{name: "unlimited", wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = req
+			middleware.SignerMiddleware(
+				func() bool { return false },
+				func(*http.Request) bool { return !tt.untrusted },
+			)(c)
+			h.ListReceivers(c)
+			if recorder.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d: %s", recorder.Code, tt.wantCode, recorder.Body.String())
+			}
+		})
+	}
+}
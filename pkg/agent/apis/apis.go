@@ -7,45 +7,248 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sunweiwe/kuber/pkg/agent/client"
 	"github.com/sunweiwe/kuber/pkg/agent/cluster"
 	"github.com/sunweiwe/kuber/pkg/agent/middleware"
+	"github.com/sunweiwe/kuber/pkg/agent/ws"
 	"github.com/sunweiwe/kuber/pkg/api/kuber"
 	"github.com/sunweiwe/kuber/pkg/log"
+	"github.com/sunweiwe/kuber/pkg/utils/config"
+	"github.com/sunweiwe/kuber/pkg/utils/prometheus"
 	"github.com/sunweiwe/kuber/pkg/utils/prometheus/exporter"
 	"github.com/sunweiwe/kuber/pkg/utils/route"
 	"github.com/sunweiwe/kuber/pkg/utils/system"
 	"github.com/sunweiwe/kuber/pkg/version"
-	"k8s.io/apimachinery/pkg/labels"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 type DebugOptions struct {
-	Image       string `json:"image,omitempty"`
-	Namespace   string `json:"namespace,omitempty"`
-	PodSelector string `json:"podSelector,omitempty"`
-	Container   string `json:"container,omitempty"`
+	Image             string          `json:"image,omitempty" description:"debug tools image, used by ephemeral debug containers and node debug pods"`
+	AllowedImages     []string        `json:"allowedImages,omitempty" description:"images tenant users may choose for debug containers besides image, unrestricted callers may use any image"`
+	KubectlImage      string          `json:"kubectlImage,omitempty" description:"image of kubectl session pods, must contain kubectl and a shell"`
+	Namespace         string          `json:"namespace,omitempty" description:"namespace of kubectl session pods and node debug pods, the agent pod should run in it"`
+	StartTimeout      metav1.Duration `json:"startTimeout,omitempty" description:"timeout waiting for debug containers, node debug pods and kubectl session pods to start"`
+	TenantClusterRole string          `json:"tenantClusterRole,omitempty" description:"cluster role bound in tenant namespaces for kubectl sessions of tenant users"`
+	AdminClusterRole  string          `json:"adminClusterRole,omitempty" description:"cluster role bound cluster wide for kubectl sessions of unrestricted callers"`
+	TokenTTL          metav1.Duration `json:"tokenTTL,omitempty" description:"lifetime of the service account token in kubectl session kubeconfigs, also the max lifetime of kubectl session pods"`
 }
 
 func NewDefaultDebugOptions() *DebugOptions {
 	return &DebugOptions{
-		Namespace: os.Getenv("KUBER_NAMESPACE"),
-		PodSelector: labels.SelectorFromSet(
-			labels.Set{
-				"app.kubernetes.io/name": "kuber-agent-kubectl",
-			}).String(),
-		Container: "kuber-agent-kubectl",
-		Image:     "kuber/debug-tools:latest",
+		Namespace:         os.Getenv("KUBER_NAMESPACE"),
+		Image:             "kuber/debug-tools:latest",
+		AllowedImages:     []string{},
+		KubectlImage:      "kuber/debug-tools:latest",
+		StartTimeout:      metav1.Duration{Duration: defaultDebugStartTimeout},
+		TenantClusterRole: "edit",
+		AdminClusterRole:  "cluster-admin",
+		TokenTTL:          metav1.Duration{Duration: defaultKubectlTokenTTL},
 	}
 }
 
+func (o *DebugOptions) Validate() error {
+	if o.Image == "" {
+		return fmt.Errorf("debug.image: image is required")
+	}
+	for _, image := range o.AllowedImages {
+		if image == "" {
+			return fmt.Errorf("debug.allowedImages: image must not be empty")
+		}
+	}
+	if o.KubectlImage == "" {
+		return fmt.Errorf("debug.kubectlImage: image is required")
+	}
+	if o.StartTimeout.Duration <= 0 {
+		return fmt.Errorf("debug.startTimeout: must be positive")
+	}
+	if o.TenantClusterRole == "" || o.AdminClusterRole == "" {
+		return fmt.Errorf("debug.tenantClusterRole and debug.adminClusterRole are required")
+	}
+	// TokenRequest 要求的最短有效期
+	if o.TokenTTL.Duration < 10*time.Minute {
+		return fmt.Errorf("debug.tokenTTL: must be at least 10m")
+	}
+	return nil
+}
+
+type AuditOptions struct {
+	Dir         string `json:"dir,omitempty" description:"directory of shell session audit records and recordings, such as a mounted PVC, only log sessions if empty"`
+	Record      bool   `json:"record,omitempty" description:"record terminal io of shell sessions in asciinema v2 format"`
+	RecordInput bool   `json:"recordInput,omitempty" description:"record terminal input of shell sessions, disabled by default because input may contain passwords"`
+}
+
+func NewDefaultAuditOptions() *AuditOptions {
+	return &AuditOptions{
+		Record:      false,
+		RecordInput: false,
+	}
+}
+
+func (o *AuditOptions) Validate() error {
+	if o.Record && o.Dir == "" {
+		return fmt.Errorf("api.audit.dir: dir is required when record is enabled")
+	}
+	return nil
+}
+
+type ShellOptions struct {
+	AllowedCommands []string        `json:"allowedCommands,omitempty" description:"commands tenant users may run in pods, in role:command format, * matches any role or command, a command name also matches the command in the system bin directories, an absolute path only matches itself"`
+	ExecTimeout     metav1.Duration `json:"execTimeout,omitempty" description:"max timeout of non-interactive exec"`
+}
+
+func NewDefaultShellOptions() *ShellOptions {
+	return &ShellOptions{
+		AllowedCommands: []string{},
+		ExecTimeout:     metav1.Duration{Duration: defaultExecTimeout},
+	}
+}
+
+func (o *ShellOptions) Validate() error {
+	errs := []error{}
+	for _, entry := range o.AllowedCommands {
+		role, command, found := strings.Cut(entry, ":")
+		if !found || role == "" || command == "" {
+			errs = append(errs, fmt.Errorf("api.shell.allowedCommands: invalid entry %q, must be role:command", entry))
+			continue
+		}
+		if !validCommand(command) {
+			errs = append(errs, fmt.Errorf("api.shell.allowedCommands: invalid command %q, must be a command name or an absolute path", command))
+		}
+	}
+	if o.ExecTimeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("api.shell.execTimeout: must be positive"))
+	}
+	return errors.NewAggregate(errs)
+}
+
+type FileOptions struct {
+	MaxUploadSize     int64 `json:"maxUploadSize,omitempty" description:"max total size in bytes of files uploaded to containers"`
+	DownloadRate      int   `json:"downloadRate,omitempty" description:"download speed in bytes per second of each user, 0 means unlimited"`
+	UploadRate        int   `json:"uploadRate,omitempty" description:"upload speed in bytes per second of each user, 0 means unlimited"`
+	AgentDownloadRate int   `json:"agentDownloadRate,omitempty" description:"total download speed in bytes per second of the agent, 0 means unlimited"`
+	AgentUploadRate   int   `json:"agentUploadRate,omitempty" description:"total upload speed in bytes per second of the agent, 0 means unlimited"`
+}
+
+func NewDefaultFileOptions() *FileOptions {
+	return &FileOptions{
+		MaxUploadSize:     defaultMaxUploadSize,
+		DownloadRate:      defaultTransferRate,
+		UploadRate:        defaultTransferRate,
+		AgentDownloadRate: defaultAgentTransferRate,
+		AgentUploadRate:   defaultAgentTransferRate,
+	}
+}
+
+func (o *FileOptions) Validate() error {
+	if o.MaxUploadSize <= 0 {
+		return fmt.Errorf("api.file.maxUploadSize: must be positive")
+	}
+	rates := map[string]int{
+		"downloadRate":      o.DownloadRate,
+		"uploadRate":        o.UploadRate,
+		"agentDownloadRate": o.AgentDownloadRate,
+		"agentUploadRate":   o.AgentUploadRate,
+	}
+	for name, speed := range rates {
+		if speed < 0 {
+			return fmt.Errorf("api.file.%s: must not be negative", name)
+		}
+	}
+	return nil
+}
+
+type LogOptions struct {
+	ArchiveContainerBytes    int64 `json:"archiveContainerBytes,omitempty" description:"default bytes of each container in log archives when limitBytes is not given"`
+	MaxArchiveContainerBytes int64 `json:"maxArchiveContainerBytes,omitempty" description:"max bytes of each container in log archives, larger limitBytes are reduced to it"`
+	MaxArchiveBytes          int64 `json:"maxArchiveBytes,omitempty" description:"max total bytes of logs in one archive before compression, remaining logs are omitted"`
+}
+
+func NewDefaultLogOptions() *LogOptions {
+	return &LogOptions{
+		ArchiveContainerBytes:    defaultArchiveContainerBytes,
+		MaxArchiveContainerBytes: defaultMaxArchiveContainerBytes,
+		MaxArchiveBytes:          defaultMaxArchiveBytes,
+	}
+}
+
+func (o *LogOptions) Validate() error {
+	errs := []error{}
+	limits := map[string]int64{
+		"archiveContainerBytes":    o.ArchiveContainerBytes,
+		"maxArchiveContainerBytes": o.MaxArchiveContainerBytes,
+		"maxArchiveBytes":          o.MaxArchiveBytes,
+	}
+	for name, limit := range limits {
+		if limit <= 0 {
+			errs = append(errs, fmt.Errorf("api.log.%s: must be positive", name))
+		}
+	}
+	if o.ArchiveContainerBytes > o.MaxArchiveContainerBytes {
+		errs = append(errs, fmt.Errorf("api.log.archiveContainerBytes: must not be greater than maxArchiveContainerBytes"))
+	}
+	return errors.NewAggregate(errs)
+}
+
+type ServiceProxyOptions struct {
+	AllowedServices    []string        `json:"allowedServices,omitempty" description:"services tenant users may proxy to besides their own namespaces, in tenant:namespace/service format, * matches any tenant or service"`
+	CAFile             string          `json:"caFile,omitempty" description:"CA bundle to verify https backends, use the system CAs if empty"`
+	InsecureSkipVerify bool            `json:"insecureSkipVerify,omitempty" description:"skip verifying certificates of https backends"`
+	DialTimeout        metav1.Duration `json:"dialTimeout,omitempty" description:"timeout of connecting to backends"`
+	Timeout            metav1.Duration `json:"timeout,omitempty" description:"timeout waiting for response headers of backends, websockets are not limited after upgrade"`
+}
+
+func NewDefaultServiceProxyOptions() *ServiceProxyOptions {
+	return &ServiceProxyOptions{
+		AllowedServices: []string{},
+		DialTimeout:     metav1.Duration{Duration: defaultProxyDialTimeout},
+		Timeout:         metav1.Duration{Duration: defaultProxyTimeout},
+	}
+}
+
+func (o *ServiceProxyOptions) Validate() error {
+	errs := []error{}
+	for _, entry := range o.AllowedServices {
+		if _, _, _, err := parseAllowedService(entry); err != nil {
+			errs = append(errs, fmt.Errorf("api.serviceProxy.allowedServices: %v", err))
+		}
+	}
+	if o.CAFile != "" {
+		if _, err := os.Stat(o.CAFile); err != nil {
+			errs = append(errs, fmt.Errorf("api.serviceProxy.caFile: %v", err))
+		}
+	}
+	if o.DialTimeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("api.serviceProxy.dialTimeout: must be positive"))
+	}
+	if o.Timeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("api.serviceProxy.timeout: must be positive"))
+	}
+	return errors.NewAggregate(errs)
+}
+
 type Options struct {
-	PrometheusServer   string `json:"prometheusServer,omitempty"`
-	AlertManagerServer string `json:"alertManagerServer,omitempty"`
-	LokiServer         string `json:"lokiServer,omitempty"`
-	JaegerServer       string `json:"jaegerServer,omitempty"`
-	EnableHTTPSigs     bool   `json:"enableHTTPSigs,omitempty" description:"check http sigs, default false"`
+	PrometheusServer   string               `json:"prometheusServer,omitempty" description:"prometheus server address"`
+	AlertManagerServer string               `json:"alertManagerServer,omitempty" description:"alertmanager server address"`
+	AlertWebhookToken  string               `json:"alertWebhookToken,omitempty" description:"bearer token or basic auth password alertmanager uses to call the /alert webhook, the webhook is disabled if empty"`
+	LokiServer         string               `json:"lokiServer,omitempty" description:"loki server address"`
+	JaegerServer       string               `json:"jaegerServer,omitempty" description:"jaeger query server address"`
+	JaegerNamespaceTag string               `json:"jaegerNamespaceTag,omitempty" description:"process or span tag holding the kubernetes namespace, callers limited to some namespaces only get the spans of these namespaces"`
+	EnableHTTPSigs     bool                 `json:"enableHTTPSigs,omitempty" description:"check http sigs and the signed caller identity headers, default true (was false): unsigned callers get 401/403, sign requests with signerToken or disable it and list the gateways in trustedProxies"`
+	TrustedProxies     []string             `json:"trustedProxies,omitempty" description:"CIDRs of the gateways whose caller identity headers are trusted when http sigs is disabled"`
+	SignerToken        string               `json:"signerToken,omitempty" description:"token of http sigs, use the builtin token if empty"`
+	PrometheusTimeout  metav1.Duration      `json:"prometheusTimeout,omitempty" description:"max timeout of prometheus queries"`
+	Audit              *AuditOptions        `json:"audit,omitempty"`
+	Shell              *ShellOptions        `json:"shell,omitempty"`
+	Websocket          *ws.Options          `json:"websocket,omitempty"`
+	File               *FileOptions         `json:"file,omitempty"`
+	Log                *LogOptions          `json:"log,omitempty"`
+	ServiceProxy       *ServiceProxyOptions `json:"serviceProxy,omitempty"`
 }
 
 func NewDefaultOptions() *Options {
@@ -54,8 +257,59 @@ func NewDefaultOptions() *Options {
 		AlertManagerServer: fmt.Sprintf("http://alertmanager.%s:9090", kuber.NamespaceMonitor),
 		LokiServer:         fmt.Sprintf("http://loki-gateway.%s:3100", kuber.NamespaceLogging),
 		JaegerServer:       "http://jaeger-query.observability:16686",
-		EnableHTTPSigs:     false,
+		JaegerNamespaceTag: "k8s.namespace.name",
+		EnableHTTPSigs:     true, // 旧版本默认为 false, 不签名的调用方需要签名, 或者关闭后通过 trustedProxies 中的网关访问
+		PrometheusTimeout:  metav1.Duration{Duration: defaultPrometheusTimeout},
+		Audit:              NewDefaultAuditOptions(),
+		Shell:              NewDefaultShellOptions(),
+		Websocket:          ws.NewDefaultOptions(),
+		File:               NewDefaultFileOptions(),
+		Log:                NewDefaultLogOptions(),
+		ServiceProxy:       NewDefaultServiceProxyOptions(),
+	}
+}
+
+func (o *Options) Validate() error {
+	return errors.NewAggregate([]error{
+		config.ValidateURL("api.prometheusServer", o.PrometheusServer),
+		config.ValidateURL("api.alertManagerServer", o.AlertManagerServer),
+		config.ValidateURL("api.lokiServer", o.LokiServer),
+		config.ValidateURL("api.jaegerServer", o.JaegerServer),
+		validateCIDRs("api.trustedProxies", o.TrustedProxies),
+		o.Audit.Validate(),
+		o.Shell.Validate(),
+		o.Websocket.Validate(),
+		o.File.Validate(),
+		o.Log.Validate(),
+		o.ServiceProxy.Validate(),
+	})
+}
+
+func validateCIDRs(field string, cidrs []string) error {
+	for _, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("%s: %v", field, err)
+		}
+	}
+	return nil
+}
+
+// TrustedProxy 请求是否直接来自可信的网关, 只看连接的地址, 不信任 X-Forwarded-For
+func (o *Options) TrustedProxy(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
 	}
+	for _, cidr := range o.TrustedProxies {
+		if _, ipnet, err := net.ParseCIDR(cidr); err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 type handlerMux struct{ r *route.Router }
@@ -88,7 +342,7 @@ func (mu handlerMux) register(group, version, resource, action string, handler g
 }
 
 // TODO
-func Run(ctx context.Context, cluster cluster.Interface, system *system.Options, options *Options, debugOptions *DebugOptions) error {
+func Run(ctx context.Context, cluster cluster.Interface, system *system.Options, runtime *Runtime) error {
 	G := gin.New()
 
 	G.Use(
@@ -100,9 +354,11 @@ func Run(ctx context.Context, cluster cluster.Interface, system *system.Options,
 		gin.Recovery(),
 	)
 
-	if options.EnableHTTPSigs {
-		G.Use(middleware.SignerMiddleware())
-	}
+	G.Use(middleware.SignerMiddleware(func() bool {
+		return runtime.Load().Options.EnableHTTPSigs
+	}, func(req *http.Request) bool {
+		return runtime.Load().Options.TrustedProxy(req)
+	}))
 
 	router := route.NewRouter()
 
@@ -131,12 +387,29 @@ func Run(ctx context.Context, cluster cluster.Interface, system *system.Options,
 		ctx.JSON(http.StatusOK, gin.H{"healthy": "ok"})
 	})
 
+	// Kubernetes 和 apiserver 证书过期时间用于多集群管理中心探测集群, 获取失败时为空
+	versionCache := newClusterVersionCache(cluster)
 	routes.r.GET("/version", func(ctx *gin.Context) {
-		ctx.JSON(http.StatusOK, version.Get())
+		clusterVersion := versionCache.Get(ctx.Request.Context())
+		ret := struct {
+			version.Version
+			ConfigHash             string
+			Kubernetes             string
+			APIServerCertExpiredAt *time.Time
+		}{
+			Version:                version.Get(),
+			ConfigHash:             runtime.Load().Hash,
+			Kubernetes:             clusterVersion.Kubernetes,
+			APIServerCertExpiredAt: clusterVersion.APIServerCertExpiredAt,
+		}
+		ctx.JSON(http.StatusOK, ret)
 	})
 
-	serviceProxyHandler := ServiceProxyHandler{}
+	serviceProxyHandler := &ServiceProxyHandler{cluster: cluster, runtime: runtime}
 	routes.r.ANY("/v1/service-proxy/{realpath}*", serviceProxyHandler.ServiceProxy)
+	routes.r.ANY("/v1/service-proxy/namespaces/{namespace}/services/{service}/proxy/{realpath}*", serviceProxyHandler.ServiceProxy)
+	routes.r.ANY("/v1/service-proxy/namespaces/{namespace}/services/{service}/proxy/", serviceProxyHandler.ServiceProxy)
+	routes.r.ANY("/v1/service-proxy/namespaces/{namespace}/services/{service}/proxy", serviceProxyHandler.ServiceProxy)
 
 	// restful api for all k8s resources
 	routes.registerREST(cluster)
@@ -146,21 +419,29 @@ func Run(ctx context.Context, cluster cluster.Interface, system *system.Options,
 	routes.register("statistics.system", "v1", "workloads", ActionList, staticsHandler.ClusterWorkloadStatistics)
 	routes.register("statistics.system", "v1", "resources", ActionList, staticsHandler.ClusterResourceStatistics)
 
-	nodeHandler := &NodeHandler{C: cluster.GetClient()}
+	nodeHandler := &NodeHandler{C: cluster.GetClient(), cluster: cluster, runtime: runtime}
+	routes.register("core", "v1", "nodes", ActionList, nodeHandler.List)
 	routes.register("core", "v1", "nodes", ActionGet, nodeHandler.GET)
 	routes.register("core", "v1", "nodes", "metadata", nodeHandler.PatchNodeLabelOrAnnotations)
 	routes.register("core", "v1", "nodes", "taint", nodeHandler.PatchNodeTaint)
 	routes.register("core", "v1", "nodes", "cordon", nodeHandler.PatchNodeCordon)
+	routes.register("core", "v1", "nodes", "debug", nodeHandler.DebugNode)
+	routes.register("core", "v1", "nodes", "drain", nodeHandler.Drain)
+	routes.register("core", "v1", "nodes", "uncordon", nodeHandler.Uncordon)
 
 	nsHandler := &NamespaceHandler{C: cluster.GetClient()}
 	routes.register("core", "v1", "namespaces", ActionList, nsHandler.List)
 
-	podHandler := PodHandler{cluster: cluster, debugoptions: debugOptions}
+	podHandler := PodHandler{cluster: cluster, runtime: runtime}
 	routes.register("core", "v1", "pods", ActionList, podHandler.List)
 	routes.register("core", "v1", "pods", "shell", podHandler.Exec)
+	routes.register("core", "v1", "pods", "exec", podHandler.ExecCommand)
+	routes.register("core", "v1", "pods", "debug", podHandler.DebugPod)
 	routes.register("core", "v1", "pods", "logs", podHandler.ContainerLogs)
+	routes.register("core", "v1", "pods", "logarchive", podHandler.LogArchive)
 	routes.register("core", "v1", "pods", "file", podHandler.DownloadFile)
 	routes.register("core", "v1", "pods", "upfile", podHandler.UploadFile)
+	routes.register("core", "v1", "pods", "ls", podHandler.ListFiles)
 
 	rolloutHandler := &RolloutHandler{cluster: cluster}
 	routes.register("apps", "v1", "daemonsets", "rollouthistory", rolloutHandler.DaemonSetHistory)
@@ -170,20 +451,60 @@ func Run(ctx context.Context, cluster cluster.Interface, system *system.Options,
 	routes.register("apps", "v1", "statefulsets", "rollback", rolloutHandler.StatefulSetRollback)
 	routes.register("apps", "v1", "deployments", "rollback", rolloutHandler.DeploymentRollback)
 
-	kubectlHandler := KubectlHandler{cluster: cluster, debugOptions: debugOptions}
+	kubectlHandler := NewKubectlHandler(cluster, runtime)
 	routes.register("system", "v1", "kubectl", ActionList, kubectlHandler.Exec)
+	// 清理 agent 异常退出后遗留的 kubectl 会话
+	go wait.UntilWithContext(ctx, kubectlHandler.CollectGarbage, kubectlGCInterval)
 
-	prometheusHandler, err := NewPrometheusHandler(options.PrometheusServer)
-	if err != nil {
-		return err
-	}
-	routes.register("prometheus", "v1", "vector", ActionList, prometheusHandler.Vector)
+	sessionHandler := &SessionHandler{cluster: cluster, runtime: runtime}
+	routes.register("system", "v1", "sessions", ActionList, sessionHandler.List)
+	routes.register("system", "v1", "sessions", ActionGet, sessionHandler.Get)
+	routes.register("system", "v1", "sessions", "replay", sessionHandler.Replay)
 
-	alertManagerHandler, err := NewAlertManagerClient(options.AlertManagerServer, cluster.Kubernetes())
-	if err != nil {
-		return err
+	prometheusHandler := &prometheusHandler{cluster: cluster, runtime: runtime}
+	routes.register("prometheus", "v1", "vector", ActionList, prometheusHandler.Vector)
+	routes.register("prometheus", "v1", "matrix", ActionList, prometheusHandler.Matrix)
+	routes.register("prometheus", "v1", "series", ActionList, prometheusHandler.Series)
+	routes.register("prometheus", "v1", "labels", ActionList, prometheusHandler.LabelNames)
+	routes.register("prometheus", "v1", "labels", ActionGet, prometheusHandler.LabelValues)
+	routes.register("prometheus", "v1", "targets", ActionList, prometheusHandler.Targets)
+	routes.register("prometheus", "v1", "rules", ActionList, prometheusHandler.Rules)
+	routes.register("prometheus", "v1", "metrics", ActionList, prometheusHandler.MetricTemplates)
+	// 路由中同一位置的变量共用一个节点, namespace 级别的资源按照名称单独注册
+	for _, resource := range prometheus.NamespacedMetricResources() {
+		routes.r.GET("/custom/prometheus/v1/metrics/"+resource+"/{namespace}/{name}/{metric}", prometheusHandler.NamespacedMetric(resource))
 	}
+	routes.r.GET("/custom/prometheus/v1/metrics/{resource}/{name}/{metric}", prometheusHandler.Metric)
+
+	podMetricsHandler := &PodMetricsHandler{C: cluster.GetClient()}
+	routes.register("metrics.k8s.io", "v1beta1", "pods", ActionList, podMetricsHandler.ListPods)
+	routes.register("metrics.k8s.io", "v1beta1", "top", ActionGet, podMetricsHandler.Top)
+
+	alertManagerHandler := &AlertManagerHandler{cluster: cluster, runtime: runtime}
 	routes.register("alertmanager", "v1", "alerts", ActionList, alertManagerHandler.ListAlerts)
+	routes.register("alertmanager", "v1", "groups", ActionList, alertManagerHandler.ListAlertGroups)
+	routes.register("alertmanager", "v1", "receivers", ActionList, alertManagerHandler.ListReceivers)
+	routes.register("alertmanager", "v1", "status", ActionList, alertManagerHandler.Status)
+	routes.register("alertmanager", "v1", "silences", ActionList, alertManagerHandler.ListSilences)
+	routes.register("alertmanager", "v1", "silences", ActionGet, alertManagerHandler.GetSilence)
+	routes.register("alertmanager", "v1", "silences", "expire", alertManagerHandler.ExpireSilence)
+	routes.r.POST("/custom/alertmanager/v1/silences", alertManagerHandler.CreateSilence)
+	routes.r.POST("/custom/alertmanager/v1/namespaces/{namespace}/silences", alertManagerHandler.CreateSilence)
+	// 已经在 SignerMiddleware 的白名单中, alertmanager 无法签名, 使用 alertWebhookToken 认证
+	routes.r.POST("/alert", alertManagerHandler.Webhook)
+
+	lokiHandler := &LokiHandler{cluster: cluster, runtime: runtime}
+	routes.register("loki", "v1", "queryrange", ActionList, lokiHandler.QueryRange)
+	routes.register("loki", "v1", "query", ActionList, lokiHandler.Query)
+	routes.register("loki", "v1", "labels", ActionList, lokiHandler.Labels)
+	routes.register("loki", "v1", "labels", ActionGet, lokiHandler.LabelValues)
+	routes.register("loki", "v1", "tail", ActionList, lokiHandler.Tail)
+
+	jaegerHandler := &JaegerHandler{cluster: cluster, runtime: runtime}
+	routes.register("jaeger", "v1", "services", ActionList, jaegerHandler.Services)
+	routes.register("jaeger", "v1", "services", "operations", jaegerHandler.Operations)
+	routes.register("jaeger", "v1", "traces", ActionList, jaegerHandler.SearchTraces)
+	routes.register("jaeger", "v1", "traces", ActionGet, jaegerHandler.GetTrace)
 
 	jobHandle := &JobHandler{C: cluster.GetClient(), cluster: cluster}
 	routes.register("batch", "v1", "jobs", ActionList, jobHandle.List)
@@ -192,7 +513,13 @@ func Run(ctx context.Context, cluster cluster.Interface, system *system.Options,
 	routes.register("core", "v1", "events", ActionList, eventHandler.List)
 
 	// service client internal apis
-	internalClientRest := client.ClientRest{Cli: cluster.GetClient()}
+	internalClientRest := client.ClientRest{
+		Cli:     cluster.GetClient(),
+		Cluster: cluster,
+		Websocket: func() *ws.Options {
+			return runtime.Load().Options.Websocket
+		},
+	}
 	internalClientRest.Register(routes.r)
 
 	if err := listen(ctx, system, G); err != nil {
@@ -0,0 +1,266 @@
+package apis
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/agent/audit"
+	"github.com/sunweiwe/kuber/pkg/agent/cluster"
+	"github.com/sunweiwe/kuber/pkg/agent/ws"
+	"github.com/sunweiwe/kuber/pkg/log"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// auditStream 在终端的输入输出上记录审计信息和录像
+type auditStream struct {
+	*ws.StreamHandler
+	session  *audit.Session
+	store    *audit.Store
+	recorder *audit.Recorder
+	closer   io.Closer
+}
+
+// newAuditStream 每个会话都会记录到日志中, 配置了目录时保存会话信息, 开启录像时保存录像
+func newAuditStream(c *gin.Context, options *AuditOptions, handler *ws.StreamHandler, kind, namespace, pod, container string) *auditStream {
+	s := &auditStream{
+		StreamHandler: handler,
+		session: &audit.Session{
+			ID:        audit.NewSessionID(),
+			Kind:      kind,
+			User:      c.GetHeader(HeaderUser),
+			Tenant:    c.GetHeader(HeaderTenant),
+			Namespace: namespace,
+			Pod:       pod,
+			Container: container,
+			Start:     time.Now(),
+		},
+	}
+	log.Info("shell session started", "id", s.session.ID, "kind", kind, "user", s.session.User,
+		"tenant", s.session.Tenant, "namespace", namespace, "pod", pod, "container", container)
+
+	if options == nil || options.Dir == "" {
+		return s
+	}
+	s.store = &audit.Store{Dir: options.Dir}
+	if options.Record {
+		// 录像失败不影响使用终端
+		if err := s.startRecording(options.RecordInput); err != nil {
+			log.Error(err, "start shell session recording", "id", s.session.ID)
+		}
+	}
+	if err := s.store.Save(s.session); err != nil {
+		log.Error(err, "save shell session", "id", s.session.ID)
+	}
+	return s
+}
+
+func (s *auditStream) startRecording(input bool) error {
+	f, err := s.store.CreateRecording(s.session.ID)
+	if err != nil {
+		return err
+	}
+	title := s.session.Kind
+	if s.session.Pod != "" {
+		title = fmt.Sprintf("%s %s/%s/%s", s.session.Kind, s.session.Namespace, s.session.Pod, s.session.Container)
+	}
+	recorder, err := audit.NewRecorder(f, title, input)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.recorder, s.closer = recorder, f
+	s.session.Recorded = true
+	return nil
+}
+
+func (s *auditStream) Read(p []byte) (int, error) {
+	n, err := s.StreamHandler.Read(p)
+	if s.recorder != nil && n > 0 {
+		s.recorder.Input(p[:n])
+	}
+	return n, err
+}
+
+func (s *auditStream) Write(p []byte) (int, error) {
+	if s.recorder != nil {
+		s.recorder.Output(p)
+	}
+	return s.StreamHandler.Write(p)
+}
+
+// Stderr 非 TTY 会话的 stderr, 与 stdout 一样记录到录像中
+func (s *auditStream) Stderr() io.Writer {
+	return auditStderr{stream: s, stderr: s.StreamHandler.Stderr()}
+}
+
+type auditStderr struct {
+	stream *auditStream
+	stderr io.Writer
+}
+
+func (w auditStderr) Write(p []byte) (int, error) {
+	if w.stream.recorder != nil {
+		w.stream.recorder.Output(p)
+	}
+	return w.stderr.Write(p)
+}
+
+func (s *auditStream) Next() *remotecommand.TerminalSize {
+	size := s.StreamHandler.Next()
+	if s.recorder != nil && size != nil {
+		s.recorder.Resize(size.Width, size.Height)
+	}
+	return size
+}
+
+// Finish 记录结束时间
+func (s *auditStream) Finish(err error) {
+	end := time.Now()
+	s.session.End = &end
+	if err != nil {
+		s.session.Error = err.Error()
+	}
+	log.Info("shell session finished", "id", s.session.ID, "user", s.session.User,
+		"duration", end.Sub(s.session.Start).String(), "error", s.session.Error)
+
+	if s.closer != nil {
+		if err := s.recorder.Err(); err != nil {
+			log.Error(err, "record shell session", "id", s.session.ID)
+		}
+		_ = s.closer.Close()
+	}
+	if s.store != nil {
+		if err := s.store.Save(s.session); err != nil {
+			log.Error(err, "save shell session", "id", s.session.ID)
+		}
+	}
+}
+
+type SessionHandler struct {
+	cluster cluster.Interface
+	runtime *Runtime
+}
+
+// @Tags        Agent.V1
+// @Summary     终端会话审计列表
+// @Description 终端会话审计列表, 租户内的用户只能看到自己namespace内的会话
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                        true  "cluster"
+// @Param       user    query    string                                        false "user"
+// @Success     200     {object} handlers.ResponseStruct{Data=[]audit.Session} "sessions"
+// @Router      /v1/proxy/cluster/{cluster}/custom/system/v1/sessions [get]
+// @Security    JWT
+func (h *SessionHandler) List(c *gin.Context) {
+	store, scope, err := h.prepare(c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	sessions, err := store.List()
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	namespace, user := c.Param("namespace"), c.Query("user")
+	ret := []*audit.Session{}
+	for _, session := range sessions {
+		if namespace != "" && session.Namespace != namespace {
+			continue
+		}
+		if user != "" && session.User != user {
+			continue
+		}
+		if !sessionVisible(scope, session) {
+			continue
+		}
+		ret = append(ret, session)
+	}
+	OK(c, ret)
+}
+
+// @Tags        Agent.V1
+// @Summary     终端会话审计详情
+// @Description 终端会话审计详情
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                      true "cluster"
+// @Param       name    path     string                                      true "session id"
+// @Success     200     {object} handlers.ResponseStruct{Data=audit.Session} "session"
+// @Router      /v1/proxy/cluster/{cluster}/custom/system/v1/sessions/{name} [get]
+// @Security    JWT
+func (h *SessionHandler) Get(c *gin.Context) {
+	session, _, err := h.session(c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	OK(c, session)
+}
+
+// @Tags        Agent.V1
+// @Summary     回放终端会话
+// @Description 返回 asciinema v2 格式的录像, 可以使用 asciinema play 或者 asciinema-player 回放
+// @Produce     plain
+// @Param       cluster path     string true "cluster"
+// @Param       name    path     string true "session id"
+// @Success     200     {string} string "asciicast"
+// @Router      /v1/proxy/cluster/{cluster}/custom/system/v1/sessions/{name}/actions/replay [get]
+// @Security    JWT
+func (h *SessionHandler) Replay(c *gin.Context) {
+	session, store, err := h.session(c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	if !session.Recorded {
+		NotOK(c, fmt.Errorf("session %s is not recorded", session.ID))
+		return
+	}
+	f, err := store.OpenRecording(session.ID)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	defer f.Close()
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.cast", session.ID))
+	c.DataFromReader(http.StatusOK, -1, "application/x-asciicast", f, nil)
+}
+
+func (h *SessionHandler) session(c *gin.Context) (*audit.Session, *audit.Store, error) {
+	store, scope, err := h.prepare(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := store.Get(c.Param("name"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !sessionVisible(scope, session) {
+		return nil, nil, scope.Forbidden("sessions", session.ID)
+	}
+	return session, store, nil
+}
+
+func (h *SessionHandler) prepare(c *gin.Context) (*audit.Store, *Scope, error) {
+	options := h.runtime.Load().Options.Audit
+	if options == nil || options.Dir == "" {
+		return nil, nil, fmt.Errorf("shell session audit is not enabled")
+	}
+	scope, err := scopeFromRequest(c.Request.Context(), h.cluster.GetClient(), c)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &audit.Store{Dir: options.Dir}, scope, nil
+}
+
+// sessionVisible kubectl 等集群级别的会话只有不受限制的调用方可以查看
+func sessionVisible(scope *Scope, session *audit.Session) bool {
+	if scope.Unlimited() {
+		return true
+	}
+	return session.Namespace != "" && session.Kind != audit.KindKubectl && scope.Contains(session.Namespace)
+}
@@ -2,200 +2,296 @@ package apis
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"math/rand"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
+	"github.com/sunweiwe/kuber/pkg/agent/audit"
 	"github.com/sunweiwe/kuber/pkg/agent/cluster"
-	"github.com/sunweiwe/kuber/pkg/agent/ws"
-	"github.com/sunweiwe/kuber/pkg/service/handlers"
+	"github.com/sunweiwe/kuber/pkg/log"
 	v1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/labels"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/remotecommand"
-	"sigs.k8s.io/controller-runtime/pkg/client"
+	"k8s.io/kubectl/pkg/scheme"
 )
 
 const (
-	DebugAgentNamespace = "debug-tools"
-	DebugAgentImage     = "kuber/debug-agent:latest"
-	DebugToolsImage     = "kuber/debug-tools:latest"
+	debugContainerPrefix  = "debugger-"
+	nodeDebuggerName      = "kuber-node-debugger"
+	nodeDebuggerContainer = "debugger"
+
+	defaultDebugStartTimeout = 2 * time.Minute
 )
 
-// ExecContainer 调试容器(websocket)
+// DebugPod 使用临时容器调试
 // @Tags        Agent.V1
 // @Summary     调试容器(websocket)
-// @Description 调试容器(websocket)
+// @Description 在 pod 中创建临时容器(ephemeral container), 共享目标容器的进程命名空间, 启动后通过 websocket 连接终端
 // @Param       cluster   path     string true  "cluster"
 // @Param       namespace path     string true  "namespace"
 // @Param       name      path     string true  "pod name"
-// @Param       container query    string true  "container"
+// @Param       container query    string false "目标容器, 默认为第一个容器"
+// @Param       image     query    string false "调试镜像, 默认为配置的 debug.image, 租户内的用户只能使用 debug.allowedImages 中的镜像"
 // @Param       stream    query    string true  "must be true"
-// @Param       agent     query    string false "agent"
-// @Param       debug     query    string false "debug"
-// @Param       fork      query    string false "fork"
 // @Success     200       {object} object "ws"
-// @Router      /v1/proxy/cluster/{cluster}/custom/core/v1/{namespace}/pods/{name}/actions/debug [get]
+// @Router      /v1/proxy/cluster/{cluster}/custom/core/v1/namespaces/{namespace}/pods/{name}/actions/debug [get]
 // @Security    JWT
 func (h *PodHandler) DebugPod(c *gin.Context) {
-	conn, err := ws.InitWebsocket(c.Writer, c.Request)
-	if err != nil {
-		_ = conn.WsWrite(websocket.TextMessage, []byte("init websocket connection error"))
-		conn.WsClose()
-		return
-	}
-	handler := &ws.StreamHandler{WsConn: conn, ResizeEvent: make(chan remotecommand.TerminalSize)}
-	exec, err := h.debug(c)
-	if err != nil {
-		log.Printf("Upgrade Websocket failed: %s", err.Error())
-		handlers.NotOK(c, err)
-		return
-	}
-
-	if err = exec.Stream(remotecommand.StreamOptions{
-		Stdin:             handler,
-		Stdout:            handler,
-		Stderr:            handler,
-		TerminalSizeQueue: handler,
-		Tty:               true,
-	}); err != nil {
-		_ = conn.WsWrite(websocket.TextMessage, []byte("init websocket stream error"+err.Error()))
-		<-time.AfterFunc(time.Duration(3)*time.Second, func() {
-			conn.WsClose()
-		}).C
-		return
-	}
+	namespace, name := c.Param("namespace"), c.Param("name")
+	target := paramFromHeaderOrQuery(c, "container", "")
+	serveTerminal(c, h.runtime.Load().Options, audit.KindDebug, namespace, name, target, true, func() (remotecommand.Executor, error) {
+		return h.debug(c, namespace, name, target)
+	})
 }
 
-func (h *PodHandler) debug(c *gin.Context) (remotecommand.Executor, error) {
-	image := paramFromHeaderOrQuery(c, "debugimage", h.debugoptions.Image)
-	command := []string{
-		"kubectl",
-		"-n",
-		c.Param("namespace"),
-		"debug",
-		c.Param("name"),
-		image,
-		"--image-pull-policy=IfNotPresent",
-		"-it",
-		"--",
-		"/start.sh",
-	}
-	podName, err := kubectlContainer(c.Request.Context(), h.cluster.GetClient(), h.debugoptions)
+func (h *PodHandler) debug(c *gin.Context, namespace, name, target string) (remotecommand.Executor, error) {
+	ctx := c.Request.Context()
+	scope, err := scopeFromRequest(ctx, h.cluster.GetClient(), c)
 	if err != nil {
 		return nil, err
 	}
-	pe := PodCmdExecutor{
-		Cluster:   h.cluster,
-		Namespace: h.debugoptions.Namespace,
-		Pod:       podName,
-		Container: "",
-		Stdin:     true,
-		Stdout:    true,
-		Stderr:    true,
-		TTY:       true,
+	if !scope.Contains(namespace) {
+		return nil, scope.Forbidden("pods", name)
 	}
-	return pe.executor(command)
-}
 
-func kubectlContainer(ctx context.Context, ctl client.Client, debug *DebugOptions) (string, error) {
-	namespace := debug.Namespace
-
-	podList := &v1.PodList{}
-	sel, err := labels.Parse(debug.PodSelector)
+	pods := h.cluster.Kubernetes().CoreV1().Pods(namespace)
+	pod, err := pods.Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	if err := ctl.List(ctx, podList, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: sel}); err != nil {
-		return "", fmt.Errorf("Failed to get kubectl container %v", err)
+	if pod.Status.Phase != v1.PodRunning {
+		return nil, fmt.Errorf("pod %s is %s, only running pods can be debugged", name, pod.Status.Phase)
+	}
+	if target == "" {
+		target = pod.Spec.Containers[0].Name
 	}
-	if len(podList.Items) == 0 {
-		return "", fmt.Errorf("Failed to get kubectl container")
+	if !hasContainer(pod.Spec.Containers, target) {
+		return nil, fmt.Errorf("container %s not found in pod %s", target, name)
 	}
 
-	var podName string
-	randTime := rand.New(rand.NewSource(time.Now().Unix()))
-	randTime.Shuffle(len(podList.Items), func(i, j int) {
-		podList.Items[i], podList.Items[j] = podList.Items[j], podList.Items[i]
+	debugOptions := h.runtime.Load().Debug
+	image, err := debugImage(scope, debugOptions, paramFromHeaderOrQuery(c, "image", ""))
+	if err != nil {
+		return nil, err
+	}
+	container := v1.EphemeralContainer{
+		EphemeralContainerCommon: v1.EphemeralContainerCommon{
+			Name:            debugContainerPrefix + utilrand.String(5),
+			Image:           image,
+			ImagePullPolicy: v1.PullIfNotPresent,
+			Stdin:           true,
+			TTY:             true,
+		},
+		TargetContainerName: target,
+	}
+	// 与 kubectl debug 相同, 使用 strategic merge patch 追加临时容器
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"ephemeralContainers": []v1.EphemeralContainer{container},
+		},
 	})
-	for _, po := range podList.Items {
-		if po.Status.Phase == v1.PodRunning {
-			podName = po.GetName()
-			break
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pods.Patch(ctx, name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}, "ephemeralcontainers"); err != nil {
+		if apiErrors.IsNotFound(err) {
+			return nil, fmt.Errorf("ephemeral containers are not supported by this cluster: %v", err)
 		}
+		return nil, err
 	}
+	log.Info("debug container created", "user", scope.User, "namespace", namespace, "pod", name,
+		"container", container.Name, "target", target, "image", container.Image)
 
-	if len(podName) == 0 {
-		return podName, fmt.Errorf("Can't find kubectl container")
+	if err := waitContainerRunning(ctx, h.cluster, namespace, name, container.Name, debugOptions.StartTimeout.Duration); err != nil {
+		return nil, err
 	}
-	return podName, nil
-}
-
-type KubectlHandler struct {
-	cluster      cluster.Interface
-	debugOptions *DebugOptions
+	return attachExecutor(h.cluster, namespace, name, container.Name)
 }
 
-// Exec         kubectl
+// DebugNode 在节点上创建调试 pod
 // @Tags        Agent.V1
-// @Summary     kubectl
-// @Description kubectl
-// @Param       cluster path     string true "cluster"
-// @Param       stream  query    string true "stream must be true"
+// @Summary     调试节点(websocket)
+// @Description 创建固定在节点上的特权 pod, 使用 hostPID/hostNetwork/hostIPC, 节点的根目录挂载在 /host, 会话结束后删除
+// @Param       cluster path     string true  "cluster"
+// @Param       name    path     string true  "node name"
+// @Param       image   query    string false "调试镜像, 默认为配置的 debug.image"
+// @Param       stream  query    string true  "must be true"
 // @Success     200     {object} object "ws"
-// @Router      /v1/proxy/cluster/{cluster}/custom/system/v1/kubectl [get]
+// @Router      /v1/proxy/cluster/{cluster}/custom/core/v1/nodes/{name}/actions/debug [get]
 // @Security    JWT
-func (h *KubectlHandler) Exec(c *gin.Context) {
-	conn, err := ws.InitWebsocket(c.Writer, c.Request)
-	if err != nil {
-		_ = conn.WsWrite(websocket.TextMessage, []byte("init websocket connection error"))
-		conn.WsClose()
+func (h *NodeHandler) DebugNode(c *gin.Context) {
+	name := c.Param("name")
+	var debugger *v1.Pod
+	serveTerminal(c, h.runtime.Load().Options, audit.KindDebug, "", name, "", true, func() (remotecommand.Executor, error) {
+		pod, err := h.debugNode(c, name)
+		if pod != nil {
+			debugger = pod
+		}
+		if err != nil {
+			return nil, err
+		}
+		return attachExecutor(h.cluster, pod.Namespace, pod.Name, nodeDebuggerContainer)
+	})
+	if debugger == nil {
 		return
 	}
-	handler := &ws.StreamHandler{WsConn: conn, ResizeEvent: make(chan remotecommand.TerminalSize)}
-	exec, err := h.kubectl(c)
+	// 请求已经结束, 使用新的 context 清理
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	grace := int64(0)
+	if err := h.cluster.Kubernetes().CoreV1().Pods(debugger.Namespace).Delete(ctx, debugger.Name,
+		metav1.DeleteOptions{GracePeriodSeconds: &grace}); err != nil && !apiErrors.IsNotFound(err) {
+		log.Error(err, "delete node debugger", "namespace", debugger.Namespace, "pod", debugger.Name)
+	}
+}
+
+// debugNode 创建成功后即使启动失败也返回 pod, 以便清理
+func (h *NodeHandler) debugNode(c *gin.Context, name string) (*v1.Pod, error) {
+	ctx := c.Request.Context()
+	scope, err := scopeFromRequest(ctx, h.cluster.GetClient(), c)
 	if err != nil {
-		log.Printf("Upgrade Websocket failed: %s", err.Error())
-		handlers.NotOK(c, err)
-		return
+		return nil, err
 	}
-	if err = exec.Stream(remotecommand.StreamOptions{
-		Stdin:             handler,
-		Stdout:            handler,
-		Stderr:            handler,
-		TerminalSizeQueue: handler,
-		Tty:               true,
-	}); err != nil {
-		_ = conn.WsWrite(websocket.TextMessage, []byte("init websocket stream error "+err.Error()))
-		<-time.AfterFunc(time.Duration(3)*time.Second, func() {
-			conn.WsClose()
-		}).C
-		return
+	if !scope.Unlimited() {
+		return nil, scope.Forbidden("nodes", name)
+	}
+	debugOptions := h.runtime.Load().Debug
+	if debugOptions.Namespace == "" {
+		return nil, fmt.Errorf("debug.namespace is required to debug nodes")
+	}
+	image, err := debugImage(scope, debugOptions, paramFromHeaderOrQuery(c, "image", ""))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := h.cluster.Kubernetes().CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{}); err != nil {
+		return nil, err
 	}
-}
 
-func (h *KubectlHandler) kubectl(c *gin.Context) (remotecommand.Executor, error) {
-	command := []string{
-		"/bin/sh",
-		"-c",
-		"export LINES=20; export COLUMNS=100; TERM=xterm-256color; export TERM; [ -x /bin/bash ] && ([ -x /usr/bin/script ] && /usr/bin/script -q -c /bin/bash /dev/null || exec /bin/bash) || exec /bin/sh",
+	privileged := true
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "node-debugger-" + name + "-",
+			Namespace:    debugOptions.Namespace,
+			Labels:       map[string]string{"app.kubernetes.io/name": nodeDebuggerName},
+		},
+		Spec: v1.PodSpec{
+			NodeName:      name,
+			HostPID:       true,
+			HostNetwork:   true,
+			HostIPC:       true,
+			RestartPolicy: v1.RestartPolicyNever,
+			// 调度到有污点的节点上
+			Tolerations: []v1.Toleration{{Operator: v1.TolerationOpExists}},
+			Containers: []v1.Container{{
+				Name:            nodeDebuggerContainer,
+				Image:           image,
+				ImagePullPolicy: v1.PullIfNotPresent,
+				Stdin:           true,
+				TTY:             true,
+				SecurityContext: &v1.SecurityContext{Privileged: &privileged},
+				VolumeMounts:    []v1.VolumeMount{{Name: "host-root", MountPath: "/host"}},
+			}},
+			Volumes: []v1.Volume{{
+				Name:         "host-root",
+				VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/"}},
+			}},
+		},
 	}
-	podName, err := kubectlContainer(c.Request.Context(), h.cluster.GetClient(), h.debugOptions)
+	created, err := h.cluster.Kubernetes().CoreV1().Pods(pod.Namespace).Create(ctx, pod, metav1.CreateOptions{})
 	if err != nil {
 		return nil, err
 	}
-	pe := PodCmdExecutor{
-		Cluster:   h.cluster,
-		Namespace: h.debugOptions.Namespace,
-		Pod:       podName,
-		Container: "",
+	log.Info("node debugger created", "user", scope.User, "node", name, "namespace", created.Namespace, "pod", created.Name)
+	if err := waitContainerRunning(ctx, h.cluster, created.Namespace, created.Name, nodeDebuggerContainer, debugOptions.StartTimeout.Duration); err != nil {
+		return created, err
+	}
+	return created, nil
+}
+
+// debugImage 未指定时使用配置的镜像, 只有不受限制的调用方可以指定任意镜像, 其他用户只能使用 AllowedImages 中的镜像
+func debugImage(scope *Scope, options *DebugOptions, image string) (string, error) {
+	if image == "" || image == options.Image || scope.Unlimited() {
+		if image == "" {
+			return options.Image, nil
+		}
+		return image, nil
+	}
+	for _, allowed := range options.AllowedImages {
+		if allowed == image {
+			return image, nil
+		}
+	}
+	return "", scope.Forbidden("images", image)
+}
+
+// waitContainerRunning 等待容器(包括临时容器)启动, 镜像错误等无法恢复的状态直接返回
+func waitContainerRunning(ctx context.Context, cluster cluster.Interface, namespace, pod, container string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := wait.PollImmediateUntilWithContext(ctx, time.Second, func(ctx context.Context) (bool, error) {
+		current, err := cluster.Kubernetes().CoreV1().Pods(namespace).Get(ctx, pod, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if current.Status.Phase == v1.PodSucceeded || current.Status.Phase == v1.PodFailed {
+			return false, fmt.Errorf("pod %s is %s", pod, current.Status.Phase)
+		}
+		statuses := append(current.Status.ContainerStatuses, current.Status.EphemeralContainerStatuses...)
+		for _, status := range statuses {
+			if status.Name != container {
+				continue
+			}
+			switch {
+			case status.State.Running != nil:
+				return true, nil
+			case status.State.Terminated != nil:
+				return false, fmt.Errorf("container %s terminated: %s %s", container,
+					status.State.Terminated.Reason, status.State.Terminated.Message)
+			case status.State.Waiting != nil && fatalWaitingReasons[status.State.Waiting.Reason]:
+				return false, fmt.Errorf("container %s failed to start: %s %s", container,
+					status.State.Waiting.Reason, status.State.Waiting.Message)
+			}
+		}
+		return false, nil
+	})
+	if errors.Is(err, wait.ErrWaitTimeout) {
+		return fmt.Errorf("timed out waiting for container %s to start", container)
+	}
+	return err
+}
+
+var fatalWaitingReasons = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// attachExecutor attach 到容器的主进程
+func attachExecutor(cluster cluster.Interface, namespace, pod, container string) (remotecommand.Executor, error) {
+	req := cluster.Kubernetes().CoreV1().RESTClient().Post().Resource("pods").Namespace(namespace).
+		Name(pod).SubResource("attach").VersionedParams(&v1.PodAttachOptions{
+		Container: container,
 		Stdin:     true,
 		Stdout:    true,
-		Stderr:    true,
+		Stderr:    false,
 		TTY:       true,
+	}, scheme.ParameterCodec)
+	return remotecommand.NewSPDYExecutor(cluster.Config(), "POST", req.URL())
+}
+
+func hasContainer(containers []v1.Container, name string) bool {
+	for _, container := range containers {
+		if container.Name == name {
+			return true
+		}
 	}
-	return pe.executor(command)
+	return false
 }
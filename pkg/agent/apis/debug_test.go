@@ -0,0 +1,47 @@
+package apis
+
+import (
+	"testing"
+
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+func TestDebugImage(t *testing.T) {
+	options := NewDefaultDebugOptions()
+	options.Image = "kuber/debug-tools:latest"
+	options.AllowedImages = []string{"busybox:1.36"}
+	unlimited := &Scope{}
+	tenant := &Scope{User: "alice", Tenant: "t1", Namespaces: []string{"t1-dev"}}
+	tests := []struct {
+		name          string
+		scope         *Scope
+		image         string
+		want          string
+		wantForbidden bool
+	}{
+		{name: "default", scope: tenant, want: "kuber/debug-tools:latest"},
+		{name: "configured image", scope: tenant, image: "kuber/debug-tools:latest", want: "kuber/debug-tools:latest"},
+		{name: "allowed image", scope: tenant, image: "busybox:1.36", want: "busybox:1.36"},
+		{name: "tenant any image", scope: tenant, image: "evil/miner:latest", wantForbidden: true},
+		{name: "tenant similar image", scope: tenant, image: "busybox:1.36-evil", wantForbidden: true},
+		{name: "unlimited any image", scope: unlimited, image: "nicolaka/netshoot", want: "nicolaka/netshoot"},
+		{name: "unlimited default", scope: unlimited, want: "kuber/debug-tools:latest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := debugImage(tt.scope, options, tt.image)
+			if tt.wantForbidden {
+				if !apiErrors.IsForbidden(err) {
+					t.Fatalf("debugImage() error = %v, want forbidden", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("debugImage() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("debugImage() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package apis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	defaultDrainTimeout = 10 * time.Minute
+	// PodDisruptionBudget 不允许驱逐时重试的间隔
+	evictionRetryInterval = 5 * time.Second
+	podDeletePollInterval = 2 * time.Second
+
+	mirrorPodAnnotation = "kubernetes.io/config.mirror"
+)
+
+// 驱逐进度
+const (
+	DrainPhaseCordoned  = "cordoned"
+	DrainPhaseSkipped   = "skipped"
+	DrainPhaseEvicting  = "evicting"
+	DrainPhaseBlocked   = "blocked"
+	DrainPhaseEvicted   = "evicted"
+	DrainPhaseFailed    = "failed"
+	DrainPhaseCompleted = "completed"
+)
+
+type drainForm struct {
+	IgnoreDaemonSets   bool `json:"ignoreDaemonSets" form:"ignoreDaemonSets"`
+	DeleteEmptyDirData bool `json:"deleteEmptyDirData" form:"deleteEmptyDirData"`
+	// 驱逐没有控制器管理的 pod, 这些 pod 不会被重建
+	Force bool `json:"force" form:"force"`
+	// 为空或者负数时使用 pod 的 terminationGracePeriodSeconds
+	GracePeriodSeconds *int64 `json:"gracePeriodSeconds" form:"gracePeriodSeconds"`
+	TimeoutSeconds     int    `json:"timeoutSeconds" form:"timeoutSeconds"`
+}
+
+// DrainEvent 通过 SSE 发送的进度, 最后一个事件的 phase 为 completed 或者 failed
+type DrainEvent struct {
+	Phase     string `json:"phase"`
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// Drain 驱逐节点上的 pod
+// @Tags        Agent.V1
+// @Summary     驱逐节点(SSE)
+// @Description 禁止调度后通过 Eviction API 驱逐节点上的 pod, PodDisruptionBudget 不允许时重试直到超时, 每个 pod 的进度作为 SSE 的 data 事件发送
+// @Accept      json
+// @Produce     text/event-stream
+// @Param       param   body     drainForm  false "选项, GET 时使用同名的 query 参数"
+// @Param       name    path     string     true  "name"
+// @Param       cluster path     string     true  "cluster"
+// @Success     200     {object} DrainEvent "progress"
+// @Router      /v1/proxy/cluster/{cluster}/custom/core/v1/nodes/{name}/actions/drain [post]
+// @Security    JWT
+func (h *NodeHandler) Drain(c *gin.Context) {
+	name := c.Param("name")
+	form := drainForm{}
+	bind := c.ShouldBind
+	if c.Request.ContentLength == 0 {
+		bind = c.ShouldBindQuery
+	}
+	if err := bind(&form); err != nil {
+		NotOK(c, err)
+		return
+	}
+	if err := h.checkNodeAccess(c, name); err != nil {
+		NotOK(c, err)
+		return
+	}
+	timeout := defaultDrainTimeout
+	if form.TimeoutSeconds > 0 {
+		timeout = time.Duration(form.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+
+	// 确认节点可以驱逐后再开始响应
+	if _, err := h.setUnschedulable(ctx, name, true); err != nil {
+		NotOK(c, err)
+		return
+	}
+	log.Info("drain node", "node", name, "user", c.GetHeader(HeaderUser))
+
+	events := make(chan DrainEvent)
+	go func() {
+		defer close(events)
+		h.drain(ctx, name, &form, events)
+	}()
+	for event := range events {
+		c.SSEvent("data", event)
+		c.Writer.Flush()
+	}
+}
+
+// Uncordon 恢复节点调度
+// @Tags        Agent.V1
+// @Summary     恢复节点调度
+// @Description 恢复节点调度, 与 drain 对应
+// @Produce     json
+// @Param       name    path     string                               true "name"
+// @Param       cluster path     string                               true "cluster"
+// @Success     200     {object} handlers.ResponseStruct{Data=object} "Node"
+// @Router      /v1/proxy/cluster/{cluster}/custom/core/v1/nodes/{name}/actions/uncordon [post]
+// @Security    JWT
+func (h *NodeHandler) Uncordon(c *gin.Context) {
+	name := c.Param("name")
+	if err := h.checkNodeAccess(c, name); err != nil {
+		NotOK(c, err)
+		return
+	}
+	node, err := h.setUnschedulable(c.Request.Context(), name, false)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	OK(c, node)
+}
+
+// checkNodeAccess 只有不受租户限制的调用方可以维护节点
+func (h *NodeHandler) checkNodeAccess(c *gin.Context, name string) error {
+	scope, err := scopeFromRequest(c.Request.Context(), h.C, c)
+	if err != nil {
+		return err
+	}
+	if !scope.Unlimited() {
+		return scope.Forbidden("nodes", name)
+	}
+	return nil
+}
+
+func (h *NodeHandler) setUnschedulable(ctx context.Context, name string, unschedulable bool) (*corev1.Node, error) {
+	node := &corev1.Node{}
+	if err := h.C.Get(ctx, types.NamespacedName{Name: name}, node); err != nil {
+		return nil, err
+	}
+	if node.Spec.Unschedulable == unschedulable {
+		return node, nil
+	}
+	patch := client.MergeFrom(node.DeepCopy())
+	node.Spec.Unschedulable = unschedulable
+	if err := h.C.Patch(ctx, node, patch); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (h *NodeHandler) drain(ctx context.Context, name string, form *drainForm, events chan<- DrainEvent) {
+	events <- DrainEvent{Phase: DrainPhaseCordoned, Message: fmt.Sprintf("node %s cordoned", name)}
+
+	// 直接查询 apiserver, 缓存中可能还没有刚调度的 pod
+	podList, err := h.cluster.Kubernetes().CoreV1().Pods(corev1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", name).String(),
+	})
+	if err != nil {
+		events <- DrainEvent{Phase: DrainPhaseFailed, Message: err.Error()}
+		return
+	}
+
+	pods := []corev1.Pod{}
+	errs := []string{}
+	for _, pod := range podList.Items {
+		skip, reason := drainFilter(&pod, form)
+		switch {
+		case reason == "":
+			pods = append(pods, pod)
+		case skip:
+			events <- DrainEvent{Phase: DrainPhaseSkipped, Namespace: pod.Namespace, Pod: pod.Name, Message: reason}
+		default:
+			errs = append(errs, fmt.Sprintf("%s/%s: %s", pod.Namespace, pod.Name, reason))
+		}
+	}
+	// 与 kubectl drain 相同, 有不能驱逐的 pod 时不驱逐任何 pod
+	if len(errs) > 0 {
+		events <- DrainEvent{Phase: DrainPhaseFailed, Message: "cannot evict pods: " + strings.Join(errs, "; ")}
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	failed := make(chan struct{}, len(pods))
+	for i := range pods {
+		wg.Add(1)
+		go func(pod *corev1.Pod) {
+			defer wg.Done()
+			if err := h.evictPod(ctx, pod, form.GracePeriodSeconds, events); err != nil {
+				failed <- struct{}{}
+				events <- DrainEvent{Phase: DrainPhaseFailed, Namespace: pod.Namespace, Pod: pod.Name, Message: err.Error()}
+			}
+		}(&pods[i])
+	}
+	wg.Wait()
+
+	if n := len(failed); n > 0 {
+		events <- DrainEvent{Phase: DrainPhaseFailed, Message: fmt.Sprintf("%d of %d pods failed to evict from node %s", n, len(pods), name)}
+		return
+	}
+	log.Info("node drained", "node", name, "pods", len(pods))
+	events <- DrainEvent{Phase: DrainPhaseCompleted, Message: fmt.Sprintf("%d pods evicted from node %s", len(pods), name)}
+}
+
+// drainFilter reason 为空时驱逐, skip 为 true 时跳过, 否则不能驱逐
+func drainFilter(pod *corev1.Pod, form *drainForm) (skip bool, reason string) {
+	if _, ok := pod.Annotations[mirrorPodAnnotation]; ok {
+		return true, "mirror pod"
+	}
+	// 已经结束的 pod 直接驱逐
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return false, ""
+	}
+	controller := metav1.GetControllerOf(pod)
+	if controller != nil && controller.Kind == "DaemonSet" {
+		if form.IgnoreDaemonSets {
+			return true, "managed by DaemonSet " + controller.Name
+		}
+		return false, "managed by DaemonSet, use ignoreDaemonSets"
+	}
+	if controller == nil && !form.Force {
+		return false, "not managed by a controller, use force"
+	}
+	for _, volume := range pod.Spec.Volumes {
+		if volume.EmptyDir != nil && !form.DeleteEmptyDirData {
+			return false, "has local emptyDir data, use deleteEmptyDirData"
+		}
+	}
+	return false, ""
+}
+
+// evictPod 驱逐并等待 pod 删除
+func (h *NodeHandler) evictPod(ctx context.Context, pod *corev1.Pod, gracePeriodSeconds *int64, events chan<- DrainEvent) error {
+	deleteOptions := &metav1.DeleteOptions{}
+	if gracePeriodSeconds != nil && *gracePeriodSeconds >= 0 {
+		deleteOptions.GracePeriodSeconds = gracePeriodSeconds
+	}
+	eviction := &policyv1.Eviction{
+		ObjectMeta:    metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace},
+		DeleteOptions: deleteOptions,
+	}
+	pods := h.cluster.Kubernetes().CoreV1().Pods(pod.Namespace)
+
+	blocked := ""
+	for {
+		err := pods.EvictV1(ctx, eviction)
+		if err == nil || apiErrors.IsNotFound(err) {
+			break
+		}
+		if !apiErrors.IsTooManyRequests(err) {
+			return err
+		}
+		// 违反 PodDisruptionBudget, 消息变化时才通知
+		if msg := err.Error(); msg != blocked {
+			blocked = msg
+			events <- DrainEvent{Phase: DrainPhaseBlocked, Namespace: pod.Namespace, Pod: pod.Name, Message: msg}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("eviction blocked until timeout: %s", blocked)
+		case <-time.After(evictionRetryInterval):
+		}
+	}
+	events <- DrainEvent{Phase: DrainPhaseEvicting, Namespace: pod.Namespace, Pod: pod.Name}
+
+	ticker := time.NewTicker(podDeletePollInterval)
+	defer ticker.Stop()
+	for {
+		current, err := pods.Get(ctx, pod.Name, metav1.GetOptions{})
+		if apiErrors.IsNotFound(err) || (err == nil && current.UID != pod.UID) {
+			events <- DrainEvent{Phase: DrainPhaseEvicted, Namespace: pod.Namespace, Pod: pod.Name}
+			return nil
+		}
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("pod was not deleted before timeout")
+		case <-ticker.C:
+		}
+	}
+}
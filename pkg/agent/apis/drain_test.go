@@ -0,0 +1,77 @@
+package apis
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDrainFilter(t *testing.T) {
+	ownedBy := func(kind string) []metav1.OwnerReference {
+		controller := true
+		return []metav1.OwnerReference{{Kind: kind, Name: "web", Controller: &controller}}
+	}
+	emptyDir := []corev1.Volume{{Name: "cache", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+	tests := []struct {
+		name       string
+		pod        corev1.Pod
+		form       drainForm
+		wantSkip   bool
+		wantReason bool
+	}{
+		{
+			name:     "mirror pod",
+			pod:      corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{mirrorPodAnnotation: "hash"}}},
+			form:     drainForm{Force: true},
+			wantSkip: true, wantReason: true,
+		},
+		{
+			name: "finished pod without controller",
+			pod:  corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodSucceeded}},
+		},
+		{
+			name:       "daemonset",
+			pod:        corev1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: ownedBy("DaemonSet")}},
+			wantReason: true,
+		},
+		{
+			name:     "daemonset ignored",
+			pod:      corev1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: ownedBy("DaemonSet")}},
+			form:     drainForm{IgnoreDaemonSets: true},
+			wantSkip: true, wantReason: true,
+		},
+		{
+			name:       "without controller",
+			pod:        corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodRunning}},
+			wantReason: true,
+		},
+		{
+			name: "without controller forced",
+			pod:  corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodRunning}},
+			form: drainForm{Force: true},
+		},
+		{
+			name: "replicaset",
+			pod:  corev1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: ownedBy("ReplicaSet")}},
+		},
+		{
+			name:       "emptyDir",
+			pod:        corev1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: ownedBy("ReplicaSet")}, Spec: corev1.PodSpec{Volumes: emptyDir}},
+			wantReason: true,
+		},
+		{
+			name: "emptyDir deleted",
+			pod:  corev1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: ownedBy("ReplicaSet")}, Spec: corev1.PodSpec{Volumes: emptyDir}},
+			form: drainForm{DeleteEmptyDirData: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			skip, reason := drainFilter(&tt.pod, &tt.form)
+			if skip != tt.wantSkip || (reason != "") != tt.wantReason {
+				t.Errorf("drainFilter() = %v, %q, want skip %v, reason %v", skip, reason, tt.wantSkip, tt.wantReason)
+			}
+		})
+	}
+}
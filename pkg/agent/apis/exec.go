@@ -0,0 +1,245 @@
+package apis
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/log"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+const (
+	defaultExecTimeout = 30 * time.Second
+	// 非交互执行时 stdout/stderr 最多返回的字节数
+	maxExecOutputBytes = 1024 * 1024
+	// 探测 shell 的超时时间
+	shellProbeTimeout = 5 * time.Second
+)
+
+// 自动探测时依次尝试的 shell
+var defaultShells = []string{"bash", "sh", "ash"}
+
+var supportedShells = map[string]bool{"bash": true, "sh": true, "ash": true, "zsh": true}
+
+// commandSearchPath 允许的命令名对应的系统目录, 不使用容器内可以修改的 PATH
+var commandSearchPath = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// ExecResult 非交互执行的结果
+type ExecResult struct {
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	ExitCode  int    `json:"exitCode"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// ExecCommand 在容器中执行命令
+// @Tags        Agent.V1
+// @Summary     在容器中执行命令
+// @Description 非交互执行命令, 请求体作为stdin, 返回stdout, stderr和退出码. 租户内的用户只能使用允许的命令
+// @Accept      octet-stream
+// @Produce     json
+// @Param       cluster   path     string                                   true  "cluster"
+// @Param       namespace path     string                                   true  "namespace"
+// @Param       name      path     string                                   true  "pod"
+// @Param       container query    string                                   false "container"
+// @Param       command   query    []string                                 true  "命令和参数, 可以多个"
+// @Param       timeout   query    string                                   false "超时时间, 如 10s, 不能超过配置的超时时间"
+// @Param       body      body     string                                   false "stdin"
+// @Success     200       {object} handlers.ResponseStruct{Data=ExecResult} "result"
+// @Router      /v1/proxy/cluster/{cluster}/custom/core/v1/namespaces/{namespace}/pods/{name}/actions/exec [post]
+// @Security    JWT
+func (h *PodHandler) ExecCommand(c *gin.Context) {
+	command := c.QueryArray("command")
+	if len(command) == 0 || command[0] == "" {
+		NotOK(c, fmt.Errorf("command is required"))
+		return
+	}
+	if err := h.checkCommand(c, command); err != nil {
+		NotOK(c, err)
+		return
+	}
+
+	options := h.runtime.Load().Options.Shell
+	timeout := options.ExecTimeout.Duration
+	if d, err := time.ParseDuration(c.Query("timeout")); err == nil && d > 0 && d < timeout {
+		timeout = d
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+
+	pe := &PodCmdExecutor{
+		Cluster:   h.cluster,
+		Namespace: c.Param("namespace"),
+		Pod:       c.Param("name"),
+		Container: paramFromHeaderOrQuery(c, "container", ""),
+	}
+	var stdin io.Reader
+	if c.Request.Body != nil && c.Request.ContentLength != 0 {
+		stdin = c.Request.Body
+	}
+	log.Info("exec command", "user", c.GetHeader(HeaderUser), "namespace", pe.Namespace, "pod", pe.Pod,
+		"container", pe.Container, "command", strings.Join(command, " "))
+
+	stdout := &limitedBuffer{limit: maxExecOutputBytes}
+	stderr := &limitedBuffer{limit: maxExecOutputBytes}
+	result := ExecResult{}
+	if err := pe.run(ctx, command, stdin, stdout, stderr); err != nil {
+		exitErr := utilexec.CodeExitError{}
+		switch {
+		case errors.As(err, &exitErr):
+			result.ExitCode = exitErr.ExitStatus()
+		case ctx.Err() == context.DeadlineExceeded:
+			NotOK(c, fmt.Errorf("command timed out after %s", timeout))
+			return
+		default:
+			NotOK(c, err)
+			return
+		}
+	}
+	result.Stdout, result.Stderr = stdout.String(), stderr.String()
+	result.Truncated = stdout.truncated || stderr.truncated
+	OK(c, result)
+}
+
+// shellCommand 交互式终端的命令, 指定 command 时需要在允许的范围内, 否则使用 shell
+// 两种情况都需要 namespace 在调用方的范围内
+func (h *PodHandler) shellCommand(c *gin.Context, pe *PodCmdExecutor) ([]string, error) {
+	if command := c.QueryArray("command"); len(command) > 0 && command[0] != "" {
+		if err := h.checkCommand(c, command); err != nil {
+			return nil, err
+		}
+		return command, nil
+	}
+	if _, err := h.checkNamespace(c); err != nil {
+		return nil, err
+	}
+
+	shell := paramFromHeaderOrQuery(c, "shell", "")
+	if shell != "" && !supportedShells[shell] {
+		return nil, fmt.Errorf("unsupported shell %q", shell)
+	}
+	if shell == "" {
+		detected, err := pe.detectShell(c.Request.Context())
+		if err != nil {
+			return nil, err
+		}
+		shell = detected
+	}
+	return []string{
+		shell,
+		"-c",
+		"export LINES=20; export COLUMNS=100; export LANG=C.UTF-8; export TERM=xterm-256color; exec " + shell,
+	}, nil
+}
+
+// checkNamespace 调用方只能在其范围内的 namespace 中执行命令
+func (h *PodHandler) checkNamespace(c *gin.Context) (*Scope, error) {
+	scope, err := scopeFromRequest(c.Request.Context(), h.cluster.GetClient(), c)
+	if err != nil {
+		return nil, err
+	}
+	if !scope.Contains(c.Param("namespace")) {
+		return nil, scope.Forbidden("namespaces", c.Param("namespace"))
+	}
+	return scope, nil
+}
+
+// checkCommand 租户内的用户只能执行为其角色配置的命令
+func (h *PodHandler) checkCommand(c *gin.Context, command []string) error {
+	scope, err := h.checkNamespace(c)
+	if err != nil {
+		return err
+	}
+	if scope.Unlimited() || commandAllowed(h.runtime.Load().Options.Shell.AllowedCommands, scope.Role, command[0]) {
+		return nil
+	}
+	return scope.Forbidden("commands", command[0])
+}
+
+// commandAllowed allowed 的格式为 role:command, * 匹配任意角色或者命令
+//
+// 配置为绝对路径时只匹配相同的路径; 配置为命令名时匹配同名的命令,
+// 或者 commandSearchPath 目录下的同名文件, 不匹配其他目录下的同名文件, 如 /tmp/ls
+func commandAllowed(allowed []string, role, command string) bool {
+	for _, entry := range allowed {
+		r, cmd, found := strings.Cut(entry, ":")
+		if !found || (r != "*" && r != role) {
+			continue
+		}
+		if cmd == "*" || cmd == command {
+			return true
+		}
+		if !strings.Contains(cmd, "/") && path.IsAbs(command) && path.Clean(command) == command && path.Base(command) == cmd {
+			for _, dir := range commandSearchPath {
+				if path.Dir(command) == dir {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// validCommand allowedCommands 中的命令只能是 *, 命令名或者绝对路径
+func validCommand(cmd string) bool {
+	return cmd == "*" || !strings.Contains(cmd, "/") || (path.IsAbs(cmd) && path.Clean(cmd) == cmd)
+}
+
+// detectShell 依次尝试 bash, sh, ash, 返回第一个可以执行的
+func (pe *PodCmdExecutor) detectShell(ctx context.Context) (string, error) {
+	errs := []string{}
+	for _, shell := range defaultShells {
+		probeCtx, cancel := context.WithTimeout(ctx, shellProbeTimeout)
+		err := pe.run(probeCtx, []string{shell, "-c", "exit 0"}, nil, io.Discard, io.Discard)
+		cancel()
+		if err == nil {
+			return shell, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", shell, err))
+	}
+	return "", fmt.Errorf("no shell found in container: %s", strings.Join(errs, "; "))
+}
+
+// run 非交互执行命令
+func (pe *PodCmdExecutor) run(ctx context.Context, command []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	runner := *pe
+	runner.Stdin = stdin != nil
+	runner.Stdout = true
+	runner.Stderr = true
+	runner.TTY = false
+	exec, err := runner.executor(command)
+	if err != nil {
+		return err
+	}
+	return exec.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+}
+
+// limitedBuffer 超过限制的内容直接丢弃, 不影响命令的执行
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remain := b.limit - b.Len(); remain < len(p) {
+		b.truncated = true
+		if remain > 0 {
+			b.Buffer.Write(p[:remain])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
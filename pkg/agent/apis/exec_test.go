@@ -0,0 +1,158 @@
+package apis
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/agent/cluster"
+	"github.com/sunweiwe/kuber/pkg/agent/middleware"
+	"github.com/sunweiwe/kuber/pkg/api/kuber/v1beta1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// fakeCluster 只提供 client 和 clientset, 其他方法未实现
+type fakeCluster struct {
+	cluster.Interface
+	client     client.Client
+	kubernetes kubernetes.Interface
+}
+
+func (f *fakeCluster) GetClient() client.Client {
+	return f.client
+}
+
+func (f *fakeCluster) Kubernetes() kubernetes.Interface {
+	return f.kubernetes
+}
+
+func TestCommandAllowed(t *testing.T) {
+	allowed := []string{"viewer:ls", "viewer:/opt/app/bin/status", "*:cat", "admin:*"}
+	tests := []struct {
+		role    string
+		command string
+		want    bool
+	}{
+		{role: "viewer", command: "ls", want: true},
+		{role: "viewer", command: "/bin/ls", want: true},
+		{role: "viewer", command: "/usr/local/bin/ls", want: true},
+		{role: "viewer", command: "/tmp/ls", want: false},
+		{role: "viewer", command: "/bin/../tmp/ls", want: false},
+		{role: "viewer", command: "./ls", want: false},
+		{role: "viewer", command: "bin/ls", want: false},
+		{role: "viewer", command: "/opt/app/bin/status", want: true},
+		{role: "viewer", command: "status", want: false},
+		{role: "viewer", command: "/usr/bin/status", want: false},
+		{role: "editor", command: "cat", want: true},
+		{role: "editor", command: "ls", want: false},
+		{role: "admin", command: "/tmp/anything", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role+" "+tt.command, func(t *testing.T) {
+			if got := commandAllowed(allowed, tt.role, tt.command); got != tt.want {
+				t.Errorf("commandAllowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShellOptionsValidate(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		wantErr bool
+	}{
+		{allowed: []string{"*:*", "viewer:ls", "viewer:/bin/ls"}},
+		{allowed: []string{"viewer"}, wantErr: true},
+		{allowed: []string{"viewer:bin/ls"}, wantErr: true},
+		{allowed: []string{"viewer:/bin/../tmp/ls"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		o := NewDefaultShellOptions()
+		o.AllowedCommands = tt.allowed
+		if err := o.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate() %v error = %v, wantErr %v", tt.allowed, err, tt.wantErr)
+		}
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := v1beta1.SchemeBuilder.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&v1beta1.Environment{
+		ObjectMeta: metav1.ObjectMeta{Name: "dev"},
+		Spec:       v1beta1.EnvironmentSpec{Tenant: "t1", Namespace: "t1-dev"},
+	}).Build()
+	options := NewDefaultOptions()
+	options.Shell.AllowedCommands = []string{"*:ls"}
+	runtime, err := NewRuntime(options, NewDefaultDebugOptions(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &PodHandler{cluster: &fakeCluster{client: cli}, runtime: runtime}
+
+	tenant := map[string]string{HeaderUser: "alice", HeaderTenant: "t1"}
+	tests := []struct {
+		name      string
+		namespace string
+		query     string
+		header    map[string]string
+		untrusted bool
+		want      []string
+		wantCode  int
+	}{
+		{name: "unauthenticated shell", namespace: "t1-dev", query: "shell=bash", untrusted: true, wantCode: http.StatusUnauthorized},
+		{name: "shell out of scope", namespace: "t2-dev", query: "shell=bash", header: tenant, wantCode: http.StatusForbidden},
+		{name: "command out of scope", namespace: "t2-dev", query: "command=ls", header: tenant, wantCode: http.StatusForbidden},
+		{name: "command not allowed", namespace: "t1-dev", query: "command=/tmp/ls", header: tenant, wantCode: http.StatusForbidden},
+		{name: "command allowed", namespace: "t1-dev", query: "command=/bin/ls&command=-l", header: tenant, want: []string{"/bin/ls", "-l"}},
+		{name: "unsupported shell", namespace: "t1-dev", query: "shell=fish", header: tenant, wantCode: -1},
+		{
+			name:      "shell in scope",
+			namespace: "t1-dev",
+			query:     "shell=bash",
+			header:    tenant,
+			want:      []string{"bash", "-c", "export LINES=20; export COLUMNS=100; export LANG=C.UTF-8; export TERM=xterm-256color; exec bash"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = req
+			c.Params = gin.Params{{Key: "namespace", Value: tt.namespace}, {Key: "name", Value: "web-0"}}
+			middleware.SignerMiddleware(
+				func() bool { return false },
+				func(*http.Request) bool { return !tt.untrusted },
+			)(c)
+
+			got, err := h.shellCommand(c, &PodCmdExecutor{})
+			if tt.wantCode != 0 {
+				if err == nil {
+					t.Fatalf("shellCommand() = %v, want error", got)
+				}
+				if status, ok := err.(apiErrors.APIStatus); tt.wantCode > 0 && (!ok || int(status.Status().Code) != tt.wantCode) {
+					t.Fatalf("shellCommand() error = %v, want code %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("shellCommand() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("shellCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,671 @@
+package apis
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/agent/cluster"
+	"github.com/sunweiwe/kuber/pkg/log"
+	"github.com/sunweiwe/kuber/pkg/service/handlers"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	defaultMaxUploadSize = 100 * 1024 * 1024
+	defaultTransferRate  = 1024 * 1024
+	// agent 所有用户的总速率
+	defaultAgentTransferRate = 16 * 1024 * 1024
+
+	// 目录列表最多读取的 stat 输出
+	maxListOutputBytes = 8 * 1024 * 1024
+	// stat 的输出格式, 文件名放在最后, 可以包含分隔符
+	statFormat = "%s\t%f\t%Y\t%n"
+
+	FormatTar   = "tar"
+	FormatTarGz = "tar.gz"
+	FormatZip   = "zip"
+	FormatRaw   = "raw"
+)
+
+// FileInfo 容器内的文件
+type FileInfo struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// file, dir, symlink, other
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// UploadResult 每个上传文件的结果
+type UploadResult struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Mode  string `json:"mode"`
+	Error string `json:"error,omitempty"`
+}
+
+// ListFiles 列出容器内的目录
+// @Tags        Agent.V1
+// @Summary     列出容器内的目录
+// @Description 列出容器内的目录, 容器内需要有 find 和 stat
+// @Produce     json
+// @Param       cluster   path     string                                     true  "cluster"
+// @Param       namespace path     string                                     true  "namespace"
+// @Param       name      path     string                                     true  "pod"
+// @Param       container query    string                                     false "container"
+// @Param       path      query    string                                     false "目录, 默认为 /"
+// @Success     200       {object} handlers.ResponseStruct{Data=[]FileInfo} "files"
+// @Router      /v1/proxy/cluster/{cluster}/custom/core/v1/namespaces/{namespace}/pods/{name}/actions/ls [get]
+// @Security    JWT
+func (h *PodHandler) ListFiles(c *gin.Context) {
+	dir := paramFromHeaderOrQuery(c, "path", "/")
+	if dir != "/" {
+		if err := validateFilename(dir); err != nil {
+			NotOK(c, err)
+			return
+		}
+	}
+	files, err := h.fileTransfer(c, dir).List(c.Request.Context())
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	OK(c, files)
+}
+
+// DownloadFile 从容器下载文件
+// @Tags        Agent.V1
+// @Summary     从容器下载文件
+// @Description 下载文件或者目录, format 为 raw 时只能下载普通文件, 支持 Range 断点续传
+// @Param       cluster   path     string true  "cluster"
+// @Param       namespace path     string true  "namespace"
+// @Param       name      path     string true  "pod"
+// @Param       container query    string false "container"
+// @Param       filename  query    string true  "filename"
+// @Param       format    query    string false "tar(默认)/tar.gz/zip/raw"
+// @Success     200       {object} object "file"
+// @Router      /v1/proxy/cluster/{cluster}/custom/core/v1/namespaces/{namespace}/pods/{name}/actions/file [get]
+// @Security    JWT
+func (h *PodHandler) DownloadFile(c *gin.Context) {
+	filename := paramFromHeaderOrQuery(c, "filename", "")
+	if e := validateFilename(filename); e != nil {
+		NotOK(c, e)
+		return
+	}
+	if err := h.fileTransfer(c, filename).Download(c, paramFromHeaderOrQuery(c, "format", FormatTar)); err != nil {
+		if c.Writer.Written() {
+			// 响应已经开始, 只能中断
+			log.Error(err, "download file", "pod", c.Param("name"), "filename", filename)
+			return
+		}
+		c.Writer.Header().Del("Content-Disposition")
+		NotOK(c, err)
+		return
+	}
+}
+
+// UploadFile  upload files to container
+// @Tags        Agent.V1
+// @Summary     upload files to container
+// @Description 上传文件到容器的目录, 目录不存在时创建, modes[] 与 files[] 一一对应, 默认为 0644. 部分文件失败时返回500和每个文件的结果
+// @Accept      multipart/form-data
+// @Produce     json
+// @Param       cluster   path     string true  "cluster"
+// @Param       namespace path     string true  "namespace"
+// @Param       name      path     string true  "pod"
+// @Param       container query    string false "container"
+// @Param       dest      formData string true  "目标目录"
+// @Param       files[]   formData file   true  "files"
+// @Param       modes[]   formData string false "八进制的文件权限, 如 0755"
+// @Success     200       {object} handlers.ResponseStruct{Data=[]UploadResult} "results"
+// @Router      /v1/proxy/cluster/{cluster}/custom/core/v1/namespaces/{namespace}/pods/{name}/actions/upfile [post]
+// @Security    JWT
+func (h *PodHandler) UploadFile(c *gin.Context) {
+	maxSize := h.runtime.Load().Options.File.MaxUploadSize
+	if c.Request.ContentLength > maxSize {
+		NotOK(c, apiErrors.NewRequestEntityTooLargeError(fmt.Sprintf("upload size must not exceed %d bytes", maxSize)))
+		return
+	}
+	// multipart 的边界等额外内容
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+1024*1024)
+
+	form := &uploadForm{}
+	if err := c.ShouldBind(form); err != nil {
+		NotOK(c, err)
+		return
+	}
+	results, err := h.fileTransfer(c, "").Upload(c.Request.Context(), form, maxSize)
+	if err != nil {
+		if results == nil {
+			NotOK(c, err)
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, handlers.ResponseStruct{Message: err.Error(), Data: results})
+		return
+	}
+	OK(c, results)
+}
+
+func (h *PodHandler) fileTransfer(c *gin.Context, filename string) *FileTransfer {
+	return &FileTransfer{
+		Cluster:   h.cluster,
+		Namespace: c.Param("namespace"),
+		Pod:       c.Param("name"),
+		Container: paramFromHeaderOrQuery(c, "container", ""),
+		Filename:  filename,
+		User:      transferIdentity(c),
+		Limiter:   h.runtime.Transfer(),
+	}
+}
+
+func validateFilename(name string) error {
+	if name == "" || name == "/" || name == "." {
+		return fmt.Errorf("filename is invalid")
+	}
+	if !strings.HasPrefix(name, "/") {
+		return fmt.Errorf("filename is invalid, please use absolute path")
+	}
+	fs := strings.Split(name, "/")
+	for _, sep := range fs {
+		if strings.Contains(sep, "..") {
+			return fmt.Errorf("filename is invalid, please use absolute path")
+		}
+	}
+	return nil
+}
+
+// FileTransfer 通过 exec 在容器中执行 tar/find/stat 等命令传输文件
+type FileTransfer struct {
+	Cluster   cluster.Interface
+	Namespace string
+	Pod       string
+	Container string
+	Filename  string
+	// 传输速度按用户限制
+	User    string
+	Limiter *TransferLimiter
+}
+
+func (fd *FileTransfer) executor() *PodCmdExecutor {
+	return &PodCmdExecutor{
+		Cluster:   fd.Cluster,
+		Namespace: fd.Namespace,
+		Pod:       fd.Pod,
+		Container: fd.Container,
+	}
+}
+
+// List 目录下的文件, 按照目录在前、名称排序
+func (fd *FileTransfer) List(ctx context.Context) ([]FileInfo, error) {
+	start := strings.TrimSuffix(fd.Filename, "/") + "/"
+	stdout := &limitedBuffer{limit: maxListOutputBytes}
+	stderr := &limitedBuffer{limit: maxExecOutputBytes}
+	err := fd.executor().run(ctx, []string{"find", start, "-mindepth", "1", "-maxdepth", "1", "-exec", "stat", "-c", statFormat, "{}", "+"},
+		nil, stdout, stderr)
+	if stdout.truncated {
+		return nil, fmt.Errorf("too many files in %s", fd.Filename)
+	}
+	files := parseStat(stdout.String())
+	// 部分文件在列出后被删除时仍然返回其他文件
+	if err != nil && len(files) == 0 {
+		return nil, execError(err, stderr)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if (files[i].Type == "dir") != (files[j].Type == "dir") {
+			return files[i].Type == "dir"
+		}
+		return files[i].Name < files[j].Name
+	})
+	return files, nil
+}
+
+func (fd *FileTransfer) stat(ctx context.Context) (*FileInfo, error) {
+	stdout := &limitedBuffer{limit: maxExecOutputBytes}
+	stderr := &limitedBuffer{limit: maxExecOutputBytes}
+	if err := fd.executor().run(ctx, []string{"stat", "-c", statFormat, fd.Filename}, nil, stdout, stderr); err != nil {
+		return nil, execError(err, stderr)
+	}
+	files := parseStat(stdout.String())
+	if len(files) != 1 {
+		return nil, fmt.Errorf("unexpected stat output %q", stdout.String())
+	}
+	return &files[0], nil
+}
+
+func (fd *FileTransfer) Download(c *gin.Context, format string) error {
+	if format == FormatRaw {
+		return fd.downloadRaw(c)
+	}
+	ctx := c.Request.Context()
+	dir, base := path.Dir(fd.Filename), path.Base(fd.Filename)
+	command := []string{"tar", "cf", "-", "-C", dir, base}
+	stderr := &limitedBuffer{limit: maxExecOutputBytes}
+	w := fd.Limiter.Writer(ctx, fd.User, DirectionDownload, c.Writer)
+
+	var err error
+	switch format {
+	case FormatTar:
+		setAttachment(c, base+".tar", "application/x-tar")
+		err = fd.executor().run(ctx, command, nil, w, stderr)
+	case FormatTarGz, "tgz":
+		setAttachment(c, base+".tar.gz", "application/gzip")
+		// 在 agent 中压缩, 容器内不需要 gzip
+		gw := gzip.NewWriter(w)
+		if err = fd.executor().run(ctx, command, nil, gw, stderr); err == nil {
+			err = gw.Close()
+		}
+	case FormatZip:
+		setAttachment(c, base+".zip", "application/zip")
+		// remotecommand 忽略 stdout 的写入错误, 转换失败时需要取消命令
+		zipCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			err := fd.executor().run(zipCtx, command, nil, pw, stderr)
+			_ = pw.CloseWithError(err)
+			done <- err
+		}()
+		if err = tarToZip(w, pr); err != nil {
+			cancel()
+		}
+		_ = pr.CloseWithError(err)
+		if execErr := <-done; err == nil {
+			err = execErr
+		}
+	default:
+		return fmt.Errorf("unsupported format %q, must be one of tar, tar.gz, zip, raw", format)
+	}
+	if err != nil {
+		return execError(err, stderr)
+	}
+	return nil
+}
+
+// downloadRaw 下载单个文件, 支持 bytes=start-, bytes=start-end 和 bytes=-suffix 形式的 Range
+func (fd *FileTransfer) downloadRaw(c *gin.Context) error {
+	ctx := c.Request.Context()
+	info, err := fd.stat(ctx)
+	if err != nil {
+		return err
+	}
+	if info.Type != "file" {
+		return fmt.Errorf("%s is not a regular file, please use format tar, tar.gz or zip", fd.Filename)
+	}
+	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime.Unix(), info.Size)
+	start, end := int64(0), info.Size-1
+	partial := false
+	if rng := c.GetHeader("Range"); rng != "" && (c.GetHeader("If-Range") == "" || c.GetHeader("If-Range") == etag) {
+		if start, end, err = parseRange(rng, info.Size); err != nil {
+			c.Header("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			return &apiErrors.StatusError{ErrStatus: metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusRequestedRangeNotSatisfiable,
+				Reason:  metav1.StatusReasonBadRequest,
+				Message: err.Error(),
+			}}
+		}
+		partial = true
+	}
+
+	setAttachment(c, info.Name, "application/octet-stream")
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	length := end - start + 1
+	if info.Size == 0 {
+		length = 0
+	}
+	c.Header("Content-Length", strconv.FormatInt(length, 10))
+	if partial {
+		c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, info.Size))
+		c.Status(http.StatusPartialContent)
+	}
+
+	command := []string{"cat", fd.Filename}
+	if start > 0 {
+		command = []string{"tail", "-c", "+" + strconv.FormatInt(start+1, 10), fd.Filename}
+	}
+	// 范围结束后取消命令
+	rangeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stderr := &limitedBuffer{limit: maxExecOutputBytes}
+	w := &rangeWriter{w: fd.Limiter.Writer(ctx, fd.User, DirectionDownload, c.Writer), remain: length, done: cancel}
+	if err := fd.executor().run(rangeCtx, command, nil, w, stderr); err != nil && w.remain > 0 {
+		return execError(err, stderr)
+	}
+	return nil
+}
+
+func (fd *FileTransfer) Upload(ctx context.Context, form *uploadForm, maxSize int64) ([]UploadResult, error) {
+	if err := validateFilename(form.Dest); err != nil {
+		return nil, err
+	}
+	files, err := form.files(maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	failed := make(chan map[string]error, 1)
+	go func() {
+		errs, err := convertTar(pw, files)
+		_ = pw.CloseWithError(err)
+		failed <- errs
+	}()
+	// 目录不存在时创建, -v 输出解压的文件用于判断每个文件的结果
+	stdout := &limitedBuffer{limit: maxExecOutputBytes}
+	stderr := &limitedBuffer{limit: maxExecOutputBytes}
+	command := []string{"sh", "-c", `mkdir -p "$0" && exec tar xvf - -C "$0"`, form.Dest}
+	stdin := fd.Limiter.Reader(ctx, fd.User, DirectionUpload, pr)
+	execErr := fd.executor().run(ctx, command, stdin, stdout, stderr)
+	_ = pr.CloseWithError(execErr)
+	fileErrs := <-failed
+
+	extracted := map[string]bool{}
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		extracted[strings.TrimPrefix(strings.TrimSpace(line), "./")] = true
+	}
+	results := make([]UploadResult, 0, len(files))
+	failures := 0
+	for _, file := range files {
+		result := UploadResult{Name: file.name, Size: file.header.Size, Mode: file.mode.String()}
+		switch {
+		case fileErrs[file.name] != nil:
+			result.Error = fileErrs[file.name].Error()
+		case execErr != nil && !extracted[file.name]:
+			result.Error = execError(execErr, stderr).Error()
+		}
+		if result.Error != "" {
+			failures++
+		}
+		results = append(results, result)
+	}
+	if failures > 0 {
+		return results, fmt.Errorf("%d of %d files failed to upload to %s", failures, len(files), form.Dest)
+	}
+	return results, nil
+}
+
+type uploadForm struct {
+	Dest  string                  `form:"dest" binding:"required"`
+	Files []*multipart.FileHeader `form:"files[]" binding:"required"`
+	Modes []string                `form:"modes[]"`
+}
+
+type uploadFile struct {
+	name   string
+	mode   os.FileMode
+	header *multipart.FileHeader
+}
+
+// files 检查文件名、权限和总大小
+func (uf *uploadForm) files(maxSize int64) ([]uploadFile, error) {
+	if len(uf.Modes) > 0 && len(uf.Modes) != len(uf.Files) {
+		return nil, fmt.Errorf("modes[] must have the same length as files[]")
+	}
+	files := make([]uploadFile, 0, len(uf.Files))
+	total := int64(0)
+	for i, header := range uf.Files {
+		name := header.Filename
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+			return nil, fmt.Errorf("invalid filename %q", name)
+		}
+		mode := os.FileMode(0o644)
+		if len(uf.Modes) > 0 && uf.Modes[i] != "" {
+			m, err := strconv.ParseUint(uf.Modes[i], 8, 32)
+			if err != nil || m > 0o7777 {
+				return nil, fmt.Errorf("invalid mode %q of %s", uf.Modes[i], name)
+			}
+			mode = os.FileMode(m)
+		}
+		total += header.Size
+		files = append(files, uploadFile{name: name, mode: mode, header: header})
+	}
+	if total > maxSize {
+		return nil, apiErrors.NewRequestEntityTooLargeError(fmt.Sprintf("upload size must not exceed %d bytes", maxSize))
+	}
+	return files, nil
+}
+
+// convertTar 返回每个文件打开失败的错误, 写入失败时返回错误并结束
+func convertTar(w io.Writer, files []uploadFile) (map[string]error, error) {
+	errs := map[string]error{}
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for _, file := range files {
+		fd, err := file.header.Open()
+		if err != nil {
+			errs[file.name] = err
+			continue
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:    file.name,
+			Size:    file.header.Size,
+			ModTime: now,
+			Mode:    int64(file.mode),
+		})
+		if err == nil {
+			_, err = io.CopyN(tw, fd, file.header.Size)
+		}
+		fd.Close()
+		if err != nil {
+			errs[file.name] = err
+			log.Error(err, "convert tar error", "file", file.name)
+			return errs, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		log.Error(err, "convert tar error")
+		return errs, err
+	}
+	return errs, nil
+}
+
+// tarToZip 把 tar 流转换为 zip, 符号链接保存为链接目标
+func tarToZip(w io.Writer, r io.Reader) error {
+	zw := zip.NewWriter(w)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		fh, err := zip.FileInfoHeader(hdr.FileInfo())
+		if err != nil {
+			return err
+		}
+		fh.Name = hdr.Name
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			fh.Name = strings.TrimSuffix(hdr.Name, "/") + "/"
+			if _, err := zw.CreateHeader(fh); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			fh.Method = zip.Deflate
+			fw, err := zw.CreateHeader(fh)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(fw, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			fw, err := zw.CreateHeader(fh)
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(fw, hdr.Linkname); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+// parseStat 解析 statFormat 格式的输出, 忽略无法解析的行
+func parseStat(out string) []FileInfo {
+	files := []FileInfo{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, "\t", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		size, err1 := strconv.ParseInt(fields[0], 10, 64)
+		raw, err2 := strconv.ParseUint(fields[1], 16, 32)
+		mtime, err3 := strconv.ParseInt(fields[2], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		mode := unixFileMode(uint32(raw))
+		files = append(files, FileInfo{
+			Name:    path.Base(fields[3]),
+			Path:    path.Clean(fields[3]),
+			Type:    fileType(mode),
+			Size:    size,
+			Mode:    mode.String(),
+			ModTime: time.Unix(mtime, 0),
+		})
+	}
+	return files
+}
+
+// unixFileMode 转换 st_mode
+func unixFileMode(raw uint32) os.FileMode {
+	mode := os.FileMode(raw & 0o777)
+	switch raw & 0o170000 {
+	case 0o040000:
+		mode |= os.ModeDir
+	case 0o120000:
+		mode |= os.ModeSymlink
+	case 0o010000:
+		mode |= os.ModeNamedPipe
+	case 0o140000:
+		mode |= os.ModeSocket
+	case 0o020000:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case 0o060000:
+		mode |= os.ModeDevice
+	}
+	if raw&0o4000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if raw&0o2000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if raw&0o1000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "dir"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode.IsRegular():
+		return "file"
+	default:
+		return "other"
+	}
+}
+
+// parseRange 只支持单个范围, 包括 bytes=start-, bytes=start-end 和 bytes=-suffix
+func parseRange(header string, size int64) (int64, int64, error) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	if spec == header || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("unsupported range %q", header)
+	}
+	startStr, endStr, _ := strings.Cut(spec, "-")
+	startStr, endStr = strings.TrimSpace(startStr), strings.TrimSpace(endStr)
+	if startStr == "" {
+		// 最后 suffix 个字节, 超过文件大小时返回整个文件
+		suffix, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || suffix <= 0 || size == 0 {
+			return 0, 0, fmt.Errorf("invalid range %q", header)
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, nil
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, fmt.Errorf("invalid range %q", header)
+	}
+	end := size - 1
+	if endStr != "" {
+		if end, err = strconv.ParseInt(endStr, 10, 64); err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid range %q", header)
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	return start, end, nil
+}
+
+var errRangeDone = errors.New("range done")
+
+// rangeWriter 写满范围后调用 done 结束命令, 超出范围的内容不再写入并返回 errRangeDone
+type rangeWriter struct {
+	w      io.Writer
+	remain int64
+	done   func()
+}
+
+func (rw *rangeWriter) Write(p []byte) (int, error) {
+	if rw.remain <= 0 {
+		return 0, errRangeDone
+	}
+	truncated := int64(len(p)) > rw.remain
+	if truncated {
+		p = p[:rw.remain]
+	}
+	n, err := rw.w.Write(p)
+	rw.remain -= int64(n)
+	if rw.remain <= 0 {
+		rw.done()
+	}
+	if err == nil && truncated {
+		err = errRangeDone
+	}
+	return n, err
+}
+
+func setAttachment(c *gin.Context, filename, contentType string) {
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+}
+
+// execError 带上命令的 stderr
+func execError(err error, stderr *limitedBuffer) error {
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("%s: %v", msg, err)
+	}
+	return err
+}
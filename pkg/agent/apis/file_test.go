@@ -0,0 +1,194 @@
+package apis
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseStat(t *testing.T) {
+	out := "4096\t41ed\t1672531200\t/data\n" +
+		"12\t81a4\t1672531201\t/data/a b.txt\n" +
+		"7\ta1ff\t1672531202\t/data/link\n" +
+		"0\t21b6\t1672531203\t/data/tab\tname\n" +
+		"invalid line\n" +
+		"x\t81a4\t1672531201\t/data/bad-size\n" +
+		"\n"
+	want := []FileInfo{
+		{Name: "data", Path: "/data", Type: "dir", Size: 4096, Mode: "drwxr-xr-x", ModTime: time.Unix(1672531200, 0)},
+		{Name: "a b.txt", Path: "/data/a b.txt", Type: "file", Size: 12, Mode: "-rw-r--r--", ModTime: time.Unix(1672531201, 0)},
+		{Name: "link", Path: "/data/link", Type: "symlink", Size: 7, Mode: "Lrwxrwxrwx", ModTime: time.Unix(1672531202, 0)},
+		{Name: "tab\tname", Path: "/data/tab\tname", Type: "other", Size: 0, Mode: "Dcrw-rw-rw-", ModTime: time.Unix(1672531203, 0)},
+	}
+	if got := parseStat(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseStat() = %+v, want %+v", got, want)
+	}
+	if got := parseStat(""); len(got) != 0 {
+		t.Errorf("parseStat(\"\") = %+v, want empty", got)
+	}
+}
+
+func TestUnixFileMode(t *testing.T) {
+	tests := []struct {
+		raw  uint32
+		want os.FileMode
+	}{
+		{raw: 0o100644, want: 0o644},
+		{raw: 0o040755, want: os.ModeDir | 0o755},
+		{raw: 0o120777, want: os.ModeSymlink | 0o777},
+		{raw: 0o010600, want: os.ModeNamedPipe | 0o600},
+		{raw: 0o140755, want: os.ModeSocket | 0o755},
+		{raw: 0o020666, want: os.ModeDevice | os.ModeCharDevice | 0o666},
+		{raw: 0o060660, want: os.ModeDevice | 0o660},
+		{raw: 0o104755, want: os.ModeSetuid | 0o755},
+		{raw: 0o102755, want: os.ModeSetgid | 0o755},
+		{raw: 0o041777, want: os.ModeDir | os.ModeSticky | 0o777},
+	}
+	for _, tt := range tests {
+		if got := unixFileMode(tt.raw); got != tt.want {
+			t.Errorf("unixFileMode(%o) = %v, want %v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header    string
+		size      int64
+		wantStart int64
+		wantEnd   int64
+		wantErr   bool
+	}{
+		{header: "bytes=0-", size: 100, wantStart: 0, wantEnd: 99},
+		{header: "bytes=10-19", size: 100, wantStart: 10, wantEnd: 19},
+		{header: "bytes=90-200", size: 100, wantStart: 90, wantEnd: 99},
+		{header: "bytes= 5 - 6 ", size: 100, wantStart: 5, wantEnd: 6},
+		{header: "bytes=-10", size: 100, wantStart: 90, wantEnd: 99},
+		{header: "bytes=-200", size: 100, wantStart: 0, wantEnd: 99},
+		{header: "bytes=-0", size: 100, wantErr: true},
+		{header: "bytes=-1", size: 0, wantErr: true},
+		{header: "bytes=-", size: 100, wantErr: true},
+		{header: "bytes=100-", size: 100, wantErr: true},
+		{header: "bytes=20-10", size: 100, wantErr: true},
+		{header: "bytes=0-1,5-6", size: 100, wantErr: true},
+		{header: "items=0-1", size: 100, wantErr: true},
+		{header: "bytes=a-b", size: 100, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			start, end, err := parseRange(tt.header, tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (start != tt.wantStart || end != tt.wantEnd) {
+				t.Errorf("parseRange() = %d-%d, want %d-%d", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestRangeWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	done := 0
+	w := &rangeWriter{w: buf, remain: 5, done: func() { done++ }}
+
+	if n, err := w.Write([]byte("abc")); n != 3 || err != nil {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	// 超出范围的部分不写入, 返回 errRangeDone
+	if n, err := w.Write([]byte("defg")); n != 2 || !errors.Is(err, errRangeDone) {
+		t.Fatalf("Write() = %d, %v, want 2, errRangeDone", n, err)
+	}
+	if n, err := w.Write([]byte("h")); n != 0 || !errors.Is(err, errRangeDone) {
+		t.Fatalf("Write() = %d, %v, want 0, errRangeDone", n, err)
+	}
+	if buf.String() != "abcde" || done == 0 {
+		t.Errorf("written %q, done %d", buf.String(), done)
+	}
+
+	// 恰好写满时没有错误
+	buf.Reset()
+	w = &rangeWriter{w: buf, remain: 3, done: func() {}}
+	if n, err := w.Write([]byte("abc")); n != 3 || err != nil {
+		t.Errorf("Write() = %d, %v", n, err)
+	}
+}
+
+func TestTarToZip(t *testing.T) {
+	mtime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	tarBuf := &bytes.Buffer{}
+	tw := tar.NewWriter(tarBuf)
+	entries := []struct {
+		hdr     *tar.Header
+		content string
+	}{
+		{hdr: &tar.Header{Name: "data", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: mtime}},
+		{hdr: &tar.Header{Name: "data/a.txt", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: mtime}, content: "hello"},
+		{hdr: &tar.Header{Name: "data/link", Typeflag: tar.TypeSymlink, Linkname: "a.txt", Mode: 0o777, ModTime: mtime}},
+		{hdr: &tar.Header{Name: "data/fifo", Typeflag: tar.TypeFifo, Mode: 0o644, ModTime: mtime}},
+	}
+	for _, e := range entries {
+		e.hdr.Size = int64(len(e.content))
+		if err := tw.WriteHeader(e.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, e.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zipBuf := &bytes.Buffer{}
+	if err := tarToZip(zipBuf, tarBuf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(zipBuf.Bytes()), int64(zipBuf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]struct {
+		content string
+		mode    os.FileMode
+	}{
+		"data/":      {mode: os.ModeDir | 0o755},
+		"data/a.txt": {content: "hello", mode: 0o644},
+		"data/link":  {content: "a.txt", mode: os.ModeSymlink | 0o777},
+	}
+	if len(zr.File) != len(want) {
+		t.Fatalf("zip has %d files, want %d", len(zr.File), len(want))
+	}
+	for _, f := range zr.File {
+		w, ok := want[f.Name]
+		if !ok {
+			t.Errorf("unexpected file %s", f.Name)
+			continue
+		}
+		if f.Mode() != w.mode {
+			t.Errorf("%s mode = %v, want %v", f.Name, f.Mode(), w.mode)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != w.content {
+			t.Errorf("%s content = %q, want %q", f.Name, content, w.content)
+		}
+	}
+
+	if err := tarToZip(io.Discard, bytes.NewReader([]byte("not a tar stream, at least 512 bytes are needed"))); err == nil {
+		t.Errorf("tarToZip() with invalid tar expect error")
+	}
+}
@@ -0,0 +1,321 @@
+package apis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/agent/cluster"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// JaegerHandler 服务和操作列表没有 namespace 信息, 只允许不限制范围的调用方
+// 链路只返回调用方 namespace 的 span, namespace 取自 jaegerNamespaceTag
+type JaegerHandler struct {
+	cluster cluster.Interface
+	runtime *Runtime
+}
+
+// jaeger query 接口的返回格式
+type jaegerResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Total  int             `json:"total"`
+	Errors []struct {
+		Code    int    `json:"code"`
+		Msg     string `json:"msg"`
+		TraceID string `json:"traceID,omitempty"`
+	} `json:"errors"`
+}
+
+// jaegerKeyValue span 和 process 的 tag
+type jaegerKeyValue struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// jaegerSpan 只解析判断 namespace 需要的字段, 返回时使用原始内容
+type jaegerSpan struct {
+	ProcessID string           `json:"processID"`
+	Tags      []jaegerKeyValue `json:"tags"`
+}
+
+type jaegerProcess struct {
+	Tags []jaegerKeyValue `json:"tags"`
+}
+
+// @Tags        Agent.V1
+// @Summary     Jaeger 服务列表
+// @Description Jaeger 服务列表, 只允许不限制范围的调用方
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                 true "cluster"
+// @Success     200     {object} handlers.ResponseStruct{Data=[]string} "services"
+// @Router      /v1/proxy/cluster/{cluster}/custom/jaeger/v1/services [get]
+// @Security    JWT
+func (h *JaegerHandler) Services(c *gin.Context) {
+	if err := h.requireUnlimited(c, "services"); err != nil {
+		NotOK(c, err)
+		return
+	}
+	h.proxy(c, "/api/services", nil)
+}
+
+// @Tags        Agent.V1
+// @Summary     Jaeger 服务的操作列表
+// @Description Jaeger 服务的操作列表, 只允许不限制范围的调用方
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                 true "cluster"
+// @Param       name    path     string                                 true "service"
+// @Success     200     {object} handlers.ResponseStruct{Data=[]string} "operations"
+// @Router      /v1/proxy/cluster/{cluster}/custom/jaeger/v1/services/{name}/actions/operations [get]
+// @Security    JWT
+func (h *JaegerHandler) Operations(c *gin.Context) {
+	if err := h.requireUnlimited(c, "operations"); err != nil {
+		NotOK(c, err)
+		return
+	}
+	h.proxy(c, "/api/services/"+url.PathEscape(c.Param("name"))+"/operations", nil)
+}
+
+// @Tags        Agent.V1
+// @Summary     Jaeger 查询链路
+// @Description Jaeger 查询链路, 范围受限的调用方只返回其 namespace 的 span
+// @Accept      json
+// @Produce     json
+// @Param       cluster     path     string                                 true  "cluster"
+// @Param       service     query    string                                 true  "service"
+// @Param       operation   query    string                                 false "operation"
+// @Param       tag         query    []string                               false "tag, key:value 格式, 可以多个"
+// @Param       tags        query    string                                 false "tags, json 格式"
+// @Param       minDuration query    string                                 false "最小耗时, 如 100ms"
+// @Param       maxDuration query    string                                 false "最大耗时, 如 1s"
+// @Param       start       query    int                                    false "开始时间, 微秒时间戳"
+// @Param       end         query    int                                    false "结束时间, 微秒时间戳"
+// @Param       lookback    query    string                                 false "lookback, 如 1h"
+// @Param       limit       query    int                                    false "limit, 默认20"
+// @Success     200         {object} handlers.ResponseStruct{Data=[]object} "traces"
+// @Router      /v1/proxy/cluster/{cluster}/custom/jaeger/v1/traces [get]
+// @Security    JWT
+func (h *JaegerHandler) SearchTraces(c *gin.Context) {
+	if c.Query("service") == "" {
+		NotOK(c, fmt.Errorf("service is required"))
+		return
+	}
+	params := url.Values{
+		"limit": {c.DefaultQuery("limit", "20")},
+	}
+	for _, key := range []string{"service", "operation", "minDuration", "maxDuration", "start", "end", "lookback"} {
+		if v := c.Query(key); v != "" {
+			params.Set(key, v)
+		}
+	}
+	tags, err := jaegerTags(c.Query("tags"), c.QueryArray("tag"))
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	if tags != "" {
+		params.Set("tags", tags)
+	}
+	h.traces(c, "/api/traces", params, false)
+}
+
+// @Tags        Agent.V1
+// @Summary     Jaeger 获取链路详情
+// @Description Jaeger 获取链路详情, 范围受限的调用方只返回其 namespace 的 span
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                 true "cluster"
+// @Param       name    path     string                                 true "trace id"
+// @Success     200     {object} handlers.ResponseStruct{Data=[]object} "trace"
+// @Router      /v1/proxy/cluster/{cluster}/custom/jaeger/v1/traces/{name} [get]
+// @Security    JWT
+func (h *JaegerHandler) GetTrace(c *gin.Context) {
+	h.traces(c, "/api/traces/"+url.PathEscape(c.Param("name")), nil, true)
+}
+
+func (h *JaegerHandler) requireUnlimited(c *gin.Context, resource string) error {
+	scope, err := scopeFromRequest(c.Request.Context(), h.cluster.GetClient(), c)
+	if err != nil {
+		return err
+	}
+	if !scope.Unlimited() {
+		return scope.Forbidden(resource, "jaeger")
+	}
+	return nil
+}
+
+// traces 范围受限的调用方只返回其 namespace 的 span, single 为 true 时没有 span 返回 404
+func (h *JaegerHandler) traces(c *gin.Context, path string, params url.Values, single bool) {
+	scope, err := scopeFromRequest(c.Request.Context(), h.cluster.GetClient(), c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	data, err := h.get(c.Request.Context(), path, params)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	if scope.Unlimited() {
+		OK(c, data)
+		return
+	}
+	traces, err := scopeTraces(data, h.runtime.Load().Options.JaegerNamespaceTag, scope)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	if single && len(traces) == 0 {
+		NotOK(c, apiErrors.NewNotFound(schema.GroupResource{Resource: "traces"}, c.Param("name")))
+		return
+	}
+	OK(c, traces)
+}
+
+func (h *JaegerHandler) proxy(c *gin.Context, path string, params url.Values) {
+	data, err := h.get(c.Request.Context(), path, params)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	OK(c, data)
+}
+
+func (h *JaegerHandler) get(ctx context.Context, path string, params url.Values) (json.RawMessage, error) {
+	server := h.runtime.Load().Options.JaegerServer
+	if server == "" {
+		return nil, fmt.Errorf("jaeger server is not configured")
+	}
+	u, err := upstreamURL(server, path, params)
+	if err != nil {
+		return nil, err
+	}
+	resp := &jaegerResponse{}
+	if err := getJSON(ctx, u, resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Errors) > 0 {
+		msgs := make([]string, 0, len(resp.Errors))
+		for _, e := range resp.Errors {
+			msgs = append(msgs, e.Msg)
+		}
+		return nil, fmt.Errorf("jaeger: %s", strings.Join(msgs, "; "))
+	}
+	return resp.Data, nil
+}
+
+// jaegerTags 合并 json 格式的 tags 和 key:value 格式的 tag 参数
+func jaegerTags(tagsJSON string, tags []string) (string, error) {
+	merged := map[string]string{}
+	if tagsJSON != "" {
+		if err := json.Unmarshal([]byte(tagsJSON), &merged); err != nil {
+			return "", fmt.Errorf("invalid tags %q: %v", tagsJSON, err)
+		}
+	}
+	for _, tag := range tags {
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return "", fmt.Errorf("invalid tag %q, must be key:value", tag)
+		}
+		merged[kv[0]] = kv[1]
+	}
+	if len(merged) == 0 {
+		return "", nil
+	}
+	content, err := json.Marshal(merged)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// scopeTraces 只保留 namespace 在范围内的 span 和它们的 process, 没有 namespace tag 的 span 被移除
+// 没有 span 的链路被移除, 链路和 span 的其他字段保持不变
+func scopeTraces(data json.RawMessage, tag string, scope *Scope) ([]map[string]json.RawMessage, error) {
+	traces := []map[string]json.RawMessage{}
+	if len(data) == 0 || string(data) == "null" {
+		return traces, nil
+	}
+	all := []map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("decode jaeger traces: %v", err)
+	}
+	for _, trace := range all {
+		rawSpans := []json.RawMessage{}
+		processes := map[string]json.RawMessage{}
+		if err := unmarshalField(trace, "spans", &rawSpans); err != nil {
+			return nil, err
+		}
+		if err := unmarshalField(trace, "processes", &processes); err != nil {
+			return nil, err
+		}
+		processNamespace := map[string]string{}
+		for id, raw := range processes {
+			process := jaegerProcess{}
+			if err := json.Unmarshal(raw, &process); err != nil {
+				return nil, fmt.Errorf("decode jaeger process: %v", err)
+			}
+			processNamespace[id] = tagValue(process.Tags, tag)
+		}
+
+		kept, keptProcesses := []json.RawMessage{}, map[string]json.RawMessage{}
+		for _, raw := range rawSpans {
+			span := jaegerSpan{}
+			if err := json.Unmarshal(raw, &span); err != nil {
+				return nil, fmt.Errorf("decode jaeger span: %v", err)
+			}
+			// span 的 tag 优先, 没有时使用 process 的 tag
+			namespace := tagValue(span.Tags, tag)
+			if namespace == "" {
+				namespace = processNamespace[span.ProcessID]
+			}
+			if namespace == "" || !scope.Contains(namespace) {
+				continue
+			}
+			kept = append(kept, raw)
+			if process, ok := processes[span.ProcessID]; ok {
+				keptProcesses[span.ProcessID] = process
+			}
+		}
+		if len(kept) == 0 {
+			continue
+		}
+		var err error
+		if trace["spans"], err = json.Marshal(kept); err != nil {
+			return nil, err
+		}
+		if trace["processes"], err = json.Marshal(keptProcesses); err != nil {
+			return nil, err
+		}
+		traces = append(traces, trace)
+	}
+	return traces, nil
+}
+
+func unmarshalField(object map[string]json.RawMessage, key string, v interface{}) error {
+	raw, ok := object[key]
+	if !ok || string(raw) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("decode jaeger %s: %v", key, err)
+	}
+	return nil
+}
+
+func tagValue(tags []jaegerKeyValue, key string) string {
+	for _, tag := range tags {
+		if tag.Key == key {
+			if value, ok := tag.Value.(string); ok {
+				return value
+			}
+		}
+	}
+	return ""
+}
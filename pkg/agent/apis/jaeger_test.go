@@ -0,0 +1,249 @@
+package apis
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/agent/middleware"
+	"github.com/sunweiwe/kuber/pkg/api/kuber/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestJaegerTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		tagsJSON string
+		tags     []string
+		want     string
+		wantErr  bool
+	}{
+		{name: "empty"},
+		{name: "json only", tagsJSON: `{"http.status_code":"500"}`, want: `{"http.status_code":"500"}`},
+		{name: "key value only", tags: []string{"error:true", "env:prod"}, want: `{"env":"prod","error":"true"}`},
+		{name: "key value overrides json", tagsJSON: `{"error":"false"}`, tags: []string{"error:true"}, want: `{"error":"true"}`},
+		{name: "value contains colon", tags: []string{"http.url:http://a:80/b"}, want: `{"http.url":"http://a:80/b"}`},
+		{name: "empty value", tags: []string{"error:"}, want: `{"error":""}`},
+		{name: "invalid json", tagsJSON: `{"error":`, wantErr: true},
+		{name: "json is not an object of strings", tagsJSON: `{"error":true}`, wantErr: true},
+		{name: "missing colon", tags: []string{"error"}, wantErr: true},
+		{name: "empty key", tags: []string{":true"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := jaegerTags(tt.tagsJSON, tt.tags)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("jaegerTags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("jaegerTags() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJaegerHandlerGet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/services":
+			_, _ = w.Write([]byte(`{"data":["frontend","backend"],"total":2}`))
+		case "/api/traces":
+			if r.URL.Query().Get("service") != "frontend" {
+				t.Errorf("unexpected query %s", r.URL.RawQuery)
+			}
+			_, _ = w.Write([]byte(`{"data":null,"errors":[{"code":400,"msg":"bad lookback"},{"code":400,"msg":"bad limit"}]}`))
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	options := NewDefaultOptions()
+	options.JaegerServer = server.URL + "/"
+	runtime, err := NewRuntime(options, NewDefaultDebugOptions(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &JaegerHandler{runtime: runtime}
+
+	tests := []struct {
+		name    string
+		path    string
+		params  url.Values
+		want    string
+		wantErr string
+	}{
+		{name: "data", path: "/api/services", want: `["frontend","backend"]`},
+		{
+			name:    "jaeger errors",
+			path:    "/api/traces",
+			params:  url.Values{"service": {"frontend"}},
+			wantErr: "jaeger: bad lookback; bad limit",
+		},
+		{
+			name:    "upstream status",
+			path:    "/api/unknown",
+			wantErr: server.Listener.Addr().String() + " 404 Not Found: not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := h.get(context.Background(), tt.path, tt.params)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("get() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("get() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("get() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+const (
+	testTraceInScope = `{"traceID":"t1","spans":[` +
+		`{"traceID":"t1","spanID":"s1","processID":"p1","tags":[]},` +
+		`{"traceID":"t1","spanID":"s2","processID":"p2","tags":[]},` +
+		`{"traceID":"t1","spanID":"s3","processID":"p3","tags":[{"key":"k8s.namespace.name","type":"string","value":"t1-dev"}]},` +
+		`{"traceID":"t1","spanID":"s4","processID":"p3","tags":[]}],` +
+		`"processes":{` +
+		`"p1":{"serviceName":"web","tags":[{"key":"k8s.namespace.name","type":"string","value":"t1-dev"}]},` +
+		`"p2":{"serviceName":"db","tags":[{"key":"k8s.namespace.name","type":"string","value":"shared"}]},` +
+		`"p3":{"serviceName":"job","tags":[]}},"warnings":["clock skew"]}`
+	testTraceOutOfScope = `{"traceID":"t2","spans":[{"traceID":"t2","spanID":"x","processID":"p1"}],` +
+		`"processes":{"p1":{"serviceName":"other","tags":[{"key":"k8s.namespace.name","type":"string","value":"t2-dev"}]}}}`
+)
+
+func spanIDs(t *testing.T, trace map[string]json.RawMessage) ([]string, []string) {
+	spans := []struct {
+		SpanID string `json:"spanID"`
+	}{}
+	if err := json.Unmarshal(trace["spans"], &spans); err != nil {
+		t.Fatal(err)
+	}
+	processes := map[string]json.RawMessage{}
+	if err := json.Unmarshal(trace["processes"], &processes); err != nil {
+		t.Fatal(err)
+	}
+	ids, processIDs := []string{}, []string{}
+	for _, span := range spans {
+		ids = append(ids, span.SpanID)
+	}
+	for id := range processes {
+		processIDs = append(processIDs, id)
+	}
+	sort.Strings(processIDs)
+	return ids, processIDs
+}
+
+func TestScopeTraces(t *testing.T) {
+	data := json.RawMessage("[" + testTraceInScope + "," + testTraceOutOfScope + "]")
+	traces, err := scopeTraces(data, "k8s.namespace.name", &Scope{Namespaces: []string{"t1-dev"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 1 || string(traces[0]["traceID"]) != `"t1"` {
+		t.Fatalf("scopeTraces() = %d traces, want only t1", len(traces))
+	}
+	// s3 使用 span 的 tag, s4 所在的 process 和 span 都没有 namespace
+	spans, processes := spanIDs(t, traces[0])
+	if !reflect.DeepEqual(spans, []string{"s1", "s3"}) || !reflect.DeepEqual(processes, []string{"p1", "p3"}) {
+		t.Errorf("scopeTraces() spans = %v, processes = %v", spans, processes)
+	}
+	if string(traces[0]["warnings"]) != `["clock skew"]` {
+		t.Errorf("scopeTraces() warnings = %s", traces[0]["warnings"])
+	}
+
+	if traces, err := scopeTraces(data, "k8s.namespace.name", &Scope{Namespaces: []string{}}); err != nil || len(traces) != 0 {
+		t.Errorf("scopeTraces() without namespaces = %d, %v", len(traces), err)
+	}
+	if traces, err := scopeTraces(json.RawMessage("null"), "k8s.namespace.name", &Scope{Namespaces: []string{"t1-dev"}}); err != nil || len(traces) != 0 {
+		t.Errorf("scopeTraces(null) = %d, %v", len(traces), err)
+	}
+	if _, err := scopeTraces(json.RawMessage(`{"spans":1}`), "k8s.namespace.name", &Scope{Namespaces: []string{"t1-dev"}}); err == nil {
+		t.Errorf("scopeTraces() of invalid data expect error")
+	}
+}
+
+func TestJaegerHandlerScope(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/services":
+			_, _ = w.Write([]byte(`{"data":["web"]}`))
+		case "/api/traces/t1":
+			_, _ = w.Write([]byte(`{"data":[` + testTraceInScope + `]}`))
+		case "/api/traces/t2":
+			_, _ = w.Write([]byte(`{"data":[` + testTraceOutOfScope + `]}`))
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	scheme := runtime.NewScheme()
+	if err := v1beta1.SchemeBuilder.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&v1beta1.Environment{
+		ObjectMeta: metav1.ObjectMeta{Name: "dev"},
+		Spec:       v1beta1.EnvironmentSpec{Tenant: "t1", Namespace: "t1-dev"},
+	}).Build()
+	options := NewDefaultOptions()
+	options.JaegerServer = server.URL
+	runtime, err := NewRuntime(options, NewDefaultDebugOptions(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &JaegerHandler{cluster: &fakeCluster{client: cli}, runtime: runtime}
+
+	tenant := map[string]string{HeaderUser: "alice", HeaderTenant: "t1"}
+	tests := []struct {
+		name      string
+		handler   gin.HandlerFunc
+		trace     string
+		header    map[string]string
+		untrusted bool
+		wantCode  int
+	}{
+		{name: "unauthenticated", handler: h.Services, untrusted: true, wantCode: http.StatusUnauthorized},
+		{name: "tenant services", handler: h.Services, header: tenant, wantCode: http.StatusForbidden},
+		{name: "tenant operations", handler: h.Operations, header: tenant, wantCode: http.StatusForbidden},
+		{name: "unlimited services", handler: h.Services, wantCode: http.StatusOK},
+		{name: "tenant trace", handler: h.GetTrace, trace: "t1", header: tenant, wantCode: http.StatusOK},
+		{name: "tenant trace out of scope", handler: h.GetTrace, trace: "t2", header: tenant, wantCode: http.StatusNotFound},
+		{name: "unlimited trace", handler: h.GetTrace, trace: "t2", wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = req
+			c.Params = gin.Params{{Key: "name", Value: tt.trace}}
+			middleware.SignerMiddleware(
+				func() bool { return false },
+				func(*http.Request) bool { return !tt.untrusted },
+			)(c)
+			tt.handler(c)
+			if recorder.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d: %s", recorder.Code, tt.wantCode, recorder.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,406 @@
+package apis
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/agent/audit"
+	"github.com/sunweiwe/kuber/pkg/agent/cluster"
+	"github.com/sunweiwe/kuber/pkg/api/kuber"
+	"github.com/sunweiwe/kuber/pkg/log"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	// kubectl 会话创建的对象上的标签, 值为会话 ID
+	labelKubectlSession = kuber.GroupName + "/kubectl-session"
+	annotationUser      = kuber.GroupName + "/user"
+	// 创建会话的 agent pod 名称和 namespace, 用于判断会话是否已经遗留
+	annotationKubectlAgent          = kuber.GroupName + "/kubectl-agent"
+	annotationKubectlAgentNamespace = kuber.GroupName + "/kubectl-agent-namespace"
+	// 没有设置 POD_NAMESPACE 环境变量时从 ServiceAccount 的挂载中读取 agent 所在的 namespace
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	kubectlSessionPrefix = "kuber-kubectl-"
+	kubectlContainer     = "kubectl"
+	kubectlHome          = "/home/kubectl"
+	kubectlConfigDir     = "/etc/kuber/kubectl"
+	// 会话 pod 使用的非 root 用户
+	kubectlUID int64 = 1000
+
+	defaultKubectlTokenTTL = time.Hour
+	kubectlGCInterval      = 10 * time.Minute
+)
+
+type KubectlHandler struct {
+	cluster cluster.Interface
+	runtime *Runtime
+	// agent 所在的 pod 名称和 namespace, namespace 可能与 debug.namespace 不同
+	agent          string
+	agentNamespace string
+	// 正在进行的会话 ID
+	sessions sync.Map
+}
+
+func NewKubectlHandler(cluster cluster.Interface, runtime *Runtime) *KubectlHandler {
+	hostname, _ := os.Hostname()
+	return &KubectlHandler{cluster: cluster, runtime: runtime, agent: hostname, agentNamespace: agentNamespace()}
+}
+
+// agentNamespace 无法确定时为空, 其他 agent 不回收这样的会话, 只能等待 token 过期
+func agentNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	content, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// kubectlSession 每个 kubectl 终端使用独立的 pod, ServiceAccount 和 kubeconfig, 会话结束后删除
+// pod 不挂载任何 ServiceAccount token, kubeconfig 通过只属于该会话的 Secret 挂载
+type kubectlSession struct {
+	id        string
+	user      string
+	namespace string
+	// ServiceAccount, pod, Secret 和 RoleBinding 使用相同的名称
+	name string
+	// RoleBinding 所在的 namespace, 为 nil 时使用 ClusterRoleBinding
+	bindings []string
+}
+
+// Exec         kubectl
+// @Tags        Agent.V1
+// @Summary     kubectl
+// @Description kubectl 终端, 每个会话使用独立的 pod 和临时的 ServiceAccount, 租户内的用户只能访问租户的 namespace, 会话结束后删除
+// @Param       cluster path     string true "cluster"
+// @Param       stream  query    string true "stream must be true"
+// @Success     200     {object} object "ws"
+// @Router      /v1/proxy/cluster/{cluster}/custom/system/v1/kubectl [get]
+// @Security    JWT
+func (h *KubectlHandler) Exec(c *gin.Context) {
+	var session *kubectlSession
+	serveTerminal(c, h.runtime.Load().Options, audit.KindKubectl, "", "", "", true, func() (remotecommand.Executor, error) {
+		s, err := h.prepareSession(c)
+		if s != nil {
+			session = s
+		}
+		if err != nil {
+			return nil, err
+		}
+		return attachExecutor(h.cluster, s.namespace, s.name, kubectlContainer)
+	})
+	if session != nil {
+		h.cleanupSession(session)
+		h.sessions.Delete(session.id)
+	}
+}
+
+// prepareSession 创建 ServiceAccount 和授权, 生成短期 token 的 kubeconfig, 启动会话的 pod
+// 返回的 session 不为 nil 时需要清理, 即使返回了错误
+func (h *KubectlHandler) prepareSession(c *gin.Context) (*kubectlSession, error) {
+	ctx := c.Request.Context()
+	scope, err := scopeFromRequest(ctx, h.cluster.GetClient(), c)
+	if err != nil {
+		return nil, err
+	}
+	if !scope.Unlimited() && len(scope.Namespaces) == 0 {
+		return nil, fmt.Errorf("tenant %s has no namespace in this cluster", scope.Tenant)
+	}
+	debugOptions := h.runtime.Load().Debug
+	if debugOptions.Namespace == "" {
+		return nil, fmt.Errorf("debug.namespace is required to run kubectl")
+	}
+
+	id := audit.NewSessionID()
+	session := &kubectlSession{
+		id:        id,
+		user:      scope.User,
+		namespace: debugOptions.Namespace,
+		name:      kubectlSessionPrefix + id,
+		bindings:  scope.Namespaces,
+	}
+	// 先登记再创建, 避免被垃圾回收
+	h.sessions.Store(id, struct{}{})
+	meta := metav1.ObjectMeta{
+		Name:   session.name,
+		Labels: map[string]string{labelKubectlSession: id},
+		Annotations: map[string]string{
+			annotationUser:                  scope.User,
+			annotationKubectlAgent:          h.agent,
+			annotationKubectlAgentNamespace: h.agentNamespace,
+		},
+	}
+
+	cs := h.cluster.Kubernetes()
+	sa := &v1.ServiceAccount{ObjectMeta: *meta.DeepCopy()}
+	sa.Namespace = session.namespace
+	sa, err = cs.CoreV1().ServiceAccounts(session.namespace).Create(ctx, sa, metav1.CreateOptions{})
+	if err != nil {
+		h.sessions.Delete(id)
+		return nil, err
+	}
+	subjects := []rbacv1.Subject{{
+		Kind:      rbacv1.ServiceAccountKind,
+		Name:      session.name,
+		Namespace: session.namespace,
+	}}
+	if session.bindings == nil {
+		binding := &rbacv1.ClusterRoleBinding{
+			ObjectMeta: *meta.DeepCopy(),
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: debugOptions.AdminClusterRole},
+			Subjects:   subjects,
+		}
+		if _, err := cs.RbacV1().ClusterRoleBindings().Create(ctx, binding, metav1.CreateOptions{}); err != nil {
+			return session, err
+		}
+	} else {
+		for _, ns := range session.bindings {
+			binding := &rbacv1.RoleBinding{
+				ObjectMeta: *meta.DeepCopy(),
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: debugOptions.TenantClusterRole},
+				Subjects:   subjects,
+			}
+			binding.Namespace = ns
+			if _, err := cs.RbacV1().RoleBindings(ns).Create(ctx, binding, metav1.CreateOptions{}); err != nil {
+				return session, err
+			}
+		}
+	}
+
+	expiration := int64(debugOptions.TokenTTL.Seconds())
+	token, err := cs.CoreV1().ServiceAccounts(session.namespace).CreateToken(ctx, session.name,
+		&authenticationv1.TokenRequest{Spec: authenticationv1.TokenRequestSpec{ExpirationSeconds: &expiration}},
+		metav1.CreateOptions{})
+	if err != nil {
+		return session, err
+	}
+	defaultNamespace := v1.NamespaceDefault
+	if len(session.bindings) > 0 {
+		defaultNamespace = session.bindings[0]
+	}
+	kubeconfig, err := h.kubeconfig(token.Status.Token, defaultNamespace)
+	if err != nil {
+		return session, err
+	}
+
+	// pod 和 Secret 属于 ServiceAccount, 删除 ServiceAccount 时一起删除
+	owner := *metav1.NewControllerRef(sa, v1.SchemeGroupVersion.WithKind("ServiceAccount"))
+	secret := &v1.Secret{
+		ObjectMeta: *meta.DeepCopy(),
+		Type:       v1.SecretTypeOpaque,
+		Data:       map[string][]byte{"config": kubeconfig},
+	}
+	secret.Namespace = session.namespace
+	secret.OwnerReferences = []metav1.OwnerReference{owner}
+	if _, err := cs.CoreV1().Secrets(session.namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		return session, err
+	}
+	pod := kubectlSessionPod(session, meta, owner, debugOptions)
+	if _, err := cs.CoreV1().Pods(session.namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		return session, err
+	}
+	if err := waitContainerRunning(ctx, h.cluster, session.namespace, session.name, kubectlContainer, debugOptions.StartTimeout.Duration); err != nil {
+		return session, err
+	}
+	log.Info("kubectl session prepared", "id", id, "user", scope.User, "pod", session.name,
+		"namespaces", strings.Join(session.bindings, ","))
+	return session, nil
+}
+
+// kubectlSessionPod 会话独占的 pod, 不挂载 ServiceAccount token, 使用非 root 用户, 最长运行 TokenTTL
+func kubectlSessionPod(s *kubectlSession, meta metav1.ObjectMeta, owner metav1.OwnerReference, options *DebugOptions) *v1.Pod {
+	automount, nonRoot, escalation := false, true, false
+	uid := kubectlUID
+	deadline := int64(options.TokenTTL.Seconds())
+	configMode := int32(0440)
+	pod := &v1.Pod{
+		ObjectMeta: *meta.DeepCopy(),
+		Spec: v1.PodSpec{
+			AutomountServiceAccountToken: &automount,
+			EnableServiceLinks:           &automount,
+			RestartPolicy:                v1.RestartPolicyNever,
+			ActiveDeadlineSeconds:        &deadline,
+			SecurityContext: &v1.PodSecurityContext{
+				RunAsUser:    &uid,
+				RunAsGroup:   &uid,
+				FSGroup:      &uid,
+				RunAsNonRoot: &nonRoot,
+			},
+			Containers: []v1.Container{{
+				Name:            kubectlContainer,
+				Image:           options.KubectlImage,
+				ImagePullPolicy: v1.PullIfNotPresent,
+				Command:         []string{"/bin/sh", "-c", "[ -x /bin/bash ] && exec /bin/bash || exec /bin/sh"},
+				WorkingDir:      kubectlHome,
+				Env: []v1.EnvVar{
+					{Name: "HOME", Value: kubectlHome},
+					{Name: "KUBECONFIG", Value: kubectlConfigDir + "/config"},
+					{Name: "TERM", Value: "xterm-256color"},
+					{Name: "LANG", Value: "C.UTF-8"},
+				},
+				Stdin:     true,
+				StdinOnce: true,
+				TTY:       true,
+				SecurityContext: &v1.SecurityContext{
+					AllowPrivilegeEscalation: &escalation,
+					Capabilities:             &v1.Capabilities{Drop: []v1.Capability{"ALL"}},
+				},
+				VolumeMounts: []v1.VolumeMount{
+					{Name: "home", MountPath: kubectlHome},
+					{Name: "kubeconfig", MountPath: kubectlConfigDir, ReadOnly: true},
+				},
+			}},
+			Volumes: []v1.Volume{
+				{Name: "home", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+				{Name: "kubeconfig", VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{
+					SecretName:  s.name,
+					DefaultMode: &configMode,
+				}}},
+			},
+		},
+	}
+	pod.Namespace = s.namespace
+	pod.OwnerReferences = []metav1.OwnerReference{owner}
+	return pod
+}
+
+// kubeconfig 使用 agent 连接 apiserver 的地址和 CA
+func (h *KubectlHandler) kubeconfig(token, namespace string) ([]byte, error) {
+	config := h.cluster.Config()
+	caData := config.CAData
+	if len(caData) == 0 && config.CAFile != "" {
+		content, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		caData = content
+	}
+	kubeconfig := clientcmdapi.NewConfig()
+	kubeconfig.Clusters["kuber"] = &clientcmdapi.Cluster{
+		Server:                   config.Host,
+		CertificateAuthorityData: caData,
+		InsecureSkipTLSVerify:    config.Insecure,
+	}
+	kubeconfig.AuthInfos["kuber"] = &clientcmdapi.AuthInfo{Token: token}
+	kubeconfig.Contexts["kuber"] = &clientcmdapi.Context{Cluster: "kuber", AuthInfo: "kuber", Namespace: namespace}
+	kubeconfig.CurrentContext = "kuber"
+	return clientcmd.Write(*kubeconfig)
+}
+
+// cleanupSession 删除 ServiceAccount 后 token 立即失效
+func (h *KubectlHandler) cleanupSession(s *kubectlSession) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cs := h.cluster.Kubernetes()
+	ignoreNotFound := func(err error) error {
+		if apiErrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	grace := int64(0)
+	if err := cs.CoreV1().Pods(s.namespace).Delete(ctx, s.name, metav1.DeleteOptions{GracePeriodSeconds: &grace}); ignoreNotFound(err) != nil {
+		log.Error(err, "delete kubectl session pod", "id", s.id)
+	}
+	if err := cs.CoreV1().Secrets(s.namespace).Delete(ctx, s.name, metav1.DeleteOptions{}); ignoreNotFound(err) != nil {
+		log.Error(err, "delete kubectl session secret", "id", s.id)
+	}
+	if s.bindings == nil {
+		if err := cs.RbacV1().ClusterRoleBindings().Delete(ctx, s.name, metav1.DeleteOptions{}); ignoreNotFound(err) != nil {
+			log.Error(err, "delete kubectl session clusterrolebinding", "id", s.id)
+		}
+	}
+	for _, ns := range s.bindings {
+		if err := cs.RbacV1().RoleBindings(ns).Delete(ctx, s.name, metav1.DeleteOptions{}); ignoreNotFound(err) != nil {
+			log.Error(err, "delete kubectl session rolebinding", "id", s.id, "namespace", ns)
+		}
+	}
+	if err := cs.CoreV1().ServiceAccounts(s.namespace).Delete(ctx, s.name, metav1.DeleteOptions{}); ignoreNotFound(err) != nil {
+		log.Error(err, "delete kubectl session serviceaccount", "id", s.id)
+	}
+	log.Info("kubectl session cleaned up", "id", s.id, "user", s.user)
+}
+
+// CollectGarbage 清理遗留的 kubectl 会话, 以下情况认为会话已经遗留:
+// 创建时间超过 TokenTTL, token 已经失效;
+// 由当前 agent 创建但不在进行中, 如 agent 容器重启或者清理失败;
+// 创建会话的 agent pod 已经不存在
+func (h *KubectlHandler) CollectGarbage(ctx context.Context) {
+	debugOptions := h.runtime.Load().Debug
+	if debugOptions.Namespace == "" {
+		return
+	}
+	cs := h.cluster.Kubernetes()
+	accounts, err := cs.CoreV1().ServiceAccounts(debugOptions.Namespace).List(ctx, metav1.ListOptions{LabelSelector: labelKubectlSession})
+	if err != nil {
+		log.Error(err, "list kubectl session serviceaccounts")
+		return
+	}
+	// 同一个 agent 只查询一次
+	agents := map[string]bool{}
+	for _, sa := range accounts.Items {
+		id := sa.Labels[labelKubectlSession]
+		if !h.sessionOrphaned(ctx, &sa, debugOptions, agents) {
+			continue
+		}
+		session := &kubectlSession{id: id, user: sa.Annotations[annotationUser], namespace: sa.Namespace, name: sa.Name}
+		bindings, err := cs.RbacV1().RoleBindings(v1.NamespaceAll).List(ctx, metav1.ListOptions{
+			LabelSelector: labels.Set{labelKubectlSession: id}.String(),
+		})
+		if err != nil {
+			log.Error(err, "list kubectl session rolebindings", "id", id)
+			continue
+		}
+		for _, binding := range bindings.Items {
+			session.bindings = append(session.bindings, binding.Namespace)
+		}
+		// 没有 RoleBinding 时删除 ClusterRoleBinding, 不存在时忽略
+		h.cleanupSession(session)
+		log.Info("orphaned kubectl session collected", "id", id, "agent", sa.Annotations[annotationKubectlAgent])
+	}
+}
+
+func (h *KubectlHandler) sessionOrphaned(ctx context.Context, sa *v1.ServiceAccount, options *DebugOptions, agents map[string]bool) bool {
+	if time.Since(sa.CreationTimestamp.Time) > options.TokenTTL.Duration {
+		return true
+	}
+	agent := sa.Annotations[annotationKubectlAgent]
+	if agent == h.agent {
+		_, active := h.sessions.Load(sa.Labels[labelKubectlSession])
+		return !active
+	}
+	// 不知道 agent 所在的 namespace 时无法判断, 等待 token 过期
+	namespace := sa.Annotations[annotationKubectlAgentNamespace]
+	if agent == "" || namespace == "" {
+		return false
+	}
+	key := namespace + "/" + agent
+	exists, checked := agents[key]
+	if !checked {
+		_, err := h.cluster.Kubernetes().CoreV1().Pods(namespace).Get(ctx, agent, metav1.GetOptions{})
+		if err != nil && !apiErrors.IsNotFound(err) {
+			log.Error(err, "get kubectl session agent", "agent", agent, "namespace", namespace)
+			return false
+		}
+		exists = err == nil
+		agents[key] = exists
+	}
+	return !exists
+}
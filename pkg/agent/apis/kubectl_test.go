@@ -0,0 +1,125 @@
+package apis
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestKubectlSessionPod(t *testing.T) {
+	options := NewDefaultDebugOptions()
+	options.KubectlImage = "bitnami/kubectl:1.26"
+	session := &kubectlSession{id: "abc", namespace: "kuber", name: kubectlSessionPrefix + "abc"}
+	owner := metav1.OwnerReference{APIVersion: "v1", Kind: "ServiceAccount", Name: session.name, UID: "uid"}
+	meta := metav1.ObjectMeta{Name: session.name, Labels: map[string]string{labelKubectlSession: "abc"}}
+
+	pod := kubectlSessionPod(session, meta, owner, options)
+	if pod.Namespace != "kuber" || pod.Name != session.name || pod.Labels[labelKubectlSession] != "abc" {
+		t.Errorf("unexpected pod meta %v", pod.ObjectMeta)
+	}
+	if len(pod.OwnerReferences) != 1 || pod.OwnerReferences[0].UID != "uid" {
+		t.Errorf("pod owner = %v", pod.OwnerReferences)
+	}
+	if pod.Spec.AutomountServiceAccountToken == nil || *pod.Spec.AutomountServiceAccountToken {
+		t.Errorf("pod must not mount service account tokens")
+	}
+	if pod.Spec.SecurityContext.RunAsNonRoot == nil || !*pod.Spec.SecurityContext.RunAsNonRoot {
+		t.Errorf("pod must run as non root")
+	}
+	if pod.Spec.ActiveDeadlineSeconds == nil || *pod.Spec.ActiveDeadlineSeconds != int64(options.TokenTTL.Seconds()) {
+		t.Errorf("pod deadline = %v", pod.Spec.ActiveDeadlineSeconds)
+	}
+	container := pod.Spec.Containers[0]
+	if container.Name != kubectlContainer || container.Image != "bitnami/kubectl:1.26" || !container.TTY || !container.Stdin {
+		t.Errorf("unexpected container %v", container)
+	}
+	secret := pod.Spec.Volumes[1].Secret
+	if secret == nil || secret.SecretName != session.name {
+		t.Errorf("kubeconfig volume = %v", pod.Spec.Volumes[1])
+	}
+}
+
+func TestKubectlCollectGarbage(t *testing.T) {
+	now := time.Now()
+	sa := func(id, agent, agentNamespace string, age time.Duration) *v1.ServiceAccount {
+		annotations := map[string]string{annotationKubectlAgent: agent}
+		if agentNamespace != "" {
+			annotations[annotationKubectlAgentNamespace] = agentNamespace
+		}
+		return &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+			Name:              kubectlSessionPrefix + id,
+			Namespace:         "kuber",
+			Labels:            map[string]string{labelKubectlSession: id},
+			Annotations:       annotations,
+			CreationTimestamp: metav1.NewTime(now.Add(-age)),
+		}}
+	}
+	// agent 运行在 kuber-system, 会话在 debug.namespace kuber 中
+	objects := []runtime.Object{
+		sa("expired", "agent-0", "kuber-system", 2*time.Hour),
+		sa("active", "agent-0", "kuber-system", time.Minute),
+		sa("inactive", "agent-0", "kuber-system", time.Minute),
+		sa("other-alive", "agent-1", "kuber-system", time.Minute),
+		sa("other-gone", "agent-2", "kuber-system", time.Minute),
+		// 没有记录 agent 的 namespace, 等待过期
+		sa("unknown-namespace", "agent-2", "", time.Minute),
+		// 不属于 kubectl 会话
+		&v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "kuber"}},
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "agent-1", Namespace: "kuber-system"}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{
+			Name:      kubectlSessionPrefix + "other-gone",
+			Namespace: "t1-dev",
+			Labels:    map[string]string{labelKubectlSession: "other-gone"},
+		}},
+		&rbacv1.ClusterRoleBinding{ObjectMeta: metav1.ObjectMeta{
+			Name:   kubectlSessionPrefix + "expired",
+			Labels: map[string]string{labelKubectlSession: "expired"},
+		}},
+	}
+	cs := kubefake.NewSimpleClientset(objects...)
+
+	debugOptions := NewDefaultDebugOptions()
+	debugOptions.Namespace = "kuber"
+	runtime, err := NewRuntime(NewDefaultOptions(), debugOptions, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &KubectlHandler{cluster: &fakeCluster{kubernetes: cs}, runtime: runtime, agent: "agent-0", agentNamespace: "kuber-system"}
+	h.sessions.Store("active", struct{}{})
+
+	ctx := context.Background()
+	h.CollectGarbage(ctx)
+
+	accounts, err := cs.CoreV1().ServiceAccounts("kuber").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, sa := range accounts.Items {
+		got = append(got, sa.Name)
+	}
+	sort.Strings(got)
+	want := []string{"default", kubectlSessionPrefix + "active", kubectlSessionPrefix + "other-alive", kubectlSessionPrefix + "unknown-namespace"}
+	if len(got) != len(want) {
+		t.Fatalf("service accounts = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("service accounts = %v, want %v", got, want)
+		}
+	}
+	if _, err := cs.RbacV1().RoleBindings("t1-dev").Get(ctx, kubectlSessionPrefix+"other-gone", metav1.GetOptions{}); !apiErrors.IsNotFound(err) {
+		t.Errorf("rolebinding of orphaned session not deleted: %v", err)
+	}
+	if _, err := cs.RbacV1().ClusterRoleBindings().Get(ctx, kubectlSessionPrefix+"expired", metav1.GetOptions{}); !apiErrors.IsNotFound(err) {
+		t.Errorf("clusterrolebinding of expired session not deleted: %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package apis
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	defaultArchiveContainerBytes    = 10 * 1024 * 1024
+	defaultMaxArchiveContainerBytes = 100 * 1024 * 1024
+	defaultMaxArchiveBytes          = 500 * 1024 * 1024
+	// 单个容器的日志小于该大小时不使用临时文件
+	logSpoolMemoryBytes = 1024 * 1024
+	// 超过压缩包上限时写入的说明文件
+	logArchiveTruncatedFile = "TRUNCATED.txt"
+)
+
+// LogArchive 下载日志压缩包
+// @Tags        Agent.V1
+// @Summary     下载日志压缩包
+// @Description 下载 pod 或者工作负载下所有 pod 的所有容器(包括 init 容器和上一次退出的容器)的日志, 每个容器一个文件, 格式为 tar.gz, 每个容器和整个压缩包的大小受 agent 配置限制, 超过压缩包上限时剩余的日志不再下载
+// @Param       cluster      path     string true  "cluster"
+// @Param       namespace    path     string true  "namespace"
+// @Param       name         path     string true  "pod, 指定 kind 和 workload 时忽略"
+// @Param       container    query    string false "container, 为空时下载所有容器"
+// @Param       kind         query    string false "Deployment/StatefulSet/DaemonSet/Job"
+// @Param       workload     query    string false "工作负载名称"
+// @Param       sinceSeconds query    int    false "最近多少秒的日志"
+// @Param       sinceTime    query    string false "开始时间, RFC3339"
+// @Param       until        query    string false "结束时间, RFC3339"
+// @Param       tail         query    int    false "每个容器最多多少行"
+// @Param       limitBytes   query    int    false "每个容器最多多少字节, 默认和上限由 agent 配置"
+// @Success     200          {object} object "tar.gz"
+// @Router      /v1/proxy/cluster/{cluster}/custom/core/v1/namespaces/{namespace}/pods/{name}/actions/logarchive [get]
+// @Security    JWT
+func (h *PodHandler) LogArchive(c *gin.Context) {
+	logOpt, err := podLogOptions(c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	// 归档只读取已有的日志, 带上时间戳方便按照时间排查
+	logOpt.Follow = false
+	logOpt.Previous = false
+	logOpt.Timestamps = true
+	if paramFromHeaderOrQuery(c, "tail", "") == "" {
+		logOpt.TailLines = nil
+	}
+	var until time.Time
+	if v := c.Query("until"); v != "" {
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			NotOK(c, fmt.Errorf("invalid until %q, must be RFC3339", v))
+			return
+		}
+	}
+	targets, err := h.logTargets(c, logOpt.Container, true)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+
+	name := c.Param("name")
+	if kind, workload := c.Query("kind"), c.Query("workload"); kind != "" && workload != "" {
+		name = strings.ToLower(kind) + "-" + workload
+	}
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{
+			"filename": name + "-logs.tar.gz",
+		}),
+	)
+
+	ctx := c.Request.Context()
+	limits := h.runtime.Load().Options.Log
+	containerLimit := archiveContainerLimit(logOpt.LimitBytes, limits)
+	remaining := limits.MaxArchiveBytes
+	// 与文件下载共享用户的下载速度
+	gw := gzip.NewWriter(h.runtime.Transfer().Writer(ctx, transferIdentity(c), DirectionDownload, c.Writer))
+	tw := tar.NewWriter(gw)
+	namespace := c.Param("namespace")
+archive:
+	for _, target := range targets {
+		opt := logOpt.DeepCopy()
+		opt.Container = target.container
+		previous := []bool{false}
+		if target.restarts > 0 {
+			previous = append(previous, true)
+		}
+		for _, prev := range previous {
+			if remaining <= 0 {
+				// 超过整个压缩包的上限, 剩余的日志不再下载
+				content := fmt.Sprintf("log archive reached the limit of %d bytes, remaining logs are omitted\n", limits.MaxArchiveBytes)
+				if err := writeTarFile(tw, logArchiveTruncatedFile, int64(len(content)), strings.NewReader(content)); err != nil {
+					return
+				}
+				break archive
+			}
+			filename := target.pod + "/" + target.container + ".log"
+			if prev {
+				filename = target.pod + "/" + target.container + ".previous.log"
+			}
+			opt.Previous = prev
+			limit := containerLimit
+			if limit > remaining {
+				limit = remaining
+			}
+			opt.LimitBytes = &limit
+			size, err := h.archiveLogs(ctx, tw, namespace, target.pod, filename, opt, until)
+			remaining -= size
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				// 响应已经开始, 错误写到单独的文件中
+				log.Error(err, "archive logs", "pod", target.pod, "container", target.container)
+				content := err.Error() + "\n"
+				if err := writeTarFile(tw, filename+".error", int64(len(content)), strings.NewReader(content)); err != nil {
+					return
+				}
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		log.Error(err, "close log archive")
+		return
+	}
+	_ = gw.Close()
+}
+
+// archiveContainerLimit 每个容器的日志上限, 未指定 limitBytes 时使用默认值, 超过上限时取上限
+func archiveContainerLimit(limitBytes *int64, o *LogOptions) int64 {
+	limit := o.ArchiveContainerBytes
+	if limitBytes != nil {
+		limit = *limitBytes
+	}
+	if limit > o.MaxArchiveContainerBytes {
+		limit = o.MaxArchiveContainerBytes
+	}
+	return limit
+}
+
+// archiveLogs tar 需要提前知道文件大小, 日志先缓存在 logSpool 中, 返回写入的日志大小
+func (h *PodHandler) archiveLogs(ctx context.Context, tw *tar.Writer, namespace, pod, filename string, opt *v1.PodLogOptions, until time.Time) (int64, error) {
+	out, err := h.cluster.Kubernetes().CoreV1().Pods(namespace).GetLogs(pod, opt).Stream(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	spool := &logSpool{}
+	defer spool.Close()
+
+	// limitBytes 由 kubelet 限制, 这里再限制一次, 避免临时文件无限增长
+	var r io.Reader = out
+	if opt.LimitBytes != nil {
+		r = io.LimitReader(out, *opt.LimitBytes)
+	}
+	size, err := copyLogsUntil(spool, r, until)
+	if err != nil {
+		return 0, err
+	}
+	content, err := spool.Reader()
+	if err != nil {
+		return 0, err
+	}
+	return size, writeTarFile(tw, filename, size, content)
+}
+
+// logSpool 日志较小时直接在内存中写入压缩包, 超过 logSpoolMemoryBytes 后才转存到临时文件
+type logSpool struct {
+	buf  bytes.Buffer
+	file *os.File
+}
+
+func (s *logSpool) Write(p []byte) (int, error) {
+	if s.file == nil && s.buf.Len()+len(p) > logSpoolMemoryBytes {
+		file, err := os.CreateTemp("", "kuber-logs-*")
+		if err != nil {
+			return 0, err
+		}
+		s.file = file
+		if _, err := s.buf.WriteTo(file); err != nil {
+			return 0, err
+		}
+	}
+	if s.file != nil {
+		return s.file.Write(p)
+	}
+	return s.buf.Write(p)
+}
+
+// Reader 从头读取缓存的日志
+func (s *logSpool) Reader() (io.Reader, error) {
+	if s.file == nil {
+		return &s.buf, nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.file, nil
+}
+
+func (s *logSpool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	_ = s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// copyLogsUntil 日志按照时间顺序输出, 遇到超过结束时间的行就停止
+func copyLogsUntil(w io.Writer, r io.Reader, until time.Time) (int64, error) {
+	if until.IsZero() {
+		return io.Copy(w, r)
+	}
+	var size int64
+	reader := bufio.NewReaderSize(r, maxLogLineBytes)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) > 0 {
+			if ts, _, found := strings.Cut(string(line), " "); found {
+				if t, perr := time.Parse(time.RFC3339Nano, ts); perr == nil && t.After(until) {
+					return size, nil
+				}
+			}
+			n, werr := w.Write(line)
+			size += int64(n)
+			if werr != nil {
+				return size, werr
+			}
+		}
+		switch {
+		case err == nil, errors.Is(err, bufio.ErrBufferFull):
+		case errors.Is(err, io.EOF):
+			return size, nil
+		default:
+			return size, err
+		}
+	}
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    path.Clean(name),
+		Size:    size,
+		Mode:    0644,
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err := io.CopyN(tw, r, size)
+	return err
+}
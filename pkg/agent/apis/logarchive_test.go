@@ -0,0 +1,118 @@
+package apis
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveContainerLimit(t *testing.T) {
+	int64p := func(n int64) *int64 { return &n }
+	o := &LogOptions{ArchiveContainerBytes: 10, MaxArchiveContainerBytes: 100, MaxArchiveBytes: 1000}
+	tests := []struct {
+		name       string
+		limitBytes *int64
+		want       int64
+	}{
+		{name: "default", want: 10},
+		{name: "requested", limitBytes: int64p(50), want: 50},
+		{name: "requested over max", limitBytes: int64p(500), want: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := archiveContainerLimit(tt.limitBytes, o); got != tt.want {
+				t.Errorf("archiveContainerLimit() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogOptionsValidate(t *testing.T) {
+	if err := NewDefaultLogOptions().Validate(); err != nil {
+		t.Errorf("default options: %v", err)
+	}
+	invalid := []*LogOptions{
+		{ArchiveContainerBytes: 0, MaxArchiveContainerBytes: 100, MaxArchiveBytes: 1000},
+		{ArchiveContainerBytes: 10, MaxArchiveContainerBytes: 100, MaxArchiveBytes: -1},
+		{ArchiveContainerBytes: 200, MaxArchiveContainerBytes: 100, MaxArchiveBytes: 1000},
+	}
+	for _, o := range invalid {
+		if err := o.Validate(); err == nil {
+			t.Errorf("Validate() %+v expect error", o)
+		}
+	}
+}
+
+func TestCopyLogsUntil(t *testing.T) {
+	logs := "2023-01-01T00:00:00Z a\n2023-01-01T00:00:01Z b\nnot a timestamp\n2023-01-01T00:00:02Z c\n"
+	tests := []struct {
+		name  string
+		until time.Time
+		want  string
+	}{
+		{name: "no until", want: logs},
+		{name: "until", until: time.Date(2023, 1, 1, 0, 0, 1, 0, time.UTC), want: "2023-01-01T00:00:00Z a\n2023-01-01T00:00:01Z b\nnot a timestamp\n"},
+		{name: "before all", until: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			size, err := copyLogsUntil(buf, strings.NewReader(logs), tt.until)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want || size != int64(len(tt.want)) {
+				t.Errorf("copyLogsUntil() = %q, %d, want %q", buf.String(), size, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogSpool(t *testing.T) {
+	tests := []struct {
+		name     string
+		writes   []int
+		wantFile bool
+	}{
+		{name: "memory", writes: []int{10, logSpoolMemoryBytes - 10}},
+		{name: "spill to file", writes: []int{10, logSpoolMemoryBytes}, wantFile: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spool := &logSpool{}
+			want := []byte{}
+			for i, n := range tt.writes {
+				p := bytes.Repeat([]byte{byte('a' + i)}, n)
+				if _, err := spool.Write(p); err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, p...)
+			}
+			if (spool.file != nil) != tt.wantFile {
+				t.Fatalf("spool file = %v, want file %v", spool.file, tt.wantFile)
+			}
+			r, err := spool.Reader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("spool content length = %d, want %d", len(got), len(want))
+			}
+			if err := spool.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantFile {
+				if _, err := os.Stat(spool.file.Name()); !os.IsNotExist(err) {
+					t.Errorf("temp file %s not removed", spool.file.Name())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package apis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/sunweiwe/kuber/pkg/agent/ws"
+	"github.com/sunweiwe/kuber/pkg/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	defaultLogTailLines = 1000
+	// 单行日志超过该长度时拆分成多个frame
+	maxLogLineBytes = 64 * 1024
+	// 聚合模式下最多同时读取的容器日志数量
+	maxLogStreams = 50
+	// 关键字高亮使用的终端颜色
+	logHighlightStart = "\x1b[1;31m"
+	logHighlightEnd   = "\x1b[0m"
+)
+
+// logTarget 一个容器的日志流
+type logTarget struct {
+	pod       string
+	container string
+	// 容器重启次数, 大于0时可以获取上一次的日志
+	restarts int32
+}
+
+type logFilter struct {
+	// 只保留包含关键字的行
+	keyword string
+	// 高亮的关键字
+	highlight string
+	// 聚合模式下在每行前加上 [pod/container]
+	prefix bool
+}
+
+// apply 返回处理后的行, 不满足过滤条件时返回 false
+func (f *logFilter) apply(target logTarget, line string) (string, bool) {
+	if f.keyword != "" && !strings.Contains(line, f.keyword) {
+		return "", false
+	}
+	if f.highlight != "" {
+		line = strings.ReplaceAll(line, f.highlight, logHighlightStart+f.highlight+logHighlightEnd)
+	}
+	if f.prefix {
+		line = "[" + target.pod + "/" + target.container + "] " + line
+	}
+	return line, true
+}
+
+// ContainerLogs 获取容器的stdout输出
+// @Tags        Agent.V1
+// @Summary     实时获取日志STDOUT输出(websocket)
+// @Description 实时获取日志STDOUT输出(websocket), 每一行日志是一个 frame. aggregate 模式下合并所有容器的日志, 指定 kind 和 workload 时合并工作负载下所有 pod 的日志
+// @Param       cluster      path     string true  "cluster"
+// @Param       namespace    path     string true  "namespace"
+// @Param       name         path     string true  "pod, 指定 kind 和 workload 时忽略"
+// @Param       container    query    string false "container, aggregate 模式下为空时合并所有容器"
+// @Param       stream       query    string true  "stream must be true"
+// @Param       follow       query    string false "follow, 默认 true"
+// @Param       tail         query    int    false "tail line (default 1000), -1 表示全部"
+// @Param       previous     query    bool   false "查看上一次退出的容器的日志"
+// @Param       sinceSeconds query    int    false "最近多少秒的日志"
+// @Param       sinceTime    query    string false "从该时间开始的日志, RFC3339"
+// @Param       timestamps   query    bool   false "每行前加上时间戳"
+// @Param       limitBytes   query    int    false "每个容器最多返回的字节数"
+// @Param       filter       query    string false "只返回包含关键字的行"
+// @Param       highlight    query    string false "高亮的关键字"
+// @Param       aggregate    query    bool   false "合并多个容器的日志, 每行前加上 [pod/container]"
+// @Param       kind         query    string false "Deployment/StatefulSet/DaemonSet/Job"
+// @Param       workload     query    string false "工作负载名称"
+// @Success     200          {object} object "ws"
+// @Router      /v1/proxy/cluster/{cluster}/custom/core/v1/namespaces/{namespace}/pods/{name}/actions/logs [get]
+// @Security    JWT
+func (h *PodHandler) ContainerLogs(c *gin.Context) {
+	logOpt, err := podLogOptions(c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	aggregate, _ := strconv.ParseBool(c.Query("aggregate"))
+	targets, err := h.logTargets(c, logOpt.Container, aggregate)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	if len(targets) > maxLogStreams {
+		NotOK(c, fmt.Errorf("too many containers (%d), at most %d containers can be aggregated", len(targets), maxLogStreams))
+		return
+	}
+	filter := &logFilter{
+		keyword:   c.Query("filter"),
+		highlight: c.Query("highlight"),
+		prefix:    aggregate,
+	}
+
+	conn, err := h.runtime.Load().Options.Websocket.Upgrader().Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Infof("Upgrade Websocket failed: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	// 客户端断开时停止读取日志
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	writer := &logFrameWriter{conn: conn}
+	namespace := c.Param("namespace")
+	wg := sync.WaitGroup{}
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target logTarget) {
+			defer wg.Done()
+			opt := logOpt.DeepCopy()
+			opt.Container = target.container
+			if err := h.streamLogs(ctx, namespace, target, opt, filter, writer); err != nil && ctx.Err() == nil {
+				msg := err.Error()
+				if filter.prefix {
+					msg = "[" + target.pod + "/" + target.container + "] " + msg
+				}
+				_ = writer.WriteLine(msg)
+			}
+		}(target)
+	}
+	wg.Wait()
+	_ = writer.Close()
+}
+
+func (h *PodHandler) streamLogs(ctx context.Context, namespace string, target logTarget, opt *v1.PodLogOptions, filter *logFilter, writer *logFrameWriter) error {
+	out, err := h.cluster.Kubernetes().CoreV1().Pods(namespace).GetLogs(target.pod, opt).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	return readLogLines(out, func(line string) error {
+		if content, ok := filter.apply(target, line); ok {
+			return writer.WriteLine(content)
+		}
+		return nil
+	})
+}
+
+// readLogLines 超过 maxLogLineBytes 的行分段返回, 分段不会切断多字节字符, 无效的字节替换为 U+FFFD
+func readLogLines(r io.Reader, fn func(line string) error) error {
+	reader := bufio.NewReaderSize(r, maxLogLineBytes)
+	var partial []byte
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(partial) > 0 {
+			line, partial = append(partial, line...), nil
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			line, partial = ws.SplitUTF8(line)
+		}
+		if len(line) > 0 {
+			if ferr := fn(strings.ToValidUTF8(strings.TrimRight(string(line), "\r\n"), string(utf8.RuneError))); ferr != nil {
+				return ferr
+			}
+		}
+		switch {
+		case err == nil, errors.Is(err, bufio.ErrBufferFull):
+		case errors.Is(err, io.EOF):
+			if len(partial) > 0 {
+				return fn(strings.ToValidUTF8(string(partial), string(utf8.RuneError)))
+			}
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// logTargets 解析需要读取的容器, 聚合模式下为空的container表示所有容器
+func (h *PodHandler) logTargets(c *gin.Context, container string, aggregate bool) ([]logTarget, error) {
+	ctx := c.Request.Context()
+	namespace := c.Param("namespace")
+
+	pods := []v1.Pod{}
+	if kind, workload := c.Query("kind"), c.Query("workload"); kind != "" && workload != "" {
+		if !aggregate {
+			return nil, fmt.Errorf("aggregate is required when kind and workload are specified")
+		}
+		selLabels, err := h.controllerLabel(ctx, namespace, kind, workload)
+		if err != nil {
+			return nil, err
+		}
+		if len(selLabels) == 0 {
+			return nil, fmt.Errorf("unsupported kind %q", kind)
+		}
+		podList := &v1.PodList{}
+		if err := h.cluster.GetClient().List(ctx, podList,
+			client.InNamespace(namespace),
+			client.MatchingLabelsSelector{Selector: labels.SelectorFromSet(selLabels)},
+		); err != nil {
+			return nil, err
+		}
+		pods = podList.Items
+	} else {
+		pod := v1.Pod{}
+		if err := h.cluster.GetClient().Get(ctx, types.NamespacedName{Namespace: namespace, Name: c.Param("name")}, &pod); err != nil {
+			return nil, err
+		}
+		pods = append(pods, pod)
+	}
+	return podLogTargets(pods, container, aggregate)
+}
+
+func podLogTargets(pods []v1.Pod, container string, aggregate bool) ([]logTarget, error) {
+	targets := []logTarget{}
+	for _, pod := range pods {
+		restarts := map[string]int32{}
+		for _, status := range pod.Status.InitContainerStatuses {
+			restarts[status.Name] = status.RestartCount
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			restarts[status.Name] = status.RestartCount
+		}
+		if !aggregate || container != "" {
+			targets = append(targets, logTarget{pod: pod.Name, container: container, restarts: restarts[container]})
+			continue
+		}
+		// init 容器排在前面, 与启动顺序一致
+		for _, containers := range [][]v1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+			for _, ctr := range containers {
+				targets = append(targets, logTarget{pod: pod.Name, container: ctr.Name, restarts: restarts[ctr.Name]})
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no container found")
+	}
+	return targets, nil
+}
+
+func podLogOptions(c *gin.Context) (*v1.PodLogOptions, error) {
+	opt := &v1.PodLogOptions{
+		Container: paramFromHeaderOrQuery(c, "container", ""),
+		Follow:    paramFromHeaderOrQuery(c, "follow", "true") == "true",
+	}
+	for key, into := range map[string]*bool{"previous": &opt.Previous, "timestamps": &opt.Timestamps} {
+		if v := c.Query(key); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", key, v)
+			}
+			*into = b
+		}
+	}
+	for key, into := range map[string]**int64{"sinceSeconds": &opt.SinceSeconds, "limitBytes": &opt.LimitBytes} {
+		if v := c.Query(key); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid %s %q", key, v)
+			}
+			*into = &n
+		}
+	}
+	if v := c.Query("sinceTime"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sinceTime %q, must be RFC3339", v)
+		}
+		opt.SinceTime = &metav1.Time{Time: t}
+	}
+	if opt.SinceSeconds != nil && opt.SinceTime != nil {
+		return nil, fmt.Errorf("at most one of sinceSeconds or sinceTime may be specified")
+	}
+
+	// 指定了开始时间时默认不限制行数
+	tail := paramFromHeaderOrQuery(c, "tail", "")
+	if tail == "" && opt.SinceSeconds == nil && opt.SinceTime == nil {
+		tail = strconv.Itoa(defaultLogTailLines)
+	}
+	if tail != "" {
+		n, err := strconv.ParseInt(tail, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tail %q", tail)
+		}
+		if n >= 0 {
+			opt.TailLines = &n
+		}
+	}
+	return opt, nil
+}
+
+// logFrameWriter 每一行写一个 websocket frame, 多个日志流并发写入
+type logFrameWriter struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+// WriteLine 文本消息必须是有效的 UTF-8, 否则浏览器会关闭连接
+func (w *logFrameWriter) WriteLine(line string) error {
+	if !utf8.ValidString(line) {
+		line = strings.ToValidUTF8(line, string(utf8.RuneError))
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conn.WriteMessage(websocket.TextMessage, []byte(line))
+}
+
+func (w *logFrameWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
@@ -0,0 +1,196 @@
+package apis
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLogFilterApply(t *testing.T) {
+	target := logTarget{pod: "web-0", container: "app"}
+	tests := []struct {
+		name   string
+		filter logFilter
+		line   string
+		want   string
+		wantOK bool
+	}{
+		{name: "no filter", line: "hello", want: "hello", wantOK: true},
+		{name: "keyword matched", filter: logFilter{keyword: "err"}, line: "an error", want: "an error", wantOK: true},
+		{name: "keyword not matched", filter: logFilter{keyword: "err"}, line: "ok"},
+		{name: "highlight", filter: logFilter{highlight: "err"}, line: "err and err", want: logHighlightStart + "err" + logHighlightEnd + " and " + logHighlightStart + "err" + logHighlightEnd, wantOK: true},
+		{name: "prefix", filter: logFilter{prefix: true}, line: "hello", want: "[web-0/app] hello", wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.filter.apply(target, tt.line)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("apply() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestPodLogTargets(t *testing.T) {
+	pod := func(name string, containers ...string) v1.Pod {
+		p := v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		for i, c := range containers {
+			p.Spec.Containers = append(p.Spec.Containers, v1.Container{Name: c})
+			p.Status.ContainerStatuses = append(p.Status.ContainerStatuses, v1.ContainerStatus{Name: c, RestartCount: int32(i)})
+		}
+		return p
+	}
+	pods := []v1.Pod{pod("web-0", "app", "sidecar"), pod("web-1", "app", "sidecar")}
+	initPod := pod("job-0", "main")
+	initPod.Spec.InitContainers = []v1.Container{{Name: "init"}}
+	initPod.Status.InitContainerStatuses = []v1.ContainerStatus{{Name: "init", RestartCount: 2}}
+	tests := []struct {
+		name      string
+		container string
+		aggregate bool
+		pods      []v1.Pod
+		want      []logTarget
+		wantErr   bool
+	}{
+		{
+			name:      "single container",
+			container: "sidecar",
+			pods:      pods[:1],
+			want:      []logTarget{{pod: "web-0", container: "sidecar", restarts: 1}},
+		},
+		{
+			name:      "aggregate all containers",
+			aggregate: true,
+			pods:      pods,
+			want: []logTarget{
+				{pod: "web-0", container: "app"}, {pod: "web-0", container: "sidecar", restarts: 1},
+				{pod: "web-1", container: "app"}, {pod: "web-1", container: "sidecar", restarts: 1},
+			},
+		},
+		{
+			name:      "aggregate one container of workload",
+			container: "app",
+			aggregate: true,
+			pods:      pods,
+			want:      []logTarget{{pod: "web-0", container: "app"}, {pod: "web-1", container: "app"}},
+		},
+		{
+			name:      "aggregate with init containers",
+			aggregate: true,
+			pods:      []v1.Pod{initPod},
+			want:      []logTarget{{pod: "job-0", container: "init", restarts: 2}, {pod: "job-0", container: "main"}},
+		},
+		{
+			name:      "init container",
+			container: "init",
+			pods:      []v1.Pod{initPod},
+			want:      []logTarget{{pod: "job-0", container: "init", restarts: 2}},
+		},
+		{
+			name:      "no pods",
+			aggregate: true,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := podLogTargets(tt.pods, tt.container, tt.aggregate)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("podLogTargets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("podLogTargets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPodLogOptions(t *testing.T) {
+	int64p := func(n int64) *int64 { return &n }
+	tests := []struct {
+		query   string
+		want    *v1.PodLogOptions
+		wantErr bool
+	}{
+		{
+			query: "",
+			want:  &v1.PodLogOptions{Follow: true, TailLines: int64p(defaultLogTailLines)},
+		},
+		{
+			query: "container=app&follow=false&tail=-1&previous=true&timestamps=true&limitBytes=1024",
+			want:  &v1.PodLogOptions{Container: "app", Previous: true, Timestamps: true, LimitBytes: int64p(1024)},
+		},
+		{
+			query: "sinceSeconds=60",
+			want:  &v1.PodLogOptions{Follow: true, SinceSeconds: int64p(60)},
+		},
+		{
+			query: "sinceSeconds=60&tail=10",
+			want:  &v1.PodLogOptions{Follow: true, SinceSeconds: int64p(60), TailLines: int64p(10)},
+		},
+		{query: "sinceSeconds=60&sinceTime=2023-01-01T00:00:00Z", wantErr: true},
+		{query: "sinceSeconds=0", wantErr: true},
+		{query: "sinceTime=yesterday", wantErr: true},
+		{query: "previous=maybe", wantErr: true},
+		{query: "tail=ten", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/logs?"+tt.query, nil)
+			got, err := podLogOptions(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("podLogOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("podLogOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadLogLines(t *testing.T) {
+	long := strings.Repeat("a", maxLogLineBytes-1)
+	tests := []struct {
+		name string
+		logs string
+		want []string
+	}{
+		{name: "lines", logs: "a\r\nb\nlast", want: []string{"a", "b", "last"}},
+		// 缓冲区在 "中" 的第一个字节处满, 整个字符放到下一段
+		{name: "long line", logs: long + "中b\nc\n", want: []string{long, "中b", "c"}},
+		{name: "invalid utf8", logs: "ok\xff\n", want: []string{"ok\uFFFD"}},
+		{name: "incomplete rune at eof", logs: long + "\xe4", want: []string{long, "\uFFFD"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			err := readLogLines(strings.NewReader(tt.logs), func(line string) error {
+				if !utf8.ValidString(line) {
+					t.Errorf("line %q is not valid utf8", line)
+				}
+				got = append(got, line)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readLogLines() = %d lines %.20q, want %d lines %.20q", len(got), got, len(tt.want), tt.want)
+			}
+		})
+	}
+
+	stop := errors.New("stop")
+	if err := readLogLines(strings.NewReader("a\nb\n"), func(string) error { return stop }); !errors.Is(err, stop) {
+		t.Errorf("readLogLines() error = %v, want %v", err, stop)
+	}
+}
@@ -0,0 +1,375 @@
+package apis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/sunweiwe/kuber/pkg/agent/cluster"
+	"github.com/sunweiwe/kuber/pkg/log"
+	"github.com/sunweiwe/kuber/pkg/utils/loki"
+)
+
+const (
+	lokiNamespaceLabel = "namespace"
+	lokiDefaultLimit   = 100
+	lokiMaxLimit       = 5000
+)
+
+type LokiHandler struct {
+	cluster cluster.Interface
+	runtime *Runtime
+}
+
+type lokiResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+type LogEntry struct {
+	// 纳秒时间戳
+	Timestamp string            `json:"timestamp"`
+	Line      string            `json:"line"`
+	Labels    map[string]string `json:"labels"`
+}
+
+// LogQueryResult streams 类型的结果展开为按时间排序的日志行, 其他类型原样返回
+type LogQueryResult struct {
+	ResultType string          `json:"resultType"`
+	Entries    []LogEntry      `json:"entries,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	// 下一页的查询范围, 为空时没有更多数据
+	Next *LogPage `json:"next,omitempty"`
+}
+
+type LogPage struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+// @Tags        Agent.V1
+// @Summary     Loki 范围查询
+// @Description Loki 范围查询, 查询会被限制在调用方租户/环境的namespace内
+// @Accept      json
+// @Produce     json
+// @Param       cluster   path     string                                       true  "cluster"
+// @Param       query     query    string                                       true  "logql"
+// @Param       start     query    string                                       false "开始时间, RFC3339 或纳秒时间戳"
+// @Param       end       query    string                                       false "结束时间, RFC3339 或纳秒时间戳"
+// @Param       step      query    string                                       false "step"
+// @Param       limit     query    int                                          false "limit, 默认100"
+// @Param       direction query    string                                       false "forward/backward, 默认backward"
+// @Success     200       {object} handlers.ResponseStruct{Data=LogQueryResult} "logs"
+// @Router      /v1/proxy/cluster/{cluster}/custom/loki/v1/queryrange [get]
+// @Security    JWT
+func (h *LokiHandler) QueryRange(c *gin.Context) {
+	query, err := h.scopedQuery(c, c.Query("query"))
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	limit := lokiLimit(c)
+	direction := c.DefaultQuery("direction", "backward")
+	params := url.Values{
+		"query":     {query},
+		"limit":     {strconv.Itoa(limit)},
+		"direction": {direction},
+	}
+	for _, key := range []string{"start", "end", "step", "interval"} {
+		if v := c.Query(key); v != "" {
+			params.Set(key, v)
+		}
+	}
+	resp := &lokiResponse{}
+	if err := h.get(c.Request.Context(), "/loki/api/v1/query_range", params, resp); err != nil {
+		NotOK(c, err)
+		return
+	}
+	ret, err := convertLokiResult(resp, limit, direction)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	if ret.Next != nil {
+		if direction == "backward" {
+			ret.Next.Start = c.Query("start")
+		} else {
+			ret.Next.End = c.Query("end")
+		}
+	}
+	OK(c, ret)
+}
+
+// @Tags        Agent.V1
+// @Summary     Loki 即时查询
+// @Description Loki 即时查询, 查询会被限制在调用方租户/环境的namespace内
+// @Accept      json
+// @Produce     json
+// @Param       cluster   path     string                                       true  "cluster"
+// @Param       query     query    string                                       true  "logql"
+// @Param       time      query    string                                       false "查询时间, RFC3339 或纳秒时间戳"
+// @Param       limit     query    int                                          false "limit, 默认100"
+// @Param       direction query    string                                       false "forward/backward, 默认backward"
+// @Success     200       {object} handlers.ResponseStruct{Data=LogQueryResult} "logs"
+// @Router      /v1/proxy/cluster/{cluster}/custom/loki/v1/query [get]
+// @Security    JWT
+func (h *LokiHandler) Query(c *gin.Context) {
+	query, err := h.scopedQuery(c, c.Query("query"))
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	limit := lokiLimit(c)
+	params := url.Values{
+		"query":     {query},
+		"limit":     {strconv.Itoa(limit)},
+		"direction": {c.DefaultQuery("direction", "backward")},
+	}
+	if v := c.Query("time"); v != "" {
+		params.Set("time", v)
+	}
+	resp := &lokiResponse{}
+	if err := h.get(c.Request.Context(), "/loki/api/v1/query", params, resp); err != nil {
+		NotOK(c, err)
+		return
+	}
+	ret, err := convertLokiResult(resp, limit, params.Get("direction"))
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	// 即时查询不分页
+	ret.Next = nil
+	OK(c, ret)
+}
+
+// @Tags        Agent.V1
+// @Summary     Loki 标签列表
+// @Description Loki 标签列表
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                 true  "cluster"
+// @Param       start   query    string                                 false "开始时间"
+// @Param       end     query    string                                 false "结束时间"
+// @Success     200     {object} handlers.ResponseStruct{Data=[]string} "labels"
+// @Router      /v1/proxy/cluster/{cluster}/custom/loki/v1/labels [get]
+// @Security    JWT
+func (h *LokiHandler) Labels(c *gin.Context) {
+	h.labels(c, "/loki/api/v1/labels")
+}
+
+// @Tags        Agent.V1
+// @Summary     Loki 标签值列表
+// @Description Loki 标签值列表
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                 true  "cluster"
+// @Param       name    path     string                                 true  "label name"
+// @Param       start   query    string                                 false "开始时间"
+// @Param       end     query    string                                 false "结束时间"
+// @Success     200     {object} handlers.ResponseStruct{Data=[]string} "label values"
+// @Router      /v1/proxy/cluster/{cluster}/custom/loki/v1/labels/{name} [get]
+// @Security    JWT
+func (h *LokiHandler) LabelValues(c *gin.Context) {
+	h.labels(c, "/loki/api/v1/label/"+url.PathEscape(c.Param("name"))+"/values")
+}
+
+func (h *LokiHandler) labels(c *gin.Context, path string) {
+	params := url.Values{}
+	for _, key := range []string{"start", "end"} {
+		if v := c.Query(key); v != "" {
+			params.Set(key, v)
+		}
+	}
+	// 受限的调用方只能看到自己namespace下的标签
+	query, err := h.scopedQuery(c, "{}")
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	if query != "{}" {
+		params.Set("query", query)
+	}
+	ret := struct {
+		Data []string `json:"data"`
+	}{}
+	if err := h.get(c.Request.Context(), path, params, &ret); err != nil {
+		NotOK(c, err)
+		return
+	}
+	OK(c, ret.Data)
+}
+
+// @Tags        Agent.V1
+// @Summary     Loki 实时日志(websocket)
+// @Description Loki 实时日志(websocket), 消息格式与 loki tail 接口相同
+// @Param       cluster   path     string true  "cluster"
+// @Param       query     query    string true  "logql"
+// @Param       start     query    string false "开始时间"
+// @Param       limit     query    int    false "limit"
+// @Param       delay_for query    int    false "延迟的秒数"
+// @Param       stream    query    string true  "must be true"
+// @Success     200       {object} object "ws"
+// @Router      /v1/proxy/cluster/{cluster}/custom/loki/v1/tail [get]
+// @Security    JWT
+func (h *LokiHandler) Tail(c *gin.Context) {
+	query, err := h.scopedQuery(c, c.Query("query"))
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	params := url.Values{
+		"query": {query},
+		"limit": {strconv.Itoa(lokiLimit(c))},
+	}
+	for _, key := range []string{"start", "delay_for"} {
+		if v := c.Query(key); v != "" {
+			params.Set(key, v)
+		}
+	}
+	target, err := h.url("/loki/api/v1/tail", params)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	target.Scheme = strings.Replace(target.Scheme, "http", "ws", 1)
+
+	upstream, resp, err := websocket.DefaultDialer.DialContext(c.Request.Context(), target.String(), nil)
+	if err != nil {
+		if resp != nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			err = fmt.Errorf("%v: %s", err, body)
+		}
+		NotOK(c, err)
+		return
+	}
+	defer upstream.Close()
+
+	conn, err := h.runtime.Load().Options.Websocket.Upgrader().Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Error(err, "upgrade websocket")
+		return
+	}
+	defer conn.Close()
+
+	// 客户端断开后关闭上游连接
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				upstream.Close()
+				return
+			}
+		}
+	}()
+	for {
+		messageType, data, err := upstream.ReadMessage()
+		if err != nil {
+			_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+		if err := conn.WriteMessage(messageType, data); err != nil {
+			return
+		}
+	}
+}
+
+// scopedQuery 在 LogQL 中追加调用方可以访问的namespace
+func (h *LokiHandler) scopedQuery(c *gin.Context, query string) (string, error) {
+	if query == "" {
+		return "", fmt.Errorf("query is required")
+	}
+	scope, err := scopeFromRequest(c.Request.Context(), h.cluster.GetClient(), c)
+	if err != nil {
+		return "", err
+	}
+	if scope.Unlimited() {
+		return query, nil
+	}
+	if len(scope.Namespaces) == 0 {
+		return "", fmt.Errorf("tenant %s has no namespace in this cluster", scope.Tenant)
+	}
+	return loki.InjectMatcher(query, loki.NamespaceMatcher(lokiNamespaceLabel, scope.Namespaces))
+}
+
+func (h *LokiHandler) url(path string, params url.Values) (*url.URL, error) {
+	server := h.runtime.Load().Options.LokiServer
+	if server == "" {
+		return nil, fmt.Errorf("loki server is not configured")
+	}
+	return upstreamURL(server, path, params)
+}
+
+func (h *LokiHandler) get(ctx context.Context, path string, params url.Values, into interface{}) error {
+	u, err := h.url(path, params)
+	if err != nil {
+		return err
+	}
+	return getJSON(ctx, u, into)
+}
+
+func lokiLimit(c *gin.Context) int {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 {
+		return lokiDefaultLimit
+	}
+	if limit > lokiMaxLimit {
+		return lokiMaxLimit
+	}
+	return limit
+}
+
+func convertLokiResult(resp *lokiResponse, limit int, direction string) (*LogQueryResult, error) {
+	ret := &LogQueryResult{ResultType: resp.Data.ResultType}
+	if resp.Data.ResultType != "streams" {
+		ret.Result = resp.Data.Result
+		return ret, nil
+	}
+
+	streams := []lokiStream{}
+	if err := json.Unmarshal(resp.Data.Result, &streams); err != nil {
+		return nil, err
+	}
+	entries := []LogEntry{}
+	for _, stream := range streams {
+		for _, value := range stream.Values {
+			entries = append(entries, LogEntry{Timestamp: value[0], Line: value[1], Labels: stream.Stream})
+		}
+	}
+	forward := direction == "forward"
+	sort.SliceStable(entries, func(i, j int) bool {
+		ti, _ := strconv.ParseInt(entries[i].Timestamp, 10, 64)
+		tj, _ := strconv.ParseInt(entries[j].Timestamp, 10, 64)
+		if forward {
+			return ti < tj
+		}
+		return ti > tj
+	})
+	ret.Entries = entries
+
+	// loki 的 start 包含, end 不包含
+	if len(entries) >= limit {
+		last, _ := strconv.ParseInt(entries[len(entries)-1].Timestamp, 10, 64)
+		if forward {
+			ret.Next = &LogPage{Start: strconv.FormatInt(last+1, 10)}
+		} else {
+			ret.Next = &LogPage{End: strconv.FormatInt(last, 10)}
+		}
+	}
+	return ret, nil
+}
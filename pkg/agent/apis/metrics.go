@@ -0,0 +1,182 @@
+package apis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/common/model"
+	"github.com/sunweiwe/kuber/pkg/api/kuber/v1beta1"
+	"github.com/sunweiwe/kuber/pkg/utils/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type MetricResult struct {
+	Query string      `json:"query"`
+	Unit  string      `json:"unit"`
+	Data  model.Value `json:"data"`
+}
+
+// @Tags        Agent.V1
+// @Summary     指标模板列表
+// @Description 每种资源支持的指标模板
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                            true "cluster"
+// @Success     200     {object} handlers.ResponseStruct{Data=map[string][]string} "templates"
+// @Router      /v1/proxy/cluster/{cluster}/custom/prometheus/v1/metrics [get]
+// @Security    JWT
+func (p *prometheusHandler) MetricTemplates(c *gin.Context) {
+	OK(c, prometheus.ListMetricTemplates())
+}
+
+// @Tags        Agent.V1
+// @Summary     按照模板查询资源指标
+// @Description 按照模板查询 pods/deployments/statefulsets/daemonsets 的指标, 只能查询调用方范围内的namespace
+// @Accept      json
+// @Produce     json
+// @Param       cluster   path     string                                     true  "cluster"
+// @Param       namespace path     string                                     true  "namespace"
+// @Param       resource  path     string                                     true  "pods/deployments/statefulsets/daemonsets"
+// @Param       name      path     string                                     true  "name"
+// @Param       metric    path     string                                     true  "cpu/memory/network-in/network-out"
+// @Param       range     query    string                                     false "时间范围, 如 1h, 为空时查询当前值"
+// @Param       step      query    string                                     false "步长"
+// @Success     200       {object} handlers.ResponseStruct{Data=MetricResult} "metric"
+// @Router      /v1/proxy/cluster/{cluster}/custom/prometheus/v1/metrics/{resource}/{namespace}/{name}/{metric} [get]
+// @Security    JWT
+func (p *prometheusHandler) NamespacedMetric(resource string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := prometheus.MetricQuery{
+			Resource:  resource,
+			Metric:    c.Param("metric"),
+			Namespace: c.Param("namespace"),
+			Name:      c.Param("name"),
+		}
+		scope, err := scopeFromRequest(c.Request.Context(), p.cluster.GetClient(), c)
+		if err != nil {
+			NotOK(c, err)
+			return
+		}
+		if !scope.Contains(q.Namespace) {
+			NotOK(c, scope.Forbidden("namespaces", q.Namespace))
+			return
+		}
+		p.metric(c, q)
+	}
+}
+
+// @Tags        Agent.V1
+// @Summary     按照模板查询资源指标
+// @Description 按照模板查询 nodes/namespaces/environments/tenants 的指标, 只能查询调用方范围内的资源
+// @Accept      json
+// @Produce     json
+// @Param       cluster  path     string                                     true  "cluster"
+// @Param       resource path     string                                     true  "nodes/namespaces/environments/tenants"
+// @Param       name     path     string                                     true  "name"
+// @Param       metric   path     string                                     true  "cpu/memory/network-in/network-out"
+// @Param       range    query    string                                     false "时间范围, 如 1h, 为空时查询当前值"
+// @Param       step     query    string                                     false "步长"
+// @Success     200      {object} handlers.ResponseStruct{Data=MetricResult} "metric"
+// @Router      /v1/proxy/cluster/{cluster}/custom/prometheus/v1/metrics/{resource}/{name}/{metric} [get]
+// @Security    JWT
+func (p *prometheusHandler) Metric(c *gin.Context) {
+	q := prometheus.MetricQuery{
+		Resource: c.Param("resource"),
+		Metric:   c.Param("metric"),
+		Name:     c.Param("name"),
+	}
+	if prometheus.IsNamespacedMetricResource(q.Resource) {
+		NotOK(c, fmt.Errorf("namespace is required for %s", q.Resource))
+		return
+	}
+	ctx := c.Request.Context()
+	scope, err := scopeFromRequest(ctx, p.cluster.GetClient(), c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+
+	switch q.Resource {
+	case "nodes":
+		// 节点是集群级别的资源, 租户内的用户不能查看
+		if !scope.Unlimited() {
+			NotOK(c, scope.Forbidden(q.Resource, q.Name))
+			return
+		}
+	case "namespaces":
+		if !scope.Contains(q.Name) {
+			NotOK(c, scope.Forbidden(q.Resource, q.Name))
+			return
+		}
+	case "environments":
+		env := &v1beta1.Environment{}
+		if err := p.cluster.GetClient().Get(ctx, types.NamespacedName{Name: q.Name}, env); err != nil {
+			NotOK(c, err)
+			return
+		}
+		if !scope.Contains(env.Spec.Namespace) {
+			NotOK(c, scope.Forbidden(q.Resource, q.Name))
+			return
+		}
+		q.Namespaces = []string{env.Spec.Namespace}
+	case "tenants":
+		if !scope.Unlimited() && scope.Tenant != q.Name {
+			NotOK(c, scope.Forbidden(q.Resource, q.Name))
+			return
+		}
+		envs := &v1beta1.EnvironmentList{}
+		if err := p.cluster.GetClient().List(ctx, envs); err != nil {
+			NotOK(c, err)
+			return
+		}
+		for _, env := range envs.Items {
+			if env.Spec.Tenant == q.Name && env.Spec.Namespace != "" && scope.Contains(env.Spec.Namespace) {
+				q.Namespaces = append(q.Namespaces, env.Spec.Namespace)
+			}
+		}
+	}
+	p.metric(c, q)
+}
+
+func (p *prometheusHandler) metric(c *gin.Context, q prometheus.MetricQuery) {
+	query, err := prometheus.RenderMetricTemplate(q)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+
+	ctx, cancel := p.context(c)
+	defer cancel()
+
+	var data model.Value
+	if rangeStr := c.Query("range"); rangeStr != "" {
+		d, err := time.ParseDuration(rangeStr)
+		if err != nil || d <= 0 {
+			NotOK(c, fmt.Errorf("invalid range %q", rangeStr))
+			return
+		}
+		now := time.Now()
+		r, err := parsePromRange(
+			now.Add(-d).Format(time.RFC3339Nano),
+			now.Format(time.RFC3339Nano),
+			c.Query("step"),
+		)
+		if err != nil {
+			NotOK(c, err)
+			return
+		}
+		data, _, err = p.api().QueryRange(ctx, query, r)
+		if err != nil {
+			NotOK(c, err)
+			return
+		}
+	} else {
+		data, _, err = p.api().Query(ctx, query, time.Now())
+		if err != nil {
+			NotOK(c, err)
+			return
+		}
+	}
+	OK(c, MetricResult{Query: query, Unit: prometheus.MetricUnits[q.Metric], Data: data})
+}
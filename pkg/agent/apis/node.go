@@ -1,109 +1,394 @@
 package apis
 
 import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
 	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/agent/cluster"
+	"github.com/sunweiwe/kuber/pkg/log"
+	"github.com/sunweiwe/kuber/pkg/service/handlers"
 	corev1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
-	"k8s.io/apimachinery/pkg/fields"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/util/retry"
 	resourceHelper "k8s.io/kubectl/pkg/util/resource"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type NodeHandler struct {
-	C client.Client
+	C       client.Client
+	cluster cluster.Interface
+	runtime *Runtime
 }
 
+// metaForm 只修改给出的 key, 不在表单中的 key 保持不变
 type metaForm struct {
+	// 新增或者修改
 	Labels      map[string]string
 	Annotations map[string]string
+	// 删除
+	RemoveLabels      []string
+	RemoveAnnotations []string
 }
 
 // @Tags        Agent.V1
 // @Summary     修改node的元数据,label和annotations
-// @Description 修改node的元数据,label和annotations
+// @Description 新增、修改或者删除 node 的 label 和 annotation, 不能修改 kubernetes.io 和 k8s.io 的系统 key
+// @Description name 为 _ 时修改 labelSelector 选择的所有节点, dryRun 为 true 时只返回变化
 // @Accept      json
 // @Produce     json
-// @Param       param   body     metaForm                             true "表单"`
-// @Param       name    path     string                               true "name"
-// @Param       cluster path     string                               true "cluster"
-// @Success     200     {object} handlers.ResponseStruct{Data=object} "Node"
+// @Param       param         body     metaForm                                 true  "表单"`
+// @Param       name          path     string                                   true  "name"
+// @Param       cluster       path     string                                   true  "cluster"
+// @Param       labelSelector query    string                                   false "name 为 _ 时选择节点"
+// @Param       dryRun        query    bool                                     false "只返回变化"
+// @Success     200           {object} handlers.ResponseStruct{Data=[]NodeDiff} "NodeDiff"
 // @Router      /v1/proxy/cluster/{cluster}/custom/core/v1/nodes/{name}/actions/metadata [patch]
 // @Security    JWT
 func (h *NodeHandler) PatchNodeLabelOrAnnotations(c *gin.Context) {
-	name := c.Param("name")
 	formData := metaForm{}
 	if err := c.BindJSON(&formData); err != nil {
 		NotOK(c, err)
 		return
 	}
-
-	data := &corev1.Node{}
-	if err := h.C.Get(c.Request.Context(),
-		types.NamespacedName{Name: name}, data); err != nil {
+	if err := formData.validate(); err != nil {
 		NotOK(c, err)
 		return
 	}
-	node := data.DeepCopy()
-
-	node.SetLabels(formData.Labels)
-	node.SetAnnotations(formData.Annotations)
+	h.patchNodes(c, func(node *corev1.Node, diff *NodeDiff) error {
+		var labelProtected, annotationProtected []string
+		node.Labels, diff.Labels, labelProtected = patchMap(node.Labels, formData.Labels, formData.RemoveLabels)
+		node.Annotations, diff.Annotations, annotationProtected = patchMap(node.Annotations, formData.Annotations, formData.RemoveAnnotations)
+		return protectedError(node.Name, append(labelProtected, annotationProtected...))
+	})
+}
 
-	if err := h.C.Update(c, node); err != nil {
-		NotOK(c, err)
-		return
+func (f *metaForm) validate() error {
+	errs := []string{}
+	for key, value := range f.Labels {
+		errs = append(errs, validation.IsQualifiedName(key)...)
+		errs = append(errs, validation.IsValidLabelValue(value)...)
 	}
-	OK(c, node)
+	for key := range f.Annotations {
+		errs = append(errs, validation.IsQualifiedName(strings.ToLower(key))...)
+	}
+	if len(errs) > 0 {
+		return apiErrors.NewBadRequest(strings.Join(errs, "; "))
+	}
+	return nil
 }
 
+// taintForm 按照 key 和 effect 匹配污点
 type taintForm struct {
+	// 新增或者修改 value
 	Taints []corev1.Taint
+	// effect 为空时删除 key 的所有污点
+	RemoveTaints []corev1.Taint
 }
 
 // @Tags        Agent.V1
 // @Summary     修改节点污点
-// @Description 修改节点污点
+// @Description 新增、修改或者删除节点污点, 不能修改 node.kubernetes.io 等系统污点
+// @Description name 为 _ 时修改 labelSelector 选择的所有节点, dryRun 为 true 时只返回变化
 // @Accept      json
 // @Produce     json
-// @Param       param   body     taintForm                            true "表单"`
-// @Param       name    path     string                               true "name"
-// @Param       cluster path     string                               true "cluster"
-// @Success     200     {object} handlers.ResponseStruct{Data=object} "Node"
+// @Param       param         body     taintForm                                true  "表单"`
+// @Param       name          path     string                                   true  "name"
+// @Param       cluster       path     string                                   true  "cluster"
+// @Param       labelSelector query    string                                   false "name 为 _ 时选择节点"
+// @Param       dryRun        query    bool                                     false "只返回变化"
+// @Success     200           {object} handlers.ResponseStruct{Data=[]NodeDiff} "NodeDiff"
 // @Router      /v1/proxy/cluster/{cluster}/custom/core/v1/nodes/{name}/actions/taint [patch]
 // @Security    JWT
 func (h *NodeHandler) PatchNodeTaint(c *gin.Context) {
-	name := c.Param("name")
 	formData := taintForm{}
 	if err := c.BindJSON(&formData); err != nil {
 		NotOK(c, err)
 		return
 	}
-
-	data := &corev1.Node{}
-	if err := h.C.Get(c.Request.Context(),
-		types.NamespacedName{Name: name}, data); err != nil {
+	if err := formData.validate(); err != nil {
 		NotOK(c, err)
 		return
 	}
-	node := data.DeepCopy()
-	node.Spec.Taints = formData.Taints
+	h.patchNodes(c, func(node *corev1.Node, diff *NodeDiff) error {
+		var protected []string
+		node.Spec.Taints, diff.Taints, protected = patchTaints(node.Spec.Taints, formData.Taints, formData.RemoveTaints)
+		return protectedError(node.Name, protected)
+	})
+}
 
-	if err := h.C.Update(c, node); err != nil {
+func (f *taintForm) validate() error {
+	errs := []string{}
+	for _, taint := range f.Taints {
+		errs = append(errs, validation.IsQualifiedName(taint.Key)...)
+		errs = append(errs, validation.IsValidLabelValue(taint.Value)...)
+		switch taint.Effect {
+		case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			errs = append(errs, fmt.Sprintf("invalid effect %q of taint %s", taint.Effect, taint.Key))
+		}
+	}
+	if len(errs) > 0 {
+		return apiErrors.NewBadRequest(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Change 一个 key 的变化, 污点的 key 为 key:effect
+type Change struct {
+	Op  string `json:"op"`
+	Key string `json:"key"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+const (
+	ChangeAdd    = "add"
+	ChangeUpdate = "update"
+	ChangeRemove = "remove"
+)
+
+// NodeDiff 每个节点的变化, 失败时 Error 不为空
+type NodeDiff struct {
+	Node        string   `json:"node"`
+	Labels      []Change `json:"labels,omitempty"`
+	Annotations []Change `json:"annotations,omitempty"`
+	Taints      []Change `json:"taints,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+func (d *NodeDiff) empty() bool {
+	return len(d.Labels) == 0 && len(d.Annotations) == 0 && len(d.Taints) == 0
+}
+
+// patchNodes 使用带 resourceVersion 的 merge patch 修改节点, 冲突时重新读取后重试
+func (h *NodeHandler) patchNodes(c *gin.Context, mutate func(node *corev1.Node, diff *NodeDiff) error) {
+	ctx := c.Request.Context()
+	if err := h.checkNodeAccess(c, c.Param("name")); err != nil {
 		NotOK(c, err)
 		return
 	}
-	OK(c, node)
+	names, err := h.targetNodes(c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(c.Query("dryRun"))
+
+	nodes := h.cluster.Kubernetes().CoreV1().Nodes()
+	results := make([]NodeDiff, 0, len(names))
+	var lastErr error
+	for _, name := range names {
+		diff := NodeDiff{Node: name}
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			diff = NodeDiff{Node: name}
+			node, err := nodes.Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			original := node.DeepCopy()
+			if err := mutate(node, &diff); err != nil {
+				return err
+			}
+			if diff.empty() || dryRun {
+				return nil
+			}
+			data, err := client.MergeFromWithOptions(original, client.MergeFromWithOptimisticLock{}).Data(node)
+			if err != nil {
+				return err
+			}
+			_, err = nodes.Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{})
+			return err
+		})
+		if err != nil {
+			diff.Error, lastErr = err.Error(), err
+		} else if !diff.empty() && !dryRun {
+			log.Info("patch node", "node", name, "user", c.GetHeader(HeaderUser), "labels", len(diff.Labels),
+				"annotations", len(diff.Annotations), "taints", len(diff.Taints))
+		}
+		results = append(results, diff)
+	}
+	if lastErr != nil {
+		if len(names) == 1 {
+			NotOK(c, lastErr)
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, handlers.ResponseStruct{Message: lastErr.Error(), Data: results})
+		return
+	}
+	OK(c, results)
+}
+
+// targetNodes name 为 _ 时使用 labelSelector 选择节点
+func (h *NodeHandler) targetNodes(c *gin.Context) ([]string, error) {
+	name, selector := c.Param("name"), c.Query("labelSelector")
+	if name != "_" {
+		if selector != "" {
+			return nil, apiErrors.NewBadRequest("labelSelector is only allowed when name is _")
+		}
+		return []string{name}, nil
+	}
+	if selector == "" {
+		return nil, apiErrors.NewBadRequest("labelSelector is required when name is _")
+	}
+	sel, err := labels.Parse(selector)
+	if err != nil {
+		return nil, apiErrors.NewBadRequest(err.Error())
+	}
+	nodeList := &corev1.NodeList{}
+	if err := h.C.List(c.Request.Context(), nodeList, client.MatchingLabelsSelector{Selector: sel}); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(nodeList.Items))
+	for _, node := range nodeList.Items {
+		names = append(names, node.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// systemKey kubelet 和 kubernetes 组件管理的 key, 节点角色等由管理员设置的 key 除外
+func systemKey(key string) bool {
+	prefix, _, found := strings.Cut(key, "/")
+	if !found {
+		return false
+	}
+	if prefix == "node-role.kubernetes.io" || prefix == "node-restriction.kubernetes.io" {
+		return false
+	}
+	for _, domain := range []string{"kubernetes.io", "k8s.io"} {
+		if prefix == domain || strings.HasSuffix(prefix, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func protectedError(name string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return apiErrors.NewForbidden(schema.GroupResource{Resource: "nodes"}, name,
+		fmt.Errorf("system keys can not be changed: %s", strings.Join(keys, ", ")))
+}
+
+// patchMap 返回修改后的 map, 变化和试图修改的系统 key
+func patchMap(current, set map[string]string, remove []string) (map[string]string, []Change, []string) {
+	result := make(map[string]string, len(current)+len(set))
+	for k, v := range current {
+		result[k] = v
+	}
+	changes, protected := []Change{}, []string{}
+	for k, v := range set {
+		old, exists := result[k]
+		if exists && old == v {
+			continue
+		}
+		if systemKey(k) {
+			protected = append(protected, k)
+			continue
+		}
+		result[k] = v
+		if exists {
+			changes = append(changes, Change{Op: ChangeUpdate, Key: k, Old: old, New: v})
+		} else {
+			changes = append(changes, Change{Op: ChangeAdd, Key: k, New: v})
+		}
+	}
+	for _, k := range remove {
+		old, exists := result[k]
+		if !exists {
+			continue
+		}
+		if systemKey(k) {
+			protected = append(protected, k)
+			continue
+		}
+		delete(result, k)
+		changes = append(changes, Change{Op: ChangeRemove, Key: k, Old: old})
+	}
+	sortChanges(changes)
+	sort.Strings(protected)
+	return result, changes, protected
+}
+
+// patchTaints 污点按照 key 和 effect 匹配, 删除时 effect 为空匹配所有 effect
+func patchTaints(current, add, remove []corev1.Taint) ([]corev1.Taint, []Change, []string) {
+	result := append([]corev1.Taint{}, current...)
+	changes, protected := []Change{}, []string{}
+	for _, taint := range add {
+		key := taint.Key + ":" + string(taint.Effect)
+		index := -1
+		for i := range result {
+			if result[i].MatchTaint(&taint) {
+				index = i
+				break
+			}
+		}
+		if index >= 0 && result[index].Value == taint.Value {
+			continue
+		}
+		if systemKey(taint.Key) {
+			protected = append(protected, key)
+			continue
+		}
+		if index >= 0 {
+			changes = append(changes, Change{Op: ChangeUpdate, Key: key, Old: result[index].Value, New: taint.Value})
+			result[index].Value = taint.Value
+		} else {
+			changes = append(changes, Change{Op: ChangeAdd, Key: key, New: taint.Value})
+			result = append(result, corev1.Taint{Key: taint.Key, Value: taint.Value, Effect: taint.Effect})
+		}
+	}
+	for _, taint := range remove {
+		kept := result[:0]
+		for _, existing := range result {
+			if existing.Key != taint.Key || (taint.Effect != "" && existing.Effect != taint.Effect) {
+				kept = append(kept, existing)
+				continue
+			}
+			key := existing.Key + ":" + string(existing.Effect)
+			if systemKey(existing.Key) {
+				protected = append(protected, key)
+				kept = append(kept, existing)
+				continue
+			}
+			changes = append(changes, Change{Op: ChangeRemove, Key: key, Old: existing.Value})
+		}
+		result = kept
+	}
+	sortChanges(changes)
+	sort.Strings(protected)
+	return result, changes, protected
+}
+
+func sortChanges(changes []Change) {
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
 }
 
 type CustomNode struct {
 	Node     *corev1.Node
 	Requests map[corev1.ResourceName]resource.Quantity
 	Limits   map[corev1.ResourceName]resource.Quantity
+	Summary  NodeSummary
+	// 调用方范围内的 pod
+	Pods []PodUsage
 }
 
 // @Tags        Agent.V1
 // @Summary     自定义的NODE详情接口,(可以获取资源分配情况)
-// @Description 自定义的NODE详情接口,(可以获取资源分配情况)
+// @Description 自定义的NODE详情接口, 包含资源分配、metrics-server 采集的节点和 pod 使用量, metrics-server 不可用时没有使用量
 // @Accept      json
 // @Produce     json
 // @Param       name    path     string                                   true "name"
@@ -112,25 +397,33 @@ type CustomNode struct {
 // @Router      /v1/proxy/cluster/{cluster}/custom/core/v1/nodes/{name} [get]
 // @Security    JWT
 func (h *NodeHandler) GET(c *gin.Context) {
+	ctx := c.Request.Context()
 	name := c.Param("name")
 	node := &corev1.Node{}
-	if err := h.C.Get(c.Request.Context(),
+	if err := h.C.Get(ctx,
 		types.NamespacedName{Name: name}, node); err != nil {
 		NotOK(c, err)
 		return
 	}
+	scope, err := scopeFromRequest(ctx, h.C, c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
 
 	pods := &corev1.PodList{}
-	fs := fields.SelectorFromSet(map[string]string{"nodename": name})
-	opts := client.ListOptions{
-		FieldSelector: fs,
+	if err := h.C.List(ctx, pods, client.MatchingFields{"nodename": name}); err != nil {
+		NotOK(c, err)
+		return
 	}
-	h.C.List(c.Request.Context(), pods, &opts)
-	req, limits := NodeRequestAndLimits(node, pods)
+	active := activePods(pods.Items)
+	req, limits := NodeRequestAndLimits(node, &corev1.PodList{Items: active})
 	cNode := CustomNode{
 		Node:     node,
 		Requests: req,
 		Limits:   limits,
+		Summary:  nodeSummary(node, active, h.nodeMetrics(ctx, name)),
+		Pods:     h.podUsages(ctx, scope, active),
 	}
 	OK(c, cNode)
 }
@@ -0,0 +1,124 @@
+package apis
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestSystemKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{key: "kubernetes.io/hostname", want: true},
+		{key: "node.kubernetes.io/instance-type", want: true},
+		{key: "topology.kubernetes.io/zone", want: true},
+		{key: "beta.kubernetes.io/arch", want: true},
+		{key: "k8s.io/cloud", want: true},
+		{key: "node-role.kubernetes.io/worker", want: false},
+		{key: "node-restriction.kubernetes.io/pool", want: false},
+		{key: "notkubernetes.io/team", want: false},
+		{key: "example.com/team", want: false},
+		{key: "app", want: false},
+	}
+	for _, tt := range tests {
+		if got := systemKey(tt.key); got != tt.want {
+			t.Errorf("systemKey(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestPatchMap(t *testing.T) {
+	current := map[string]string{
+		"app":                         "web",
+		"team":                        "a",
+		"kubernetes.io/hostname":      "n1",
+		"topology.kubernetes.io/zone": "z1",
+	}
+	set := map[string]string{"app": "web", "team": "b", "env": "prod", "kubernetes.io/hostname": "n2"}
+	remove := []string{"app", "missing", "topology.kubernetes.io/zone"}
+
+	result, changes, protected := patchMap(current, set, remove)
+	wantResult := map[string]string{
+		"team":                        "b",
+		"env":                         "prod",
+		"kubernetes.io/hostname":      "n1",
+		"topology.kubernetes.io/zone": "z1",
+	}
+	if !reflect.DeepEqual(result, wantResult) {
+		t.Errorf("patchMap() result = %v, want %v", result, wantResult)
+	}
+	wantChanges := []Change{
+		{Op: ChangeRemove, Key: "app", Old: "web"},
+		{Op: ChangeAdd, Key: "env", New: "prod"},
+		{Op: ChangeUpdate, Key: "team", Old: "a", New: "b"},
+	}
+	if !reflect.DeepEqual(changes, wantChanges) {
+		t.Errorf("patchMap() changes = %+v, want %+v", changes, wantChanges)
+	}
+	wantProtected := []string{"kubernetes.io/hostname", "topology.kubernetes.io/zone"}
+	if !reflect.DeepEqual(protected, wantProtected) {
+		t.Errorf("patchMap() protected = %v, want %v", protected, wantProtected)
+	}
+	if current["app"] != "web" || current["team"] != "a" {
+		t.Errorf("patchMap() modified current map: %v", current)
+	}
+
+	// 没有变化时返回空的 slice
+	_, changes, protected = patchMap(current, map[string]string{"app": "web"}, nil)
+	if len(changes) != 0 || len(protected) != 0 {
+		t.Errorf("patchMap() without change = %+v, %v", changes, protected)
+	}
+}
+
+func TestPatchTaints(t *testing.T) {
+	current := []corev1.Taint{
+		{Key: "dedicated", Value: "gpu", Effect: corev1.TaintEffectNoSchedule},
+		{Key: "dedicated", Value: "gpu", Effect: corev1.TaintEffectNoExecute},
+		{Key: "node.kubernetes.io/unreachable", Effect: corev1.TaintEffectNoExecute},
+	}
+	add := []corev1.Taint{
+		{Key: "dedicated", Value: "ml", Effect: corev1.TaintEffectNoSchedule},
+		{Key: "spot", Value: "true", Effect: corev1.TaintEffectPreferNoSchedule},
+		{Key: "dedicated", Value: "gpu", Effect: corev1.TaintEffectNoExecute},
+		{Key: "node.kubernetes.io/not-ready", Effect: corev1.TaintEffectNoSchedule},
+	}
+	remove := []corev1.Taint{
+		{Key: "dedicated", Effect: corev1.TaintEffectNoExecute},
+		{Key: "node.kubernetes.io/unreachable"},
+		{Key: "missing"},
+	}
+
+	result, changes, protected := patchTaints(current, add, remove)
+	wantResult := []corev1.Taint{
+		{Key: "dedicated", Value: "ml", Effect: corev1.TaintEffectNoSchedule},
+		{Key: "node.kubernetes.io/unreachable", Effect: corev1.TaintEffectNoExecute},
+		{Key: "spot", Value: "true", Effect: corev1.TaintEffectPreferNoSchedule},
+	}
+	if !reflect.DeepEqual(result, wantResult) {
+		t.Errorf("patchTaints() result = %+v, want %+v", result, wantResult)
+	}
+	wantChanges := []Change{
+		{Op: ChangeRemove, Key: "dedicated:NoExecute", Old: "gpu"},
+		{Op: ChangeUpdate, Key: "dedicated:NoSchedule", Old: "gpu", New: "ml"},
+		{Op: ChangeAdd, Key: "spot:PreferNoSchedule", New: "true"},
+	}
+	if !reflect.DeepEqual(changes, wantChanges) {
+		t.Errorf("patchTaints() changes = %+v, want %+v", changes, wantChanges)
+	}
+	wantProtected := []string{"node.kubernetes.io/not-ready:NoSchedule", "node.kubernetes.io/unreachable:NoExecute"}
+	if !reflect.DeepEqual(protected, wantProtected) {
+		t.Errorf("patchTaints() protected = %v, want %v", protected, wantProtected)
+	}
+	if current[0].Value != "gpu" || len(current) != 3 {
+		t.Errorf("patchTaints() modified current taints: %+v", current)
+	}
+
+	// 删除时 effect 为空匹配所有 effect
+	result, changes, _ = patchTaints(current[:2], nil, []corev1.Taint{{Key: "dedicated"}})
+	if len(result) != 0 || len(changes) != 2 {
+		t.Errorf("patchTaints() remove all effects = %+v, %+v", result, changes)
+	}
+}
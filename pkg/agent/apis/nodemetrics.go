@@ -0,0 +1,263 @@
+package apis
+
+import (
+	"context"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	resourceHelper "k8s.io/kubectl/pkg/util/resource"
+	metricsV1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ResourceUsage 节点一种资源的分配和使用, 百分比相对于 allocatable
+// metrics-server 不可用时 Usage 和 UsagePercent 为空
+type ResourceUsage struct {
+	Allocatable     resource.Quantity  `json:"allocatable"`
+	Requests        resource.Quantity  `json:"requests"`
+	Limits          resource.Quantity  `json:"limits"`
+	Usage           *resource.Quantity `json:"usage,omitempty"`
+	RequestsPercent float64            `json:"requestsPercent"`
+	LimitsPercent   float64            `json:"limitsPercent"`
+	UsagePercent    *float64           `json:"usagePercent,omitempty"`
+}
+
+// PodCount 未结束的 pod 数量和节点允许的最大 pod 数量
+type PodCount struct {
+	Count    int     `json:"count"`
+	Capacity int64   `json:"capacity"`
+	Percent  float64 `json:"percent"`
+}
+
+// NodeConditions 节点状况汇总
+type NodeConditions struct {
+	// True/False/Unknown
+	Ready string `json:"ready"`
+	// 状态为 True 的异常状况, 如 MemoryPressure, DiskPressure
+	Problems []string `json:"problems,omitempty"`
+}
+
+// NodeSummary 节点的资源分配和使用情况
+type NodeSummary struct {
+	Name          string         `json:"name"`
+	Unschedulable bool           `json:"unschedulable"`
+	Conditions    NodeConditions `json:"conditions"`
+	CPU           ResourceUsage  `json:"cpu"`
+	Memory        ResourceUsage  `json:"memory"`
+	Pods          PodCount       `json:"pods"`
+	// metrics-server 采集的时间
+	Timestamp *metav1.Time `json:"timestamp,omitempty"`
+}
+
+// PodUsage 节点上 pod 的资源分配和使用
+type PodUsage struct {
+	Namespace string              `json:"namespace"`
+	Name      string              `json:"name"`
+	Phase     corev1.PodPhase     `json:"phase"`
+	Requests  corev1.ResourceList `json:"requests"`
+	Limits    corev1.ResourceList `json:"limits"`
+	Usage     corev1.ResourceList `json:"usage,omitempty"`
+}
+
+// @Tags        Agent.V1
+// @Summary     节点列表(包含资源分配和使用情况)
+// @Description 节点的 CPU 内存分配和 metrics-server 采集的使用量, pod 数量和节点状况, metrics-server 不可用时没有使用量
+// @Accept      json
+// @Produce     json
+// @Param       cluster       path     string                                       true  "cluster"
+// @Param       labelSelector query    string                                       false "labelSelector"
+// @Success     200           {object} handlers.ResponseStruct{Data=[]NodeSummary} "NodeSummary"
+// @Router      /v1/proxy/cluster/{cluster}/custom/core/v1/nodes [get]
+// @Security    JWT
+func (h *NodeHandler) List(c *gin.Context) {
+	ctx := c.Request.Context()
+	opts := []client.ListOption{}
+	if selector := c.Query("labelSelector"); selector != "" {
+		sel, err := labels.Parse(selector)
+		if err != nil {
+			NotOK(c, err)
+			return
+		}
+		opts = append(opts, client.MatchingLabelsSelector{Selector: sel})
+	}
+	nodes := &corev1.NodeList{}
+	if err := h.C.List(ctx, nodes, opts...); err != nil {
+		NotOK(c, err)
+		return
+	}
+	pods := &corev1.PodList{}
+	if err := h.C.List(ctx, pods); err != nil {
+		NotOK(c, err)
+		return
+	}
+	podsOfNode := map[string][]corev1.Pod{}
+	for _, pod := range activePods(pods.Items) {
+		podsOfNode[pod.Spec.NodeName] = append(podsOfNode[pod.Spec.NodeName], pod)
+	}
+
+	metricsOfNode := map[string]*metricsV1beta1.NodeMetrics{}
+	nodeMetrics := &metricsV1beta1.NodeMetricsList{}
+	if err := h.C.List(ctx, nodeMetrics); err != nil {
+		log.Debugf("list node metrics: %v", err)
+	}
+	for i := range nodeMetrics.Items {
+		metricsOfNode[nodeMetrics.Items[i].Name] = &nodeMetrics.Items[i]
+	}
+
+	summaries := make([]NodeSummary, 0, len(nodes.Items))
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		summaries = append(summaries, nodeSummary(node, podsOfNode[node.Name], metricsOfNode[node.Name]))
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Name < summaries[j].Name
+	})
+	OK(c, summaries)
+}
+
+// nodeMetrics metrics-server 没有安装或者还没有采集到节点时返回 nil
+// metrics-server 不可用是正常情况, 只在 debug 级别记录
+func (h *NodeHandler) nodeMetrics(ctx context.Context, name string) *metricsV1beta1.NodeMetrics {
+	metrics := &metricsV1beta1.NodeMetrics{}
+	if err := h.C.Get(ctx, types.NamespacedName{Name: name}, metrics); err != nil {
+		log.Debugf("get metrics of node %s: %v", name, err)
+		return nil
+	}
+	return metrics
+}
+
+// podUsages 调用方范围内的 pod, 按照 namespace 和 name 排序
+// 只查询这些 pod 所在 namespace 的使用量, 避免列出整个集群的 PodMetrics
+func (h *NodeHandler) podUsages(ctx context.Context, scope *Scope, pods []corev1.Pod) []PodUsage {
+	inScope := []*corev1.Pod{}
+	namespaces := map[string]bool{}
+	for i := range pods {
+		if scope.Contains(pods[i].Namespace) {
+			inScope = append(inScope, &pods[i])
+			namespaces[pods[i].Namespace] = true
+		}
+	}
+
+	usageOfPod := map[types.NamespacedName]corev1.ResourceList{}
+	for ns := range namespaces {
+		podMetrics := &metricsV1beta1.PodMetricsList{}
+		if err := h.C.List(ctx, podMetrics, client.InNamespace(ns)); err != nil {
+			// metrics-server 不可用时其他 namespace 也会失败
+			log.Debugf("list pod metrics of namespace %s: %v", ns, err)
+			break
+		}
+		for _, metrics := range podMetrics.Items {
+			usage := corev1.ResourceList{}
+			for _, container := range metrics.Containers {
+				addResourceList(usage, container.Usage)
+			}
+			usageOfPod[types.NamespacedName{Namespace: metrics.Namespace, Name: metrics.Name}] = usage
+		}
+	}
+
+	usages := make([]PodUsage, 0, len(inScope))
+	for _, pod := range inScope {
+		requests, limits := resourceHelper.PodRequestsAndLimits(pod)
+		usages = append(usages, PodUsage{
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+			Phase:     pod.Status.Phase,
+			Requests:  requests,
+			Limits:    limits,
+			Usage:     usageOfPod[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}],
+		})
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].Namespace != usages[j].Namespace {
+			return usages[i].Namespace < usages[j].Namespace
+		}
+		return usages[i].Name < usages[j].Name
+	})
+	return usages
+}
+
+// nodeSummary pods 为节点上未结束的 pod, metrics 为空时没有使用量
+func nodeSummary(node *corev1.Node, pods []corev1.Pod, metrics *metricsV1beta1.NodeMetrics) NodeSummary {
+	requests, limits := NodeRequestAndLimits(node, &corev1.PodList{Items: pods})
+	summary := NodeSummary{
+		Name:          node.Name,
+		Unschedulable: node.Spec.Unschedulable,
+		Conditions:    nodeConditions(node),
+		CPU:           resourceUsage(corev1.ResourceCPU, node.Status.Allocatable, requests, limits, metrics),
+		Memory:        resourceUsage(corev1.ResourceMemory, node.Status.Allocatable, requests, limits, metrics),
+		Pods: PodCount{
+			Count:    len(pods),
+			Capacity: node.Status.Allocatable.Pods().Value(),
+		},
+	}
+	summary.Pods.Percent = percent(float64(summary.Pods.Count), float64(summary.Pods.Capacity))
+	if metrics != nil {
+		summary.Timestamp = &metrics.Timestamp
+	}
+	return summary
+}
+
+func resourceUsage(name corev1.ResourceName, allocatable, requests, limits corev1.ResourceList, metrics *metricsV1beta1.NodeMetrics) ResourceUsage {
+	usage := ResourceUsage{
+		Allocatable: allocatable[name],
+		Requests:    requests[name],
+		Limits:      limits[name],
+	}
+	total := usage.Allocatable.AsApproximateFloat64()
+	usage.RequestsPercent = percent(usage.Requests.AsApproximateFloat64(), total)
+	usage.LimitsPercent = percent(usage.Limits.AsApproximateFloat64(), total)
+	if metrics != nil {
+		if used, ok := metrics.Usage[name]; ok {
+			usagePercent := percent(used.AsApproximateFloat64(), total)
+			usage.Usage, usage.UsagePercent = &used, &usagePercent
+		}
+	}
+	return usage
+}
+
+func nodeConditions(node *corev1.Node) NodeConditions {
+	conditions := NodeConditions{Ready: string(corev1.ConditionUnknown)}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			conditions.Ready = string(condition.Status)
+			continue
+		}
+		if condition.Status == corev1.ConditionTrue {
+			conditions.Problems = append(conditions.Problems, string(condition.Type))
+		}
+	}
+	return conditions
+}
+
+// activePods 已经结束的 pod 不占用节点资源
+func activePods(pods []corev1.Pod) []corev1.Pod {
+	active := make([]corev1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		active = append(active, pod)
+	}
+	return active
+}
+
+func addResourceList(list, add corev1.ResourceList) {
+	for name, quantity := range add {
+		value := list[name]
+		value.Add(quantity)
+		list[name] = value
+	}
+}
+
+func percent(value, total float64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(int(value/total*10000)) / 100
+}
@@ -0,0 +1,133 @@
+package apis
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	metricsV1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		value float64
+		total float64
+		want  float64
+	}{
+		{value: 50, total: 200, want: 25},
+		{value: 1, total: 3, want: 33.33},
+		{value: 2, total: 1, want: 200},
+		{value: 5, total: 0, want: 0},
+		{value: 5, total: -1, want: 0},
+	}
+	for _, tt := range tests {
+		if got := percent(tt.value, tt.total); got != tt.want {
+			t.Errorf("percent(%v, %v) = %v, want %v", tt.value, tt.total, got, tt.want)
+		}
+	}
+}
+
+func TestNodeConditions(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions []corev1.NodeCondition
+		want       NodeConditions
+	}{
+		{name: "no conditions", want: NodeConditions{Ready: "Unknown"}},
+		{
+			name: "ready with pressure",
+			conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+				{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionTrue},
+				{Type: corev1.NodeDiskPressure, Status: corev1.ConditionFalse},
+			},
+			want: NodeConditions{Ready: "True", Problems: []string{"MemoryPressure"}},
+		},
+		{
+			name: "not ready",
+			conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeNetworkUnavailable, Status: corev1.ConditionTrue},
+				{Type: corev1.NodeReady, Status: corev1.ConditionFalse},
+			},
+			want: NodeConditions{Ready: "False", Problems: []string{"NetworkUnavailable"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &corev1.Node{Status: corev1.NodeStatus{Conditions: tt.conditions}}
+			if got := nodeConditions(node); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nodeConditions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// listRecorder 记录 List 的 namespace
+type listRecorder struct {
+	client.Client
+	namespaces []string
+}
+
+func (r *listRecorder) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOptions := &client.ListOptions{}
+	listOptions.ApplyOptions(opts)
+	r.namespaces = append(r.namespaces, listOptions.Namespace)
+	return r.Client.List(ctx, list, opts...)
+}
+
+func TestPodUsages(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := metricsV1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	containerUsage := func(cpu string) metricsV1beta1.ContainerMetrics {
+		return metricsV1beta1.ContainerMetrics{Usage: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu)}}
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&metricsV1beta1.PodMetrics{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "web-0"},
+			Containers: []metricsV1beta1.ContainerMetrics{containerUsage("50m"), containerUsage("70m")},
+		},
+		&metricsV1beta1.PodMetrics{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "api-0"},
+			Containers: []metricsV1beta1.ContainerMetrics{containerUsage("10m")},
+		},
+	).Build()
+	recorder := &listRecorder{Client: cli}
+	h := &NodeHandler{C: recorder}
+	pods := []corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "api-0"}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "web-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "web-0"}, Status: corev1.PodStatus{Phase: corev1.PodRunning}},
+	}
+
+	usages := h.podUsages(context.Background(), &Scope{Namespaces: []string{"dev"}}, pods)
+	if !reflect.DeepEqual(recorder.namespaces, []string{"dev"}) {
+		t.Errorf("listed pod metrics of namespaces %v, want [dev]", recorder.namespaces)
+	}
+	if len(usages) != 2 || usages[0].Name != "web-0" || usages[1].Name != "web-1" {
+		t.Fatalf("podUsages() = %+v, want dev/web-0 and dev/web-1", usages)
+	}
+	if cpu := usages[0].Usage[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse("120m")) != 0 || usages[0].Phase != corev1.PodRunning {
+		t.Errorf("usage of web-0 = %v, phase %s", cpu.String(), usages[0].Phase)
+	}
+	if usages[1].Usage != nil {
+		t.Errorf("usage of web-1 without metrics = %v", usages[1].Usage)
+	}
+
+	// 没有范围内的 pod 时不查询
+	recorder.namespaces = nil
+	if usages := h.podUsages(context.Background(), &Scope{Namespaces: []string{"test"}}, pods); len(usages) != 0 || len(recorder.namespaces) != 0 {
+		t.Errorf("podUsages() out of scope = %+v, listed %v", usages, recorder.namespaces)
+	}
+}
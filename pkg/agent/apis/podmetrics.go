@@ -0,0 +1,358 @@
+package apis
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/api/kuber/v1beta1"
+	"github.com/sunweiwe/kuber/pkg/log"
+	"github.com/sunweiwe/kuber/pkg/utils/kubertype"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	resourceHelper "k8s.io/kubectl/pkg/util/resource"
+	metricsV1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// 聚合的维度
+const (
+	TopByPod         = "pods"
+	TopByWorkload    = "workloads"
+	TopByNamespace   = "namespaces"
+	TopByEnvironment = "environments"
+)
+
+type PodMetricsHandler struct {
+	C client.Client
+}
+
+// WorkloadRef pod 所属的工作负载, Deployment 通过 ReplicaSet 的 owner 查找
+type WorkloadRef struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+type ContainerUsage struct {
+	Name     string              `json:"name"`
+	Requests corev1.ResourceList `json:"requests"`
+	Limits   corev1.ResourceList `json:"limits"`
+	Usage    corev1.ResourceList `json:"usage,omitempty"`
+}
+
+type PodMetricsItem struct {
+	PodUsage
+	// 没有控制器时为空
+	Workload   *WorkloadRef     `json:"workload,omitempty"`
+	Containers []ContainerUsage `json:"containers"`
+	// metrics-server 采集的时间
+	Timestamp *metav1.Time `json:"timestamp,omitempty"`
+}
+
+// TopItem 按照 pod, 工作负载, namespace 或者环境聚合的资源
+type TopItem struct {
+	Kind      string              `json:"kind"`
+	Namespace string              `json:"namespace,omitempty"`
+	Name      string              `json:"name"`
+	Pods      int                 `json:"pods"`
+	Requests  corev1.ResourceList `json:"requests"`
+	Limits    corev1.ResourceList `json:"limits"`
+	Usage     corev1.ResourceList `json:"usage"`
+}
+
+type topKey struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+// MetricsResult metrics-server 不可用时 Available 为 false, 只有 requests 和 limits, 按照 requests 排序
+type MetricsResult struct {
+	Available bool        `json:"available"`
+	Message   string      `json:"message,omitempty"`
+	Items     interface{} `json:"items"`
+}
+
+// @Tags        Agent.V1
+// @Summary     pod 和容器的使用量
+// @Description metrics-server 采集的 pod 和容器使用量, 包含 requests limits 和所属的工作负载, 只返回调用方范围内的 pod
+// @Accept      json
+// @Produce     json
+// @Param       cluster       path     string                                                                 true  "cluster"
+// @Param       namespace     path     string                                                                 true  "namespace, _all 为所有namespace"
+// @Param       labelSelector query    string                                                                 false "labelSelector"
+// @Param       sortBy        query    string                                                                 false "cpu/memory, 默认cpu"
+// @Param       limit         query    int                                                                    false "返回前几个, 0 为不限制"
+// @Success     200           {object} handlers.ResponseStruct{Data=MetricsResult{Items=[]PodMetricsItem}} "pods"
+// @Router      /v1/proxy/cluster/{cluster}/custom/metrics.k8s.io/v1beta1/namespaces/{namespace}/pods [get]
+// @Security    JWT
+func (h *PodMetricsHandler) ListPods(c *gin.Context) {
+	sortBy, limit, err := topOptions(c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	items, message, err := h.podMetrics(c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return usageLess(sortBy, &items[j].PodUsage, &items[i].PodUsage)
+	})
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	OK(c, MetricsResult{Available: message == "", Message: message, Items: items})
+}
+
+// @Tags        Agent.V1
+// @Summary     按照使用量排序的资源
+// @Description 类似 kubectl top, 按照 pods/workloads/namespaces/environments 聚合 metrics-server 采集的使用量, 只统计调用方范围内的 pod
+// @Accept      json
+// @Produce     json
+// @Param       cluster       path     string                                                          true  "cluster"
+// @Param       namespace     path     string                                                          true  "namespace, _all 为所有namespace"
+// @Param       name          path     string                                                          true  "pods/workloads/namespaces/environments"
+// @Param       labelSelector query    string                                                          false "pod 的 labelSelector"
+// @Param       sortBy        query    string                                                          false "cpu/memory, 默认cpu"
+// @Param       limit         query    int                                                             false "返回前几个, 0 为不限制"
+// @Success     200           {object} handlers.ResponseStruct{Data=MetricsResult{Items=[]TopItem}} "top"
+// @Router      /v1/proxy/cluster/{cluster}/custom/metrics.k8s.io/v1beta1/namespaces/{namespace}/top/{name} [get]
+// @Security    JWT
+func (h *PodMetricsHandler) Top(c *gin.Context) {
+	by := c.Param("name")
+	switch by {
+	case TopByPod, TopByWorkload, TopByNamespace, TopByEnvironment:
+	default:
+		NotOK(c, apiErrors.NewBadRequest(fmt.Sprintf("unsupported %q, must be one of pods, workloads, namespaces, environments", by)))
+		return
+	}
+	sortBy, limit, err := topOptions(c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	pods, message, err := h.podMetrics(c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+
+	environmentOf := map[string]string{}
+	if by == TopByEnvironment {
+		envs := &v1beta1.EnvironmentList{}
+		if err := h.C.List(c.Request.Context(), envs); err != nil {
+			NotOK(c, err)
+			return
+		}
+		for _, env := range envs.Items {
+			if env.Spec.Namespace != "" {
+				environmentOf[env.Spec.Namespace] = env.Name
+			}
+		}
+	}
+
+	items := []*TopItem{}
+	index := map[topKey]*TopItem{}
+	for i := range pods {
+		pod := &pods[i]
+		key := topKey{kind: "Pod", namespace: pod.Namespace, name: pod.Name}
+		switch by {
+		case TopByWorkload:
+			if pod.Workload != nil {
+				key.kind, key.name = pod.Workload.Kind, pod.Workload.Name
+			}
+		case TopByNamespace:
+			key = topKey{kind: "Namespace", name: pod.Namespace}
+		case TopByEnvironment:
+			env, ok := environmentOf[pod.Namespace]
+			if !ok {
+				continue
+			}
+			key.kind, key.name = "Environment", env
+		}
+		item, ok := index[key]
+		if !ok {
+			item = &TopItem{
+				Kind: key.kind, Namespace: key.namespace, Name: key.name,
+				Requests: corev1.ResourceList{}, Limits: corev1.ResourceList{}, Usage: corev1.ResourceList{},
+			}
+			index[key] = item
+			items = append(items, item)
+		}
+		item.Pods++
+		addResourceList(item.Requests, pod.Requests)
+		addResourceList(item.Limits, pod.Limits)
+		addResourceList(item.Usage, pod.Usage)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return usageLess(sortBy,
+			&PodUsage{Namespace: items[j].Namespace, Name: items[j].Name, Requests: items[j].Requests, Usage: items[j].Usage},
+			&PodUsage{Namespace: items[i].Namespace, Name: items[i].Name, Requests: items[i].Requests, Usage: items[i].Usage})
+	})
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	OK(c, MetricsResult{Available: message == "", Message: message, Items: items})
+}
+
+// podMetrics 调用方范围内未结束的 pod, metrics-server 不可用时 message 不为空, 只有 requests 和 limits
+func (h *PodMetricsHandler) podMetrics(c *gin.Context) ([]PodMetricsItem, string, error) {
+	ctx := c.Request.Context()
+	ns := c.Param("namespace")
+	if ns == allNamespace || ns == "_" {
+		ns = ""
+	}
+	scope, err := scopeFromRequest(ctx, h.C, c)
+	if err != nil {
+		return nil, "", err
+	}
+	if ns != "" && !scope.Contains(ns) {
+		return nil, "", scope.Forbidden("namespaces", ns)
+	}
+
+	// 范围受限时只查询范围内的 namespace, 不在整个集群中查询
+	namespaces := []string{ns}
+	if ns == "" && !scope.Unlimited() {
+		namespaces = scope.Namespaces
+	}
+	var selector labels.Selector
+	if value := c.Query("labelSelector"); value != "" {
+		if selector, err = labels.Parse(value); err != nil {
+			return nil, "", apiErrors.NewBadRequest(err.Error())
+		}
+	}
+
+	pods := []corev1.Pod{}
+	deploymentOf := map[types.NamespacedName]*metav1.OwnerReference{}
+	for _, namespace := range namespaces {
+		opts := []client.ListOption{client.InNamespace(namespace)}
+		if selector != nil {
+			opts = append(opts, client.MatchingLabelsSelector{Selector: selector})
+		}
+		podList := &corev1.PodList{}
+		if err := h.C.List(ctx, podList, opts...); err != nil {
+			return nil, "", err
+		}
+		pods = append(pods, podList.Items...)
+		replicaSets := &appsv1.ReplicaSetList{}
+		if err := h.C.List(ctx, replicaSets, client.InNamespace(namespace)); err != nil {
+			return nil, "", err
+		}
+		for i := range replicaSets.Items {
+			rs := &replicaSets.Items[i]
+			if owner := metav1.GetControllerOf(rs); owner != nil && owner.Kind == kubertype.Deployment {
+				deploymentOf[types.NamespacedName{Namespace: rs.Namespace, Name: rs.Name}] = owner
+			}
+		}
+	}
+
+	// 使用量只按照 namespace 查询, 与 pod 按照名称对应
+	message := ""
+	metricsOf := map[types.NamespacedName]*metricsV1beta1.PodMetrics{}
+	for _, namespace := range namespaces {
+		podMetrics := &metricsV1beta1.PodMetricsList{}
+		if err := h.C.List(ctx, podMetrics, client.InNamespace(namespace)); err != nil {
+			// metrics-server 不可用时其他 namespace 也会失败
+			log.Debugf("list pod metrics of namespace %s: %v", namespace, err)
+			message = fmt.Sprintf("metrics-server is not available: %v", err)
+			break
+		}
+		for i := range podMetrics.Items {
+			metrics := &podMetrics.Items[i]
+			metricsOf[types.NamespacedName{Namespace: metrics.Namespace, Name: metrics.Name}] = metrics
+		}
+	}
+
+	items := []PodMetricsItem{}
+	for _, pod := range activePods(pods) {
+		if !scope.Contains(pod.Namespace) {
+			continue
+		}
+		items = append(items, podMetricsItem(&pod, metricsOf[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}], deploymentOf))
+	}
+	return items, message, nil
+}
+
+func podMetricsItem(pod *corev1.Pod, metrics *metricsV1beta1.PodMetrics, deploymentOf map[types.NamespacedName]*metav1.OwnerReference) PodMetricsItem {
+	requests, limits := resourceHelper.PodRequestsAndLimits(pod)
+	item := PodMetricsItem{
+		PodUsage: PodUsage{
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+			Phase:     pod.Status.Phase,
+			Requests:  requests,
+			Limits:    limits,
+		},
+		Containers: make([]ContainerUsage, 0, len(pod.Spec.Containers)),
+	}
+	if controller := metav1.GetControllerOf(pod); controller != nil {
+		item.Workload = &WorkloadRef{Kind: controller.Kind, Name: controller.Name}
+		if controller.Kind == kubertype.ReplicaSet {
+			if owner, ok := deploymentOf[types.NamespacedName{Namespace: pod.Namespace, Name: controller.Name}]; ok {
+				item.Workload = &WorkloadRef{Kind: owner.Kind, Name: owner.Name}
+			}
+		}
+	}
+
+	usageOf := map[string]corev1.ResourceList{}
+	if metrics != nil {
+		item.Usage, item.Timestamp = corev1.ResourceList{}, &metrics.Timestamp
+		for _, container := range metrics.Containers {
+			usageOf[container.Name] = container.Usage
+			addResourceList(item.Usage, container.Usage)
+		}
+	}
+	for _, container := range pod.Spec.Containers {
+		item.Containers = append(item.Containers, ContainerUsage{
+			Name:     container.Name,
+			Requests: container.Resources.Requests,
+			Limits:   container.Resources.Limits,
+			Usage:    usageOf[container.Name],
+		})
+	}
+	return item
+}
+
+func topOptions(c *gin.Context) (corev1.ResourceName, int, error) {
+	sortBy := corev1.ResourceCPU
+	switch c.DefaultQuery("sortBy", "cpu") {
+	case "cpu":
+	case "memory":
+		sortBy = corev1.ResourceMemory
+	default:
+		return "", 0, apiErrors.NewBadRequest("sortBy must be cpu or memory")
+	}
+	limit := 0
+	if value := c.Query("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			return "", 0, apiErrors.NewBadRequest(fmt.Sprintf("invalid limit %q", value))
+		}
+	}
+	return sortBy, limit, nil
+}
+
+// usageLess 按照使用量比较, 使用量相同(如 metrics-server 不可用)时比较 requests, 最后按照名称
+func usageLess(name corev1.ResourceName, a, b *PodUsage) bool {
+	usageA, usageB := a.Usage[name], b.Usage[name]
+	if cmp := usageA.Cmp(usageB); cmp != 0 {
+		return cmp < 0
+	}
+	requestA, requestB := a.Requests[name], b.Requests[name]
+	if cmp := requestA.Cmp(requestB); cmp != 0 {
+		return cmp < 0
+	}
+	// 名称升序, 与使用量的降序相反
+	if a.Namespace != b.Namespace {
+		return a.Namespace > b.Namespace
+	}
+	return a.Name > b.Name
+}
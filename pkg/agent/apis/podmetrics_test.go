@@ -0,0 +1,174 @@
+package apis
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/agent/middleware"
+	"github.com/sunweiwe/kuber/pkg/api/kuber/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestUsageLess(t *testing.T) {
+	cpu := func(value string) corev1.ResourceList {
+		return corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(value)}
+	}
+	tests := []struct {
+		name string
+		a    PodUsage
+		b    PodUsage
+		want bool
+	}{
+		{name: "less usage", a: PodUsage{Name: "a", Usage: cpu("100m")}, b: PodUsage{Name: "b", Usage: cpu("200m")}, want: true},
+		{name: "more usage", a: PodUsage{Name: "a", Usage: cpu("1")}, b: PodUsage{Name: "b", Usage: cpu("200m")}},
+		{name: "usage before requests", a: PodUsage{Name: "a", Usage: cpu("100m"), Requests: cpu("2")}, b: PodUsage{Name: "b", Usage: cpu("200m")}, want: true},
+		{name: "without usage", a: PodUsage{Name: "a", Requests: cpu("50m")}, b: PodUsage{Name: "b", Requests: cpu("100m")}, want: true},
+		{name: "same usage, more requests", a: PodUsage{Name: "a", Usage: cpu("100m"), Requests: cpu("1")}, b: PodUsage{Name: "b", Usage: cpu("100m")}},
+		{name: "same usage and requests, name", a: PodUsage{Namespace: "dev", Name: "b"}, b: PodUsage{Namespace: "dev", Name: "a"}, want: true},
+		{name: "same usage and requests, namespace", a: PodUsage{Namespace: "prod", Name: "a"}, b: PodUsage{Namespace: "dev", Name: "b"}, want: true},
+		{name: "equal", a: PodUsage{Namespace: "dev", Name: "a"}, b: PodUsage{Namespace: "dev", Name: "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := usageLess(corev1.ResourceCPU, &tt.a, &tt.b); got != tt.want {
+				t.Errorf("usageLess() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// 与 top 相同按照使用量降序, 使用量相同时名称升序
+	usages := []PodUsage{
+		{Namespace: "dev", Name: "c", Usage: cpu("100m")},
+		{Namespace: "dev", Name: "b", Usage: cpu("100m")},
+		{Namespace: "dev", Name: "a", Usage: cpu("300m")},
+		{Namespace: "dev", Name: "d"},
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		return usageLess(corev1.ResourceCPU, &usages[j], &usages[i])
+	})
+	names := ""
+	for _, usage := range usages {
+		names += usage.Name
+	}
+	if names != "abcd" {
+		t.Errorf("sorted pods = %s, want abcd", names)
+	}
+}
+
+func TestTopOptions(t *testing.T) {
+	tests := []struct {
+		query      string
+		wantSortBy corev1.ResourceName
+		wantLimit  int
+		wantErr    bool
+	}{
+		{query: "", wantSortBy: corev1.ResourceCPU},
+		{query: "sortBy=cpu&limit=10", wantSortBy: corev1.ResourceCPU, wantLimit: 10},
+		{query: "sortBy=memory", wantSortBy: corev1.ResourceMemory},
+		{query: "limit=0", wantSortBy: corev1.ResourceCPU},
+		{query: "sortBy=disk", wantErr: true},
+		{query: "sortBy=", wantErr: true},
+		{query: "limit=-1", wantErr: true},
+		{query: "limit=ten", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/?"+tt.query, nil)
+			sortBy, limit, err := topOptions(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("topOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if sortBy != tt.wantSortBy || limit != tt.wantLimit {
+				t.Errorf("topOptions() = %s, %d, want %s, %d", sortBy, limit, tt.wantSortBy, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestPodMetricsScope(t *testing.T) {
+	// 没有注册 metrics 的类型, 相当于 metrics-server 不可用
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1beta1.SchemeBuilder.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&v1beta1.Environment{
+			ObjectMeta: metav1.ObjectMeta{Name: "dev"},
+			Spec:       v1beta1.EnvironmentSpec{Tenant: "t1", Namespace: "t1-dev"},
+		},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "t1-dev", Name: "web"}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "db"}},
+	).Build()
+
+	// 租户先在所有 namespace 中查询环境
+	tenant := map[string]string{HeaderUser: "alice", HeaderTenant: "t1"}
+	tests := []struct {
+		name           string
+		namespace      string
+		header         map[string]string
+		wantForbidden  bool
+		wantPods       []string
+		wantNamespaces []string
+	}{
+		{name: "tenant all namespaces", namespace: allNamespace, header: tenant,
+			wantPods: []string{"t1-dev/web"}, wantNamespaces: []string{"", "t1-dev", "t1-dev", "t1-dev"}},
+		{name: "tenant namespace", namespace: "t1-dev", header: tenant,
+			wantPods: []string{"t1-dev/web"}, wantNamespaces: []string{"", "t1-dev", "t1-dev", "t1-dev"}},
+		{name: "tenant other namespace", namespace: "other", header: tenant, wantForbidden: true},
+		{name: "unlimited all namespaces", namespace: allNamespace,
+			wantPods: []string{"other/db", "t1-dev/web"}, wantNamespaces: []string{"", "", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &listRecorder{Client: cli}
+			h := &PodMetricsHandler{C: recorder}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = req
+			c.Params = gin.Params{{Key: "namespace", Value: tt.namespace}}
+			middleware.SignerMiddleware(func() bool { return false }, func(*http.Request) bool { return true })(c)
+
+			items, message, err := h.podMetrics(c)
+			if tt.wantForbidden {
+				if !apiErrors.IsForbidden(err) {
+					t.Errorf("podMetrics() error = %v, want forbidden", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message == "" {
+				t.Errorf("podMetrics() message is empty, want metrics-server is not available")
+			}
+			pods := []string{}
+			for _, item := range items {
+				pods = append(pods, item.Namespace+"/"+item.Name)
+			}
+			sort.Strings(pods)
+			if !reflect.DeepEqual(pods, tt.wantPods) {
+				t.Errorf("podMetrics() pods = %v, want %v", pods, tt.wantPods)
+			}
+			if !reflect.DeepEqual(recorder.namespaces, tt.wantNamespaces) {
+				t.Errorf("podMetrics() listed namespaces %q, want %q", recorder.namespaces, tt.wantNamespaces)
+			}
+		})
+	}
+}
@@ -2,26 +2,30 @@ package apis
 
 import (
 	"context"
+	"fmt"
+	"math"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/sunweiwe/kuber/pkg/agent/cluster"
 	"github.com/sunweiwe/kuber/pkg/service/handlers"
+	"github.com/sunweiwe/kuber/pkg/utils/prometheus"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
 )
 
-type prometheusHandler struct {
-	client api.Client
-}
+const (
+	defaultPrometheusTimeout = 60 * time.Second
+	defaultQueryRange        = time.Hour
+	// 单次范围查询最多返回的点数, 与 prometheus 的限制保持一致
+	maxQueryRangePoints = 11000
+)
 
-func NewPrometheusHandler(server string) (*prometheusHandler, error) {
-	client, err := api.NewClient(api.Config{Address: server})
-	if err != nil {
-		return nil, err
-	}
-	return &prometheusHandler{client: client}, nil
+type prometheusHandler struct {
+	cluster cluster.Interface
+	runtime *Runtime
 }
 
 // @Tags        Agent.V1
@@ -31,18 +35,28 @@ func NewPrometheusHandler(server string) (*prometheusHandler, error) {
 // @Produce     json
 // @Param       cluster  path     string                               true  "cluster"
 // @Param       query    query    string                               false "query"
+// @Param       time     query    string                               false "查询时间, RFC3339 或秒级时间戳, 默认当前时间"
+// @Param       timeout  query    string                               false "超时时间, 如 30s, 不能超过配置的超时时间"
 // @Param       nullable query    bool                                 false "nullable"
 // @Success     200      {object} handlers.ResponseStruct{Data=object} "vector"
 // @Router      /v1/proxy/cluster/{cluster}/custom/prometheus/v1/vector [get]
 // @Security    JWT
 func (p *prometheusHandler) Vector(c *gin.Context) {
-	query := c.Query("query")
+	query, err := p.scopedQuery(c, c.Query("query"))
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	ts, err := parsePromTime(c.Query("time"), time.Now())
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
 
-	v1api := v1.NewAPI(p.client)
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	ctx, cancel := p.context(c)
 	defer cancel()
 
-	obj, _, err := v1api.Query(ctx, query, time.Now())
+	obj, _, err := p.api().Query(ctx, query, ts)
 	if err != nil {
 		NotOK(c, err)
 		return
@@ -59,3 +73,352 @@ func (p *prometheusHandler) Vector(c *gin.Context) {
 	}
 	OK(c, obj)
 }
+
+// @Tags        Agent.V1
+// @Summary     Prometheus Matrix
+// @Description Prometheus 范围查询
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                               true  "cluster"
+// @Param       query   query    string                               true  "query"
+// @Param       start   query    string                               false "开始时间, RFC3339 或秒级时间戳, 默认一小时前"
+// @Param       end     query    string                               false "结束时间, RFC3339 或秒级时间戳, 默认当前时间"
+// @Param       step    query    string                               false "步长, 如 30s 或秒数, 默认按照时间范围计算"
+// @Param       timeout query    string                               false "超时时间, 如 30s, 不能超过配置的超时时间"
+// @Success     200     {object} handlers.ResponseStruct{Data=object} "matrix"
+// @Router      /v1/proxy/cluster/{cluster}/custom/prometheus/v1/matrix [get]
+// @Security    JWT
+func (p *prometheusHandler) Matrix(c *gin.Context) {
+	query, err := p.scopedQuery(c, c.Query("query"))
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	r, err := parsePromRange(c.Query("start"), c.Query("end"), c.Query("step"))
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+
+	ctx, cancel := p.context(c)
+	defer cancel()
+
+	obj, _, err := p.api().QueryRange(ctx, query, r)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	OK(c, obj)
+}
+
+// @Tags        Agent.V1
+// @Summary     Prometheus Series
+// @Description Prometheus 查询时间序列
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                               true  "cluster"
+// @Param       match   query    []string                             true  "series selector, 可以多个"
+// @Param       start   query    string                               false "开始时间, RFC3339 或秒级时间戳, 默认一小时前"
+// @Param       end     query    string                               false "结束时间, RFC3339 或秒级时间戳, 默认当前时间"
+// @Success     200     {object} handlers.ResponseStruct{Data=[]object} "series"
+// @Router      /v1/proxy/cluster/{cluster}/custom/prometheus/v1/series [get]
+// @Security    JWT
+func (p *prometheusHandler) Series(c *gin.Context) {
+	matches := c.QueryArray("match")
+	if len(matches) == 0 {
+		NotOK(c, fmt.Errorf("at least one match is required"))
+		return
+	}
+	matches, err := p.scopedMatches(c, matches)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	start, end, err := parsePromStartEnd(c.Query("start"), c.Query("end"))
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+
+	ctx, cancel := p.context(c)
+	defer cancel()
+
+	series, _, err := p.api().Series(ctx, matches, start, end)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	OK(c, series)
+}
+
+// @Tags        Agent.V1
+// @Summary     Prometheus LabelNames
+// @Description Prometheus 标签列表
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                 true  "cluster"
+// @Param       match   query    []string                               false "series selector, 可以多个"
+// @Param       start   query    string                                 false "开始时间, RFC3339 或秒级时间戳, 默认一小时前"
+// @Param       end     query    string                                 false "结束时间, RFC3339 或秒级时间戳, 默认当前时间"
+// @Success     200     {object} handlers.ResponseStruct{Data=[]string} "labels"
+// @Router      /v1/proxy/cluster/{cluster}/custom/prometheus/v1/labels [get]
+// @Security    JWT
+func (p *prometheusHandler) LabelNames(c *gin.Context) {
+	matches, err := p.scopedMatches(c, c.QueryArray("match"))
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	start, end, err := parsePromStartEnd(c.Query("start"), c.Query("end"))
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+
+	ctx, cancel := p.context(c)
+	defer cancel()
+
+	names, _, err := p.api().LabelNames(ctx, matches, start, end)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	OK(c, names)
+}
+
+// @Tags        Agent.V1
+// @Summary     Prometheus LabelValues
+// @Description Prometheus 标签值列表
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                 true  "cluster"
+// @Param       name    path     string                                 true  "label name"
+// @Param       match   query    []string                               false "series selector, 可以多个"
+// @Param       start   query    string                                 false "开始时间, RFC3339 或秒级时间戳, 默认一小时前"
+// @Param       end     query    string                                 false "结束时间, RFC3339 或秒级时间戳, 默认当前时间"
+// @Success     200     {object} handlers.ResponseStruct{Data=[]string} "label values"
+// @Router      /v1/proxy/cluster/{cluster}/custom/prometheus/v1/labels/{name} [get]
+// @Security    JWT
+func (p *prometheusHandler) LabelValues(c *gin.Context) {
+	matches, err := p.scopedMatches(c, c.QueryArray("match"))
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	start, end, err := parsePromStartEnd(c.Query("start"), c.Query("end"))
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+
+	ctx, cancel := p.context(c)
+	defer cancel()
+
+	values, _, err := p.api().LabelValues(ctx, c.Param("name"), matches, start, end)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	OK(c, values)
+}
+
+// @Tags        Agent.V1
+// @Summary     Prometheus Targets
+// @Description Prometheus 采集目标
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                          true "cluster"
+// @Success     200     {object} handlers.ResponseStruct{Data=v1.TargetsResult} "targets"
+// @Router      /v1/proxy/cluster/{cluster}/custom/prometheus/v1/targets [get]
+// @Security    JWT
+func (p *prometheusHandler) Targets(c *gin.Context) {
+	// 采集目标和规则包含整个集群的信息, 租户内的用户不能查看
+	if err := p.requireUnlimited(c, "targets"); err != nil {
+		NotOK(c, err)
+		return
+	}
+	ctx, cancel := p.context(c)
+	defer cancel()
+
+	targets, err := p.api().Targets(ctx)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	OK(c, targets)
+}
+
+// @Tags        Agent.V1
+// @Summary     Prometheus Rules
+// @Description Prometheus 告警和记录规则
+// @Accept      json
+// @Produce     json
+// @Param       cluster path     string                                        true "cluster"
+// @Success     200     {object} handlers.ResponseStruct{Data=v1.RulesResult} "rules"
+// @Router      /v1/proxy/cluster/{cluster}/custom/prometheus/v1/rules [get]
+// @Security    JWT
+func (p *prometheusHandler) Rules(c *gin.Context) {
+	// 采集目标和规则包含整个集群的信息, 租户内的用户不能查看
+	if err := p.requireUnlimited(c, "rules"); err != nil {
+		NotOK(c, err)
+		return
+	}
+	ctx, cancel := p.context(c)
+	defer cancel()
+
+	rules, err := p.api().Rules(ctx)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	OK(c, rules)
+}
+
+// scopedQuery 租户内的用户只能查询所属环境的namespace, 无法安全改写的查询直接拒绝
+func (p *prometheusHandler) scopedQuery(c *gin.Context, query string) (string, error) {
+	matcher, err := p.namespaceMatcher(c)
+	if err != nil || matcher == "" {
+		return query, err
+	}
+	scoped, err := prometheus.InjectMatcher(query, matcher)
+	if err != nil {
+		return "", apiErrors.NewBadRequest(fmt.Sprintf("unable to restrict query to tenant namespaces: %v", err))
+	}
+	return scoped, nil
+}
+
+// scopedMatches 未指定 series selector 时只返回范围内namespace的数据
+func (p *prometheusHandler) scopedMatches(c *gin.Context, matches []string) ([]string, error) {
+	matcher, err := p.namespaceMatcher(c)
+	if err != nil || matcher == "" {
+		return matches, err
+	}
+	if len(matches) == 0 {
+		return []string{"{" + matcher + "}"}, nil
+	}
+	scoped := make([]string, 0, len(matches))
+	for _, match := range matches {
+		s, err := prometheus.InjectMatcher(match, matcher)
+		if err != nil {
+			return nil, apiErrors.NewBadRequest(fmt.Sprintf("unable to restrict match to tenant namespaces: %v", err))
+		}
+		scoped = append(scoped, s)
+	}
+	return scoped, nil
+}
+
+// namespaceMatcher 不限制时返回空
+func (p *prometheusHandler) namespaceMatcher(c *gin.Context) (string, error) {
+	scope, err := scopeFromRequest(c.Request.Context(), p.cluster.GetClient(), c)
+	if err != nil {
+		return "", err
+	}
+	if scope.Unlimited() {
+		return "", nil
+	}
+	if len(scope.Namespaces) == 0 {
+		return "", scope.Forbidden("namespaces", "")
+	}
+	return prometheus.NamespaceMatcher(scope.Namespaces), nil
+}
+
+func (p *prometheusHandler) requireUnlimited(c *gin.Context, resource string) error {
+	scope, err := scopeFromRequest(c.Request.Context(), p.cluster.GetClient(), c)
+	if err != nil {
+		return err
+	}
+	if !scope.Unlimited() {
+		return scope.Forbidden(resource, "")
+	}
+	return nil
+}
+
+func (p *prometheusHandler) api() v1.API {
+	return v1.NewAPI(p.runtime.Load().Prometheus)
+}
+
+// context 客户端断开时取消查询, timeout 参数只能缩短配置的超时时间
+func (p *prometheusHandler) context(c *gin.Context) (context.Context, context.CancelFunc) {
+	timeout := p.runtime.Load().Options.PrometheusTimeout.Duration
+	if timeout <= 0 {
+		timeout = defaultPrometheusTimeout
+	}
+	if d, err := time.ParseDuration(c.Query("timeout")); err == nil && d > 0 && d < timeout {
+		timeout = d
+	}
+	return context.WithTimeout(c.Request.Context(), timeout)
+}
+
+// parsePromTime 支持 RFC3339 和秒级时间戳, 与 prometheus http api 一致
+func parsePromTime(s string, defaultTime time.Time) (time.Time, error) {
+	if s == "" {
+		return defaultTime, nil
+	}
+	if t, err := parseFiniteFloat(s); err == nil {
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, must be RFC3339 or unix timestamp", s)
+}
+
+func parsePromStartEnd(start, end string) (time.Time, time.Time, error) {
+	now := time.Now()
+	endTime, err := parsePromTime(end, now)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	startTime, err := parsePromTime(start, endTime.Add(-defaultQueryRange))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if startTime.After(endTime) {
+		return time.Time{}, time.Time{}, fmt.Errorf("start time must not be after end time")
+	}
+	return startTime, endTime, nil
+}
+
+// parsePromRange 未指定步长时按照时间范围取大约 60 个点
+func parsePromRange(start, end, step string) (v1.Range, error) {
+	startTime, endTime, err := parsePromStartEnd(start, end)
+	if err != nil {
+		return v1.Range{}, err
+	}
+	r := v1.Range{Start: startTime, End: endTime}
+	switch {
+	case step == "":
+		r.Step = endTime.Sub(startTime) / 60
+		if r.Step < time.Second {
+			r.Step = time.Second
+		}
+	default:
+		if seconds, err := parseFiniteFloat(step); err == nil {
+			r.Step = time.Duration(seconds * float64(time.Second))
+		} else if d, err := time.ParseDuration(step); err == nil {
+			r.Step = d
+		} else {
+			return r, fmt.Errorf("invalid step %q", step)
+		}
+	}
+	if r.Step <= 0 {
+		return r, fmt.Errorf("step must be positive")
+	}
+	if endTime.Sub(startTime)/r.Step > maxQueryRangePoints {
+		return r, fmt.Errorf("exceeded maximum resolution of %d points, increase the step", maxQueryRangePoints)
+	}
+	return r, nil
+}
+
+// parseFiniteFloat strconv.ParseFloat 接受 NaN 和 Inf, 转换成时间后没有意义
+func parseFiniteFloat(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("%q is not a finite number", s)
+	}
+	return f, nil
+}
@@ -0,0 +1,116 @@
+package apis
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePromTime(t *testing.T) {
+	def := time.Unix(100, 0)
+	tests := []struct {
+		name    string
+		s       string
+		want    time.Time
+		wantErr bool
+	}{
+		{name: "default", s: "", want: def},
+		{name: "unix", s: "1700000000", want: time.Unix(1700000000, 0)},
+		{name: "unix with fraction", s: "1700000000.5", want: time.Unix(1700000000, int64(500*time.Millisecond))},
+		{name: "rfc3339", s: "2023-11-14T22:13:20Z", want: time.Unix(1700000000, 0)},
+		{name: "rfc3339 nano", s: "2023-11-14T22:13:20.25+00:00", want: time.Unix(1700000000, int64(250*time.Millisecond))},
+		{name: "nan", s: "NaN", wantErr: true},
+		{name: "inf", s: "+Inf", wantErr: true},
+		{name: "negative inf", s: "-inf", wantErr: true},
+		{name: "invalid", s: "yesterday", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePromTime(tt.s, def)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePromTime(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.Equal(tt.want) {
+				t.Errorf("parsePromTime(%q) = %v, want %v", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePromStartEnd(t *testing.T) {
+	tests := []struct {
+		name      string
+		start     string
+		end       string
+		wantStart time.Time
+		wantEnd   time.Time
+		wantErr   bool
+	}{
+		{name: "start and end", start: "1000", end: "2000", wantStart: time.Unix(1000, 0), wantEnd: time.Unix(2000, 0)},
+		{name: "default range", end: "7200", wantStart: time.Unix(7200, 0).Add(-defaultQueryRange), wantEnd: time.Unix(7200, 0)},
+		{name: "start after end", start: "2000", end: "1000", wantErr: true},
+		{name: "invalid start", start: "NaN", end: "1000", wantErr: true},
+		{name: "invalid end", start: "1000", end: "Inf", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, err := parsePromStartEnd(tt.start, tt.end)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePromStartEnd() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("parsePromStartEnd() = %v, %v, want %v, %v", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+
+	// 未指定结束时间时使用当前时间
+	start, end, err := parsePromStartEnd("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(end); d < 0 || d > time.Minute {
+		t.Errorf("parsePromStartEnd() end = %v, want now", end)
+	}
+	if got := end.Sub(start); got != defaultQueryRange {
+		t.Errorf("parsePromStartEnd() range = %v, want %v", got, defaultQueryRange)
+	}
+}
+
+func TestParsePromRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    string
+		end      string
+		step     string
+		wantStep time.Duration
+		wantErr  bool
+	}{
+		{name: "auto step", start: "0", end: "3600", wantStep: time.Minute},
+		{name: "auto step at least one second", start: "0", end: "30", wantStep: time.Second},
+		{name: "seconds step", start: "0", end: "3600", step: "15", wantStep: 15 * time.Second},
+		{name: "fractional step", start: "0", end: "60", step: "0.5", wantStep: 500 * time.Millisecond},
+		{name: "duration step", start: "0", end: "3600", step: "5m", wantStep: 5 * time.Minute},
+		{name: "zero step", start: "0", end: "3600", step: "0", wantErr: true},
+		{name: "negative step", start: "0", end: "3600", step: "-1m", wantErr: true},
+		{name: "nan step", start: "0", end: "3600", step: "NaN", wantErr: true},
+		{name: "inf step", start: "0", end: "3600", step: "Inf", wantErr: true},
+		{name: "invalid step", start: "0", end: "3600", step: "fast", wantErr: true},
+		{name: "max points", start: "0", end: "11000", step: "1", wantStep: time.Second},
+		{name: "exceeded max points", start: "0", end: "11001", step: "1", wantErr: true},
+		{name: "invalid range", start: "3600", end: "0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePromRange(tt.start, tt.end, tt.step)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePromRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.Step != tt.wantStep {
+				t.Errorf("parsePromRange() step = %v, want %v", got.Step, tt.wantStep)
+			}
+		})
+	}
+}
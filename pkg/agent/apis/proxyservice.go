@@ -1,45 +1,300 @@
 package apis
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/agent/cluster"
+	"github.com/sunweiwe/kuber/pkg/log"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-type ServiceProxyHandler struct{}
+const (
+	defaultProxyDialTimeout = 10 * time.Second
+	defaultProxyTimeout     = 60 * time.Second
 
-func (sp *ServiceProxyHandler) ServiceProxy(c *gin.Context) {
-	var host string
-	namespace := c.Request.Header.Get("namespace")
-	service := c.Request.Header.Get("service")
-	port := c.Request.Header.Get("port")
+	serviceProxyPrefix = "/v1/service-proxy"
+	// 上游网关去掉的路径前缀, 与代理路径一起作为后端 UI 的根路径
+	headerForwardedPrefix = "X-Forwarded-Prefix"
+)
+
+// Set-Cookie 中的 Path 属性
+var cookiePathRegexp = regexp.MustCompile(`(?i)(;\s*path=)([^;]*)`)
+
+type ServiceProxyHandler struct {
+	cluster cluster.Interface
+	runtime *Runtime
+
+	// 配置更新后重新创建
+	mu        sync.Mutex
+	options   *ServiceProxyOptions
+	transport *http.Transport
+}
+
+type proxyTarget struct {
+	scheme    string
+	namespace string
+	service   string
+	port      string
+	// 后端的路径
+	path string
+	// 调用方访问后端根路径使用的路径
+	prefix string
+}
+
+func (t *proxyTarget) host() string {
+	host := fmt.Sprintf("%s.%s.svc", t.service, t.namespace)
+	if t.port != "" {
+		host = net.JoinHostPort(host, t.port)
+	}
+	return host
+}
+
+// ServiceProxy 代理到集群内的 service, 支持 https 后端和 websocket
+// 后端返回的 Location 和 Cookie 的 Path 改写为代理的路径, 后端 UI 可以使用 X-Forwarded-Prefix 配置根路径
+// @Tags        Agent.V1
+// @Summary     service proxy
+// @Description service 的格式为 [scheme:]name[:port], 如 https:grafana:3000, 租户内的用户只能访问租户的 namespace 和允许的 service
+// @Param       namespace path string true  "namespace"
+// @Param       service   path string true  "[scheme:]name[:port]"
+// @Param       realpath  path string false "后端路径"
+// @Success     200       {object} object "proxied response"
+// @Router      /v1/service-proxy/namespaces/{namespace}/services/{service}/proxy/{realpath} [get]
+// @Security    JWT
+func (h *ServiceProxyHandler) ServiceProxy(c *gin.Context) {
+	target, err := proxyTargetFromRequest(c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	// 后端页面中的相对路径需要以 / 结尾的根路径
+	if c.Param("namespace") != "" && !strings.HasSuffix(c.Request.URL.Path, "/") && c.Param("realpath") == "" {
+		location := target.prefix + "/"
+		if c.Request.URL.RawQuery != "" {
+			location += "?" + c.Request.URL.RawQuery
+		}
+		c.Redirect(http.StatusMovedPermanently, location)
+		return
+	}
+	options := h.runtime.Load().Options.ServiceProxy
+	scope, err := scopeFromRequest(c.Request.Context(), h.cluster.GetClient(), c)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	if !scope.Contains(target.namespace) && !serviceAllowed(options.AllowedServices, scope.Tenant, target.namespace, target.service) {
+		NotOK(c, scope.Forbidden("services", target.namespace+"/"+target.service))
+		return
+	}
+	transport, err := h.transportFor(options)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+
+	backend := &url.URL{Scheme: target.scheme, Host: target.host()}
+	proxy := &httputil.ReverseProxy{
+		Transport: transport,
+		Director: func(r *http.Request) {
+			r.Host = backend.Host
+			r.URL.Scheme = backend.Scheme
+			r.URL.Host = backend.Host
+			r.URL.Path = target.path
+			r.URL.RawPath = ""
+			// 保留原始的 query, 重新编码会改变参数顺序和转义
+			r.URL.RawQuery = c.Request.URL.RawQuery
+			r.Header.Set(headerForwardedPrefix, target.prefix)
+			if r.Header.Get("X-Forwarded-Host") == "" {
+				r.Header.Set("X-Forwarded-Host", c.Request.Host)
+			}
+			if r.Header.Get("X-Forwarded-Proto") == "" {
+				proto := "http"
+				if c.Request.TLS != nil {
+					proto = "https"
+				}
+				r.Header.Set("X-Forwarded-Proto", proto)
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			if location := resp.Header.Get("Location"); location != "" {
+				resp.Header.Set("Location", rewriteLocation(location, target.prefix, backend))
+			}
+			cookies := resp.Header.Values("Set-Cookie")
+			for i, cookie := range cookies {
+				cookies[i] = rewriteCookiePath(cookie, target.prefix)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			log.Error(err, "service proxy", "target", backend.String(), "path", target.path)
+			status := metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusBadGateway,
+				Reason:  metav1.StatusReasonServiceUnavailable,
+				Message: fmt.Sprintf("proxy to %s: %v", backend.String(), err),
+			}
+			var netErr net.Error
+			if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+				status.Code, status.Reason = http.StatusGatewayTimeout, metav1.StatusReasonTimeout
+			}
+			NotOK(c, &apiErrors.StatusError{ErrStatus: status})
+		},
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
 
-	if port == "" {
-		host = fmt.Sprintf("%s.%s.svc", service, namespace)
+// proxyTargetFromRequest 兼容通过 namespace/service/port header 指定 service 的旧接口
+func proxyTargetFromRequest(c *gin.Context) (*proxyTarget, error) {
+	forwardedPrefix := strings.TrimSuffix(c.GetHeader(headerForwardedPrefix), "/")
+	realpath := strings.TrimPrefix(c.Param("realpath"), "/")
+
+	target := &proxyTarget{scheme: "http", path: "/" + realpath}
+	if namespace := c.Param("namespace"); namespace != "" {
+		service := c.Param("service")
+		target.namespace = namespace
+		target.prefix = fmt.Sprintf("%s%s/namespaces/%s/services/%s/proxy", forwardedPrefix, serviceProxyPrefix, namespace, service)
+		parts := strings.Split(service, ":")
+		if len(parts) > 1 && (parts[0] == "http" || parts[0] == "https") {
+			target.scheme, parts = parts[0], parts[1:]
+		}
+		switch len(parts) {
+		case 1:
+			target.service = parts[0]
+		case 2:
+			target.service, target.port = parts[0], parts[1]
+		default:
+			return nil, fmt.Errorf("invalid service %q, must be [scheme:]name[:port]", service)
+		}
 	} else {
-		host = fmt.Sprintf("%s.%s.svc:%s", service, namespace, port)
+		if realpath == "_" {
+			target.path = "/"
+		}
+		target.namespace = c.GetHeader("namespace")
+		target.service = c.GetHeader("service")
+		target.port = c.GetHeader("port")
+		if scheme := c.GetHeader("scheme"); scheme != "" {
+			target.scheme = scheme
+		}
+		target.prefix = forwardedPrefix + serviceProxyPrefix
+	}
+	if target.namespace == "" || target.service == "" {
+		return nil, fmt.Errorf("namespace and service are required")
+	}
+	if target.scheme != "http" && target.scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q, must be http or https", target.scheme)
 	}
+	if strings.ContainsAny(target.namespace+target.service+target.port, "/.@?#") {
+		return nil, fmt.Errorf("invalid service %s/%s", target.namespace, target.service)
+	}
+	return target, nil
+}
 
-	targetHost := url.URL{
-		Host:   host,
-		Scheme: "http",
+// transportFor 复用连接, 配置变化时重新创建
+func (h *ServiceProxyHandler) transportFor(options *ServiceProxyOptions) (*http.Transport, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.transport != nil && h.options == options {
+		return h.transport, nil
 	}
 
-	realpath := c.Param("realpath")
-	if realpath == "_" {
-		realpath = ""
+	tlsConfig := &tls.Config{InsecureSkipVerify: options.InsecureSkipVerify} //nolint:gosec
+	if options.CAFile != "" {
+		content, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate found in %s", options.CAFile)
+		}
+		tlsConfig.RootCAs = pool
 	}
+	if h.transport != nil {
+		h.transport.CloseIdleConnections()
+	}
+	h.options = options
+	h.transport = &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: options.DialTimeout.Duration, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   options.DialTimeout.Duration,
+		ResponseHeaderTimeout: options.Timeout.Duration,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return h.transport, nil
+}
 
-	proxy := httputil.NewSingleHostReverseProxy(&targetHost)
-	proxy.Director = func(r *http.Request) {
-		r.Host = host
-		r.URL.Host = host
-		r.URL.Scheme = "http"
-		r.URL.Path = "/" + realpath
-		r.URL.RawQuery = c.Request.URL.Query().Encode()
+// parseAllowedService 解析 tenant:namespace/service 格式, namespace 不能为 *
+func parseAllowedService(entry string) (tenant, namespace, service string, err error) {
+	tenant, rest, found := strings.Cut(entry, ":")
+	if found {
+		namespace, service, found = strings.Cut(rest, "/")
 	}
-	proxy.ServeHTTP(c.Writer, c.Request)
+	if !found || tenant == "" || namespace == "" || namespace == "*" || service == "" {
+		return "", "", "", fmt.Errorf("invalid entry %q, must be tenant:namespace/service", entry)
+	}
+	return tenant, namespace, service, nil
+}
+
+func serviceAllowed(allowed []string, tenant, namespace, service string) bool {
+	for _, entry := range allowed {
+		t, ns, svc, err := parseAllowedService(entry)
+		if err != nil {
+			continue
+		}
+		if (t == "*" || t == tenant) && ns == namespace && (svc == "*" || svc == service) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteLocation 后端的绝对路径加上代理的前缀, 指向其他地址的 Location 不变
+func rewriteLocation(location, prefix string, backend *url.URL) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	if u.IsAbs() {
+		if !strings.EqualFold(u.Host, backend.Host) {
+			return location
+		}
+		u.Scheme, u.Host = "", ""
+	} else if u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return location
+	}
+	// 后端已经配置了根路径
+	if u.Path != prefix && !strings.HasPrefix(u.Path, prefix+"/") {
+		u.Path = prefix + u.Path
+		u.RawPath = ""
+	}
+	return u.String()
+}
+
+func rewriteCookiePath(cookie, prefix string) string {
+	return cookiePathRegexp.ReplaceAllStringFunc(cookie, func(attr string) string {
+		match := cookiePathRegexp.FindStringSubmatch(attr)
+		path := strings.TrimSpace(match[2])
+		if !strings.HasPrefix(path, "/") || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return attr
+		}
+		return match[1] + prefix + path
+	})
 }
@@ -0,0 +1,107 @@
+package apis
+
+import (
+	"net/url"
+	"testing"
+)
+
+const testProxyPrefix = "/internal/proxy/namespaces/monitoring/services/grafana"
+
+func TestParseAllowedService(t *testing.T) {
+	tests := []struct {
+		entry         string
+		wantTenant    string
+		wantNamespace string
+		wantService   string
+		wantErr       bool
+	}{
+		{entry: "t1:monitoring/grafana", wantTenant: "t1", wantNamespace: "monitoring", wantService: "grafana"},
+		{entry: "*:public/*", wantTenant: "*", wantNamespace: "public", wantService: "*"},
+		{entry: "monitoring/grafana", wantErr: true},
+		{entry: "t1:monitoring", wantErr: true},
+		{entry: ":monitoring/grafana", wantErr: true},
+		{entry: "t1:/grafana", wantErr: true},
+		{entry: "t1:*/grafana", wantErr: true},
+		{entry: "t1:monitoring/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			tenant, namespace, service, err := parseAllowedService(tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAllowedService() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tenant != tt.wantTenant || namespace != tt.wantNamespace || service != tt.wantService {
+				t.Errorf("parseAllowedService() = %q, %q, %q", tenant, namespace, service)
+			}
+		})
+	}
+}
+
+func TestServiceAllowed(t *testing.T) {
+	allowed := []string{"t1:monitoring/grafana", "*:public/*", "invalid", "t2:*/web"}
+	tests := []struct {
+		tenant    string
+		namespace string
+		service   string
+		want      bool
+	}{
+		{tenant: "t1", namespace: "monitoring", service: "grafana", want: true},
+		{tenant: "t1", namespace: "monitoring", service: "prometheus"},
+		{tenant: "t2", namespace: "monitoring", service: "grafana"},
+		{tenant: "t3", namespace: "public", service: "docs", want: true},
+		{tenant: "t3", namespace: "public-2", service: "docs"},
+		// 无效的条目被忽略, namespace 不能是通配符
+		{tenant: "t2", namespace: "default", service: "web"},
+	}
+	for _, tt := range tests {
+		if got := serviceAllowed(allowed, tt.tenant, tt.namespace, tt.service); got != tt.want {
+			t.Errorf("serviceAllowed(%s, %s/%s) = %v, want %v", tt.tenant, tt.namespace, tt.service, got, tt.want)
+		}
+	}
+	if serviceAllowed(nil, "t1", "monitoring", "grafana") {
+		t.Errorf("serviceAllowed() without entries = true")
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	backend := &url.URL{Scheme: "http", Host: "grafana.monitoring:3000"}
+	tests := []struct {
+		location string
+		want     string
+	}{
+		{location: "/login", want: testProxyPrefix + "/login"},
+		{location: "/login?redirect=%2F", want: testProxyPrefix + "/login?redirect=%2F"},
+		{location: "http://grafana.monitoring:3000/login", want: testProxyPrefix + "/login"},
+		{location: "HTTP://Grafana.Monitoring:3000/login", want: testProxyPrefix + "/login"},
+		{location: testProxyPrefix + "/login", want: testProxyPrefix + "/login"},
+		{location: testProxyPrefix, want: testProxyPrefix},
+		{location: "https://sso.example.com/login", want: "https://sso.example.com/login"},
+		{location: "//sso.example.com/login", want: "//sso.example.com/login"},
+		{location: "login", want: "login"},
+		{location: "://invalid", want: "://invalid"},
+	}
+	for _, tt := range tests {
+		if got := rewriteLocation(tt.location, testProxyPrefix, backend); got != tt.want {
+			t.Errorf("rewriteLocation(%q) = %q, want %q", tt.location, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteCookiePath(t *testing.T) {
+	tests := []struct {
+		cookie string
+		want   string
+	}{
+		{cookie: "sid=1; Path=/", want: "sid=1; Path=" + testProxyPrefix + "/"},
+		{cookie: "sid=1; path=/app; HttpOnly", want: "sid=1; path=" + testProxyPrefix + "/app; HttpOnly"},
+		{cookie: "sid=1; Path= /app", want: "sid=1; Path=" + testProxyPrefix + "/app"},
+		{cookie: "sid=1; Path=" + testProxyPrefix + "/app", want: "sid=1; Path=" + testProxyPrefix + "/app"},
+		{cookie: "sid=1; Path=app", want: "sid=1; Path=app"},
+		{cookie: "sid=1; HttpOnly", want: "sid=1; HttpOnly"},
+	}
+	for _, tt := range tests {
+		if got := rewriteCookiePath(tt.cookie, testProxyPrefix); got != tt.want {
+			t.Errorf("rewriteCookiePath(%q) = %q, want %q", tt.cookie, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package apis
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/api"
+	"github.com/sunweiwe/kuber/pkg/utils/httpsigs"
+)
+
+// Runtime 可以热更新的配置
+// 更新时整体替换, 正在进行的请求和已经建立的 websocket 连接继续使用旧的配置
+type Runtime struct {
+	value atomic.Value
+	// 令牌桶在 NewRuntime 中创建, 配置更新时保留, 只更新速率
+	transfer *TransferLimiter
+}
+
+type RuntimeConfig struct {
+	Hash       string
+	Options    *Options
+	Debug      *DebugOptions
+	Prometheus api.Client
+}
+
+func NewRuntime(options *Options, debugOptions *DebugOptions, hash string) (*Runtime, error) {
+	r := &Runtime{transfer: NewTransferLimiter(options.File)}
+	if err := r.Update(options, debugOptions, hash); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Update 创建新的客户端后再替换, 失败时保留原有配置
+func (r *Runtime) Update(options *Options, debugOptions *DebugOptions, hash string) error {
+	prometheus, err := api.NewClient(api.Config{Address: options.PrometheusServer})
+	if err != nil {
+		return err
+	}
+	httpsigs.GetSigner().SetToken(options.SignerToken)
+	r.transfer.SetRates(options.File)
+	r.value.Store(&RuntimeConfig{
+		Hash:       hash,
+		Options:    options,
+		Debug:      debugOptions,
+		Prometheus: prometheus,
+	})
+	return nil
+}
+
+func (r *Runtime) Load() *RuntimeConfig {
+	return r.value.Load().(*RuntimeConfig)
+}
+
+// Transfer 所有文件传输共享的限速器
+func (r *Runtime) Transfer() *TransferLimiter {
+	return r.transfer
+}
@@ -0,0 +1,99 @@
+package apis
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/agent/middleware"
+	"github.com/sunweiwe/kuber/pkg/api/kuber/v1beta1"
+	"github.com/sunweiwe/kuber/pkg/utils/httpsigs"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// 调用方信息, 由 service 代理请求时通过 header 传入, 与请求一起签名
+const (
+	HeaderUser        = httpsigs.HeaderUser
+	HeaderTenant      = httpsigs.HeaderTenant
+	HeaderEnvironment = httpsigs.HeaderEnvironment
+	HeaderRole        = httpsigs.HeaderRole
+)
+
+// RoleSystemAdmin 平台管理员, 不指定租户时可以访问所有namespace
+const RoleSystemAdmin = "sysadmin"
+
+// Scope 调用方可以访问的namespace范围
+type Scope struct {
+	User        string
+	Tenant      string
+	Environment string
+	// 租户内的角色, 不指定租户时为 RoleSystemAdmin 表示平台管理员
+	Role string
+	// Namespaces 为 nil 时不限制
+	Namespaces []string
+}
+
+func (s *Scope) Unlimited() bool {
+	return s.Namespaces == nil
+}
+
+func (s *Scope) Contains(namespace string) bool {
+	if s.Unlimited() {
+		return true
+	}
+	for _, ns := range s.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// Forbidden 超出调用方范围时返回 403
+func (s *Scope) Forbidden(resource, name string) error {
+	return apiErrors.NewForbidden(schema.GroupResource{Resource: resource}, name,
+		fmt.Errorf("user %q of tenant %q has no access", s.User, s.Tenant))
+}
+
+// scopeFromRequest 根据租户和环境解析出可以访问的namespace, 默认拒绝:
+// 身份 header 未经签名或者可信网关时返回 401;
+// 未指定租户时只有平台管理员和不带任何身份的内部调用不做限制, 其他用户为空列表;
+// 租户下没有环境时为空列表
+func scopeFromRequest(ctx context.Context, cli client.Client, c *gin.Context) (*Scope, error) {
+	if !middleware.Authenticated(c) {
+		return nil, apiErrors.NewUnauthorized("caller identity is not signed")
+	}
+	scope := &Scope{
+		User:        c.GetHeader(HeaderUser),
+		Tenant:      c.GetHeader(HeaderTenant),
+		Environment: c.GetHeader(HeaderEnvironment),
+		Role:        c.GetHeader(HeaderRole),
+	}
+	if scope.Tenant == "" {
+		internal := scope.User == "" && scope.Role == "" && scope.Environment == ""
+		if !internal && scope.Role != RoleSystemAdmin {
+			scope.Namespaces = []string{}
+		}
+		return scope, nil
+	}
+
+	envs := &v1beta1.EnvironmentList{}
+	if err := cli.List(ctx, envs); err != nil {
+		return nil, fmt.Errorf("list environments: %v", err)
+	}
+	scope.Namespaces = []string{}
+	for _, env := range envs.Items {
+		if env.Spec.Tenant != scope.Tenant || env.Spec.Namespace == "" {
+			continue
+		}
+		if scope.Environment != "" && env.Name != scope.Environment {
+			continue
+		}
+		scope.Namespaces = append(scope.Namespaces, env.Spec.Namespace)
+	}
+	sort.Strings(scope.Namespaces)
+	return scope, nil
+}
@@ -0,0 +1,160 @@
+package apis
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/agent/middleware"
+	"github.com/sunweiwe/kuber/pkg/api/kuber/v1beta1"
+	"github.com/sunweiwe/kuber/pkg/utils/httpsigs"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestScopeFromRequest(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := v1beta1.SchemeBuilder.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	env := func(name, tenant, namespace string) *v1beta1.Environment {
+		return &v1beta1.Environment{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       v1beta1.EnvironmentSpec{Tenant: tenant, Namespace: namespace},
+		}
+	}
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		env("dev", "t1", "t1-dev"),
+		env("prod", "t1", "t1-prod"),
+		env("other", "t2", "t2-dev"),
+	).Build()
+
+	tests := []struct {
+		name           string
+		header         map[string]string
+		signed         bool
+		trusted        bool
+		wantUnlimited  bool
+		wantNamespaces []string
+		wantErr        bool
+	}{
+		{
+			name:    "unsigned without identity",
+			wantErr: true,
+		},
+		{
+			name:    "unsigned admin",
+			header:  map[string]string{HeaderUser: "admin", HeaderRole: RoleSystemAdmin},
+			wantErr: true,
+		},
+		{
+			name:          "signed internal caller",
+			signed:        true,
+			wantUnlimited: true,
+		},
+		{
+			name:          "signed system admin",
+			header:        map[string]string{HeaderUser: "admin", HeaderRole: RoleSystemAdmin},
+			signed:        true,
+			wantUnlimited: true,
+		},
+		{
+			name:           "signed user without tenant",
+			header:         map[string]string{HeaderUser: "alice"},
+			signed:         true,
+			wantNamespaces: []string{},
+		},
+		{
+			name:           "signed role without tenant",
+			header:         map[string]string{HeaderRole: "admin"},
+			signed:         true,
+			wantNamespaces: []string{},
+		},
+		{
+			name:           "signed tenant",
+			header:         map[string]string{HeaderUser: "alice", HeaderTenant: "t1"},
+			signed:         true,
+			wantNamespaces: []string{"t1-dev", "t1-prod"},
+		},
+		{
+			name:           "system admin role inside tenant",
+			header:         map[string]string{HeaderUser: "alice", HeaderTenant: "t1", HeaderRole: RoleSystemAdmin},
+			signed:         true,
+			wantNamespaces: []string{"t1-dev", "t1-prod"},
+		},
+		{
+			name:           "trusted gateway with environment",
+			header:         map[string]string{HeaderUser: "alice", HeaderTenant: "t1", HeaderEnvironment: "prod"},
+			trusted:        true,
+			wantNamespaces: []string{"t1-prod"},
+		},
+		{
+			name:           "tenant without environments",
+			header:         map[string]string{HeaderUser: "bob", HeaderTenant: "t3"},
+			trusted:        true,
+			wantNamespaces: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/custom/system/v1/sessions", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			if tt.signed {
+				httpsigs.GetSigner().Sign(req, "")
+			}
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = req
+			middleware.SignerMiddleware(
+				func() bool { return tt.signed },
+				func(*http.Request) bool { return tt.trusted },
+			)(c)
+
+			scope, err := scopeFromRequest(context.Background(), cli, c)
+			if tt.wantErr {
+				if !apiErrors.IsUnauthorized(err) {
+					t.Fatalf("scopeFromRequest() error = %v, want unauthorized", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("scopeFromRequest() error = %v", err)
+			}
+			if scope.Unlimited() != tt.wantUnlimited {
+				t.Fatalf("scopeFromRequest() unlimited = %v, want %v", scope.Unlimited(), tt.wantUnlimited)
+			}
+			if !tt.wantUnlimited && !reflect.DeepEqual(scope.Namespaces, tt.wantNamespaces) {
+				t.Errorf("scopeFromRequest() namespaces = %v, want %v", scope.Namespaces, tt.wantNamespaces)
+			}
+		})
+	}
+}
+
+func TestOptionsTrustedProxy(t *testing.T) {
+	o := &Options{TrustedProxies: []string{"10.0.0.0/8", "fd00::/8"}}
+	tests := []struct {
+		remoteAddr string
+		want       bool
+	}{
+		{remoteAddr: "10.1.2.3:4567", want: true},
+		{remoteAddr: "[fd00::1]:4567", want: true},
+		{remoteAddr: "192.168.1.1:4567", want: false},
+		{remoteAddr: "invalid", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Forwarded-For", "10.0.0.1")
+			if got := o.TrustedProxy(req); got != tt.want {
+				t.Errorf("TrustedProxy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package apis
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/agent/ws"
+	"github.com/sunweiwe/kuber/pkg/log"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// serveTerminal 升级 websocket 后运行交互式终端并记录审计, 连接断开时结束远端的命令
+// websocket 建立后的错误发送给客户端, channel 协议写到 error channel
+// tty 为 false 时 executor 也不能使用 TTY, stderr 单独发送, 不支持调整终端大小
+func serveTerminal(c *gin.Context, options *Options, kind, namespace, pod, container string, tty bool, newExecutor func() (remotecommand.Executor, error)) {
+	conn, err := ws.InitWebsocket(c.Writer, c.Request, options.Websocket)
+	if err != nil {
+		log.Infof("Upgrade websocket failed: %s", err.Error())
+		return
+	}
+	defer conn.WsClose()
+
+	exec, err := newExecutor()
+	if err != nil {
+		log.Infof("Init exec failed: %s", err.Error())
+		_ = conn.WriteError(err.Error())
+		return
+	}
+	ctx, cancel := conn.Context(c.Request.Context())
+	defer cancel()
+
+	stream := newAuditStream(c, options.Audit, ws.NewStreamHandler(conn), kind, namespace, pod, container)
+	streamOptions := remotecommand.StreamOptions{
+		Stdin:             stream,
+		Stdout:            stream,
+		Stderr:            stream,
+		TerminalSizeQueue: stream,
+		Tty:               true,
+	}
+	if !tty {
+		streamOptions.Stderr = stream.Stderr()
+		streamOptions.TerminalSizeQueue = nil
+		streamOptions.Tty = false
+	}
+	err = exec.StreamWithContext(ctx, streamOptions)
+	stream.Finish(err)
+	if err != nil && ctx.Err() == nil {
+		_ = conn.WriteError(err.Error())
+	}
+}
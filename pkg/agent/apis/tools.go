@@ -1,6 +1,15 @@
 package apis
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
 	"github.com/gin-gonic/gin"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
@@ -41,3 +50,50 @@ func labelSelector(c *gin.Context) labels.Selector {
 	sel := labels.SelectorFromSet(labelsMap)
 	return sel
 }
+
+// upstreamURL 拼接 loki/jaeger 等上游服务的地址
+func upstreamURL(server, path string, params url.Values) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSuffix(server, "/") + path)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = params.Encode()
+	return u, nil
+}
+
+// getJSON 请求上游服务并解析json, 非200时返回上游的错误信息
+func getJSON(ctx context.Context, u *url.URL, into interface{}) error {
+	return doJSON(ctx, http.MethodGet, u, nil, into)
+}
+
+// doJSON body 不为空时以json发送, into 为空时不解析返回内容
+func doJSON(ctx context.Context, method string, u *url.URL, body, into interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(content)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		content, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s %s: %s", u.Host, resp.Status, strings.TrimSpace(string(content)))
+	}
+	if into == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
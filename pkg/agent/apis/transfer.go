@@ -0,0 +1,216 @@
+package apis
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/agent/middleware"
+	"github.com/sunweiwe/kuber/pkg/utils/prometheus/exporter"
+	"golang.org/x/time/rate"
+)
+
+const (
+	DirectionDownload = "download"
+	DirectionUpload   = "upload"
+
+	// 空闲超过该时间的用户令牌桶会被回收
+	transferLimiterIdle = 10 * time.Minute
+	// 单次等待令牌的最大字节数, 同时作为令牌桶的最小容量
+	transferChunkSize = 32 * 1024
+	anonymousUser     = "anonymous"
+)
+
+// TransferLimiter 同一个用户的所有传输共享一个令牌桶, agent 的所有传输再共享一个令牌桶
+// 配置热更新时只修改速率, 已有的令牌桶继续使用
+type TransferLimiter struct {
+	mu sync.Mutex
+	// 每个用户的速率, bytes/s
+	rates  map[string]int
+	agent  map[string]*rate.Limiter
+	users  map[transferUser]*userLimiter
+	lastGC time.Time
+}
+
+type transferUser struct {
+	user      string
+	direction string
+}
+
+type userLimiter struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+func NewTransferLimiter(options *FileOptions) *TransferLimiter {
+	l := &TransferLimiter{
+		agent:  map[string]*rate.Limiter{},
+		users:  map[transferUser]*userLimiter{},
+		lastGC: time.Now(),
+	}
+	l.SetRates(options)
+	return l
+}
+
+// SetRates 速率为 0 时不限速
+func (l *TransferLimiter) SetRates(options *FileOptions) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rates = map[string]int{
+		DirectionDownload: options.DownloadRate,
+		DirectionUpload:   options.UploadRate,
+	}
+	agentRates := map[string]int{
+		DirectionDownload: options.AgentDownloadRate,
+		DirectionUpload:   options.AgentUploadRate,
+	}
+	for direction, speed := range agentRates {
+		if limiter, ok := l.agent[direction]; ok {
+			setLimit(limiter, speed)
+		} else {
+			l.agent[direction] = newLimiter(speed)
+		}
+	}
+	for key, user := range l.users {
+		setLimit(user.limiter, l.rates[key.direction])
+	}
+}
+
+// Writer 写入前等待令牌, ctx 取消时返回 ctx 的错误
+func (l *TransferLimiter) Writer(ctx context.Context, user, direction string, w io.Writer) io.Writer {
+	return &limitedWriter{transfer: l.transfer(ctx, user, direction), w: w}
+}
+
+// Reader 读取后等待令牌, 读取的数据量不超过令牌桶的容量
+func (l *TransferLimiter) Reader(ctx context.Context, user, direction string, r io.Reader) io.Reader {
+	return &limitedReader{transfer: l.transfer(ctx, user, direction), r: r}
+}
+
+// transferIdentity 限速和统计使用的用户, 身份 header 未经签名或者可信网关时都作为匿名用户, 避免伪造用户绕过限速
+func transferIdentity(c *gin.Context) string {
+	if !middleware.Authenticated(c) {
+		return anonymousUser
+	}
+	return c.GetHeader(HeaderUser)
+}
+
+func (l *TransferLimiter) transfer(ctx context.Context, user, direction string) *transfer {
+	if user == "" {
+		user = anonymousUser
+	}
+	return &transfer{ctx: ctx, limiter: l, user: user, direction: direction, metrics: exporter.GetTransferCollector()}
+}
+
+// limiters 返回用户和 agent 的令牌桶
+func (l *TransferLimiter) limiters(user, direction string) (*rate.Limiter, *rate.Limiter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastGC) > transferLimiterIdle {
+		for key, u := range l.users {
+			if now.Sub(u.lastUsed) > transferLimiterIdle {
+				delete(l.users, key)
+			}
+		}
+		l.lastGC = now
+	}
+	key := transferUser{user: user, direction: direction}
+	u, ok := l.users[key]
+	if !ok {
+		u = &userLimiter{limiter: newLimiter(l.rates[direction])}
+		l.users[key] = u
+	}
+	u.lastUsed = now
+	return u.limiter, l.agent[direction]
+}
+
+type transfer struct {
+	ctx       context.Context
+	limiter   *TransferLimiter
+	user      string
+	direction string
+	metrics   *exporter.TransferCollector
+}
+
+// wait n 不超过 transferChunkSize
+func (t *transfer) wait(n int) error {
+	user, agent := t.limiter.limiters(t.user, t.direction)
+	if err := user.WaitN(t.ctx, n); err != nil {
+		return err
+	}
+	if err := agent.WaitN(t.ctx, n); err != nil {
+		return err
+	}
+	t.metrics.Add(t.user, t.direction, n)
+	return nil
+}
+
+type limitedWriter struct {
+	*transfer
+	w io.Writer
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > transferChunkSize {
+			n = transferChunkSize
+		}
+		if err := lw.wait(n); err != nil {
+			return written, err
+		}
+		m, err := lw.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+type limitedReader struct {
+	*transfer
+	r io.Reader
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > transferChunkSize {
+		p = p[:transferChunkSize]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if waitErr := lr.wait(n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func limitOf(speed int) rate.Limit {
+	if speed <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(speed)
+}
+
+func burstOf(speed int) int {
+	if speed < transferChunkSize {
+		return transferChunkSize
+	}
+	return speed
+}
+
+func newLimiter(speed int) *rate.Limiter {
+	return rate.NewLimiter(limitOf(speed), burstOf(speed))
+}
+
+func setLimit(limiter *rate.Limiter, speed int) {
+	limiter.SetLimit(limitOf(speed))
+	limiter.SetBurst(burstOf(speed))
+}
@@ -0,0 +1,124 @@
+package apis
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sunweiwe/kuber/pkg/agent/middleware"
+	"golang.org/x/time/rate"
+)
+
+func TestTransferLimiterLimiters(t *testing.T) {
+	options := NewDefaultFileOptions()
+	options.DownloadRate = 64 * 1024
+	options.UploadRate = 0
+	options.AgentDownloadRate = 1024 * 1024
+	l := NewTransferLimiter(options)
+
+	alice, agent := l.limiters("alice", DirectionDownload)
+	if alice.Limit() != rate.Limit(64*1024) || alice.Burst() != 64*1024 {
+		t.Errorf("user limiter = %v/%d", alice.Limit(), alice.Burst())
+	}
+	if agent.Limit() != rate.Limit(1024*1024) {
+		t.Errorf("agent limiter = %v", agent.Limit())
+	}
+	// 同一个用户同一个方向共享令牌桶
+	if again, _ := l.limiters("alice", DirectionDownload); again != alice {
+		t.Errorf("limiter of the same user is not shared")
+	}
+	if bob, _ := l.limiters("bob", DirectionDownload); bob == alice {
+		t.Errorf("limiter of different users is shared")
+	}
+	upload, _ := l.limiters("alice", DirectionUpload)
+	if upload == alice || upload.Limit() != rate.Inf {
+		t.Errorf("upload limiter = %v", upload.Limit())
+	}
+
+	// 更新速率时保留已有的令牌桶
+	options.DownloadRate = 16 * 1024
+	l.SetRates(options)
+	if updated, _ := l.limiters("alice", DirectionDownload); updated != alice || updated.Limit() != rate.Limit(16*1024) || updated.Burst() != transferChunkSize {
+		t.Errorf("updated limiter = %v/%d", updated.Limit(), updated.Burst())
+	}
+}
+
+func TestTransferLimiterGC(t *testing.T) {
+	l := NewTransferLimiter(NewDefaultFileOptions())
+	l.limiters("idle", DirectionDownload)
+	l.limiters("active", DirectionDownload)
+	past := time.Now().Add(-2 * transferLimiterIdle)
+	l.users[transferUser{user: "idle", direction: DirectionDownload}].lastUsed = past
+	l.lastGC = past
+
+	l.limiters("active", DirectionDownload)
+	if _, ok := l.users[transferUser{user: "idle", direction: DirectionDownload}]; ok {
+		t.Errorf("idle user limiter is not collected")
+	}
+	if _, ok := l.users[transferUser{user: "active", direction: DirectionDownload}]; !ok {
+		t.Errorf("active user limiter is collected")
+	}
+}
+
+func TestTransferLimiterWriterReader(t *testing.T) {
+	l := NewTransferLimiter(NewDefaultFileOptions())
+	data := bytes.Repeat([]byte("a"), 3*transferChunkSize+1)
+
+	buf := &bytes.Buffer{}
+	n, err := l.Writer(context.Background(), "alice", DirectionDownload, buf).Write(data)
+	if err != nil || n != len(data) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	got, err := io.ReadAll(l.Reader(context.Background(), "alice", DirectionUpload, bytes.NewReader(data)))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Read() = %d, %v", len(got), err)
+	}
+
+	// 令牌不足时等待, ctx 取消后返回已经写入的部分
+	options := NewDefaultFileOptions()
+	options.DownloadRate = 1
+	slow := NewTransferLimiter(options)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	buf.Reset()
+	n, err = slow.Writer(ctx, "alice", DirectionDownload, buf).Write(data)
+	if err == nil || n != transferChunkSize {
+		t.Errorf("Write() = %d, %v, want %d and error", n, err, transferChunkSize)
+	}
+}
+
+func TestTransferIdentity(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string
+		trusted bool
+		want    string
+	}{
+		{name: "authenticated", user: "alice", trusted: true, want: "alice"},
+		{name: "unauthenticated", user: "alice", want: anonymousUser},
+		{name: "authenticated without user", trusted: true, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", strings.NewReader(""))
+			if tt.user != "" {
+				req.Header.Set(HeaderUser, tt.user)
+			}
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = req
+			middleware.SignerMiddleware(
+				func() bool { return false },
+				func(*http.Request) bool { return tt.trusted },
+			)(c)
+			if got := transferIdentity(c); got != tt.want {
+				t.Errorf("transferIdentity() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package apis
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sunweiwe/kuber/pkg/agent/cluster"
+	clusterutil "github.com/sunweiwe/kuber/pkg/utils/cluster"
+)
+
+// 多集群管理中心会频繁探测 /version, 缓存一段时间避免每次都访问 apiserver 和建立 TLS 连接
+const clusterVersionCacheTTL = time.Minute
+
+type clusterVersion struct {
+	Kubernetes             string
+	APIServerCertExpiredAt *time.Time
+}
+
+// clusterVersionCache 缓存 Kubernetes 版本和 apiserver 证书过期时间, 过期后由一个请求重新获取, 其他请求等待结果
+type clusterVersionCache struct {
+	ttl   time.Duration
+	fetch func(ctx context.Context) clusterVersion
+
+	mu        sync.Mutex
+	value     clusterVersion
+	fetchedAt time.Time
+}
+
+func newClusterVersionCache(cluster cluster.Interface) *clusterVersionCache {
+	return &clusterVersionCache{
+		ttl: clusterVersionCacheTTL,
+		fetch: func(ctx context.Context) clusterVersion {
+			ret := clusterVersion{}
+			if serverVersion, err := cluster.Kubernetes().Discovery().ServerVersion(); err == nil {
+				ret.Kubernetes = serverVersion.GitVersion
+			}
+			if host := cluster.Config().Host; strings.HasPrefix(host, "https://") {
+				if expiredAt, err := clusterutil.GetServerCertExpiredTime(ctx, host); err == nil {
+					ret.APIServerCertExpiredAt = expiredAt
+				}
+			}
+			return ret
+		},
+	}
+}
+
+// Get 获取失败的部分为空, 调用方断开导致的失败不缓存
+func (c *clusterVersionCache) Get(ctx context.Context) clusterVersion {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.fetchedAt.IsZero() && time.Since(c.fetchedAt) < c.ttl {
+		return c.value
+	}
+	value := c.fetch(ctx)
+	if ctx.Err() != nil {
+		return value
+	}
+	c.value, c.fetchedAt = value, time.Now()
+	return value
+}
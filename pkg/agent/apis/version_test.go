@@ -0,0 +1,42 @@
+package apis
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClusterVersionCache(t *testing.T) {
+	fetched := 0
+	cache := &clusterVersionCache{
+		ttl: time.Hour,
+		fetch: func(ctx context.Context) clusterVersion {
+			fetched++
+			return clusterVersion{Kubernetes: "v1.27.0"}
+		},
+	}
+
+	// 调用方断开时不缓存
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	cache.Get(canceled)
+	if fetched != 1 {
+		t.Fatalf("fetched %d times, want 1", fetched)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if got := cache.Get(ctx); got.Kubernetes != "v1.27.0" {
+			t.Errorf("Get() = %v, want v1.27.0", got)
+		}
+	}
+	if fetched != 2 {
+		t.Errorf("fetched %d times, want 2", fetched)
+	}
+
+	cache.fetchedAt = time.Now().Add(-2 * time.Hour)
+	cache.Get(ctx)
+	if fetched != 3 {
+		t.Errorf("fetched %d times after ttl, want 3", fetched)
+	}
+}
@@ -0,0 +1,99 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWidth  = 80
+	defaultHeight = 24
+)
+
+// asciinema v2 事件类型
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+	EventResize = "r"
+)
+
+// https://docs.asciinema.org/manual/asciicast/v2/
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recorder 以 asciinema v2 格式记录终端的输入输出, 可以并发调用
+type Recorder struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+	err   error
+	// 是否记录输入, 输入中可能包含密码
+	input bool
+}
+
+func NewRecorder(w io.Writer, title string, input bool) (*Recorder, error) {
+	r := &Recorder{w: w, start: time.Now(), input: input}
+	header, err := json.Marshal(castHeader{
+		Version:   2,
+		Width:     defaultWidth,
+		Height:    defaultHeight,
+		Timestamp: r.start.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": "xterm-256color"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", header); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Recorder) Output(data []byte) {
+	r.event(EventOutput, string(data))
+}
+
+func (r *Recorder) Input(data []byte) {
+	if r.input {
+		r.event(EventInput, string(data))
+	}
+}
+
+func (r *Recorder) Resize(width, height uint16) {
+	r.event(EventResize, fmt.Sprintf("%dx%d", width, height))
+}
+
+// Err 返回第一次写入失败的错误, 失败后不再记录
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) event(kind, data string) {
+	if data == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	elapsed := time.Since(r.start).Seconds()
+	line, err := json.Marshal([]interface{}{elapsed, kind, data})
+	if err != nil {
+		r.err = err
+		return
+	}
+	_, r.err = fmt.Fprintf(r.w, "%s\n", line)
+}
@@ -0,0 +1,132 @@
+// Package audit 记录交互式终端会话, 录像使用 asciinema v2 格式
+package audit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	KindShell   = "shell"
+	KindKubectl = "kubectl"
+	KindDebug   = "debug"
+
+	sessionSuffix   = ".json"
+	recordingSuffix = ".cast"
+)
+
+var sessionIDRegexp = regexp.MustCompile(`^[0-9]{14}-[0-9a-f]{8}$`)
+
+// Session 一次终端会话的审计信息
+type Session struct {
+	ID        string     `json:"id"`
+	Kind      string     `json:"kind"`
+	User      string     `json:"user"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Namespace string     `json:"namespace,omitempty"`
+	Pod       string     `json:"pod,omitempty"`
+	Container string     `json:"container,omitempty"`
+	Start     time.Time  `json:"start"`
+	End       *time.Time `json:"end,omitempty"`
+	// 异常结束时的错误
+	Error string `json:"error,omitempty"`
+	// 是否有录像
+	Recorded bool `json:"recorded"`
+}
+
+func NewSessionID() string {
+	buf := make([]byte, 4)
+	_, _ = rand.Read(buf)
+	return time.Now().Format("20060102150405") + "-" + hex.EncodeToString(buf)
+}
+
+// Store 把会话信息和录像保存在目录中, 目录可以是挂载的PVC
+type Store struct {
+	Dir string
+}
+
+func (s *Store) Save(session *Session) error {
+	content, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0o750); err != nil {
+		return err
+	}
+	// 先写临时文件再重命名, 避免列表时读到不完整的内容
+	tmp := s.path(session.ID, sessionSuffix) + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(session.ID, sessionSuffix))
+}
+
+// CreateRecording 创建录像文件
+func (s *Store) CreateRecording(id string) (*os.File, error) {
+	if err := os.MkdirAll(s.Dir, 0o750); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(s.path(id, recordingSuffix), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+}
+
+// OpenRecording 打开录像文件
+func (s *Store) OpenRecording(id string) (*os.File, error) {
+	if !sessionIDRegexp.MatchString(id) {
+		return nil, fmt.Errorf("invalid session id %q", id)
+	}
+	return os.Open(s.path(id, recordingSuffix))
+}
+
+func (s *Store) Get(id string) (*Session, error) {
+	if !sessionIDRegexp.MatchString(id) {
+		return nil, fmt.Errorf("invalid session id %q", id)
+	}
+	content, err := os.ReadFile(s.path(id, sessionSuffix))
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{}
+	if err := json.Unmarshal(content, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// List 按照开始时间倒序返回
+func (s *Store) List() ([]*Session, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Session{}, nil
+		}
+		return nil, err
+	}
+	sessions := []*Session{}
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), sessionSuffix)
+		if entry.IsDir() || !sessionIDRegexp.MatchString(id) || id+sessionSuffix != entry.Name() {
+			continue
+		}
+		session, err := s.Get(id)
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Start.After(sessions[j].Start)
+	})
+	return sessions, nil
+}
+
+func (s *Store) path(id, suffix string) string {
+	return filepath.Join(s.Dir, id+suffix)
+}
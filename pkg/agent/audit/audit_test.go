@@ -0,0 +1,84 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	r, err := NewRecorder(buf, "shell", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Output([]byte("$ "))
+	r.Input([]byte("ls\r"))
+	r.Resize(120, 40)
+	r.Output([]byte("a.txt\r\n"))
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(buf)
+	if !scanner.Scan() {
+		t.Fatal("missing header")
+	}
+	header := castHeader{}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 2 || header.Title != "shell" {
+		t.Errorf("unexpected header %+v", header)
+	}
+
+	events := [][]interface{}{}
+	for scanner.Scan() {
+		event := []interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	want := [][2]string{{EventOutput, "$ "}, {EventResize, "120x40"}, {EventOutput, "a.txt\r\n"}}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d: %v", len(events), len(want), events)
+	}
+	for i, event := range events {
+		if event[1] != want[i][0] || event[2] != want[i][1] {
+			t.Errorf("event %d = %v, want %v", i, event, want[i])
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	store := &Store{Dir: t.TempDir()}
+	first := &Session{ID: NewSessionID(), Kind: KindShell, Start: time.Now().Add(-time.Minute)}
+	second := &Session{ID: NewSessionID(), Kind: KindKubectl, Start: time.Now()}
+	for _, s := range []*Session{first, second} {
+		if err := store.Save(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 其他文件会被忽略
+	if err := os.WriteFile(store.Dir+"/other.json", []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != second.ID || sessions[1].ID != first.ID {
+		t.Errorf("unexpected sessions %+v", sessions)
+	}
+	if _, err := store.Get("../etc/passwd"); err == nil {
+		t.Error("expected error for invalid session id")
+	}
+	if _, err := store.OpenRecording(first.ID); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
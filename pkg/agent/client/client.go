@@ -11,8 +11,8 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/sunweiwe/kuber/pkg/log"
-	"github.com/sunweiwe/kuber/pkg/utils/proxy"
+	"github.com/sunweiwe/kuber/pkg/agent/cluster"
+	"github.com/sunweiwe/kuber/pkg/agent/ws"
 	"github.com/sunweiwe/kuber/pkg/utils/route"
 	"github.com/sunweiwe/kuber/pkg/utils/stream"
 	corev1 "k8s.io/api/core/v1"
@@ -39,7 +39,10 @@ const (
 )
 
 type ClientRest struct {
-	Cli client.Client
+	Cli     client.Client
+	Cluster cluster.Interface
+	// 热更新的 websocket 配置
+	Websocket func() *ws.Options
 }
 
 func (h *ClientRest) Register(r *route.Router) {
@@ -268,64 +271,6 @@ func (h *ClientRest) Delete(c *gin.Context) {
 	OK(c, obj)
 }
 
-func (h *ClientRest) PortForward(c *gin.Context) {
-	gvk := h.parseGVK(c)
-
-	if gvk.Group != "" || gvk.Version != "v1" {
-		NotOK(c, fmt.Errorf("unsupported group: %s", gvk.GroupVersionKind.GroupVersion()))
-		return
-	}
-
-	port, err := strconv.Atoi(c.Query("port"))
-	if err != nil {
-		NotOK(c, err)
-		return
-	}
-
-	ctx := c.Request.Context()
-	process := func() error {
-		var target string
-		switch gvk.Kind {
-		case "Pod":
-			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: gvk.Name, Namespace: gvk.Namespace}}
-			if err := h.Cli.Get(ctx, client.ObjectKeyFromObject(pod), pod); err != nil {
-				return err
-			}
-			if pod.Status.Phase != corev1.PodRunning {
-				return fmt.Errorf("pod %s is not running", pod.Name)
-			}
-			// pod: {pod-ip}.
-			target = fmt.Sprintf("%s:%d", pod.Status.PodIP, port)
-		case "Service", "":
-			// see: https://kubernetes.io/docs/concepts/services-networking/dns-pod-service/
-			// svc: {svcname}.{namespace}.svc
-			target = fmt.Sprintf("%s.%s.svc:%d", gvk.Name, gvk.Namespace, port)
-		}
-
-		tcpProxy, err := proxy.NewTCPProxy(target, -1)
-		if err != nil {
-			return err
-		}
-
-		source, _, err := c.Writer.Hijack()
-		if err != nil {
-			return fmt.Errorf("unable hijack http connection: %v", err)
-		}
-
-		if err := tcpProxy.ServeConn(source); err != nil {
-			log.Errorf("copy connection error: %v", err)
-			// already hijacked,return nil avoid http response
-			return nil
-		}
-		return nil
-	}
-
-	if err := process(); err != nil {
-		NotOK(c, err)
-		return
-	}
-}
-
 func (h *ClientRest) Proxy(c *gin.Context) {
 	gvk := h.parseGVK(c)
 
@@ -0,0 +1,345 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/sunweiwe/kuber/pkg/agent/ws"
+	"github.com/sunweiwe/kuber/pkg/utils/httpsigs"
+)
+
+// ForwardedPort 本地端口为 0 时随机选择
+type ForwardedPort struct {
+	Local  uint16
+	Remote uint16
+}
+
+// ParseForwardedPorts 解析 [LOCAL:]REMOTE 形式的端口, 与 kubectl port-forward 相同
+func ParseForwardedPorts(specs []string) ([]ForwardedPort, error) {
+	ports := make([]ForwardedPort, 0, len(specs))
+	for _, spec := range specs {
+		local, remote := spec, spec
+		if i := strings.Index(spec, ":"); i >= 0 {
+			local, remote = spec[:i], spec[i+1:]
+		}
+		remotePort, err := strconv.ParseUint(remote, 10, 16)
+		if err != nil || remotePort == 0 {
+			return nil, fmt.Errorf("invalid remote port in %q", spec)
+		}
+		localPort := uint64(0)
+		if local != "" {
+			if localPort, err = strconv.ParseUint(local, 10, 16); err != nil {
+				return nil, fmt.Errorf("invalid local port in %q", spec)
+			}
+		}
+		ports = append(ports, ForwardedPort{Local: uint16(localPort), Remote: uint16(remotePort)})
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("at least one port is required")
+	}
+	if len(ports) > maxForwardPorts {
+		return nil, fmt.Errorf("at most %d ports can be forwarded at once", maxForwardPorts)
+	}
+	return ports, nil
+}
+
+// PortForwarder 监听本地端口, 所有本地连接复用一个到 agent 的 websocket, agent 为每个连接创建新的 stream
+// websocket 断开后, 新的本地连接重新建立 websocket
+type PortForwarder struct {
+	// agent 地址, 如 https://kuber-agent:8080
+	Server    string
+	Namespace string
+	// Pod 或者 Service
+	Kind     string
+	Name     string
+	Address  string
+	Ports    []ForwardedPort
+	Insecure bool
+	Out      io.Writer
+
+	mu      sync.Mutex
+	session *forwardSession
+}
+
+// Run 直到 ctx 取消
+func (pf *PortForwarder) Run(ctx context.Context) error {
+	listeners := make([]net.Listener, 0, len(pf.Ports))
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	for _, port := range pf.Ports {
+		l, err := net.Listen("tcp", net.JoinHostPort(pf.Address, strconv.Itoa(int(port.Local))))
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, l)
+		fmt.Fprintf(pf.Out, "Forwarding from %s -> %d\n", l.Addr(), port.Remote)
+	}
+
+	wg := sync.WaitGroup{}
+	for i, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener, port ForwardedPort) {
+			defer wg.Done()
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go pf.handleConnection(ctx, conn, port)
+			}
+		}(l, pf.Ports[i])
+	}
+	<-ctx.Done()
+	for _, l := range listeners {
+		l.Close()
+	}
+	wg.Wait()
+	pf.mu.Lock()
+	if pf.session != nil {
+		pf.session.close(fmt.Errorf("port-forward stopped"))
+	}
+	pf.mu.Unlock()
+	return nil
+}
+
+// url 转发所有端口, 本地连接打开时选择端口
+func (pf *PortForwarder) url() (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSuffix(pf.Server, "/"))
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	u.Path += fmt.Sprintf("%s/core/v1/namespaces/%s/%s/%s/portforward", RoutePrefix, pf.Namespace, pf.Kind, pf.Name)
+	ports := make([]string, 0, len(pf.Ports))
+	for _, port := range pf.Ports {
+		ports = append(ports, strconv.Itoa(int(port.Remote)))
+	}
+	u.RawQuery = url.Values{"ports": []string{strings.Join(ports, ",")}}.Encode()
+	return u, nil
+}
+
+func (pf *PortForwarder) handleConnection(ctx context.Context, conn net.Conn, port ForwardedPort) {
+	defer conn.Close()
+	fmt.Fprintf(pf.Out, "Handling connection for %d\n", port.Remote)
+	session, err := pf.getSession(ctx)
+	if err == nil {
+		err = session.forward(conn, port.Remote)
+	}
+	if err != nil {
+		fmt.Fprintf(pf.Out, "Error forwarding %s -> %d: %v\n", conn.LocalAddr(), port.Remote, err)
+	}
+}
+
+// getSession 返回当前的 websocket, 已经断开时重新连接
+func (pf *PortForwarder) getSession(ctx context.Context) (*forwardSession, error) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.session != nil && !pf.session.closed() {
+		return pf.session, nil
+	}
+	wsConn, err := pf.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pf.session = newForwardSession(wsConn)
+	go pf.session.readLoop()
+	return pf.session, nil
+}
+
+func (pf *PortForwarder) dial(ctx context.Context) (*websocket.Conn, error) {
+	u, err := pf.url()
+	if err != nil {
+		return nil, err
+	}
+	// 与 agent 的 http 签名相同, agent 不检查签名时没有影响
+	req := &http.Request{URL: u, Header: http.Header{}}
+	httpsigs.GetSigner().Sign(req, "")
+	dialer := &websocket.Dialer{
+		Proxy:           http.ProxyFromEnvironment,
+		Subprotocols:    []string{ws.PortForwardProtocol},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: pf.Insecure}, //nolint:gosec
+	}
+	wsConn, resp, err := dialer.DialContext(ctx, u.String(), req.Header)
+	if err != nil {
+		if resp != nil {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		return nil, err
+	}
+	if wsConn.Subprotocol() != ws.PortForwardProtocol {
+		wsConn.Close()
+		return nil, fmt.Errorf("agent does not support protocol %s", ws.PortForwardProtocol)
+	}
+	return wsConn, nil
+}
+
+// forwardSession 多路复用协议的客户端, 只有 readLoop 读取 websocket
+type forwardSession struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	mu     sync.Mutex
+	conns  map[uint32]*forwardConn
+	nextID uint32
+	done   chan struct{}
+	err    error
+}
+
+type forwardConn struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+// finish 只有第一次调用生效
+func (fc *forwardConn) finish(err error) {
+	fc.once.Do(func() {
+		fc.err = err
+		close(fc.done)
+	})
+}
+
+func newForwardSession(conn *websocket.Conn) *forwardSession {
+	return &forwardSession{
+		conn:  conn,
+		conns: map[uint32]*forwardConn{},
+		done:  make(chan struct{}),
+	}
+}
+
+func (s *forwardSession) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close 结束所有连接
+func (s *forwardSession) close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed() {
+		return
+	}
+	s.err = err
+	close(s.done)
+	s.conn.Close()
+}
+
+func (s *forwardSession) write(typ byte, id uint32, payload []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteMessage(websocket.BinaryMessage, encodeFrame(typ, id, payload))
+}
+
+// forward 打开新的连接, 直到 pod 端关闭, 出错或者 websocket 断开
+func (s *forwardSession) forward(conn net.Conn, port uint16) error {
+	s.mu.Lock()
+	if s.closed() {
+		s.mu.Unlock()
+		return s.err
+	}
+	id := s.nextID
+	s.nextID++
+	fc := &forwardConn{conn: conn, done: make(chan struct{})}
+	s.conns[id] = fc
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, id)
+		s.mu.Unlock()
+	}()
+
+	portBytes := make([]byte, 2)
+	binary.LittleEndian.PutUint16(portBytes, port)
+	if err := s.write(frameOpen, id, portBytes); err != nil {
+		return err
+	}
+	go func() {
+		buf := make([]byte, portForwardFrameSize)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if err := s.write(frameData, id, buf[:n]); err != nil {
+					fc.finish(err)
+					return
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		// 本地不再发送数据, 等待 pod 端关闭
+		_ = s.write(frameClose, id, nil)
+	}()
+
+	select {
+	case <-fc.done:
+		return fc.err
+	case <-s.done:
+		return s.err
+	}
+}
+
+// readLoop 把数据分发给对应的本地连接, 写入本地连接阻塞时所有连接都等待
+func (s *forwardSession) readLoop() {
+	for {
+		messageType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				err = fmt.Errorf("port-forward session closed")
+			}
+			s.close(err)
+			return
+		}
+		// agent 关闭空闲连接等错误作为文本发送
+		if messageType == websocket.TextMessage {
+			s.close(fmt.Errorf("%s", data))
+			return
+		}
+		typ, id, payload, ok := decodeFrame(data)
+		if !ok {
+			continue
+		}
+		s.mu.Lock()
+		fc := s.conns[id]
+		s.mu.Unlock()
+		if fc == nil {
+			continue
+		}
+		switch typ {
+		case frameData:
+			if _, err := fc.conn.Write(payload); err != nil {
+				_ = s.write(frameReset, id, nil)
+				fc.finish(err)
+			}
+		case frameClose:
+			fc.finish(nil)
+		case frameError:
+			fc.finish(fmt.Errorf("%s", payload))
+		}
+	}
+}
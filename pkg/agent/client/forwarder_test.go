@@ -0,0 +1,179 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sunweiwe/kuber/pkg/agent/ws"
+)
+
+func TestParseForwardedPorts(t *testing.T) {
+	tooMany := make([]string, maxForwardPorts+1)
+	for i := range tooMany {
+		tooMany[i] = "80"
+	}
+	tests := []struct {
+		name    string
+		specs   []string
+		want    []ForwardedPort
+		wantErr bool
+	}{
+		{name: "remote only", specs: []string{"80"}, want: []ForwardedPort{{Local: 80, Remote: 80}}},
+		{name: "local and remote", specs: []string{"8080:80", "9443:443"}, want: []ForwardedPort{{Local: 8080, Remote: 80}, {Local: 9443, Remote: 443}}},
+		{name: "random local", specs: []string{":80"}, want: []ForwardedPort{{Local: 0, Remote: 80}}},
+		{name: "zero local", specs: []string{"0:80"}, want: []ForwardedPort{{Local: 0, Remote: 80}}},
+		{name: "zero remote", specs: []string{"8080:0"}, wantErr: true},
+		{name: "missing remote", specs: []string{"8080:"}, wantErr: true},
+		{name: "invalid local", specs: []string{"http:80"}, wantErr: true},
+		{name: "out of range", specs: []string{"70000:80"}, wantErr: true},
+		{name: "none", wantErr: true},
+		{name: "too many", specs: tooMany, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseForwardedPorts(tt.specs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseForwardedPorts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseForwardedPorts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortForwarderURL(t *testing.T) {
+	pf := &PortForwarder{
+		Server:    "https://agent:8080/",
+		Namespace: "default",
+		Kind:      "svc",
+		Name:      "web",
+		Ports:     []ForwardedPort{{Local: 8080, Remote: 80}, {Remote: 443}},
+	}
+	u, err := pf.url()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "wss://agent:8080" + RoutePrefix + "/core/v1/namespaces/default/svc/web/portforward?ports=80%2C443"
+	if u.String() != want {
+		t.Errorf("url() = %s, want %s", u, want)
+	}
+}
+
+// fakeAgent 回显数据, 收到 close 后关闭连接, 只允许转发 80 端口
+func fakeAgent(t *testing.T, opened chan<- uint32) *httptest.Server {
+	upgrader := websocket.Upgrader{Subprotocols: []string{ws.PortForwardProtocol}}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			typ, id, payload, ok := decodeFrame(data)
+			if !ok {
+				continue
+			}
+			var reply []byte
+			switch typ {
+			case frameOpen:
+				if binary.LittleEndian.Uint16(payload) != 80 {
+					reply = encodeFrame(frameError, id, []byte("port is not forwarded"))
+				} else {
+					opened <- id
+				}
+			case frameData:
+				reply = encodeFrame(frameData, id, payload)
+			case frameClose:
+				reply = encodeFrame(frameClose, id, nil)
+			}
+			if reply != nil {
+				if err := conn.WriteMessage(websocket.BinaryMessage, reply); err != nil {
+					return
+				}
+			}
+		}
+	}))
+}
+
+func TestForwardSession(t *testing.T) {
+	opened := make(chan uint32, 4)
+	server := fakeAgent(t, opened)
+	defer server.Close()
+	pf := &PortForwarder{Server: server.URL, Namespace: "default", Kind: "pods", Name: "web", Ports: []ForwardedPort{{Remote: 80}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	session, err := pf.getSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := pf.getSession(ctx); again != session {
+		t.Fatalf("getSession() dials a new websocket while the session is open")
+	}
+
+	// 两个本地连接复用同一个 websocket
+	wg := sync.WaitGroup{}
+	locals := make([]net.Conn, 2)
+	errs := make([]error, 2)
+	for i := range locals {
+		local, remote := net.Pipe()
+		locals[i] = local
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = session.forward(remote, 80)
+		}(i)
+	}
+	ids := map[uint32]bool{<-opened: true, <-opened: true}
+	if len(ids) != 2 {
+		t.Fatalf("connections opened with ids %v, want 2 different ids", ids)
+	}
+	for i, local := range locals {
+		message := strings.Repeat(string(rune('a'+i)), 10)
+		if _, err := local.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(message))
+		if _, err := io.ReadFull(local, got); err != nil || string(got) != message {
+			t.Fatalf("read %q, %v, want %q", got, err, message)
+		}
+		local.Close()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("forward() of connection %d = %v", i, err)
+		}
+	}
+
+	// agent 返回的错误
+	local, remote := net.Pipe()
+	defer local.Close()
+	if err := session.forward(remote, 443); err == nil || err.Error() != "port is not forwarded" {
+		t.Errorf("forward() = %v, want agent error", err)
+	}
+
+	// websocket 断开后重新连接
+	session.close(io.EOF)
+	if err := session.forward(remote, 80); err != io.EOF {
+		t.Errorf("forward() on closed session = %v, want %v", err, io.EOF)
+	}
+	if again, err := pf.getSession(ctx); err != nil || again == session {
+		t.Errorf("getSession() = %v, %v, want a new session", again, err)
+	}
+}
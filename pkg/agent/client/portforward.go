@@ -0,0 +1,494 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/sunweiwe/kuber/pkg/agent/ws"
+	"github.com/sunweiwe/kuber/pkg/log"
+	"github.com/sunweiwe/kuber/pkg/utils/prometheus/exporter"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+	"k8s.io/kubectl/pkg/util"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// 一次端口转发最多转发的端口数
+	maxForwardPorts = 16
+	// 每个 websocket 消息的最大数据量, 小于 websocket 的读取限制
+	portForwardFrameSize = 32 * 1024
+	// 多路复用协议中一个 websocket 同时转发的最大连接数
+	maxForwardConnections = 128
+)
+
+// 多路复用协议的消息类型, 消息格式为 类型(1 字节) + 连接 id(4 字节, 大端) + 数据
+const (
+	// 客户端打开连接, 数据为两个字节(小端)的端口号
+	frameOpen byte = iota
+	frameData
+	// 发送方不再发送数据, agent 发送时表示 pod 端已经关闭
+	frameClose
+	// 客户端放弃连接
+	frameReset
+	// agent 发送的连接错误
+	frameError
+
+	frameHeaderSize = 5
+)
+
+func encodeFrame(typ byte, id uint32, payload []byte) []byte {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:frameHeaderSize], id)
+	copy(frame[frameHeaderSize:], payload)
+	return frame
+}
+
+func decodeFrame(frame []byte) (typ byte, id uint32, payload []byte, ok bool) {
+	if len(frame) < frameHeaderSize {
+		return 0, 0, nil, false
+	}
+	return frame[0], binary.BigEndian.Uint32(frame[1:frameHeaderSize]), frame[frameHeaderSize:], true
+}
+
+// PortForward 通过 apiserver 的 pods/portforward 子资源转发端口
+// websocket 使用 v4.channel.k8s.io 子协议时与 kubelet 的 websocket 端口转发相同, 每个端口只转发一个连接:
+// 第 i 个端口的数据 channel 为 2i, 错误 channel 为 2i+1, 每个 channel 的第一个消息是两个字节(小端)的端口号
+// 客户端发送只有 channel 的空消息表示不再发送数据, 所有端口的 pod 端关闭后断开连接
+// 使用 v1.portforward.kuber.io 子协议时多个连接复用一个 websocket, 每个连接创建新的 stream, 客户端断开后结束
+// @Tags        Agent.V1
+// @Summary     port-forward(websocket)
+// @Description 转发 pod 或者 service 对应 pod 的端口, service 的端口转换为 pod 的端口
+// @Param       namespace path     string true  "namespace"
+// @Param       kind      path     string true  "Pod/Service"
+// @Param       name      path     string true  "name"
+// @Param       ports     query    []int  true  "ports, 可以重复或者逗号分隔"
+// @Success     200       {object} object "ws"
+// @Router      /internal/core/v1/namespaces/{namespace}/{kind}/{name}/portforward [get]
+func (h *ClientRest) PortForward(c *gin.Context) {
+	gvk := h.parseGVK(c)
+	if gvk.Group != "" || gvk.Version != "v1" {
+		NotOK(c, fmt.Errorf("unsupported group: %s", gvk.GroupVersionKind.GroupVersion()))
+		return
+	}
+	ports, err := parsePorts(append(c.QueryArray("ports"), c.QueryArray("port")...))
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	pod, targetPorts, err := h.portForwardTarget(ctx, gvk, ports)
+	if err != nil {
+		NotOK(c, err)
+		return
+	}
+	metrics := exporter.GetPortForwardCollector()
+	streamConn, err := h.dialPortForward(pod)
+	if err != nil {
+		metrics.SessionFailed()
+		NotOK(c, fmt.Errorf("port-forward to pod %s: %v", pod.Name, err))
+		return
+	}
+	defer streamConn.Close()
+
+	conn, err := ws.InitWebsocket(c.Writer, c.Request, h.Websocket())
+	if err != nil {
+		log.Error(err, "upgrade port-forward websocket")
+		return
+	}
+	defer conn.WsClose()
+
+	metrics.SessionStarted()
+	defer metrics.SessionFinished()
+	log.Info("port-forward started", "namespace", pod.Namespace, "pod", pod.Name, "ports", targetPorts)
+	session := &portForwardSession{conn: conn, streamConn: streamConn, metrics: metrics}
+	if conn.Protocol() == ws.PortForwardProtocol {
+		err = session.serve(ports, targetPorts)
+	} else {
+		err = session.run(ports, targetPorts)
+	}
+	if err != nil {
+		log.Error(err, "port-forward", "namespace", pod.Namespace, "pod", pod.Name)
+	}
+	log.Info("port-forward finished", "namespace", pod.Namespace, "pod", pod.Name, "ports", targetPorts)
+}
+
+func parsePorts(values []string) ([]int32, error) {
+	var ports []int32
+	for _, value := range values {
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			port, err := strconv.ParseUint(s, 10, 16)
+			if err != nil || port == 0 {
+				return nil, fmt.Errorf("invalid port %q", s)
+			}
+			ports = append(ports, int32(port))
+		}
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("ports is required")
+	}
+	if len(ports) > maxForwardPorts {
+		return nil, fmt.Errorf("at most %d ports can be forwarded at once", maxForwardPorts)
+	}
+	return ports, nil
+}
+
+// portForwardTarget 返回转发的 pod 和 pod 的端口
+// service 选择一个运行中的 pod, 与 kubectl port-forward svc/xxx 相同
+func (h *ClientRest) portForwardTarget(ctx context.Context, gvk GVK, ports []int32) (*corev1.Pod, []int32, error) {
+	switch strings.ToLower(gvk.Kind) {
+	case "pod", "pods":
+		pod := &corev1.Pod{}
+		if err := h.Cli.Get(ctx, client.ObjectKey{Namespace: gvk.Namespace, Name: gvk.Name}, pod); err != nil {
+			return nil, nil, err
+		}
+		if pod.Status.Phase != corev1.PodRunning {
+			return nil, nil, fmt.Errorf("pod %s is not running", pod.Name)
+		}
+		return pod, ports, nil
+	case "service", "services", "svc":
+		svc := &corev1.Service{}
+		if err := h.Cli.Get(ctx, client.ObjectKey{Namespace: gvk.Namespace, Name: gvk.Name}, svc); err != nil {
+			return nil, nil, err
+		}
+		if len(svc.Spec.Selector) == 0 {
+			return nil, nil, fmt.Errorf("service %s has no selector", svc.Name)
+		}
+		podList := &corev1.PodList{}
+		if err := h.Cli.List(ctx, podList, client.InNamespace(svc.Namespace),
+			client.MatchingLabelsSelector{Selector: labels.SelectorFromSet(svc.Spec.Selector)}); err != nil {
+			return nil, nil, err
+		}
+		pod := runningPod(podList.Items)
+		if pod == nil {
+			return nil, nil, fmt.Errorf("no running pod of service %s", svc.Name)
+		}
+		targetPorts := make([]int32, 0, len(ports))
+		for _, port := range ports {
+			target, err := util.LookupContainerPortNumberByServicePort(*svc, *pod, port)
+			if err != nil {
+				return nil, nil, err
+			}
+			targetPorts = append(targetPorts, target)
+		}
+		return pod, targetPorts, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported kind %s, must be Pod or Service", gvk.Kind)
+	}
+}
+
+// runningPod 优先选择 ready 的 pod, 结果按名称稳定
+func runningPod(pods []corev1.Pod) *corev1.Pod {
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	var running *corev1.Pod
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		for _, cond := range pod.Status.Conditions {
+			if cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue {
+				return pod
+			}
+		}
+		if running == nil {
+			running = pod
+		}
+	}
+	return running
+}
+
+func (h *ClientRest) dialPortForward(pod *corev1.Pod) (httpstream.Connection, error) {
+	transport, upgrader, err := spdy.RoundTripperFor(h.Cluster.Config())
+	if err != nil {
+		return nil, err
+	}
+	req := h.Cluster.Kubernetes().CoreV1().RESTClient().Post().Resource("pods").
+		Namespace(pod.Namespace).Name(pod.Name).SubResource("portforward")
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, req.URL())
+	streamConn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	return streamConn, err
+}
+
+type portForwardSession struct {
+	conn       *ws.WsConnection
+	streamConn httpstream.Connection
+	metrics    *exporter.PortForwardCollector
+
+	mu sync.Mutex
+	// 多路复用协议中客户端连接 id 对应的 stream
+	conns         map[uint32]*forwardedConn
+	nextRequestID int
+}
+
+type forwardedConn struct {
+	errorStream httpstream.Stream
+	dataStream  httpstream.Stream
+}
+
+// createStreams 每对 stream 使用不同的 request id, 对应 pod 端的一个连接
+func (s *portForwardSession) createStreams(port int32) (httpstream.Stream, httpstream.Stream, error) {
+	s.mu.Lock()
+	requestID := s.nextRequestID
+	s.nextRequestID++
+	s.mu.Unlock()
+
+	headers := http.Header{}
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	headers.Set(corev1.PortHeader, strconv.Itoa(int(port)))
+	headers.Set(corev1.PortForwardRequestIDHeader, strconv.Itoa(requestID))
+	errorStream, err := s.streamConn.CreateStream(headers)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create error stream of port %d: %v", port, err)
+	}
+	// 不写入错误 stream
+	errorStream.Close()
+	headers.Set(corev1.StreamType, corev1.StreamTypeData)
+	dataStream, err := s.streamConn.CreateStream(headers)
+	if err != nil {
+		s.streamConn.RemoveStreams(errorStream)
+		return nil, nil, fmt.Errorf("create data stream of port %d: %v", port, err)
+	}
+	return errorStream, dataStream, nil
+}
+
+// run channel 协议, 转发到所有端口的 pod 端关闭或者 websocket 断开
+func (s *portForwardSession) run(ports, targetPorts []int32) error {
+	dataStreams := make([]httpstream.Stream, len(ports))
+	for i := range ports {
+		errorStream, dataStream, err := s.createStreams(targetPorts[i])
+		if err != nil {
+			return err
+		}
+		dataStreams[i] = dataStream
+
+		// 客户端根据第一个消息确认端口
+		portBytes := make([]byte, 2)
+		binary.LittleEndian.PutUint16(portBytes, uint16(ports[i]))
+		for _, channel := range []byte{byte(2 * i), byte(2*i + 1)} {
+			if err := s.conn.WsWrite(websocket.BinaryMessage, append([]byte{channel}, portBytes...)); err != nil {
+				return err
+			}
+		}
+		go s.readError(errorStream, []byte{byte(2*i + 1)})
+	}
+
+	wg := sync.WaitGroup{}
+	for i, dataStream := range dataStreams {
+		wg.Add(1)
+		go func(channel byte, dataStream httpstream.Stream) {
+			defer wg.Done()
+			s.copyToClient(dataStream, []byte{channel})
+		}(byte(2*i), dataStream)
+	}
+	go s.copyToPod(dataStreams)
+
+	remoteDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(remoteDone)
+	}()
+	select {
+	case <-remoteDone:
+	case <-s.conn.Done():
+	}
+	return nil
+}
+
+// serve 多路复用协议, 客户端每打开一个连接创建一对新的 stream, 转发到 websocket 断开
+// 只有一个 goroutine 读取 websocket, 写入 pod 阻塞时所有连接都等待
+func (s *portForwardSession) serve(ports, targetPorts []int32) error {
+	s.conns = map[uint32]*forwardedConn{}
+	go func() {
+		select {
+		case <-s.streamConn.CloseChan():
+			s.conn.WsClose()
+		case <-s.conn.Done():
+		}
+	}()
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return nil
+			}
+			return err
+		}
+		typ, id, payload, ok := decodeFrame(data)
+		if !ok {
+			continue
+		}
+		if typ == frameOpen {
+			if err := s.open(id, payload, ports, targetPorts); err != nil {
+				s.writeFrame(frameError, id, []byte(err.Error()))
+			}
+			continue
+		}
+		s.mu.Lock()
+		fc := s.conns[id]
+		s.mu.Unlock()
+		if fc == nil {
+			continue
+		}
+		switch typ {
+		case frameData:
+			if _, err := fc.dataStream.Write(payload); err != nil {
+				s.remove(id)
+				s.writeFrame(frameError, id, []byte(err.Error()))
+				continue
+			}
+			s.metrics.AddBytes("in", len(payload))
+		case frameClose:
+			fc.dataStream.Close()
+		case frameReset:
+			s.remove(id)
+		}
+	}
+}
+
+func (s *portForwardSession) open(id uint32, payload []byte, ports, targetPorts []int32) error {
+	if len(payload) != 2 {
+		return fmt.Errorf("invalid port")
+	}
+	port := int32(binary.LittleEndian.Uint16(payload))
+	index := -1
+	for i := range ports {
+		if ports[i] == port {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("port %d is not forwarded", port)
+	}
+	s.mu.Lock()
+	_, exists := s.conns[id]
+	count := len(s.conns)
+	s.mu.Unlock()
+	if exists {
+		return fmt.Errorf("connection %d already exists", id)
+	}
+	if count >= maxForwardConnections {
+		return fmt.Errorf("at most %d connections can be forwarded at once", maxForwardConnections)
+	}
+
+	errorStream, dataStream, err := s.createStreams(targetPorts[index])
+	if err != nil {
+		return err
+	}
+	fc := &forwardedConn{errorStream: errorStream, dataStream: dataStream}
+	s.mu.Lock()
+	s.conns[id] = fc
+	s.mu.Unlock()
+
+	go func() {
+		errorDone := make(chan struct{})
+		go func() {
+			defer close(errorDone)
+			s.readError(errorStream, encodeFrame(frameError, id, nil))
+		}()
+		s.copyToClient(dataStream, encodeFrame(frameData, id, nil))
+		// pod 端关闭 data stream 前可能写入了错误
+		select {
+		case <-errorDone:
+		case <-s.conn.Done():
+		}
+		s.remove(id)
+		s.writeFrame(frameClose, id, nil)
+	}()
+	return nil
+}
+
+// remove 重置连接的 stream, 连接已经移除时不做处理
+func (s *portForwardSession) remove(id uint32) {
+	s.mu.Lock()
+	fc := s.conns[id]
+	delete(s.conns, id)
+	s.mu.Unlock()
+	if fc == nil {
+		return
+	}
+	fc.dataStream.Reset()
+	fc.errorStream.Reset()
+	s.streamConn.RemoveStreams(fc.errorStream, fc.dataStream)
+}
+
+func (s *portForwardSession) writeFrame(typ byte, id uint32, payload []byte) {
+	if err := s.conn.WsWrite(websocket.BinaryMessage, encodeFrame(typ, id, payload)); err != nil {
+		s.conn.WsClose()
+	}
+}
+
+// readError header 为 channel 或者多路复用协议的消息头
+func (s *portForwardSession) readError(errorStream httpstream.Stream, header []byte) {
+	message, err := io.ReadAll(errorStream)
+	if err != nil || len(message) == 0 {
+		return
+	}
+	if err := s.conn.WsWrite(websocket.BinaryMessage, append(header, message...)); err != nil {
+		s.conn.WsClose()
+	}
+}
+
+func (s *portForwardSession) copyToClient(dataStream httpstream.Stream, header []byte) {
+	buf := make([]byte, len(header)+portForwardFrameSize)
+	copy(buf, header)
+	for {
+		n, err := dataStream.Read(buf[len(header):])
+		if n > 0 {
+			if err := s.conn.WsWrite(websocket.BinaryMessage, buf[:len(header)+n]); err != nil {
+				s.conn.WsClose()
+				return
+			}
+			s.conn.Touch()
+			s.metrics.AddBytes("out", n)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// copyToPod 只有一个 goroutine 读取 websocket
+func (s *portForwardSession) copyToPod(dataStreams []httpstream.Stream) {
+	defer s.conn.WsClose()
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Error(err, "read port-forward websocket")
+			}
+			return
+		}
+		if len(data) == 0 || data[0]%2 != 0 || int(data[0]/2) >= len(dataStreams) {
+			continue
+		}
+		dataStream := dataStreams[data[0]/2]
+		if len(data) == 1 {
+			dataStream.Close()
+			continue
+		}
+		if _, err := dataStream.Write(data[1:]); err != nil {
+			log.Error(err, "write port-forward stream")
+			return
+		}
+		s.metrics.AddBytes("in", len(data)-1)
+	}
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParsePorts(t *testing.T) {
+	tooMany := strings.TrimSuffix(strings.Repeat("80,", maxForwardPorts+1), ",")
+	tests := []struct {
+		name    string
+		values  []string
+		want    []int32
+		wantErr bool
+	}{
+		{name: "single", values: []string{"80"}, want: []int32{80}},
+		{name: "comma", values: []string{"80, 443,"}, want: []int32{80, 443}},
+		{name: "repeat", values: []string{"80", "8080,9090"}, want: []int32{80, 8080, 9090}},
+		{name: "empty", values: []string{"", ","}, wantErr: true},
+		{name: "none", wantErr: true},
+		{name: "zero", values: []string{"0"}, wantErr: true},
+		{name: "out of range", values: []string{"65536"}, wantErr: true},
+		{name: "not a number", values: []string{"http"}, wantErr: true},
+		{name: "too many", values: []string{tooMany}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePorts(tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePorts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePorts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunningPod(t *testing.T) {
+	pod := func(name string, phase corev1.PodPhase, ready bool) corev1.Pod {
+		p := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}, Status: corev1.PodStatus{Phase: phase}}
+		if ready {
+			p.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+		}
+		return p
+	}
+	deleting := pod("a-deleting", corev1.PodRunning, true)
+	deleting.DeletionTimestamp = &metav1.Time{}
+	tests := []struct {
+		name string
+		pods []corev1.Pod
+		want string
+	}{
+		{name: "ready first", pods: []corev1.Pod{pod("c", corev1.PodRunning, true), pod("b", corev1.PodRunning, false)}, want: "c"},
+		{name: "running by name", pods: []corev1.Pod{pod("c", corev1.PodRunning, false), pod("b", corev1.PodRunning, false)}, want: "b"},
+		{name: "skip deleting", pods: []corev1.Pod{deleting, pod("b", corev1.PodRunning, false)}, want: "b"},
+		{name: "none running", pods: []corev1.Pod{pod("a", corev1.PodPending, false)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := runningPod(tt.pods)
+			if (got == nil && tt.want != "") || (got != nil && got.Name != tt.want) {
+				t.Errorf("runningPod() = %v, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFrame(t *testing.T) {
+	frame := encodeFrame(frameData, 0x01020304, []byte("hello"))
+	if !bytes.Equal(frame[:frameHeaderSize], []byte{frameData, 1, 2, 3, 4}) {
+		t.Errorf("frame header = %v", frame[:frameHeaderSize])
+	}
+	typ, id, payload, ok := decodeFrame(frame)
+	if !ok || typ != frameData || id != 0x01020304 || string(payload) != "hello" {
+		t.Errorf("decodeFrame() = %d, %d, %q, %v", typ, id, payload, ok)
+	}
+	if _, _, payload, ok := decodeFrame(encodeFrame(frameClose, 1, nil)); !ok || len(payload) != 0 {
+		t.Errorf("decodeFrame() of empty frame = %q, %v", payload, ok)
+	}
+	if _, _, _, ok := decodeFrame([]byte{frameData, 0, 0}); ok {
+		t.Errorf("decodeFrame() of short frame expect not ok")
+	}
+}
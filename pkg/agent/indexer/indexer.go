@@ -18,7 +18,7 @@ func CustomIndexPods(c cache.Cache) error {
 
 	if err := c.IndexField(context.TODO(), &v1.Pod{}, "nodename", func(o client.Object) []string {
 		value := o.(*v1.Pod)
-		return []string{podStatus(value)}
+		return []string{value.Spec.NodeName}
 	}); err != nil {
 		return err
 	}
@@ -1,23 +1,43 @@
 package middleware
 
 import (
+	"net/http"
+
 	"github.com/gin-gonic/gin"
 	"github.com/sunweiwe/kuber/pkg/log"
 	"github.com/sunweiwe/kuber/pkg/service/handlers"
 	"github.com/sunweiwe/kuber/pkg/utils/httpsigs"
 )
 
-func SignerMiddleware() func(c *gin.Context) {
+// contextAuthenticated 调用方身份 header 是否可信
+const contextAuthenticated = "kuber-authenticated"
+
+// SignerMiddleware enabled 为 false 时跳过校验, 配置热更新后无需重新注册
+// 签名校验通过, 或者未开启签名时来自 trusted 的网关的请求, 才认为身份 header 可信
+func SignerMiddleware(enabled func() bool, trusted func(req *http.Request) bool) func(c *gin.Context) {
 	signer := httpsigs.GetSigner()
 	signer.AddWhiteList("/alert")
-	signer.AddWhiteList("/alert")
 	signer.AddWhiteList("/healthz")
 
 	return func(c *gin.Context) {
+		if !enabled() {
+			c.Set(contextAuthenticated, trusted(c.Request))
+			return
+		}
+		if signer.IsWhiteList(c.Request.URL.Path) {
+			return
+		}
 		if err := signer.Validate(c.Request); err != nil {
 			log.Error(err, "signer")
 			handlers.Forbidden(c, err)
 			c.Abort()
+			return
 		}
+		c.Set(contextAuthenticated, true)
 	}
 }
+
+// Authenticated 调用方身份是否经过签名或者可信网关
+func Authenticated(c *gin.Context) bool {
+	return c.GetBool(contextAuthenticated)
+}
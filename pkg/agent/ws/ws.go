@@ -4,136 +4,250 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/sunweiwe/kuber/pkg/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-var Upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
+const (
+	defaultPingInterval = 30 * time.Second
+	defaultIdleTimeout  = 30 * time.Minute
+	defaultWriteTimeout = 10 * time.Second
+
+	// 客户端发送的单个消息的最大长度, 终端输入和 resize 都很小
+	maxMessageBytes = 64 * 1024
+)
+
+type Options struct {
+	AllowedOrigins []string        `json:"allowedOrigins,omitempty" description:"origins allowed to open websockets besides the same origin, such as https://kuber.example.com, kuber.example.com, *.example.com or *"`
+	PingInterval   metav1.Duration `json:"pingInterval,omitempty" description:"interval of websocket ping frames, connections without pong in two intervals are closed"`
+	IdleTimeout    metav1.Duration `json:"idleTimeout,omitempty" description:"close terminals without input for this long, never if 0"`
+	WriteTimeout   metav1.Duration `json:"writeTimeout,omitempty" description:"timeout of writing a websocket frame, slow clients are disconnected"`
+}
+
+func NewDefaultOptions() *Options {
+	return &Options{
+		AllowedOrigins: []string{},
+		PingInterval:   metav1.Duration{Duration: defaultPingInterval},
+		IdleTimeout:    metav1.Duration{Duration: defaultIdleTimeout},
+		WriteTimeout:   metav1.Duration{Duration: defaultWriteTimeout},
+	}
+}
+
+func (o *Options) Validate() error {
+	for _, origin := range o.AllowedOrigins {
+		if origin == "" {
+			return fmt.Errorf("api.websocket.allowedOrigins: empty origin")
+		}
+		if strings.Contains(origin, "://") {
+			if _, err := url.Parse(origin); err != nil {
+				return fmt.Errorf("api.websocket.allowedOrigins: %v", err)
+			}
+		}
+	}
+	if o.PingInterval.Duration <= 0 {
+		return fmt.Errorf("api.websocket.pingInterval: must be positive")
+	}
+	if o.IdleTimeout.Duration < 0 {
+		return fmt.Errorf("api.websocket.idleTimeout: must not be negative")
+	}
+	if o.WriteTimeout.Duration <= 0 {
+		return fmt.Errorf("api.websocket.writeTimeout: must be positive")
+	}
+	return nil
+}
+
+// Upgrader 只允许同源和配置的 origin, 没有 Origin 的非浏览器客户端不受限制
+func (o *Options) Upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{CheckOrigin: o.CheckOrigin}
+}
+
+func (o *Options) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
 		return true
-	},
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	// 经过代理时 Host 是 agent 的地址, 同时比较代理转发的原始 Host
+	for _, host := range []string{r.Host, r.Header.Get("X-Forwarded-Host")} {
+		if host != "" && strings.EqualFold(u.Host, host) {
+			return true
+		}
+	}
+	for _, allowed := range o.AllowedOrigins {
+		if originMatches(allowed, u) {
+			return true
+		}
+	}
+	log.Infof("websocket origin %s is not allowed", origin)
+	return false
 }
 
-type WsMessage struct {
-	MessageType int
-	Data        []byte
+func originMatches(allowed string, origin *url.URL) bool {
+	switch {
+	case allowed == "*":
+		return true
+	case strings.Contains(allowed, "://"):
+		return strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin.Scheme+"://"+origin.Host)
+	case strings.HasPrefix(allowed, "*."):
+		return strings.HasSuffix(strings.ToLower(origin.Hostname()), strings.ToLower(allowed[1:]))
+	default:
+		return strings.EqualFold(allowed, origin.Host) || strings.EqualFold(allowed, origin.Hostname())
+	}
 }
 
+// WsConnection 终端使用的 websocket 连接
+// 写入直接发送到客户端, 客户端读取慢时阻塞写入方, 超过写超时断开连接
 type WsConnection struct {
-	conn    *websocket.Conn
-	inChan  chan *WsMessage
-	outChan chan *WsMessage
-	cancel  context.CancelFunc
-	lock    sync.RWMutex
-	stopped bool
-	OnClose func()
-}
-
-func InitWebsocket(resp http.ResponseWriter, req *http.Request) (wsConn *WsConnection, err error) {
-	var conn *websocket.Conn
-	if conn, err = Upgrader.Upgrade(resp, req, nil); err != nil {
-		return
-	}
-	ctx, cancel := context.WithCancel(context.Background())
-	wsConn = &WsConnection{
-		conn:    conn,
-		cancel:  cancel,
-		lock:    sync.RWMutex{},
-		inChan:  make(chan *WsMessage, 1000),
-		outChan: make(chan *WsMessage, 1000),
-		stopped: false,
-	}
-	go wsConn.wsReadLoop(ctx)
-	go wsConn.wsWriteLoop(ctx)
-	return
-}
-
-func (wsConn *WsConnection) wsWriteLoop(ctx context.Context) {
-	var (
-		message *WsMessage
-		err     error
-	)
+	conn     *websocket.Conn
+	options  *Options
+	protocol string
+	writeMu  sync.Mutex
+	done     chan struct{}
+	once     sync.Once
+	// 最近一次收到客户端消息的时间, UnixNano
+	lastActive int64
+	OnClose    func()
+}
 
+// InitWebsocket 升级连接, 客户端请求 v4.channel.k8s.io 子协议时使用 channel 协议, 否则使用 xterm json 协议
+// 端口转发还可以使用 PortForwardProtocol, 升级失败时已经返回了 http 错误
+func InitWebsocket(resp http.ResponseWriter, req *http.Request, options *Options) (*WsConnection, error) {
+	upgrader := options.Upgrader()
+	upgrader.Subprotocols = []string{ChannelProtocol, PortForwardProtocol}
+	conn, err := upgrader.Upgrade(resp, req, nil)
+	if err != nil {
+		return nil, err
+	}
+	wsConn := &WsConnection{
+		conn:       conn,
+		options:    options,
+		protocol:   conn.Subprotocol(),
+		done:       make(chan struct{}),
+		lastActive: time.Now().UnixNano(),
+	}
+	pongWait := 2 * options.PingInterval.Duration
+	conn.SetReadLimit(maxMessageBytes)
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	go wsConn.keepalive()
+	return wsConn, nil
+}
+
+// keepalive 定时发送 ping, 避免代理断开空闲连接, 同时检查终端是否长时间没有输入
+func (wsConn *WsConnection) keepalive() {
+	ticker := time.NewTicker(wsConn.options.PingInterval.Duration)
+	defer ticker.Stop()
 	for {
 		select {
-		case message = <-wsConn.outChan:
-			if message != nil {
-				if err = wsConn.conn.WriteMessage(message.MessageType, message.Data); err != nil {
-					log.Errorf("failed to write websocket message %v", err)
-					wsConn.WsClose()
-				}
-			}
-		case <-ctx.Done():
-			log.Infof("stop write loop")
+		case <-wsConn.done:
+			return
+		case <-ticker.C:
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&wsConn.lastActive)))
+		if timeout := wsConn.options.IdleTimeout.Duration; timeout > 0 && idle > timeout {
+			_ = wsConn.WriteError(fmt.Sprintf("session closed after %s without input", timeout))
+			wsConn.WsClose()
+			return
+		}
+		deadline := time.Now().Add(wsConn.options.WriteTimeout.Duration)
+		if err := wsConn.conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+			log.Error(err, "write websocket ping")
+			wsConn.WsClose()
 			return
 		}
 	}
 }
 
-func (wsConn *WsConnection) WsClose() {
-	if wsConn.OnClose != nil {
-		wsConn.OnClose()
+// ReadMessage 只能由一个 goroutine 调用
+func (wsConn *WsConnection) ReadMessage() (int, []byte, error) {
+	messageType, data, err := wsConn.conn.ReadMessage()
+	if err != nil {
+		return messageType, data, err
 	}
+	atomic.StoreInt64(&wsConn.lastActive, time.Now().UnixNano())
+	_ = wsConn.conn.SetReadDeadline(time.Now().Add(2 * wsConn.options.PingInterval.Duration))
+	return messageType, data, nil
+}
 
-	wsConn.lock.Lock()
-	defer wsConn.lock.Unlock()
+// Touch 标记连接活跃, 端口转发等可能只有下行数据的连接在发送数据时调用
+func (wsConn *WsConnection) Touch() {
+	atomic.StoreInt64(&wsConn.lastActive, time.Now().UnixNano())
+}
+
+func (wsConn *WsConnection) WsWrite(messageType int, data []byte) error {
+	wsConn.writeMu.Lock()
+	defer wsConn.writeMu.Unlock()
+	select {
+	case <-wsConn.done:
+		return errors.New("can't write on closed websocket")
+	default:
+	}
+	_ = wsConn.conn.SetWriteDeadline(time.Now().Add(wsConn.options.WriteTimeout.Duration))
+	return wsConn.conn.WriteMessage(messageType, data)
+}
 
-	if wsConn.stopped {
-		return
+// WriteError channel 协议写到 error channel, 否则作为文本发送
+func (wsConn *WsConnection) WriteError(msg string) error {
+	if wsConn.protocol != ChannelProtocol {
+		return wsConn.WsWrite(websocket.TextMessage, []byte(msg))
 	}
-	wsConn.stopped = true
-	wsConn.cancel()
-	wsConn.conn.Close()
-	close(wsConn.inChan)
-	close(wsConn.outChan)
+	status, err := json.Marshal(metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  msg,
+	})
+	if err != nil {
+		return err
+	}
+	return wsConn.WsWrite(websocket.BinaryMessage, append([]byte{ErrorChannel}, status...))
 }
 
-func (wsConn *WsConnection) wsReadLoop(ctx context.Context) {
-	var (
-		messageType int
-		data        []byte
-		err         error
-	)
+// Protocol 协商的子协议, 没有子协议时为空
+func (wsConn *WsConnection) Protocol() string {
+	return wsConn.protocol
+}
 
-	for {
-		if messageType, data, err = wsConn.conn.ReadMessage(); err != nil {
-			log.Errorf("failed to read websocket msg %v", err)
-			wsConn.WsClose()
-			return
-		}
+// Done 连接关闭后返回
+func (wsConn *WsConnection) Done() <-chan struct{} {
+	return wsConn.done
+}
 
-		xMsg := xtermMessage{}
-		e := json.Unmarshal(data, &xMsg)
-		if e == nil {
-			if xMsg.MessageType == "close" {
-				closeMsg, _ := json.Marshal(xtermMessage{
-					MessageType: "input",
-					Input:       "exit\r",
-				})
-				wsConn.inChan <- &WsMessage{MessageType: messageType, Data: closeMsg}
-			}
+func (wsConn *WsConnection) WsClose() {
+	wsConn.once.Do(func() {
+		close(wsConn.done)
+		if wsConn.OnClose != nil {
+			wsConn.OnClose()
 		}
-		wsConn.inChan <- &WsMessage{MessageType: messageType, Data: data}
+		deadline := time.Now().Add(time.Second)
+		_ = wsConn.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline)
+		_ = wsConn.conn.Close()
+	})
+}
 
+// Context 连接关闭时取消
+func (wsConn *WsConnection) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
 		select {
+		case <-wsConn.done:
+			cancel()
 		case <-ctx.Done():
-			return
-		default:
-			continue
 		}
-	}
-}
-
-func (wsCoon *WsConnection) WsWrite(messageType int, data []byte) (err error) {
-	wsCoon.lock.Lock()
-	defer wsCoon.lock.Unlock()
-	if wsCoon.stopped {
-		err = errors.New("can't write on closed channel")
-		return
-	}
-	wsCoon.outChan <- &WsMessage{messageType, data}
-	return
+	}()
+	return ctx, cancel
 }
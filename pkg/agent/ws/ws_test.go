@@ -0,0 +1,163 @@
+package ws
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	options := NewDefaultOptions()
+	options.AllowedOrigins = []string{"https://kuber.example.com", "*.internal.io", "console.local:8080"}
+
+	tests := []struct {
+		origin string
+		host   string
+		want   bool
+	}{
+		{origin: "", host: "agent:8041", want: true},
+		{origin: "http://agent:8041", host: "agent:8041", want: true},
+		{origin: "https://kuber.example.com", host: "agent:8041", want: true},
+		{origin: "http://kuber.example.com", host: "agent:8041", want: false},
+		{origin: "https://a.internal.io", host: "agent:8041", want: true},
+		{origin: "https://internal.io.evil.com", host: "agent:8041", want: false},
+		{origin: "http://console.local:8080", host: "agent:8041", want: true},
+		{origin: "https://evil.com", host: "agent:8041", want: false},
+		{origin: "::", host: "agent:8041", want: false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = tt.host
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if got := options.CheckOrigin(req); got != tt.want {
+			t.Errorf("CheckOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestSplitUTF8(t *testing.T) {
+	word := []byte("中文")
+	tests := []struct {
+		name        string
+		data        []byte
+		wantText    string
+		wantPartial []byte
+	}{
+		{name: "ascii", data: []byte("ls -l\r\n"), wantText: "ls -l\r\n"},
+		{name: "complete", data: word, wantText: "中文"},
+		{name: "split", data: word[:4], wantText: "中", wantPartial: word[3:4]},
+		{name: "only partial", data: word[3:5], wantPartial: word[3:5]},
+		{name: "invalid", data: []byte{'a', 0xff, 'b'}, wantText: "a�b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, partial := SplitUTF8(tt.data)
+			if string(text) != tt.wantText || !bytes.Equal(partial, tt.wantPartial) {
+				t.Errorf("SplitUTF8() = %q, %v, want %q, %v", text, partial, tt.wantText, tt.wantPartial)
+			}
+		})
+	}
+}
+
+func TestChannelProtocol(t *testing.T) {
+	options := NewDefaultOptions()
+	options.PingInterval = metav1.Duration{Duration: time.Minute}
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := InitWebsocket(w, r, options)
+		if err != nil {
+			return
+		}
+		defer conn.WsClose()
+		handler := NewStreamHandler(conn)
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(handler, buf); err != nil {
+			t.Error(err)
+			return
+		}
+		if size := handler.Next(); size == nil || size.Width != 100 || size.Height != 30 {
+			t.Errorf("unexpected size %v", size)
+		}
+		received <- string(buf)
+		_, _ = handler.Write([]byte{0xff, 0x00})
+		_, _ = handler.Stderr().Write([]byte("error"))
+	}))
+	defer server.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{ChannelProtocol}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != ChannelProtocol {
+		t.Fatalf("subprotocol = %q", conn.Subprotocol())
+	}
+	_ = conn.WriteMessage(websocket.BinaryMessage, append([]byte{ResizeChannel}, `{"Width":100,"Height":30}`...))
+	_ = conn.WriteMessage(websocket.BinaryMessage, []byte{StdinChannel, 'l', 's'})
+	_ = conn.WriteMessage(websocket.BinaryMessage, []byte{StdinChannel, '\r'})
+
+	if got := <-received; got != "ls\r" {
+		t.Errorf("stdin = %q", got)
+	}
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 二进制输出原样发送
+	if messageType != websocket.BinaryMessage || !bytes.Equal(data, []byte{StdoutChannel, 0xff, 0x00}) {
+		t.Errorf("stdout frame = %d %v", messageType, data)
+	}
+	messageType, data, err = conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageType != websocket.BinaryMessage || !bytes.Equal(data, append([]byte{StderrChannel}, "error"...)) {
+		t.Errorf("stderr frame = %d %v", messageType, data)
+	}
+}
+
+func TestXtermProtocolStderr(t *testing.T) {
+	options := NewDefaultOptions()
+	options.PingInterval = metav1.Duration{Duration: time.Minute}
+	word := []byte("中文")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := InitWebsocket(w, r, options)
+		if err != nil {
+			return
+		}
+		defer conn.WsClose()
+		handler := NewStreamHandler(conn)
+		// stdout 和 stderr 各自保存被截断的字符
+		_, _ = handler.Write(word[:4])
+		_, _ = handler.Stderr().Write([]byte("error"))
+		_, _ = handler.Write(word[4:])
+		// 等待客户端读取完再关闭
+		_, _, _ = conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, want := range []string{"中", "error", "文"} {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != websocket.TextMessage || string(data) != want {
+			t.Errorf("message = %d %q, want %q", messageType, data, want)
+		}
+	}
+}
@@ -1,9 +1,10 @@
 package ws
 
 import (
+	"bytes"
 	"encoding/json"
-	"errors"
 	"io"
+	"sync"
 	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
@@ -11,9 +12,33 @@ import (
 	"k8s.io/client-go/tools/remotecommand"
 )
 
+// ChannelProtocol 与 kubectl exec 的 websocket 协议兼容, 每个二进制消息的第一个字节是 channel
+// https://github.com/kubernetes/kubernetes/blob/master/staging/src/k8s.io/apiserver/pkg/util/wsstream/conn.go
+const ChannelProtocol = "v4.channel.k8s.io"
+
+// PortForwardProtocol 端口转发的多路复用协议, 多个本地连接复用一个 websocket
+const PortForwardProtocol = "v1.portforward.kuber.io"
+
+const (
+	StdinChannel byte = iota
+	StdoutChannel
+	StderrChannel
+	ErrorChannel
+	ResizeChannel
+)
+
+// StreamHandler 把 websocket 连接适配为终端的 stdin/stdout 和 TerminalSizeQueue
 type StreamHandler struct {
-	WsConn      *WsConnection
-	ResizeEvent chan remotecommand.TerminalSize
+	WsConn *WsConnection
+	resize chan remotecommand.TerminalSize
+
+	// 只有 stdin 的读取方访问
+	pending []byte
+	eof     bool
+
+	writeMu sync.Mutex
+	// xterm 协议使用文本消息, 按 channel 保存被截断的 UTF-8 字符留到下一次发送
+	partial map[byte][]byte
 }
 
 type xtermMessage struct {
@@ -23,74 +48,171 @@ type xtermMessage struct {
 	Cols        uint16 `json:"cols"`
 }
 
-func (handler *StreamHandler) Next() (size *remotecommand.TerminalSize) {
-	ret := <-handler.ResizeEvent
-	size = &ret
-	return
+// channel 协议中 resize channel 的内容
+type resizeMessage struct {
+	Width  uint16 `json:"Width"`
+	Height uint16 `json:"Height"`
+}
+
+func NewStreamHandler(conn *WsConnection) *StreamHandler {
+	return &StreamHandler{
+		WsConn:  conn,
+		resize:  make(chan remotecommand.TerminalSize, 1),
+		partial: map[byte][]byte{},
+	}
+}
+
+// Next 连接关闭后返回 nil
+func (handler *StreamHandler) Next() *remotecommand.TerminalSize {
+	select {
+	case size := <-handler.resize:
+		return &size
+	case <-handler.WsConn.Done():
+		return nil
+	}
+}
+
+func (handler *StreamHandler) Write(p []byte) (int, error) {
+	return handler.write(StdoutChannel, p)
+}
+
+// Stderr 非 TTY 会话的 stderr, channel 协议写到 stderr channel, xterm 协议与 stdout 一样作为文本消息发送
+// TTY 会话中 stderr 已经合并到 stdout
+func (handler *StreamHandler) Stderr() io.Writer {
+	return channelWriter{handler: handler, channel: StderrChannel}
 }
 
-func (handler *StreamHandler) Write(p []byte) (size int, err error) {
-	copyData := make([]byte, len(p))
-	copy(copyData, p)
-	size = len(copyData)
-	err = handler.WsConn.WsWrite(websocket.TextMessage, checkUTF8(copyData))
+type channelWriter struct {
+	handler *StreamHandler
+	channel byte
+}
+
+func (w channelWriter) Write(p []byte) (int, error) {
+	return w.handler.write(w.channel, p)
+}
+
+func (handler *StreamHandler) write(channel byte, p []byte) (int, error) {
+	handler.writeMu.Lock()
+	defer handler.writeMu.Unlock()
+
+	var err error
+	if handler.WsConn.protocol == ChannelProtocol {
+		frame := make([]byte, len(p)+1)
+		frame[0] = channel
+		copy(frame[1:], p)
+		err = handler.WsConn.WsWrite(websocket.BinaryMessage, frame)
+	} else {
+		var text []byte
+		text, handler.partial[channel] = SplitUTF8(append(handler.partial[channel], p...))
+		if len(text) > 0 {
+			err = handler.WsConn.WsWrite(websocket.TextMessage, text)
+		}
+	}
 	if err != nil {
 		log.Error(err, "write websocket")
 		handler.WsConn.WsClose()
+		return 0, err
 	}
-	return
+	return len(p), nil
 }
 
-func (handler *StreamHandler) Read(p []byte) (size int, err error) {
-	var (
-		message      *WsMessage
-		xtermMessage xtermMessage
-	)
-	if message, err = handler.WsConn.WsRead(); err != nil {
-		log.Error(err, "read websocket")
-		handler.WsConn.WsClose()
-		return
+// Read 读取错误或者客户端关闭时返回 io.EOF, 结束 stdin
+func (handler *StreamHandler) Read(p []byte) (int, error) {
+	for len(handler.pending) == 0 {
+		if handler.eof {
+			return 0, io.EOF
+		}
+		_, data, err := handler.WsConn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Error(err, "read websocket")
+			}
+			handler.WsConn.WsClose()
+			return 0, io.EOF
+		}
+		if handler.WsConn.protocol == ChannelProtocol {
+			handler.handleChannel(data)
+		} else {
+			handler.handleXterm(data)
+		}
 	}
+	n := copy(p, handler.pending)
+	handler.pending = handler.pending[n:]
+	return n, nil
+}
 
-	if message == nil {
+func (handler *StreamHandler) handleChannel(data []byte) {
+	if len(data) == 0 {
 		return
 	}
+	switch data[0] {
+	case StdinChannel:
+		handler.pending = data[1:]
+	case ResizeChannel:
+		size := resizeMessage{}
+		if err := json.Unmarshal(data[1:], &size); err != nil {
+			log.Error(err, "unmarshal resize message")
+			return
+		}
+		handler.pushResize(remotecommand.TerminalSize{Width: size.Width, Height: size.Height})
+	}
+}
 
-	if err = json.Unmarshal([]byte(message.Data), &xtermMessage); err != nil {
+func (handler *StreamHandler) handleXterm(data []byte) {
+	msg := xtermMessage{}
+	if err := json.Unmarshal(data, &msg); err != nil {
 		log.Error(err, "unmarshal websocket message")
 		return
 	}
-
-	switch xtermMessage.MessageType {
+	switch msg.MessageType {
 	case "resize":
-		handler.ResizeEvent <- remotecommand.TerminalSize{Width: xtermMessage.Cols, Height: xtermMessage.Rows}
+		handler.pushResize(remotecommand.TerminalSize{Width: msg.Cols, Height: msg.Rows})
 	case "input":
-		size = len(xtermMessage.Input)
-		copy(p, xtermMessage.Input)
+		handler.pending = []byte(msg.Input)
 	case "close":
-		handler.WsConn.WsClose()
-		err = io.EOF
+		// 先退出 shell, 再结束 stdin
+		handler.pending = []byte("exit\r")
+		handler.eof = true
 	}
-	return
 }
 
-func (wsConn *WsConnection) WsRead() (message *WsMessage, err error) {
-	wsConn.lock.Lock()
-	defer wsConn.lock.Unlock()
-	if wsConn.stopped {
-		err = errors.New("can't read on closed channel")
+// pushResize 只保留最新的大小, 不阻塞读取
+func (handler *StreamHandler) pushResize(size remotecommand.TerminalSize) {
+	if size.Width == 0 || size.Height == 0 {
 		return
 	}
-	message = <-wsConn.inChan
-	return
+	for {
+		select {
+		case handler.resize <- size:
+			return
+		default:
+		}
+		select {
+		case <-handler.resize:
+		default:
+		}
+	}
 }
 
-func checkUTF8(arr []byte) []byte {
-	ret := []rune{}
-	for len(arr) > 0 {
-		r, size := utf8.DecodeRune(arr)
-		arr = arr[size:]
-		ret = append(ret, r)
+// SplitUTF8 返回可以作为文本消息发送的部分, 和末尾不完整的 UTF-8 字符, 分段读取的文本拼接前调用
+// 无效的字节替换为 U+FFFD, 完整的多字节字符不会被破坏
+func SplitUTF8(data []byte) (text, partial []byte) {
+	end := len(data)
+	// 最多回退 utf8.UTFMax-1 个字节寻找不完整字符的起始字节
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	if end < len(data) {
+		partial = append([]byte{}, data[end:]...)
+	}
+	text = data[:end]
+	if !utf8.Valid(text) {
+		text = bytes.ToValidUTF8(text, []byte(string(utf8.RuneError)))
 	}
-	return []byte(string(ret))
+	return text, partial
 }
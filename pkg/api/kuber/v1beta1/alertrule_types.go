@@ -0,0 +1,76 @@
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	AlertRulePhaseReady  = "Ready"
+	AlertRulePhaseFailed = "Failed"
+)
+
+type AlertRuleItem struct {
+	// 告警名称
+	Alert string `json:"alert"`
+	// PromQL, 会强制限制在环境的namespace内
+	Expr string `json:"expr"`
+	// 持续时间, 如 5m
+	For string `json:"for,omitempty"`
+	// 告警的label, 租户、项目、环境和namespace 的label 会被覆盖
+	Labels map[string]string `json:"labels,omitempty"`
+	// 告警的annotation
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// AlertRuleSpec defines the desired state of AlertRule
+type AlertRuleSpec struct {
+	// 环境
+	Environment string `json:"environment"`
+	// 计算间隔, 为空时使用prometheus的默认值
+	Interval string `json:"interval,omitempty"`
+	// 告警规则
+	Rules []AlertRuleItem `json:"rules"`
+}
+
+// AlertRuleStatus defines the observed state of AlertRule
+type AlertRuleStatus struct {
+	// Ready 或者 Failed
+	Phase string `json:"phase,omitempty"`
+	// 生成失败的原因
+	Message string `json:"message,omitempty"`
+	// 生成的PrometheusRule, namespace/name
+	PrometheusRule string `json:"prometheusRule,omitempty"`
+	// 最后更新时间
+	LastUpdateTime metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+//+genclient
+//+genclient:nonNamespaced
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster,shortName=tar
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Environment",type="string",JSONPath=".spec.environment"
+//+kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase"
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// AlertRule 环境级别的告警规则, 由controller生成PrometheusRule
+type AlertRule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AlertRuleSpec   `json:"spec,omitempty"`
+	Status AlertRuleStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// AlertRuleList contains a list of AlertRule
+type AlertRuleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []AlertRule `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&AlertRule{}, &AlertRuleList{})
+}
@@ -0,0 +1,96 @@
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ClusterConditionReady 集群可以正常访问
+	ClusterConditionReady = "Ready"
+	// ClusterConditionUnreachable 集群无法访问
+	ClusterConditionUnreachable = "Unreachable"
+)
+
+type SecretKeyReference struct {
+	// Secret 所在的namespace
+	Namespace string `json:"namespace"`
+	// Secret 名称
+	Name string `json:"name"`
+	// Secret 中的key
+	Key string `json:"key"`
+}
+
+type ClusterAgent struct {
+	// agent 访问地址, 如 https://kuber-agent.kuber:8041
+	Addr string `json:"addr"`
+	// agent 服务端证书的CA
+	// +kubebuilder:validation:Optional
+	CASecretRef *SecretKeyReference `json:"caSecretRef,omitempty"`
+	// agent 的 http 签名token, 与 agent 的 signerToken 相同, 为空时使用内置token
+	// +kubebuilder:validation:Optional
+	SignerTokenSecretRef *SecretKeyReference `json:"signerTokenSecretRef,omitempty"`
+}
+
+type ClusterSpec struct {
+	// 存放kubeconfig的secret, 与agent二选一
+	// +kubebuilder:validation:Optional
+	KubeConfigSecretRef *SecretKeyReference `json:"kubeConfigSecretRef,omitempty"`
+	// 通过agent访问集群
+	// +kubebuilder:validation:Optional
+	Agent *ClusterAgent `json:"agent,omitempty"`
+	// 探测间隔, 默认1m
+	// +kubebuilder:validation:Optional
+	ProbeInterval *metav1.Duration `json:"probeInterval,omitempty"`
+}
+
+type ClusterStatus struct {
+	// Kubernetes 版本
+	KubernetesVersion string `json:"kubernetesVersion,omitempty"`
+	// 节点数
+	NodeCount int `json:"nodeCount,omitempty"`
+	// 集群资源的总容量
+	Capacity corev1.ResourceList `json:"capacity,omitempty"`
+	// 集群资源的真实使用量
+	Used corev1.ResourceList `json:"used,omitempty"`
+	// 集群下的租户资源分配总量
+	TenantAllocated corev1.ResourceList `json:"tenantAllocated,omitempty"`
+	// apiserver 证书过期时间
+	APIServerCertExpiredAt *metav1.Time `json:"apiServerCertExpiredAt,omitempty"`
+	// 最后一次探测成功的时间
+	LastHeartbeatTime metav1.Time `json:"lastHeartbeatTime,omitempty"`
+	// 集群状态
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+genclient
+//+genclient:nonNamespaced
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster,shortName=kc,singular=cluster
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Version",type="string",JSONPath=".status.kubernetesVersion"
+//+kubebuilder:printcolumn:name="Nodes",type="integer",JSONPath=".status.nodeCount"
+//+kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+//+kubebuilder:printcolumn:name="Heartbeat",type="date",JSONPath=".status.lastHeartbeatTime"
+
+// Cluster 注册到多集群管理中心的集群
+type Cluster struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterSpec   `json:"spec,omitempty"`
+	Status ClusterStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ClusterList contains a list of Cluster
+type ClusterList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Cluster `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Cluster{}, &ClusterList{})
+}
@@ -17,4 +17,5 @@ var (
 var (
 	SchemeTenant      = GroupVersion.WithKind("Tenant")
 	SchemeEnvironment = GroupVersion.WithKind("Environment")
+	SchemeAlertRule   = GroupVersion.WithKind("AlertRule")
 )
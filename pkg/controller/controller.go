@@ -10,10 +10,13 @@ import (
 
 	"github.com/go-logr/logr"
 	"github.com/sunweiwe/kuber/pkg/api/kuber"
+	kuberv1beta1 "github.com/sunweiwe/kuber/pkg/api/kuber/v1beta1"
 	"github.com/sunweiwe/kuber/pkg/controller/controllers"
+	"github.com/sunweiwe/kuber/pkg/utils/config"
 	"k8s.io/api/apps/v1beta1"
 	apiExtensionsV1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/errors"
 	utilRuntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientScheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -33,6 +36,7 @@ func init() {
 	utilRuntime.Must(clientScheme.AddToScheme(scheme))
 	utilRuntime.Must(v1beta1.AddToScheme(scheme))
 	utilRuntime.Must(apiExtensionsV1.AddToScheme(scheme))
+	utilRuntime.Must(kuberv1beta1.SchemeBuilder.AddToScheme(scheme))
 
 	//+kubebuilder:scaffold:scheme
 }
@@ -57,6 +61,17 @@ func NewDefaultOptions() *Options {
 	}
 }
 
+func (o *Options) Validate() error {
+	errs := []error{
+		config.ValidateAddr("metricsAddr", o.MetricsAddr),
+		config.ValidateAddr("probeAddr", o.ProbeAddr),
+	}
+	if o.EnableWebhook {
+		errs = append(errs, config.ValidateAddr("webhookAddr", o.WebhookAddr))
+	}
+	return errors.NewAggregate(errs)
+}
+
 func Run(ctx context.Context, options *Options) error {
 	ctrl.SetLogger(zap.New(zap.UseDevMode(false)))
 
@@ -151,6 +166,24 @@ func setupControllers(mgr ctrl.Manager, options *Options, setupLog logr.Logger)
 		return err
 	}
 
+	// 没有安装 prometheus-operator 时跳过, 避免缓存同步超时导致所有控制器退出
+	prometheusRuleInstalled, err := controllers.PrometheusRuleInstalled(mgr.GetRESTMapper())
+	if err != nil {
+		setupLog.Error(err, "unable to check PrometheusRule CRD", "controller", "AlertRule")
+		return err
+	}
+	if !prometheusRuleInstalled {
+		setupLog.Info("PrometheusRule CRD is not installed, AlertRule controller is disabled", "controller", "AlertRule")
+	} else if err := (&controllers.AlertRuleReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Log:      ctrl.Log.WithName("controllers").WithName("AlertRule"),
+		Recorder: mgr.GetEventRecorderFor("AlertRule"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "AlertRule")
+		return err
+	}
+
 	if err := (&controllers.ServiceEntryReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
@@ -160,6 +193,16 @@ func setupControllers(mgr ctrl.Manager, options *Options, setupLog logr.Logger)
 		return err
 	}
 
+	if err := (&controllers.ClusterReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Log:      ctrl.Log.WithName("controllers").WithName("Cluster"),
+		Recorder: mgr.GetEventRecorderFor("Cluster"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Cluster")
+		return err
+	}
+
 	if err := (&controllers.PluginStatusController{
 		Client: mgr.GetClient(),
 		Log:    ctrl.Log.WithName("controllers").WithName("PluginStatus"),
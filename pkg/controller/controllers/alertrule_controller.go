@@ -0,0 +1,261 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/common/model"
+	"github.com/sunweiwe/kuber/pkg/api/kuber"
+	"github.com/sunweiwe/kuber/pkg/api/kuber/v1beta1"
+	"github.com/sunweiwe/kuber/pkg/utils/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	ctrlHandler "sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var prometheusRuleGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "PrometheusRule"}
+
+// 告警的路由label, alertmanager 根据这些label 把告警发送给对应的租户
+const (
+	alertLabelTenant      = "tenant"
+	alertLabelProject     = "project"
+	alertLabelEnvironment = "environment"
+	alertLabelNamespace   = "namespace"
+)
+
+type AlertRuleReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=go.kuber.io,resources=alertrules,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=go.kuber.io,resources=alertrules/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=prometheusrules,verbs=get;list;watch;create;update;patch;delete
+
+func (r *AlertRuleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	/*
+		告警规则逻辑：
+		1. 根据环境找到namespace
+		2. 生成PrometheusRule, 表达式中的每个selector都限制在环境的namespace内, 并追加路由label
+		3. 删除时由ownerReference回收PrometheusRule, 环境的namespace变化时删除原来namespace中的PrometheusRule
+	*/
+	log := r.Log.WithValues("AlertRule", req.Name)
+	var rule v1beta1.AlertRule
+	if err := r.Get(ctx, req.NamespacedName, &rule); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !rule.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	// 失败时保留原来的 PrometheusRule, namespace 恢复后仍然可以删除
+	status := v1beta1.AlertRuleStatus{Phase: v1beta1.AlertRulePhaseReady, PrometheusRule: rule.Status.PrometheusRule}
+	if err := r.sync(ctx, &rule, &status); err != nil {
+		log.Error(err, "Failed to render AlertRule")
+		r.Recorder.Eventf(&rule, corev1.EventTypeWarning, ReasonFailedUpdate, "Failed to render PrometheusRule: %v", err)
+		status.Phase = v1beta1.AlertRulePhaseFailed
+		status.Message = err.Error()
+	}
+	if rule.Status.Phase == status.Phase && rule.Status.Message == status.Message && rule.Status.PrometheusRule == status.PrometheusRule {
+		return ctrl.Result{}, nil
+	}
+	status.LastUpdateTime = metav1.Now()
+	rule.Status = status
+	if err := r.Status().Update(ctx, &rule); err != nil {
+		log.Error(err, "Failed to update AlertRule status")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+func (r *AlertRuleReconciler) sync(ctx context.Context, rule *v1beta1.AlertRule, status *v1beta1.AlertRuleStatus) error {
+	var env v1beta1.Environment
+	if err := r.Get(ctx, types.NamespacedName{Name: rule.Spec.Environment}, &env); err != nil {
+		if errors.IsNotFound(err) {
+			return fmt.Errorf("environment %q not found", rule.Spec.Environment)
+		}
+		return err
+	}
+	if env.Spec.Namespace == "" {
+		return fmt.Errorf("environment %q has no namespace", env.Name)
+	}
+
+	spec, err := renderPrometheusRuleSpec(rule, &env)
+	if err != nil {
+		return err
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(prometheusRuleGVK)
+	obj.SetName(rule.Name)
+	obj.SetNamespace(env.Spec.Namespace)
+	if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, obj, func() error {
+		// 不覆盖用户自己创建的同名PrometheusRule
+		if obj.GetResourceVersion() != "" && !metav1.IsControlledBy(obj, rule) {
+			return fmt.Errorf("PrometheusRule %s/%s already exists and is not managed by this AlertRule", obj.GetNamespace(), obj.GetName())
+		}
+		labels := obj.GetLabels()
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		labels[kuber.LabelTenant] = env.Spec.Tenant
+		labels[kuber.LabelProject] = env.Spec.Project
+		labels[kuber.LabelEnvironment] = env.Name
+		obj.SetLabels(labels)
+		obj.Object["spec"] = spec
+		return controllerutil.SetControllerReference(rule, obj, r.Scheme)
+	}); err != nil {
+		return err
+	}
+	current := env.Spec.Namespace + "/" + rule.Name
+	if previous := rule.Status.PrometheusRule; previous != "" && previous != current {
+		if err := r.deletePrometheusRule(ctx, rule, previous); err != nil {
+			return fmt.Errorf("delete previous PrometheusRule %s: %v", previous, err)
+		}
+	}
+	status.PrometheusRule = current
+	return nil
+}
+
+// deletePrometheusRule 只删除由这个 AlertRule 管理的 PrometheusRule
+func (r *AlertRuleReconciler) deletePrometheusRule(ctx context.Context, rule *v1beta1.AlertRule, namespacedName string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(namespacedName)
+	if err != nil {
+		return err
+	}
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(prometheusRuleGVK)
+	if err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(obj, rule) {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, obj))
+}
+
+// renderPrometheusRuleSpec 生成 PrometheusRule 的 spec, 使用 unstructured 避免依赖 prometheus-operator
+func renderPrometheusRuleSpec(rule *v1beta1.AlertRule, env *v1beta1.Environment) (map[string]interface{}, error) {
+	if len(rule.Spec.Rules) == 0 {
+		return nil, fmt.Errorf("at least one rule is required")
+	}
+	matcher := alertLabelNamespace + "=" + strconv.Quote(env.Spec.Namespace)
+	routing := map[string]string{
+		alertLabelTenant:      env.Spec.Tenant,
+		alertLabelProject:     env.Spec.Project,
+		alertLabelEnvironment: env.Name,
+		alertLabelNamespace:   env.Spec.Namespace,
+	}
+
+	rules := make([]interface{}, 0, len(rule.Spec.Rules))
+	for i, item := range rule.Spec.Rules {
+		if item.Alert == "" {
+			return nil, fmt.Errorf("rules[%d]: alert is required", i)
+		}
+		if item.Expr == "" {
+			return nil, fmt.Errorf("rules[%d]: expr is required", i)
+		}
+		expr, err := prometheus.InjectMatcher(item.Expr, matcher)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: invalid expr: %v", i, err)
+		}
+		out := map[string]interface{}{
+			"alert": item.Alert,
+			"expr":  expr,
+		}
+		if item.For != "" {
+			if _, err := model.ParseDuration(item.For); err != nil {
+				return nil, fmt.Errorf("rules[%d]: invalid for %q: %v", i, item.For, err)
+			}
+			out["for"] = item.For
+		}
+
+		labels := map[string]interface{}{}
+		for k, v := range item.Labels {
+			if !model.LabelName(k).IsValid() {
+				return nil, fmt.Errorf("rules[%d]: invalid label name %q", i, k)
+			}
+			labels[k] = v
+		}
+		for k, v := range routing {
+			labels[k] = v
+		}
+		out["labels"] = labels
+
+		if len(item.Annotations) > 0 {
+			annotations := map[string]interface{}{}
+			for k, v := range item.Annotations {
+				annotations[k] = v
+			}
+			out["annotations"] = annotations
+		}
+		rules = append(rules, out)
+	}
+
+	group := map[string]interface{}{
+		"name":  rule.Name,
+		"rules": rules,
+	}
+	if rule.Spec.Interval != "" {
+		if _, err := model.ParseDuration(rule.Spec.Interval); err != nil {
+			return nil, fmt.Errorf("invalid interval %q: %v", rule.Spec.Interval, err)
+		}
+		group["interval"] = rule.Spec.Interval
+	}
+	return map[string]interface{}{"groups": []interface{}{group}}, nil
+}
+
+// PrometheusRuleInstalled 集群没有安装 prometheus-operator 时, PrometheusRule 的 informer 无法同步, 不能启动 AlertRule 控制器
+func PrometheusRuleInstalled(mapper meta.RESTMapper) (bool, error) {
+	if _, err := mapper.RESTMapping(prometheusRuleGVK.GroupKind(), prometheusRuleGVK.Version); err != nil {
+		if meta.IsNoMatchError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *AlertRuleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	prometheusRule := &unstructured.Unstructured{}
+	prometheusRule.SetGroupVersionKind(prometheusRuleGVK)
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1beta1.AlertRule{}).
+		// PrometheusRule 被修改或者删除时恢复
+		Owns(prometheusRule).
+		// 环境的namespace变化时重新生成
+		Watches(&source.Kind{Type: &v1beta1.Environment{}}, ctrlHandler.EnqueueRequestsFromMapFunc(r.requestsForEnvironment)).
+		Complete(r)
+}
+
+func (r *AlertRuleReconciler) requestsForEnvironment(obj client.Object) []reconcile.Request {
+	rules := v1beta1.AlertRuleList{}
+	if err := r.List(context.Background(), &rules); err != nil {
+		r.Log.Error(err, "failed to list alert rules")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, rule := range rules.Items {
+		if rule.Spec.Environment == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&rule)})
+		}
+	}
+	return requests
+}
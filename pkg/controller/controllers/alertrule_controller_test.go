@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/sunweiwe/kuber/pkg/api/kuber/v1beta1"
+	apiErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRenderPrometheusRuleSpec(t *testing.T) {
+	env := &v1beta1.Environment{
+		ObjectMeta: metav1.ObjectMeta{Name: "dev"},
+		Spec:       v1beta1.EnvironmentSpec{Tenant: "t1", Project: "p1", Namespace: "t1-dev"},
+	}
+	tests := []struct {
+		name     string
+		rules    []v1beta1.AlertRuleItem
+		interval string
+		wantExpr string
+		wantErr  string
+	}{
+		{
+			name:     "scoped expr and routing labels",
+			rules:    []v1beta1.AlertRuleItem{{Alert: "Down", Expr: `up{job="a"} == 0`, For: "5m", Labels: map[string]string{"namespace": "other", "severity": "critical"}}},
+			interval: "1m",
+			wantExpr: `up{job="a",namespace="t1-dev"} == 0`,
+		},
+		{name: "no rules", wantErr: "at least one rule"},
+		{name: "missing alert", rules: []v1beta1.AlertRuleItem{{Expr: "up"}}, wantErr: "alert is required"},
+		{name: "invalid expr", rules: []v1beta1.AlertRuleItem{{Alert: "a", Expr: "up{"}}, wantErr: "invalid expr"},
+		{name: "invalid for", rules: []v1beta1.AlertRuleItem{{Alert: "a", Expr: "up", For: "5 minutes"}}, wantErr: "invalid for"},
+		{name: "invalid label", rules: []v1beta1.AlertRuleItem{{Alert: "a", Expr: "up", Labels: map[string]string{"a-b": "c"}}}, wantErr: "invalid label name"},
+		{name: "invalid interval", rules: []v1beta1.AlertRuleItem{{Alert: "a", Expr: "up"}}, interval: "1 minute", wantErr: "invalid interval"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := &v1beta1.AlertRule{
+				ObjectMeta: metav1.ObjectMeta{Name: "r1"},
+				Spec:       v1beta1.AlertRuleSpec{Environment: "dev", Interval: tt.interval, Rules: tt.rules},
+			}
+			spec, err := renderPrometheusRuleSpec(rule, env)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("renderPrometheusRuleSpec() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			group := spec["groups"].([]interface{})[0].(map[string]interface{})
+			if group["interval"] != tt.interval {
+				t.Errorf("interval = %v, want %s", group["interval"], tt.interval)
+			}
+			out := group["rules"].([]interface{})[0].(map[string]interface{})
+			if out["expr"] != tt.wantExpr {
+				t.Errorf("expr = %v, want %s", out["expr"], tt.wantExpr)
+			}
+			labels := out["labels"].(map[string]interface{})
+			if labels["namespace"] != "t1-dev" || labels["tenant"] != "t1" || labels["severity"] != "critical" {
+				t.Errorf("labels = %v", labels)
+			}
+		})
+	}
+}
+
+func TestAlertRuleReconcileNamespaceChanged(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := v1beta1.SchemeBuilder.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	scheme.AddKnownTypeWithName(prometheusRuleGVK, &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(prometheusRuleGVK.GroupVersion().WithKind("PrometheusRuleList"), &unstructured.UnstructuredList{})
+
+	env := &v1beta1.Environment{
+		ObjectMeta: metav1.ObjectMeta{Name: "dev"},
+		Spec:       v1beta1.EnvironmentSpec{Tenant: "t1", Project: "p1", Namespace: "ns-a"},
+	}
+	rule := &v1beta1.AlertRule{
+		ObjectMeta: metav1.ObjectMeta{Name: "r1", UID: "r1-uid"},
+		Spec: v1beta1.AlertRuleSpec{
+			Environment: "dev",
+			Rules:       []v1beta1.AlertRuleItem{{Alert: "Down", Expr: "up == 0"}},
+		},
+	}
+	// 用户自己创建的同名规则, 不由 AlertRule 管理
+	userRule := &unstructured.Unstructured{}
+	userRule.SetGroupVersionKind(prometheusRuleGVK)
+	userRule.SetNamespace("ns-c")
+	userRule.SetName("r1")
+
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(env, rule, userRule).Build()
+	r := &AlertRuleReconciler{Client: cli, Log: logr.Discard(), Scheme: scheme, Recorder: record.NewFakeRecorder(10)}
+	ctx := context.Background()
+	reconcile := func() *v1beta1.AlertRule {
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "r1"}}); err != nil {
+			t.Fatal(err)
+		}
+		got := &v1beta1.AlertRule{}
+		if err := cli.Get(ctx, types.NamespacedName{Name: "r1"}, got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	exists := func(namespace string) bool {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(prometheusRuleGVK)
+		err := cli.Get(ctx, types.NamespacedName{Namespace: namespace, Name: "r1"}, obj)
+		if err != nil && !apiErrors.IsNotFound(err) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+	setNamespace := func(namespace string) {
+		if err := cli.Get(ctx, client.ObjectKeyFromObject(env), env); err != nil {
+			t.Fatal(err)
+		}
+		env.Spec.Namespace = namespace
+		if err := cli.Update(ctx, env); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := reconcile(); got.Status.PrometheusRule != "ns-a/r1" || !exists("ns-a") {
+		t.Fatalf("status = %+v", got.Status)
+	}
+
+	// namespace 暂时为空时生成失败, 保留原来的记录
+	setNamespace("")
+	if got := reconcile(); got.Status.Phase != v1beta1.AlertRulePhaseFailed || got.Status.PrometheusRule != "ns-a/r1" {
+		t.Fatalf("status = %+v", got.Status)
+	}
+
+	setNamespace("ns-b")
+	if got := reconcile(); got.Status.PrometheusRule != "ns-b/r1" || got.Status.Phase != v1beta1.AlertRulePhaseReady {
+		t.Fatalf("status = %+v", got.Status)
+	}
+	if exists("ns-a") || !exists("ns-b") {
+		t.Errorf("previous PrometheusRule is not deleted: ns-a %v, ns-b %v", exists("ns-a"), exists("ns-b"))
+	}
+
+	// 状态中记录的规则不是由 AlertRule 管理时不删除
+	rule = reconcile()
+	rule.Status.PrometheusRule = "ns-c/r1"
+	if err := cli.Status().Update(ctx, rule); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	if !exists("ns-c") {
+		t.Error("PrometheusRule not managed by the AlertRule is deleted")
+	}
+}
+
+func TestPrometheusRuleInstalled(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	if installed, err := PrometheusRuleInstalled(mapper); err != nil || installed {
+		t.Errorf("PrometheusRuleInstalled() without CRD = %v, %v, want false", installed, err)
+	}
+	mapper.Add(prometheusRuleGVK, meta.RESTScopeNamespace)
+	if installed, err := PrometheusRuleInstalled(mapper); err != nil || !installed {
+		t.Errorf("PrometheusRuleInstalled() = %v, %v, want true", installed, err)
+	}
+}
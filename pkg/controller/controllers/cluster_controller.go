@@ -0,0 +1,296 @@
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/sunweiwe/kuber/pkg/api/kuber/v1beta1"
+	"github.com/sunweiwe/kuber/pkg/utils/cluster"
+	"github.com/sunweiwe/kuber/pkg/utils/httpsigs"
+	"github.com/sunweiwe/kuber/pkg/utils/statistics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+const (
+	defaultClusterProbeInterval = time.Minute
+	clusterProbeTimeout         = 15 * time.Second
+
+	ReasonProbeSucceeded = "ProbeSucceeded"
+	ReasonProbeFailed    = "ProbeFailed"
+)
+
+type ClusterReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=go.kuber.io,resources=clusters,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=go.kuber.io,resources=clusters/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get
+
+func (r *ClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	/*
+		集群逻辑:
+		1. 根据spec中的kubeconfig secret或者agent地址访问集群
+		2. 收集版本、节点数、资源容量和apiserver证书过期时间, 写入status
+		3. 根据探测结果设置 Ready/Unreachable condition, 并按照探测间隔重新入队
+	*/
+	log := r.Log.WithValues("cluster", req.Name)
+	var c v1beta1.Cluster
+	if err := r.Get(ctx, req.NamespacedName, &c); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !c.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	interval := defaultClusterProbeInterval
+	if c.Spec.ProbeInterval != nil && c.Spec.ProbeInterval.Duration > 0 {
+		interval = c.Spec.ProbeInterval.Duration
+	}
+
+	status := c.Status.DeepCopy()
+	probeCtx, cancel := context.WithTimeout(ctx, clusterProbeTimeout)
+	defer cancel()
+
+	if err := r.probe(probeCtx, &c, status); err != nil {
+		log.Info("cluster unreachable", "reason", err.Error())
+		setClusterReachable(status, false, err.Error())
+		if isClusterReady(&c.Status) {
+			r.Recorder.Eventf(&c, corev1.EventTypeWarning, ReasonProbeFailed, "Cluster %s is unreachable: %v", c.Name, err)
+		}
+	} else {
+		status.LastHeartbeatTime = metav1.Now()
+		setClusterReachable(status, true, "")
+		if !isClusterReady(&c.Status) {
+			r.Recorder.Eventf(&c, corev1.EventTypeNormal, ReasonProbeSucceeded, "Cluster %s is ready", c.Name)
+		}
+	}
+
+	if !equality.Semantic.DeepEqual(&c.Status, status) {
+		c.Status = *status
+		if err := r.Status().Update(ctx, &c); err != nil {
+			log.Error(err, "update cluster status")
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: interval}, nil
+}
+
+// 只在spec变化时触发, status的更新不会打断探测间隔
+func (r *ClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&v1beta1.Cluster{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
+
+func (r *ClusterReconciler) probe(ctx context.Context, c *v1beta1.Cluster, status *v1beta1.ClusterStatus) error {
+	switch {
+	case c.Spec.KubeConfigSecretRef != nil:
+		kubeconfig, err := r.secretValue(ctx, c.Spec.KubeConfigSecretRef)
+		if err != nil {
+			return err
+		}
+		return probeKubeConfig(ctx, kubeconfig, r.Scheme, status)
+	case c.Spec.Agent != nil:
+		var ca, token []byte
+		if c.Spec.Agent.CASecretRef != nil {
+			value, err := r.secretValue(ctx, c.Spec.Agent.CASecretRef)
+			if err != nil {
+				return err
+			}
+			ca = value
+		}
+		if c.Spec.Agent.SignerTokenSecretRef != nil {
+			value, err := r.secretValue(ctx, c.Spec.Agent.SignerTokenSecretRef)
+			if err != nil {
+				return err
+			}
+			token = value
+		}
+		signer := httpsigs.NewSigner(strings.TrimSpace(string(token)))
+		return probeAgent(ctx, c.Spec.Agent.Addr, ca, signer, status)
+	default:
+		return fmt.Errorf("neither kubeConfigSecretRef nor agent is specified")
+	}
+}
+
+func (r *ClusterReconciler) secretValue(ctx context.Context, ref *v1beta1.SecretKeyReference) ([]byte, error) {
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, secret); err != nil {
+		return nil, fmt.Errorf("get secret %s/%s: %v", ref.Namespace, ref.Name, err)
+	}
+	value, ok := secret.Data[ref.Key]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found in secret %s/%s", ref.Key, ref.Namespace, ref.Name)
+	}
+	return value, nil
+}
+
+func probeKubeConfig(ctx context.Context, kubeconfig []byte, scheme *runtime.Scheme, status *v1beta1.ClusterStatus) error {
+	config, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		return fmt.Errorf("parse kubeconfig: %v", err)
+	}
+	config.Timeout = clusterProbeTimeout
+
+	clientSet, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	serverVersion, err := clientSet.Discovery().ServerVersion()
+	if err != nil {
+		return err
+	}
+
+	cli, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+	nodes := &corev1.NodeList{}
+	if err := cli.List(ctx, nodes); err != nil {
+		return err
+	}
+	resources := statistics.GetClusterResourceStatistics(ctx, cli)
+
+	status.KubernetesVersion = serverVersion.GitVersion
+	status.NodeCount = len(nodes.Items)
+	status.Capacity = resources.Capacity
+	status.Used = resources.Used
+	status.TenantAllocated = resources.TenantAllocated
+
+	// 证书过期时间获取失败不影响集群状态
+	if strings.HasPrefix(config.Host, "https://") {
+		if expiredAt, err := cluster.GetServerCertExpiredTime(ctx, config.Host); err == nil {
+			status.APIServerCertExpiredAt = &metav1.Time{Time: *expiredAt}
+		}
+	}
+	return nil
+}
+
+// agent 接口的返回格式, 见 handlers.ResponseStruct
+type agentResponse struct {
+	Message   string
+	Data      json.RawMessage
+	ErrorData interface{}
+}
+
+// agent 的 /version 接口, 没有使用 ResponseStruct 包装
+type agentVersion struct {
+	Kubernetes             string
+	APIServerCertExpiredAt *time.Time
+}
+
+func probeAgent(ctx context.Context, addr string, ca []byte, signer *httpsigs.Signer, status *v1beta1.ClusterStatus) error {
+	tlsConfig := &tls.Config{}
+	if len(ca) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("invalid agent ca")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	cli := &http.Client{
+		Timeout:   clusterProbeTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+	}
+	get := func(path string, into interface{}, wrapped bool) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(addr, "/")+path, nil)
+		if err != nil {
+			return err
+		}
+		signer.Sign(req, "")
+		resp, err := cli.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("request agent %s: %s", path, resp.Status)
+		}
+		if into == nil {
+			return nil
+		}
+		if !wrapped {
+			return json.NewDecoder(resp.Body).Decode(into)
+		}
+		ret := agentResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+			return err
+		}
+		return json.Unmarshal(ret.Data, into)
+	}
+
+	if err := get("/healthz", nil, false); err != nil {
+		return err
+	}
+	version := agentVersion{}
+	if err := get("/version", &version, false); err != nil {
+		return err
+	}
+	workloads := statistics.ClusterWorkloadStatistics{}
+	if err := get("/custom/statistics.system/v1/workloads", &workloads, true); err != nil {
+		return err
+	}
+	resources := statistics.ClusterResourceStatistics{}
+	if err := get("/custom/statistics.system/v1/resources", &resources, true); err != nil {
+		return err
+	}
+
+	status.KubernetesVersion = version.Kubernetes
+	// 与 kubeconfig 相同, 证书过期时间获取失败时保留原来的值
+	if version.APIServerCertExpiredAt != nil {
+		status.APIServerCertExpiredAt = &metav1.Time{Time: *version.APIServerCertExpiredAt}
+	}
+	status.NodeCount = workloads["node"]
+	status.Capacity = resources.Capacity
+	status.Used = resources.Used
+	status.TenantAllocated = resources.TenantAllocated
+	return nil
+}
+
+func isClusterReady(status *v1beta1.ClusterStatus) bool {
+	return meta.IsStatusConditionTrue(status.Conditions, v1beta1.ClusterConditionReady)
+}
+
+func setClusterReachable(status *v1beta1.ClusterStatus, reachable bool, message string) {
+	ready, unreachable := metav1.ConditionFalse, metav1.ConditionTrue
+	reason := ReasonProbeFailed
+	if reachable {
+		ready, unreachable = metav1.ConditionTrue, metav1.ConditionFalse
+		reason = ReasonProbeSucceeded
+	}
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:    v1beta1.ClusterConditionReady,
+		Status:  ready,
+		Reason:  reason,
+		Message: message,
+	})
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:    v1beta1.ClusterConditionUnreachable,
+		Status:  unreachable,
+		Reason:  reason,
+		Message: message,
+	})
+}
@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sunweiwe/kuber/pkg/api/kuber/v1beta1"
+	"github.com/sunweiwe/kuber/pkg/utils/httpsigs"
+	"github.com/sunweiwe/kuber/pkg/utils/statistics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestProbeAgent(t *testing.T) {
+	expiredAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	agent := httpsigs.NewSigner("agent-token")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := agent.Validate(r); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var data interface{}
+		switch r.URL.Path {
+		case "/healthz":
+			data = map[string]string{"healthy": "ok"}
+		case "/version":
+			_ = json.NewEncoder(w).Encode(agentVersion{Kubernetes: "v1.26.1", APIServerCertExpiredAt: &expiredAt})
+			return
+		case "/custom/statistics.system/v1/workloads":
+			data = map[string]interface{}{"Data": statistics.ClusterWorkloadStatistics{"node": 3}}
+		case "/custom/statistics.system/v1/resources":
+			data = map[string]interface{}{"Data": statistics.ClusterResourceStatistics{
+				Capacity: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("12")},
+			}}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(data)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "signed with agent token", token: "agent-token"},
+		{name: "signed with builtin token", token: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := &v1beta1.ClusterStatus{}
+			err := probeAgent(context.Background(), server.URL, nil, httpsigs.NewSigner(tt.token), status)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("probeAgent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if status.KubernetesVersion != "v1.26.1" {
+				t.Errorf("KubernetesVersion = %q", status.KubernetesVersion)
+			}
+			if status.APIServerCertExpiredAt == nil || !status.APIServerCertExpiredAt.Time.Equal(expiredAt) {
+				t.Errorf("APIServerCertExpiredAt = %v", status.APIServerCertExpiredAt)
+			}
+			if status.NodeCount != 3 {
+				t.Errorf("NodeCount = %d", status.NodeCount)
+			}
+			if cpu := status.Capacity[corev1.ResourceCPU]; cpu.String() != "12" {
+				t.Errorf("Capacity cpu = %s", cpu.String())
+			}
+		})
+	}
+}
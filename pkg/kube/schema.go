@@ -1,9 +1,17 @@
 package kube
 
-import "k8s.io/apimachinery/pkg/runtime"
+import (
+	kuberv1beta1 "github.com/sunweiwe/kuber/pkg/api/kuber/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilRuntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientScheme "k8s.io/client-go/kubernetes/scheme"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+)
 
 func ConfigureSchema(schema *runtime.Scheme) {
-
+	utilRuntime.Must(clientScheme.AddToScheme(schema))
+	utilRuntime.Must(metricsv1beta1.AddToScheme(schema))
+	utilRuntime.Must(kuberv1beta1.SchemeBuilder.AddToScheme(schema))
 }
 
 func Scheme() *runtime.Scheme {
@@ -1,8 +1,10 @@
 package cluster
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/url"
 	"strings"
 	"time"
@@ -12,25 +14,38 @@ const (
 	APIServerURL       = "https://kubernetes.default:443"
 	K8sAPIServerCertCN = "apiserver"
 	K3sAPIServerCertCN = "k3s"
+
+	certDialTimeout = 10 * time.Second
 )
 
-func GetServerCertExpiredTime(serverURL string) (*time.Time, error) {
+// GetServerCertExpiredTime ctx 没有超时时间时最多等待 10s
+func GetServerCertExpiredTime(ctx context.Context, serverURL string) (*time.Time, error) {
 	conf := &tls.Config{
 		InsecureSkipVerify: true,
 	}
 
-	u, err := url.Parse(APIServerURL)
+	u, err := url.Parse(serverURL)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := tls.Dial("tcp", u.Host, conf)
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, certDialTimeout)
+		defer cancel()
+	}
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: certDialTimeout}, Config: conf}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
 
 	invalidConns := []string{}
-	for _, cert := range conn.ConnectionState().PeerCertificates {
+	for _, cert := range conn.(*tls.Conn).ConnectionState().PeerCertificates {
 		if strings.Contains(cert.Subject.CommonName, K8sAPIServerCertCN) ||
 			strings.Contains(cert.Subject.CommonName, K3sAPIServerCertCN) {
 			return &cert.NotAfter, nil
@@ -0,0 +1,36 @@
+package cluster
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGetServerCertExpiredTimeTimeout(t *testing.T) {
+	// 接受连接但是不完成 TLS 握手
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := GetServerCertExpiredTime(ctx, "https://"+l.Addr().String()); err == nil {
+		t.Fatal("expect error of blackholed server")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("GetServerCertExpiredTime() took %v, want to stop at ctx deadline", elapsed)
+	}
+}
@@ -0,0 +1,363 @@
+// Package config bind options struct to command line flags, env and config file
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/urfave/cli"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const FlagConfig = "config"
+
+// Validator 配置项自身的校验
+type Validator interface {
+	Validate() error
+}
+
+// Config 按照 默认值 -> 配置文件 -> 环境变量 -> 命令行参数 的顺序生成最终配置
+//
+// options struct 中的字段根据 json tag 生成参数名, 嵌套结构体以 "-" 连接,
+// 如 API.PrometheusServer 对应 --api-prometheus-server 和 <ENV_PREFIX>_API_PROMETHEUS_SERVER,
+// description tag 作为参数说明.
+type Config[T any] struct {
+	envPrefix  string
+	defaults   func() T
+	configFile string
+	values     []*flagValue
+}
+
+func New[T any](envPrefix string, defaults func() T) *Config[T] {
+	c := &Config[T]{envPrefix: envPrefix, defaults: defaults}
+	walk(reflect.ValueOf(defaults()), nil, func(path []string, field reflect.StructField, value reflect.Value) {
+		c.values = append(c.values, &flagValue{
+			path:  path,
+			kind:  value.Type(),
+			usage: field.Tag.Get("description"),
+			value: formatValue(value),
+		})
+	})
+	return c
+}
+
+// Flags 返回所有生成的命令行参数, 包括 --config
+func (c *Config[T]) Flags() []cli.Flag {
+	flags := []cli.Flag{
+		cli.GenericFlag{
+			Name:      FlagConfig,
+			Usage:     "config file path, yaml or json",
+			EnvVar:    c.envName([]string{FlagConfig}),
+			TakesFile: true,
+			Value:     &stringValue{value: &c.configFile},
+		},
+	}
+	for _, v := range c.values {
+		flags = append(flags, cli.GenericFlag{
+			Name:   strings.Join(v.path, "-"),
+			Usage:  v.usage,
+			EnvVar: c.envName(v.path),
+			Value:  v,
+		})
+	}
+	return flags
+}
+
+// ConfigFile 当前使用的配置文件, 未指定时为空
+func (c *Config[T]) ConfigFile() string {
+	return c.configFile
+}
+
+// Load 重新生成一份配置, 配置文件变化后可以重复调用
+func (c *Config[T]) Load() (T, error) {
+	options := c.defaults()
+
+	if c.configFile != "" {
+		content, err := os.ReadFile(c.configFile)
+		if err != nil {
+			return options, fmt.Errorf("read config file: %v", err)
+		}
+		if err := yaml.UnmarshalStrict(content, options); err != nil {
+			return options, fmt.Errorf("parse config file %s: %v", c.configFile, err)
+		}
+	}
+
+	// 环境变量由 cli 在解析参数时写入, 与命令行参数一起覆盖配置文件
+	root := reflect.ValueOf(options)
+	for _, v := range c.values {
+		if !v.set {
+			continue
+		}
+		if err := parseValue(lookup(root, v.path), v.value); err != nil {
+			return options, fmt.Errorf("invalid value %q for --%s: %v", v.value, strings.Join(v.path, "-"), err)
+		}
+	}
+
+	if validator, ok := interface{}(options).(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return options, fmt.Errorf("invalid config: %v", err)
+		}
+	}
+	return options, nil
+}
+
+// Command 生成 config 子命令
+func (c *Config[T]) Command() cli.Command {
+	return cli.Command{
+		Name:  "config",
+		Usage: "config helpers",
+		Subcommands: []cli.Command{
+			{
+				Name:  "dump",
+				Usage: "print the effective configuration",
+				Flags: c.Flags(),
+				Action: func(ctx *cli.Context) error {
+					options, err := c.Load()
+					if err != nil {
+						return err
+					}
+					content, err := yaml.Marshal(options)
+					if err != nil {
+						return err
+					}
+					_, err = ctx.App.Writer.Write(content)
+					return err
+				},
+			},
+		},
+	}
+}
+
+func (c *Config[T]) envName(path []string) string {
+	name := strings.ToUpper(strings.Join(path, "_"))
+	name = strings.ReplaceAll(name, "-", "_")
+	if c.envPrefix == "" {
+		return name
+	}
+	return c.envPrefix + "_" + name
+}
+
+// walk 遍历结构体中所有可以设置的叶子字段
+func walk(v reflect.Value, path []string, fn func(path []string, field reflect.StructField, value reflect.Value)) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := fieldName(field)
+		if name == "" {
+			continue
+		}
+		value := v.Field(i)
+		fieldPath := append(append([]string{}, path...), name)
+		if supported(value.Type()) {
+			fn(fieldPath, field, value)
+			continue
+		}
+		if isStruct(value.Type()) {
+			walk(value, fieldPath, fn)
+		}
+	}
+}
+
+func lookup(v reflect.Value, path []string) reflect.Value {
+	for _, name := range path {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if fieldName(v.Type().Field(i)) == name {
+				v = v.Field(i)
+				break
+			}
+		}
+	}
+	return v
+}
+
+// fieldName json tag 转换为 kebab-case, 如 prometheusServer -> prometheus-server
+func fieldName(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		name = field.Name
+	}
+	runes := []rune(name)
+	sb := strings.Builder{}
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			// 连续的大写字母视为一个单词, 如 enableHTTPSigs -> enable-http-sigs
+			prevLower := i > 0 && unicode.IsLower(runes[i-1])
+			nextLower := i > 0 && i+1 < len(runes) && unicode.IsUpper(runes[i-1]) && unicode.IsLower(runes[i+1])
+			if prevLower || nextLower {
+				sb.WriteRune('-')
+			}
+			r = unicode.ToLower(r)
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+var (
+	durationType     = reflect.TypeOf(time.Duration(0))
+	metaDurationType = reflect.TypeOf(metav1.Duration{})
+)
+
+func isStruct(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+func supported(t reflect.Type) bool {
+	if t == metaDurationType {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+func formatValue(v reflect.Value) string {
+	switch {
+	case v.Type() == durationType:
+		return time.Duration(v.Int()).String()
+	case v.Type() == metaDurationType:
+		return v.Interface().(metav1.Duration).Duration.String()
+	case v.Kind() == reflect.Slice:
+		return strings.Join(v.Interface().([]string), ",")
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+func parseValue(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Type() == metaDurationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(metav1.Duration{Duration: d}))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.CanInt():
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case v.CanUint():
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case v.CanFloat():
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case v.Kind() == reflect.Slice:
+		items := []string{}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items).Convert(v.Type()))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// flagValue 记录命令行参数的原始值, 在 Load 时再写入 options
+type flagValue struct {
+	path  []string
+	kind  reflect.Type
+	usage string
+	value string
+	set   bool
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *flagValue) Set(s string) error {
+	// 提前校验格式, 参数错误时直接报错
+	if err := parseValue(reflect.New(f.kind).Elem(), s); err != nil {
+		return err
+	}
+	f.value, f.set = s, true
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.kind.Kind() == reflect.Bool
+}
+
+type stringValue struct{ value *string }
+
+func (s *stringValue) String() string {
+	if s == nil || s.value == nil {
+		return ""
+	}
+	return *s.value
+}
+
+func (s *stringValue) Set(v string) error {
+	abs, err := filepath.Abs(v)
+	if err != nil {
+		return err
+	}
+	*s.value = abs
+	return nil
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type testSubOptions struct {
+	PrometheusServer string          `json:"prometheusServer,omitempty" description:"prometheus"`
+	EnableHTTPSigs   bool            `json:"enableHTTPSigs,omitempty"`
+	Timeout          time.Duration   `json:"timeout,omitempty"`
+	Origins          []string        `json:"origins,omitempty"`
+	QueryTimeout     metav1.Duration `json:"queryTimeout,omitempty"`
+}
+
+type testOptions struct {
+	LogLevel string          `json:"logLevel,omitempty"`
+	API      *testSubOptions `json:"api,omitempty"`
+	Ignored  string          `json:"-"`
+}
+
+func newTestOptions() *testOptions {
+	return &testOptions{
+		LogLevel: "debug",
+		API:      &testSubOptions{PrometheusServer: "http://prometheus:9090", Timeout: time.Second},
+	}
+}
+
+func TestFlagNames(t *testing.T) {
+	c := New("KUBER", newTestOptions)
+	got := map[string]string{}
+	for _, v := range c.values {
+		got[c.envName(v.path)] = v.value
+	}
+	want := map[string]string{
+		"KUBER_LOG_LEVEL":             "debug",
+		"KUBER_API_PROMETHEUS_SERVER": "http://prometheus:9090",
+		"KUBER_API_ENABLE_HTTP_SIGS":  "false",
+		"KUBER_API_TIMEOUT":           "1s",
+		"KUBER_API_ORIGINS":           "",
+		"KUBER_API_QUERY_TIMEOUT":     "0s",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("flags = %v, want %v", got, want)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	content := "logLevel: info\napi:\n  prometheusServer: http://from-file:9090\n  timeout: 5000000000\n  queryTimeout: 30s\n"
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New("KUBER", newTestOptions)
+	c.configFile = file
+	for _, v := range c.values {
+		switch v.path[len(v.path)-1] {
+		case "prometheus-server":
+			_ = v.Set("http://from-flag:9090")
+		case "origins":
+			_ = v.Set("a.com, b.com")
+		case "query-timeout":
+			_ = v.Set("2m")
+		}
+	}
+
+	options, err := c.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &testOptions{
+		LogLevel: "info",
+		API: &testSubOptions{
+			PrometheusServer: "http://from-flag:9090",
+			Timeout:          5 * time.Second,
+			Origins:          []string{"a.com", "b.com"},
+			QueryTimeout:     metav1.Duration{Duration: 2 * time.Minute},
+		},
+	}
+	if !reflect.DeepEqual(options, want) {
+		t.Errorf("Load() = %+v, want %+v", options.API, want.API)
+	}
+}
+
+func TestFlagValueSet(t *testing.T) {
+	c := New("", newTestOptions)
+	for _, v := range c.values {
+		if v.path[len(v.path)-1] == "timeout" {
+			if err := v.Set("3x"); err == nil {
+				t.Error("expect error for invalid duration")
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// ValidateURL 校验 http(s) 地址, 为空时跳过
+func ValidateURL(field, value string) error {
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%s: invalid url %q: %v", field, value, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s: url %q must start with http:// or https://", field, value)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%s: url %q has no host", field, value)
+	}
+	return nil
+}
+
+// ValidateAddr 校验监听地址, 如 :8080 或 0.0.0.0:8080
+func ValidateAddr(field, value string) error {
+	if value == "" {
+		return fmt.Errorf("%s: address is required", field)
+	}
+	_, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return fmt.Errorf("%s: invalid address %q: %v", field, value, err)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		return fmt.Errorf("%s: invalid port in address %q", field, value)
+	}
+	return nil
+}
+
+// ValidateFile 校验文件是否存在, 为空时跳过
+func ValidateFile(field, path string) error {
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%s: %v", field, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s: %s is a directory", field, path)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sunweiwe/kuber/pkg/log"
+	"sigs.k8s.io/yaml"
+)
+
+const watchDebounce = time.Second
+
+// Hash 配置内容的摘要, 用于确认当前生效的配置
+func Hash(options interface{}) string {
+	content, err := yaml.Marshal(options)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// Watch 监听配置文件变化, 文件变化后调用 onChange
+//
+// 监听的是文件所在目录, ConfigMap 挂载的文件通过替换 ..data 软链接更新, 直接监听文件会丢失事件.
+// 短时间内的多次变化合并为一次回调.
+func Watch(ctx context.Context, file string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	current, _ := filepath.EvalSymlinks(file)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			realpath, _ := filepath.EvalSymlinks(file)
+			if filepath.Clean(event.Name) == filepath.Clean(file) || realpath != current {
+				current = realpath
+				timer.Reset(watchDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Error(err, "watch config file", "file", file)
+		case <-timer.C:
+			onChange()
+		}
+	}
+}
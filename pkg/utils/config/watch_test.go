@@ -0,0 +1,123 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHash(t *testing.T) {
+	base := newTestOptions()
+	changed := newTestOptions()
+	changed.API.PrometheusServer = "http://other:9090"
+	ignored := newTestOptions()
+	ignored.Ignored = "not serialized"
+
+	tests := []struct {
+		name  string
+		other *testOptions
+		equal bool
+	}{
+		{name: "same options", other: newTestOptions(), equal: true},
+		{name: "field changed", other: changed, equal: false},
+		{name: "field not serialized", other: ignored, equal: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := Hash(base), Hash(tt.other)
+			if len(a) != 16 {
+				t.Errorf("Hash() = %q, want 16 hex chars", a)
+			}
+			if (a == b) != tt.equal {
+				t.Errorf("Hash() equal = %v, want %v", a == b, tt.equal)
+			}
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	tests := []struct {
+		name string
+		// 文件是否为 ConfigMap 挂载的软链接
+		configMap bool
+		update    func(t *testing.T, dir, file string)
+	}{
+		{
+			name: "write file",
+			update: func(t *testing.T, dir, file string) {
+				writeFile(t, file, "logLevel: info\n")
+				writeFile(t, file, "logLevel: warn\n")
+			},
+		},
+		{
+			// ConfigMap 挂载的文件通过替换 ..data 软链接更新
+			name:      "swap configmap symlink",
+			configMap: true,
+			update: func(t *testing.T, dir, file string) {
+				writeFile(t, filepath.Join(dir, "..v2", "config.yaml"), "logLevel: info\n")
+				if err := os.Symlink("..v2", filepath.Join(dir, "..data_tmp")); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "config.yaml")
+			if tt.configMap {
+				writeFile(t, filepath.Join(dir, "..v1", "config.yaml"), "logLevel: debug\n")
+				if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(filepath.Join("..data", "config.yaml"), file); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				writeFile(t, file, "logLevel: debug\n")
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			changes := make(chan struct{}, 10)
+			done := make(chan error, 1)
+			go func() {
+				done <- Watch(ctx, file, func() { changes <- struct{}{} })
+			}()
+			// 等待 watcher 开始监听
+			time.Sleep(100 * time.Millisecond)
+			tt.update(t, dir, file)
+
+			select {
+			case <-changes:
+			case <-time.After(5 * time.Second):
+				t.Fatal("onChange was not called")
+			}
+			// 多次变化合并为一次回调
+			select {
+			case <-changes:
+				t.Error("onChange was called more than once")
+			case <-time.After(2 * watchDebounce):
+			}
+			cancel()
+			if err := <-done; err != nil {
+				t.Errorf("Watch() = %v", err)
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, file, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,10 +18,22 @@ const (
 	headerTime  = "sign-time"
 )
 
+// 调用方身份, 由 service 代理请求时通过 header 传入, 与路径一起签名, 防止被篡改
+const (
+	HeaderUser        = "x-kuber-user"
+	HeaderTenant      = "x-kuber-tenant"
+	HeaderEnvironment = "x-kuber-environment"
+	HeaderRole        = "x-kuber-role"
+)
+
+var identityHeaders = []string{HeaderUser, HeaderTenant, HeaderEnvironment, HeaderRole}
+
 type Signer struct {
 	Token     string
 	Duration  int64
 	WhiteList []string
+
+	mu sync.RWMutex
 }
 
 func init() {
@@ -34,6 +47,30 @@ func GetSigner() *Signer {
 	return signer
 }
 
+// NewSigner 使用指定token签名, 用于访问不同token的多个agent, 为空时使用内置token
+func NewSigner(t string) *Signer {
+	if t == "" {
+		t = token
+	}
+	return &Signer{Token: t, Duration: 10}
+}
+
+// SetToken 更新签名使用的token, 为空时使用内置token
+func (s *Signer) SetToken(t string) {
+	if t == "" {
+		t = token
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Token = t
+}
+
+func (s *Signer) token() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Token
+}
+
 func (s *Signer) AddWhiteList(path string) {
 	if s.IsWhiteList(path) {
 		return
@@ -53,7 +90,7 @@ func (s *Signer) IsWhiteList(path string) bool {
 func (s *Signer) Sign(req *http.Request, prefix string) {
 	path := strings.TrimPrefix(req.URL.Path, prefix)
 	timeStr := strconv.FormatInt(time.Now().Unix(), 10)
-	toSignStr := path + timeStr + s.Token
+	toSignStr := path + timeStr + s.token() + identity(req.Header)
 	sign := fmt.Sprintf("%x", md5.Sum([]byte(toSignStr)))
 	req.Header.Set(headerToken, sign)
 	req.Header.Set(headerTime, timeStr)
@@ -76,10 +113,27 @@ func (s *Signer) Validate(req *http.Request) error {
 	if timestamp > after || timestamp < before {
 		return fmt.Errorf("httpsigs time out, origin: %s, now: %v", timeStr, n)
 	}
-	toSignStr := path + timeStr + s.Token
+	toSignStr := path + timeStr + s.token() + identity(req.Header)
 	signOut := fmt.Sprintf("%x", md5.Sum([]byte(toSignStr)))
 	if signOut != token {
-		return fmt.Errorf("invalid http signature, path: %s, sign: %s, sign: %s", path, toSignStr, signOut)
+		// 不能包含签名的原文和期望的签名, 原文中有 token
+		return fmt.Errorf("invalid http signature, path: %s: signature mismatch", path)
 	}
 	return nil
 }
+
+// identity 没有身份信息时为空, 与只签名路径的调用方兼容
+func identity(header http.Header) string {
+	values := make([]string, len(identityHeaders))
+	empty := true
+	for i, key := range identityHeaders {
+		values[i] = header.Get(key)
+		if values[i] != "" {
+			empty = false
+		}
+	}
+	if empty {
+		return ""
+	}
+	return "\n" + strings.Join(values, "\n")
+}
@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -244,3 +245,64 @@ func TestSigner_Sign(t *testing.T) {
 		})
 	}
 }
+
+func TestSigner_Identity(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  map[string]string
+		tamper  func(h http.Header)
+		wantErr bool
+	}{
+		{
+			name:   "no identity",
+			tamper: func(h http.Header) {},
+		},
+		{
+			name:   "signed identity",
+			header: map[string]string{HeaderUser: "alice", HeaderTenant: "t1", HeaderRole: "admin"},
+			tamper: func(h http.Header) {},
+		},
+		{
+			name:    "tenant changed",
+			header:  map[string]string{HeaderUser: "alice", HeaderTenant: "t1"},
+			tamper:  func(h http.Header) { h.Set(HeaderTenant, "t2") },
+			wantErr: true,
+		},
+		{
+			name:    "tenant removed",
+			header:  map[string]string{HeaderUser: "alice", HeaderTenant: "t1"},
+			tamper:  func(h http.Header) { h.Del(HeaderTenant) },
+			wantErr: true,
+		},
+		{
+			name:    "role added",
+			header:  map[string]string{HeaderUser: "alice"},
+			tamper:  func(h http.Header) { h.Set(HeaderRole, "sysadmin") },
+			wantErr: true,
+		},
+		{
+			name:    "value moved to another header",
+			header:  map[string]string{HeaderTenant: "t1"},
+			tamper:  func(h http.Header) { h.Del(HeaderTenant); h.Set(HeaderEnvironment, "t1") },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSigner("123456")
+			req := &http.Request{URL: &url.URL{Path: "/test"}, Header: http.Header{}}
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			s.Sign(req, "")
+			tt.tamper(req.Header)
+			err := s.Validate(req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Signer.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && strings.Contains(err.Error(), "123456") {
+				t.Errorf("Signer.Validate() error contains the token: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+// Package loki logql helpers
+package loki
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// NamespaceMatcher 生成限制namespace的匹配条件, 如 namespace=~"a|b"
+func NamespaceMatcher(label string, namespaces []string) string {
+	quoted := make([]string, len(namespaces))
+	for i, ns := range namespaces {
+		quoted[i] = regexp.QuoteMeta(ns)
+	}
+	return label + "=~" + strconv.Quote(strings.Join(quoted, "|"))
+}
+
+// InjectMatcher 在 LogQL 的每一个 stream selector 中追加 matcher
+// 追加的条件与原有条件是 "与" 的关系, 原查询只能进一步缩小范围
+// 字符串中的 "{" "}" 不会被当作 selector, 查询中没有 selector 时返回错误
+// 字符串外的 "#" 是注释, 追加的条件可能被注释掉, 直接拒绝
+func InjectMatcher(query, matcher string) (string, error) {
+	sb := strings.Builder{}
+	injected, depth, empty := 0, 0, true
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch ch {
+		case '"', '`':
+			end, err := skipString(query, i)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(query[i : end+1])
+			i, empty = end, false
+			continue
+		case '{':
+			if depth > 0 {
+				return "", fmt.Errorf("unexpected '{' at %d", i)
+			}
+			depth, empty = 1, true
+		case '}':
+			if depth == 0 {
+				return "", fmt.Errorf("unexpected '}' at %d", i)
+			}
+			if !empty {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(matcher)
+			depth = 0
+			injected++
+		case '#':
+			return "", fmt.Errorf("comments are not allowed in query, found '#' at %d", i)
+		case ' ', '\t', '\n', '\r':
+		default:
+			empty = false
+		}
+		sb.WriteByte(ch)
+	}
+	if depth != 0 {
+		return "", fmt.Errorf("unclosed stream selector")
+	}
+	if injected == 0 {
+		return "", fmt.Errorf("no stream selector found in query %q", query)
+	}
+	return sb.String(), nil
+}
+
+// skipString 返回字符串结束引号的位置
+func skipString(query string, start int) (int, error) {
+	quote := query[start]
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if quote == '"' {
+				i++
+			}
+		case quote:
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated string at %d", start)
+}
@@ -0,0 +1,70 @@
+package loki
+
+import "testing"
+
+func TestInjectMatcher(t *testing.T) {
+	matcher := NamespaceMatcher("namespace", []string{"dev", "test.a"})
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "simple",
+			query: `{app="nginx"}`,
+			want:  `{app="nginx", namespace=~"dev|test\\.a"}`,
+		},
+		{
+			name:  "empty selector",
+			query: `{}`,
+			want:  `{namespace=~"dev|test\\.a"}`,
+		},
+		{
+			name:  "braces in string",
+			query: "{app=\"a{b}\"} |= `}{` | line_format \"{{.msg}}\"",
+			want:  "{app=\"a{b}\", namespace=~\"dev|test\\\\.a\"} |= `}{` | line_format \"{{.msg}}\"",
+		},
+		{
+			name:  "metric query",
+			query: `sum by (pod) (rate({app="a"}[5m])) / sum(rate({app="b"} |= "x" [5m]))`,
+			want:  `sum by (pod) (rate({app="a", namespace=~"dev|test\\.a"}[5m])) / sum(rate({app="b", namespace=~"dev|test\\.a"} |= "x" [5m]))`,
+		},
+		{
+			name:  "hash in string",
+			query: "{app=\"a#b\"} |= `#`",
+			want:  "{app=\"a#b\", namespace=~\"dev|test\\\\.a\"} |= `#`",
+		},
+		{
+			name:    "comment hides injected matcher",
+			query:   "{namespace=\"victim\" # \"\n} # \"",
+			wantErr: true,
+		},
+		{
+			name:    "trailing comment",
+			query:   `{app="a"} # comment`,
+			wantErr: true,
+		},
+		{
+			name:    "no selector",
+			query:   `sum(1)`,
+			wantErr: true,
+		},
+		{
+			name:    "unterminated",
+			query:   `{app="a}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := InjectMatcher(tt.query, matcher)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InjectMatcher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("InjectMatcher() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package exporter
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -35,7 +36,7 @@ func (c *CertCollector) Update(ch chan<- prometheus.Metric) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	expiredAt, err := cluster.GetServerCertExpiredTime(cluster.APIServerURL)
+	expiredAt, err := cluster.GetServerCertExpiredTime(context.Background(), cluster.APIServerURL)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,111 @@
+package exporter
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sunweiwe/kuber/pkg/log"
+)
+
+// PortForwardCollector 统计端口转发的连接和流量
+type PortForwardCollector struct {
+	sessionsTotal  *prometheus.Desc
+	failuresTotal  *prometheus.Desc
+	activeSessions *prometheus.Desc
+	bytesTotal     *prometheus.Desc
+
+	sessions float64
+	failures float64
+	active   float64
+	// in: 客户端发送到 pod, out: pod 发送到客户端
+	bytes map[string]float64
+	mutex sync.Mutex
+}
+
+// GetPortForwardCollector 未注册时返回 nil, nil 的 collector 不统计
+func GetPortForwardCollector() *PortForwardCollector {
+	t, _ := InitiatedCollectors()["portforward"].(*PortForwardCollector)
+	return t
+}
+
+func NewPortForwardCollector() CollectorFunc {
+	return func(logger *log.Logger) (Collector, error) {
+		return &PortForwardCollector{
+			sessionsTotal: prometheus.NewDesc(
+				prometheus.BuildFQName(Namespace(), "portforward", "sessions_total"),
+				"Port-forward sessions established",
+				nil,
+				nil,
+			),
+			failuresTotal: prometheus.NewDesc(
+				prometheus.BuildFQName(Namespace(), "portforward", "failures_total"),
+				"Port-forward sessions failed to connect to pods",
+				nil,
+				nil,
+			),
+			activeSessions: prometheus.NewDesc(
+				prometheus.BuildFQName(Namespace(), "portforward", "active_sessions"),
+				"Port-forward sessions in progress",
+				nil,
+				nil,
+			),
+			bytesTotal: prometheus.NewDesc(
+				prometheus.BuildFQName(Namespace(), "portforward", "bytes_total"),
+				"Bytes forwarded to (in) or from (out) pods",
+				[]string{"direction"},
+				nil,
+			),
+			bytes: map[string]float64{"in": 0, "out": 0},
+		}, nil
+	}
+}
+
+func (pc *PortForwardCollector) SessionStarted() {
+	if pc == nil {
+		return
+	}
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	pc.sessions++
+	pc.active++
+}
+
+func (pc *PortForwardCollector) SessionFinished() {
+	if pc == nil {
+		return
+	}
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	pc.active--
+}
+
+func (pc *PortForwardCollector) SessionFailed() {
+	if pc == nil {
+		return
+	}
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	pc.failures++
+}
+
+func (pc *PortForwardCollector) AddBytes(direction string, n int) {
+	if pc == nil || n <= 0 {
+		return
+	}
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	pc.bytes[direction] += float64(n)
+}
+
+func (pc *PortForwardCollector) Update(ch chan<- prometheus.Metric) error {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(pc.sessionsTotal, prometheus.CounterValue, pc.sessions)
+	ch <- prometheus.MustNewConstMetric(pc.failuresTotal, prometheus.CounterValue, pc.failures)
+	ch <- prometheus.MustNewConstMetric(pc.activeSessions, prometheus.GaugeValue, pc.active)
+	for direction, value := range pc.bytes {
+		ch <- prometheus.MustNewConstMetric(pc.bytesTotal, prometheus.CounterValue, value, direction)
+	}
+	return nil
+}
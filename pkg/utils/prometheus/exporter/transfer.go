@@ -0,0 +1,108 @@
+package exporter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sunweiwe/kuber/pkg/log"
+)
+
+const (
+	// 最多统计的用户数量, 超过后新的用户统计到 transferOtherUser
+	maxTransferUsers  = 1000
+	transferOtherUser = "other"
+	// 超过该时间没有传输的用户不再输出
+	transferIdle = time.Hour
+)
+
+type transferKey struct {
+	user      string
+	direction string
+}
+
+type transferValue struct {
+	bytes    float64
+	lastUsed time.Time
+}
+
+// TransferCollector 统计每个用户上传下载容器文件的字节数
+// user 标签的数量有上限, 空闲的用户会被清理, 再次传输时从 0 开始计数
+type TransferCollector struct {
+	transferBytes *prometheus.Desc
+
+	bytes map[transferKey]*transferValue
+	mutex sync.Mutex
+}
+
+// GetTransferCollector 未注册时返回 nil, nil 的 collector 不统计
+func GetTransferCollector() *TransferCollector {
+	t, _ := InitiatedCollectors()["transfer"].(*TransferCollector)
+	return t
+}
+
+func NewTransferCollector() CollectorFunc {
+	return func(logger *log.Logger) (Collector, error) {
+		return &TransferCollector{
+			transferBytes: prometheus.NewDesc(
+				prometheus.BuildFQName(Namespace(), "file", "transfer_bytes_total"),
+				"Bytes of files transferred from or to containers",
+				[]string{"user", "direction"},
+				nil,
+			),
+			bytes: map[transferKey]*transferValue{},
+		}, nil
+	}
+}
+
+func (tc *TransferCollector) Add(user, direction string, n int) {
+	if tc == nil || n <= 0 {
+		return
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	now := time.Now()
+	key := transferKey{user: user, direction: direction}
+	value, ok := tc.bytes[key]
+	if !ok {
+		tc.prune(now)
+		if tc.users() >= maxTransferUsers {
+			key.user = transferOtherUser
+		}
+		if value, ok = tc.bytes[key]; !ok {
+			value = &transferValue{}
+			tc.bytes[key] = value
+		}
+	}
+	value.bytes += float64(n)
+	value.lastUsed = now
+}
+
+// users 不同用户的数量
+func (tc *TransferCollector) users() int {
+	users := map[string]bool{}
+	for key := range tc.bytes {
+		users[key.user] = true
+	}
+	return len(users)
+}
+
+func (tc *TransferCollector) prune(now time.Time) {
+	for key, value := range tc.bytes {
+		if now.Sub(value.lastUsed) > transferIdle {
+			delete(tc.bytes, key)
+		}
+	}
+}
+
+func (tc *TransferCollector) Update(ch chan<- prometheus.Metric) error {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	tc.prune(time.Now())
+	for key, value := range tc.bytes {
+		ch <- prometheus.MustNewConstMetric(tc.transferBytes, prometheus.CounterValue, value.bytes, key.user, key.direction)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransferCollectorAdd(t *testing.T) {
+	c, err := NewTransferCollector()(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := c.(*TransferCollector)
+	for i := 0; i < maxTransferUsers; i++ {
+		tc.Add(string(rune('a'+i%26))+string(rune(i)), "download", 1)
+	}
+	tc.Add("alice", "download", 10)
+	tc.Add("bob", "upload", 20)
+	if tc.users() != maxTransferUsers+1 {
+		t.Fatalf("users = %d, want %d", tc.users(), maxTransferUsers+1)
+	}
+	other := tc.bytes[transferKey{user: transferOtherUser, direction: "download"}]
+	if other == nil || other.bytes != 10 {
+		t.Errorf("other download = %v, want 10", other)
+	}
+	if _, ok := tc.bytes[transferKey{user: "alice", direction: "download"}]; ok {
+		t.Errorf("users over the limit should be counted as %s", transferOtherUser)
+	}
+
+	// 空闲的用户被清理后, 新用户可以单独统计
+	for _, value := range tc.bytes {
+		value.lastUsed = time.Now().Add(-2 * transferIdle)
+	}
+	tc.Add("carol", "download", 5)
+	if value := tc.bytes[transferKey{user: "carol", direction: "download"}]; value == nil || value.bytes != 5 || len(tc.bytes) != 1 {
+		t.Errorf("bytes after prune = %v", tc.bytes)
+	}
+}
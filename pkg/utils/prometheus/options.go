@@ -1,5 +1,7 @@
 package prometheus
 
+import "github.com/sunweiwe/kuber/pkg/utils/config"
+
 type ExporterOptions struct {
 	Listen string `json:"listen,omitempty" description:"listen address"`
 }
@@ -9,3 +11,7 @@ func DefaultExporterOptions() *ExporterOptions {
 		Listen: ":9100",
 	}
 }
+
+func (o *ExporterOptions) Validate() error {
+	return config.ValidateAddr("exporter.listen", o.Listen)
+}
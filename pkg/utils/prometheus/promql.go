@@ -0,0 +1,36 @@
+package prometheus
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// NamespaceMatcher 生成限制namespace的匹配条件, 如 namespace=~"a|b"
+func NamespaceMatcher(namespaces []string) string {
+	return "namespace=~" + strconv.Quote(regexpAlternation(namespaces))
+}
+
+// InjectMatcher 在 PromQL 的每一个 vector selector 中追加 matcher
+//
+// 追加的条件与原有条件是 "与" 的关系, 原查询只能进一步缩小范围.
+// 使用 prometheus 的解析器遍历语法树, range vector 和子查询中的 selector 同样会追加,
+// 无法解析的查询直接拒绝, 返回的查询由语法树重新生成, 注释等会被去掉.
+func InjectMatcher(query, matcher string) (string, error) {
+	matchers, err := parser.ParseMetricSelector("{" + matcher + "}")
+	if err != nil || len(matchers) == 0 {
+		return "", fmt.Errorf("invalid matcher %q: %v", matcher, err)
+	}
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return "", err
+	}
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok {
+			vs.LabelMatchers = append(vs.LabelMatchers, matchers...)
+		}
+		return nil
+	})
+	return expr.String(), nil
+}
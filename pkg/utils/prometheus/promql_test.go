@@ -0,0 +1,161 @@
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestInjectMatcher(t *testing.T) {
+	matcher := NamespaceMatcher([]string{"dev", "test"})
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "metric name",
+			query: `up`,
+			want:  `up{namespace=~"dev|test"}`,
+		},
+		{
+			name:  "selector",
+			query: `up{job="a",}`,
+			want:  `up{job="a",namespace=~"dev|test"}`,
+		},
+		{
+			name:  "selector only",
+			query: `{__name__=~"container_.+"}`,
+			want:  `{__name__=~"container_.+",namespace=~"dev|test"}`,
+		},
+		{
+			name:  "existing namespace matcher still restricted",
+			query: `kube_pod_info {namespace="other"}`,
+			want:  `kube_pod_info{namespace="other",namespace=~"dev|test"}`,
+		},
+		{
+			name:  "functions and aggregations",
+			query: `sum by (pod, namespace) (rate(container_cpu_usage_seconds_total{container!="", pod=~"a{1}"}[5m] offset 1h)) / on(pod) group_left(node) kube_pod_info`,
+			want:  `sum by (pod, namespace) (rate(container_cpu_usage_seconds_total{container!="",namespace=~"dev|test",pod=~"a{1}"}[5m] offset 1h)) / on (pod) group_left (node) kube_pod_info{namespace=~"dev|test"}`,
+		},
+		{
+			name:  "subquery and numbers",
+			query: `max_over_time(rate(http_requests_total[1m])[1h:5m]) > 1e+3 and up == bool Inf`,
+			want:  `max_over_time(rate(http_requests_total{namespace=~"dev|test"}[1m])[1h:5m]) > 1000 and up{namespace=~"dev|test"} == bool +Inf`,
+		},
+		{
+			name:  "strings are not selectors",
+			query: `label_replace(up, "dst", "$1", "instance", "(.*):{}")`,
+			want:  `label_replace(up{namespace=~"dev|test"}, "dst", "$1", "instance", "(.*):{}")`,
+		},
+		{
+			name:  "aggregation without trailing by",
+			query: `count(up) without (instance)`,
+			want:  `count without (instance) (up{namespace=~"dev|test"})`,
+		},
+		{
+			name:  "comments removed",
+			query: "up # {namespace=\"x\"}\n",
+			want:  `up{namespace=~"dev|test"}`,
+		},
+		{
+			name:    "unclosed paren",
+			query:   `sum(up`,
+			wantErr: true,
+		},
+		{
+			name:    "unterminated string",
+			query:   `up{job="a}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown character",
+			query:   `up; drop`,
+			wantErr: true,
+		},
+		{
+			name:    "expression in label list",
+			query:   `sum by (up{a="b"}) (up)`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := InjectMatcher(tt.query, matcher)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InjectMatcher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("InjectMatcher() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// 尝试绕过限制的查询, 结果重新解析后每个 selector 都必须带有追加的 matcher
+func TestInjectMatcherAdversarial(t *testing.T) {
+	matcher := NamespaceMatcher([]string{"dev"})
+	queries := []string{
+		`up{job="a\"} or kube_secret_info{x=\""}`,
+		"up{job=`a\"}`} or kube_secret_info",
+		`up{job='a"} or kube_secret_info{x="'}`,
+		`up{job="}"} or kube_secret_info`,
+		`up # } or kube_secret_info{namespace="kube-system"}` + "\nor kube_secret_info",
+		`up or{__name__="kube_secret_info"}`,
+		`{__name__=~".+"}`,
+		`{__name__=~".+", namespace=~".*"}`,
+		`up{namespace!~"dev"} or up`,
+		`sum by (namespace) (up) unless on () absent(kube_secret_info)`,
+		`label_replace(kube_secret_info, "namespace", "dev", "", "")`,
+		`label_join(kube_secret_info{namespace="kube-system"}, "namespace", "", "pod")`,
+		`histogram_quantile(0.9, sum by (le) (rate(http_request_duration_seconds_bucket[5m])))`,
+		`rate(kube_secret_info[5m:1m] @ end() offset 1m)`,
+		`max_over_time((kube_secret_info or up)[1h:])`,
+		`-(kube_secret_info) ^ 2 % on () group_right (secret) - up`,
+		`sort_desc(topk(10, count_values("v", kube_secret_info)))`,
+		`scalar(kube_secret_info) * vector(1) + time()`,
+		`kube_secret_info[5m] offset -1h`,
+		`((((kube_secret_info))))`,
+		`KUBE_SECRET_INFO or Sum(up) by (namespace)`,
+		`by{namespace="kube-system"} or offset{namespace="kube-system"}`,
+	}
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			got, err := InjectMatcher(query, matcher)
+			if err != nil {
+				t.Fatalf("InjectMatcher() error = %v", err)
+			}
+			expr, err := parser.ParseExpr(got)
+			if err != nil {
+				t.Fatalf("parse %s: %v", got, err)
+			}
+			selectors := 0
+			parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+				vs, ok := node.(*parser.VectorSelector)
+				if !ok {
+					return nil
+				}
+				selectors++
+				for _, m := range vs.LabelMatchers {
+					if m.String() == matcher {
+						return nil
+					}
+				}
+				t.Errorf("selector %s of %s is not restricted", vs, got)
+				return nil
+			})
+			if selectors == 0 {
+				t.Errorf("no selector found in %s", got)
+			}
+		})
+	}
+}
+
+func TestInjectMatcherInvalidMatcher(t *testing.T) {
+	for _, matcher := range []string{``, `namespace=~"a"} or up{`, `namespace=`} {
+		if _, err := InjectMatcher("up", matcher); err == nil {
+			t.Errorf("InjectMatcher() with matcher %q expect error", matcher)
+		}
+	}
+}
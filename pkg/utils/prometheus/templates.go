@@ -0,0 +1,210 @@
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// 指标模板, 由后端根据资源替换变量生成 PromQL, 前端无需编写查询语句
+// 模板变量:
+//
+//	{{ .Selector }} 资源对应的 label matcher
+//	{{ .By }}       聚合使用的 label
+//	{{ .Owner }}    工作负载通过 kube-state-metrics 关联的 pod, 非工作负载为空
+var metricTemplates = map[string]string{
+	"cpu":         `sum by ({{ .By }}) (rate(container_cpu_usage_seconds_total{container!="", {{ .Selector }}}[5m]){{ .Owner }})`,
+	"memory":      `sum by ({{ .By }}) (container_memory_working_set_bytes{container!="", {{ .Selector }}}{{ .Owner }})`,
+	"network-in":  `sum by ({{ .By }}) (rate(container_network_receive_bytes_total{ {{- .Selector -}} }[5m]){{ .Owner }})`,
+	"network-out": `sum by ({{ .By }}) (rate(container_network_transmit_bytes_total{ {{- .Selector -}} }[5m]){{ .Owner }})`,
+}
+
+// 节点使用 cadvisor 根容器的数据
+var nodeMetricTemplates = map[string]string{
+	"cpu":         `sum by (node) (rate(container_cpu_usage_seconds_total{id="/", {{ .Selector }}}[5m]))`,
+	"memory":      `sum by (node) (container_memory_working_set_bytes{id="/", {{ .Selector }}})`,
+	"network-in":  `sum by (node) (rate(container_network_receive_bytes_total{id="/", {{ .Selector }}}[5m]))`,
+	"network-out": `sum by (node) (rate(container_network_transmit_bytes_total{id="/", {{ .Selector }}}[5m]))`,
+}
+
+var MetricUnits = map[string]string{
+	"cpu":         "core",
+	"memory":      "bytes",
+	"network-in":  "bytes/s",
+	"network-out": "bytes/s",
+}
+
+type metricResource struct {
+	// 是否需要 namespace
+	namespaced bool
+	// 聚合使用的 label
+	by string
+	// 工作负载的 kind, 按照 pod 的 owner 关联, 不按照 pod 名称匹配
+	ownerKind string
+}
+
+var metricResources = map[string]metricResource{
+	"pods":         {namespaced: true, by: "pod"},
+	"deployments":  {namespaced: true, by: "pod", ownerKind: "Deployment"},
+	"statefulsets": {namespaced: true, by: "pod", ownerKind: "StatefulSet"},
+	"daemonsets":   {namespaced: true, by: "pod", ownerKind: "DaemonSet"},
+	"namespaces":   {by: "namespace"},
+	"environments": {by: "namespace"},
+	"tenants":      {by: "namespace"},
+	"nodes":        {by: "node"},
+}
+
+// MetricQuery 生成指标模板需要的参数
+type MetricQuery struct {
+	// 资源类型, 如 deployments
+	Resource string
+	// 指标名称, 如 cpu
+	Metric    string
+	Namespace string
+	Name      string
+	// environments 和 tenants 对应的namespace
+	Namespaces []string
+}
+
+// ListMetricTemplates 返回每种资源支持的指标
+func ListMetricTemplates() map[string][]string {
+	ret := map[string][]string{}
+	for resource := range metricResources {
+		templates := metricTemplates
+		if resource == "nodes" {
+			templates = nodeMetricTemplates
+		}
+		for metric := range templates {
+			ret[resource] = append(ret[resource], metric)
+		}
+		sort.Strings(ret[resource])
+	}
+	return ret
+}
+
+// IsNamespacedMetricResource 资源是否需要 namespace
+func IsNamespacedMetricResource(resource string) bool {
+	return metricResources[resource].namespaced
+}
+
+// NamespacedMetricResources 需要 namespace 的资源
+func NamespacedMetricResources() []string {
+	ret := []string{}
+	for resource, r := range metricResources {
+		if r.namespaced {
+			ret = append(ret, resource)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// RenderMetricTemplate 生成 PromQL, 变量都经过校验和转义, 不会改变查询的结构
+func RenderMetricTemplate(q MetricQuery) (string, error) {
+	resource, ok := metricResources[q.Resource]
+	if !ok {
+		return "", fmt.Errorf("unsupported resource %q", q.Resource)
+	}
+	templates := metricTemplates
+	if q.Resource == "nodes" {
+		templates = nodeMetricTemplates
+	}
+	tpl, ok := templates[q.Metric]
+	if !ok {
+		return "", fmt.Errorf("unsupported metric %q for %s", q.Metric, q.Resource)
+	}
+
+	var matchers []string
+	owner := ""
+	switch q.Resource {
+	case "nodes":
+		if err := validateName("name", q.Name, true); err != nil {
+			return "", err
+		}
+		matchers = append(matchers, "node="+strconv.Quote(q.Name))
+	case "namespaces":
+		if err := validateName("name", q.Name, false); err != nil {
+			return "", err
+		}
+		matchers = append(matchers, "namespace="+strconv.Quote(q.Name))
+	case "environments", "tenants":
+		if len(q.Namespaces) == 0 {
+			return "", fmt.Errorf("%s %s has no namespace", q.Resource, q.Name)
+		}
+		for _, ns := range q.Namespaces {
+			if err := validateName("namespace", ns, false); err != nil {
+				return "", err
+			}
+		}
+		matchers = append(matchers, "namespace=~"+strconv.Quote(regexpAlternation(q.Namespaces)))
+	default:
+		if err := validateName("namespace", q.Namespace, false); err != nil {
+			return "", err
+		}
+		if err := validateName("name", q.Name, true); err != nil {
+			return "", err
+		}
+		matchers = append(matchers, "namespace="+strconv.Quote(q.Namespace))
+		if resource.ownerKind == "" {
+			matchers = append(matchers, "pod="+strconv.Quote(q.Name))
+		} else {
+			owner = " * on (namespace, pod) group_left() " + ownerPods(resource.ownerKind, q.Namespace, q.Name)
+		}
+	}
+
+	t, err := template.New(q.Metric).Parse(tpl)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, map[string]string{
+		"Selector": strings.Join(matchers, ", "),
+		"By":       resource.by,
+		"Owner":    owner,
+	}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// ownerPods 工作负载下的 pod, 每个 pod 一条值为 1 的序列
+// deployment 的 pod 属于 replicaset, 需要再通过 kube_replicaset_owner 关联
+func ownerPods(kind, namespace, name string) string {
+	ns := "namespace=" + strconv.Quote(namespace)
+	owner := fmt.Sprintf("owner_kind=%s, owner_name=%s", strconv.Quote(kind), strconv.Quote(name))
+	if kind != "Deployment" {
+		return fmt.Sprintf("max by (namespace, pod) (kube_pod_owner{%s, %s})", ns, owner)
+	}
+	return fmt.Sprintf(`max by (namespace, pod) (`+
+		`label_replace(kube_pod_owner{%s, owner_kind="ReplicaSet"}, "replicaset", "$1", "owner_name", "(.*)")`+
+		` * on (namespace, replicaset) group_left() `+
+		`max by (namespace, replicaset) (kube_replicaset_owner{%s, %s}))`, ns, ns, owner)
+}
+
+func regexpAlternation(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = regexp.QuoteMeta(v)
+	}
+	return strings.Join(quoted, "|")
+}
+
+// validateName 只允许 kubernetes 的资源名称, subdomain 允许 "."
+func validateName(field, value string, subdomain bool) error {
+	var errs []string
+	if subdomain {
+		errs = validation.IsDNS1123Subdomain(value)
+	} else {
+		errs = validation.IsDNS1123Label(value)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid %s %q: %s", field, value, strings.Join(errs, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package prometheus
+
+import "testing"
+
+func TestRenderMetricTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   MetricQuery
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "deployment cpu",
+			query: MetricQuery{Resource: "deployments", Metric: "cpu", Namespace: "dev", Name: "web.api"},
+			want: `sum by (pod) (rate(container_cpu_usage_seconds_total{container!="", namespace="dev"}[5m])` +
+				` * on (namespace, pod) group_left() max by (namespace, pod) (` +
+				`label_replace(kube_pod_owner{namespace="dev", owner_kind="ReplicaSet"}, "replicaset", "$1", "owner_name", "(.*)")` +
+				` * on (namespace, replicaset) group_left() ` +
+				`max by (namespace, replicaset) (kube_replicaset_owner{namespace="dev", owner_kind="Deployment", owner_name="web.api"})))`,
+		},
+		{
+			name:  "statefulset memory",
+			query: MetricQuery{Resource: "statefulsets", Metric: "memory", Namespace: "dev", Name: "db"},
+			want: `sum by (pod) (container_memory_working_set_bytes{container!="", namespace="dev"}` +
+				` * on (namespace, pod) group_left() max by (namespace, pod) (kube_pod_owner{namespace="dev", owner_kind="StatefulSet", owner_name="db"}))`,
+		},
+		{
+			name:  "pod network",
+			query: MetricQuery{Resource: "pods", Metric: "network-in", Namespace: "dev", Name: "web-0"},
+			want:  `sum by (pod) (rate(container_network_receive_bytes_total{namespace="dev", pod="web-0"}[5m]))`,
+		},
+		{
+			name:  "tenant memory",
+			query: MetricQuery{Resource: "tenants", Metric: "memory", Name: "t1", Namespaces: []string{"a", "b"}},
+			want:  `sum by (namespace) (container_memory_working_set_bytes{container!="", namespace=~"a|b"})`,
+		},
+		{
+			name:  "node cpu",
+			query: MetricQuery{Resource: "nodes", Metric: "cpu", Name: "node-1"},
+			want:  `sum by (node) (rate(container_cpu_usage_seconds_total{id="/", node="node-1"}[5m]))`,
+		},
+		{
+			name:    "injection",
+			query:   MetricQuery{Resource: "pods", Metric: "cpu", Namespace: "dev", Name: `a"} or up{x="`},
+			wantErr: true,
+		},
+		{
+			name:    "tenant without namespaces",
+			query:   MetricQuery{Resource: "tenants", Metric: "cpu", Name: "t1"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown metric",
+			query:   MetricQuery{Resource: "pods", Metric: "disk", Namespace: "dev", Name: "a"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RenderMetricTemplate(tt.query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RenderMetricTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("RenderMetricTemplate() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
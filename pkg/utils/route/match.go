@@ -97,8 +97,8 @@ func (m *matcher) Register(pattern string, value interface{}) error {
 			if i == len(sections)-1 {
 				child.value = item
 			}
-			child.children = append(child.children, child)
-			sortSectionMatches(child.children)
+			cur.children = append(cur.children, child)
+			sortSectionMatches(cur.children)
 		} else {
 			child = cur.children[index]
 			if i == len(sections)-1 {
@@ -107,8 +107,8 @@ func (m *matcher) Register(pattern string, value interface{}) error {
 				}
 				child.value = item
 			}
-			cur = child
 		}
+		cur = child
 	}
 
 	return nil
@@ -0,0 +1,55 @@
+package route
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	m := matcher{root: &node{}}
+	for _, pattern := range []string{
+		"/healthz",
+		"/custom/core/v1/pods",
+		"/custom/core/v1/namespaces/{namespace}/pods/{name}",
+		"/custom/core/v1/pods/{name}/actions/shell",
+		"/v1/{group}/{version}/{resource}",
+		"/v1/service-proxy/{realpath}*",
+		"/metrics/deployments/{namespace}/{name}/{metric}",
+		"/metrics/{resource}/{name}/{metric}",
+	} {
+		if err := m.Register(pattern, pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Register("/healthz", "dup"); err == nil {
+		t.Error("expect conflict error")
+	}
+
+	tests := []struct {
+		path    string
+		want    interface{}
+		wantVar map[string]string
+	}{
+		{path: "/healthz", want: "/healthz", wantVar: map[string]string{}},
+		{path: "/custom/core/v1/pods", want: "/custom/core/v1/pods", wantVar: map[string]string{}},
+		{path: "/custom/core/v1/namespaces/dev/pods/a", want: "/custom/core/v1/namespaces/{namespace}/pods/{name}", wantVar: map[string]string{"namespace": "dev", "name": "a"}},
+		{path: "/custom/core/v1/pods/a/actions/shell", want: "/custom/core/v1/pods/{name}/actions/shell", wantVar: map[string]string{"name": "a"}},
+		{path: "/v1/apps/v1/deployments", want: "/v1/{group}/{version}/{resource}", wantVar: map[string]string{"group": "apps", "version": "v1", "resource": "deployments"}},
+		{path: "/v1/service-proxy/a/b", want: "/v1/service-proxy/{realpath}*", wantVar: map[string]string{"realpath": "a/b"}},
+		{path: "/metrics/deployments/dev/web/cpu", want: "/metrics/deployments/{namespace}/{name}/{metric}", wantVar: map[string]string{"namespace": "dev", "name": "web", "metric": "cpu"}},
+		{path: "/metrics/nodes/node-1/cpu", want: "/metrics/{resource}/{name}/{metric}", wantVar: map[string]string{"resource": "nodes", "name": "node-1", "metric": "cpu"}},
+		{path: "/metrics/deployments/web/cpu", want: "/metrics/{resource}/{name}/{metric}", wantVar: map[string]string{"resource": "deployments", "name": "web", "metric": "cpu"}},
+		{path: "/healthy", want: nil},
+		{path: "/custom/core/v1/pods/a/actions/logs", want: nil},
+	}
+	for _, tt := range tests {
+		matched, val, vars := m.Match(tt.path)
+		if matched != (tt.want != nil) || val != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.path, val, tt.want)
+			continue
+		}
+		if tt.want != nil && !reflect.DeepEqual(vars, tt.wantVar) {
+			t.Errorf("Match(%s) vars = %v, want %v", tt.path, vars, tt.wantVar)
+		}
+	}
+}
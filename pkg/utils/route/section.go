@@ -93,7 +93,7 @@ func MatchSection(complied []Element, sections []string) (bool, bool, map[string
 		switch e.kind {
 		case ElementKindConst:
 			l := len(e.param)
-			if len(section) < pos+l {
+			if len(section) < pos+l || section[pos:pos+l] != e.param {
 				return false, false, nil
 			}
 			pos += l
@@ -4,7 +4,11 @@ package system
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"os"
+
+	"github.com/sunweiwe/kuber/pkg/utils/config"
+	"k8s.io/apimachinery/pkg/util/errors"
 )
 
 type Options struct {
@@ -25,6 +29,19 @@ func NewDefaultOptions() *Options {
 	}
 }
 
+func (o *Options) Validate() error {
+	errs := []error{
+		config.ValidateAddr("system.listen", o.Listen),
+		config.ValidateFile("system.caFile", o.CAFile),
+		config.ValidateFile("system.certFile", o.CertFile),
+		config.ValidateFile("system.keyFile", o.KeyFile),
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("system.certFile and system.keyFile must be set together"))
+	}
+	return errors.NewAggregate(errs)
+}
+
 func (o *Options) TLSConfigEnabled() bool {
 	return (o.CertFile != "" && o.KeyFile != "")
 }